@@ -1,5 +1,11 @@
 package store
 
+import (
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
 /**
  Directory-based Store Interface
  */
@@ -10,20 +16,76 @@ type Store interface {
 	Read(filename string, res []byte, startOffset int64) error
 	Write(filename string, data []byte, startOffset int64) error
 	Clear(filename string, startOffset int64, size int64) error
+	// ReadV reads ranges of file opening it once, ranges adjacent to each other are read at once.
+	// ranges are read by up to parallelism goroutines, one by one if parallelism is 1 or less.
+	ReadV(filename string, ranges []Range, parallelism int) error
+	// WriteV writes extents of file in order, as one mutation where supported.
+	WriteV(filename string, extents []Extent) error
 	CreateFile(filename string) error
 	RemoveFile(filename string) error
 	SubStore(subpath string) Store
 	Truncate(filename string, size int64) error
+	// Mmap returns read-only view of data of file, for reads without copy.
+	// stores transforming data, like compressed or encrypted ones, give view of copy.
+	Mmap(filename string) (vfs.ReadOnlyMapping, error)
+	// Preallocate reserves space of file for size bytes, so writes within it do not run out of space.
+	// size of file is not changed. stores not able to reserve space only check file exists.
+	Preallocate(filename string, size int64) error
+	// CreateFileWithTTL creates file like CreateFile, expiring after ttl.
+	// expired files are absent, until removed by RemoveExpired.
+	CreateFileWithTTL(filename string, ttl time.Duration) error
+	// SetExpiry sets time file expires at, zero time means file does not expire.
+	SetExpiry(filename string, expiry time.Time) error
+	// conditional mutations, fail with PreconditionFailedError
+	// if generation of file does not match
+	WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error
+	CreateIfNotExists(filename string) error
+	RemoveIfMatch(filename string, ifGeneration uint64) error
+	Watch(path string, recursive bool) (<-chan vfs.Event, func(), error)
+	Snapshot(name string) error
+	ListSnapshots() ([]string, error)
+	OpenSnapshot(name string) (Store, error)
+	DeleteSnapshot(name string) error
+	// Sync commits data and metadata of file, and its directory entry, to stable storage.
+	Sync(filename string) error
+	// SyncAll commits files of store and its sub stores, changed since committed.
+	SyncAll() error
+	// directories are named relative to store, "" is store itself where allowed.
+	// internal data in hidden directories is not listed, and can not be named.
+	// Mkdir creates directory with its parents, failing if it exists.
+	Mkdir(dirname string) error
+	// RemoveDir removes directory, with its files and sub directories if recursive,
+	// or only if it is empty otherwise.
+	RemoveDir(dirname string, recursive bool) error
+	// ListDirs returns names of sub directories of directory, in order.
+	ListDirs(dirname string) ([]string, error)
+	IsDirExist(dirname string) bool
+	DirInfo(dirname string) (DirInfo, error)
+	// Close releases resources held by store and its sub stores, like handles of files kept open.
+	// stores stay usable after, opening files again for each operation.
+	Close() error
 }
 
 type FileInfo interface {
 	Name()	string
 	Size()	int64
+	// Generation changes on every modification of file
+	Generation()	uint64
+}
+
+type DirInfo interface {
+	// Name is "" for store itself
+	Name()	string
+	// number of files and sub directories directly in directory
+	Files()	int
+	Dirs()	int
+	ModTime()	time.Time
 }
 
 type fileInfo struct {
 	name	string
 	size	int64
+	generation	uint64
 }
 
 func (f *fileInfo) Name() string {
@@ -33,3 +95,7 @@ func (f *fileInfo) Name() string {
 func (f *fileInfo) Size() int64 {
 	return f.size
 }
+
+func (f *fileInfo) Generation() uint64 {
+	return f.generation
+}
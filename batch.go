@@ -0,0 +1,162 @@
+package store
+
+type batchOpKind int
+
+const (
+	batchRead batchOpKind = iota
+	batchWrite
+	batchClear
+	batchTruncate
+	batchCreate
+	batchRemove
+)
+
+/**
+ Batch groups operations across files, run by Run with result of each operation.
+ operations of same file are run in order they are added, and reads or writes next to each other
+ are run at once by ReadV or WriteV. files are run by up to Parallelism goroutines,
+ one by one if Parallelism is 1 or less.
+ */
+type Batch struct {
+	Parallelism int
+	ops         []batchOp
+}
+
+type batchOp struct {
+	kind     batchOpKind
+	filename string
+	offset   int64
+	size     int64
+	data     []byte
+}
+
+// Read adds read of res at offset, and returns index of its result.
+func (b *Batch) Read(filename string, res []byte, offset int64) int {
+	return b.add(batchOp{kind: batchRead, filename: filename, offset: offset, data: res})
+}
+
+// Write adds write of data at offset, and returns index of its result.
+func (b *Batch) Write(filename string, data []byte, offset int64) int {
+	return b.add(batchOp{kind: batchWrite, filename: filename, offset: offset, data: data})
+}
+
+// Clear adds clear of size bytes at offset, and returns index of its result.
+func (b *Batch) Clear(filename string, offset int64, size int64) int {
+	return b.add(batchOp{kind: batchClear, filename: filename, offset: offset, size: size})
+}
+
+// Truncate adds truncate to size, and returns index of its result.
+func (b *Batch) Truncate(filename string, size int64) int {
+	return b.add(batchOp{kind: batchTruncate, filename: filename, size: size})
+}
+
+// CreateFile adds creation of file, and returns index of its result.
+func (b *Batch) CreateFile(filename string) int {
+	return b.add(batchOp{kind: batchCreate, filename: filename})
+}
+
+// RemoveFile adds removal of file, and returns index of its result.
+func (b *Batch) RemoveFile(filename string) int {
+	return b.add(batchOp{kind: batchRemove, filename: filename})
+}
+
+// Len returns number of operations added.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) add(op batchOp) int {
+	b.ops = append(b.ops, op)
+	return len(b.ops) - 1
+}
+
+// Run runs operations on s, and returns error of each operation by its index, nil if succeeded.
+// if reads or writes run at once fail, they are run again one by one,
+// so error is given to operations failing.
+func (b *Batch) Run(s Store) []error {
+	results := make([]error, len(b.ops))
+
+	// indexes of operations of each file by its canonical name, files in order of their first operation
+	files := make([]string, 0)
+	ops := make(map[string][]int)
+	for i, op := range b.ops {
+		filename := op.filename
+		if name, err := cleanFileName("Batch", filename); err == nil {
+			filename = name
+		}
+
+		if _, ok := ops[filename]; !ok {
+			files = append(files, filename)
+		}
+		ops[filename] = append(ops[filename], i)
+	}
+
+	parallel(len(files), b.Parallelism, func(i int) error {
+		b.runFile(s, files[i], ops[files[i]], results)
+		return nil
+	})
+
+	return results
+}
+
+// runFile runs operations of indexes on file filename, and sets their results.
+// operations are run on filename, canonical name of file they are added with.
+func (b *Batch) runFile(s Store, filename string, indexes []int, results []error) {
+	for len(indexes) > 0 {
+		kind := b.ops[indexes[0]].kind
+
+		// reads or writes next to each other
+		n := 1
+		if kind == batchRead || kind == batchWrite {
+			for n < len(indexes) && b.ops[indexes[n]].kind == kind {
+				n++
+			}
+		}
+
+		group := indexes[:n]
+		indexes = indexes[n:]
+
+		if n > 1 && b.runGroup(s, filename, kind, group) == nil {
+			continue
+		}
+
+		for _, i := range group {
+			results[i] = b.runOp(s, filename, b.ops[i])
+		}
+	}
+}
+
+// runGroup runs reads or writes of indexes at once.
+func (b *Batch) runGroup(s Store, filename string, kind batchOpKind, indexes []int) error {
+	if kind == batchRead {
+		ranges := make([]Range, len(indexes))
+		for j, i := range indexes {
+			ranges[j] = Range{Offset: b.ops[i].offset, Data: b.ops[i].data}
+		}
+		return s.ReadV(filename, ranges, 1)
+	}
+
+	extents := make([]Extent, len(indexes))
+	for j, i := range indexes {
+		extents[j] = Extent{Offset: b.ops[i].offset, Data: b.ops[i].data}
+	}
+	return s.WriteV(filename, extents)
+}
+
+func (b *Batch) runOp(s Store, filename string, op batchOp) error {
+	switch op.kind {
+	case batchRead:
+		return s.Read(filename, op.data, op.offset)
+	case batchWrite:
+		return s.Write(filename, op.data, op.offset)
+	case batchClear:
+		return s.Clear(filename, op.offset, op.size)
+	case batchTruncate:
+		return s.Truncate(filename, op.size)
+	case batchCreate:
+		return s.CreateFile(filename)
+	case batchRemove:
+		return s.RemoveFile(filename)
+	}
+	return nil
+}
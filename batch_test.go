@@ -0,0 +1,66 @@
+package store
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch_Run(t *testing.T) {
+	for _, s := range testStores(t, "TestBatch_Run") {
+		for _, parallelism := range []int{1, 4} {
+			b := &Batch{Parallelism: parallelism}
+			b.CreateFile("a")
+			b.Write("a", []byte("12"), 0)
+			b.Write("a", []byte("34"), 2)
+			b.CreateFile("b")
+			b.Write("b", []byte("xyz"), 0)
+			b.Truncate("b", 2)
+
+			results := b.Run(s)
+			assert.Equal(t, 6, len(results))
+			for _, err := range results {
+				assert.Nil(t, err)
+			}
+
+			res := make([]byte, 4)
+			first, second, missing := make([]byte, 2), make([]byte, 2), make([]byte, 1)
+
+			b = &Batch{Parallelism: parallelism}
+			b.Read("a", res, 0)
+			b.Read("b", first, 0)
+			i := b.Read("b", second, 1)
+			b.Read("none", missing, 0)
+			b.RemoveFile("a")
+			b.RemoveFile("b")
+			assert.Equal(t, 6, b.Len())
+
+			// failure of reads run at once is given to failing read only
+			results = b.Run(s)
+			assert.Equal(t, "1234", string(res))
+			assert.Equal(t, "xy", string(first))
+			assert.Nil(t, results[1])
+			assert.NotNil(t, results[i])
+			assert.NotNil(t, results[3])
+			assert.Nil(t, results[4])
+			assert.Nil(t, results[5])
+			assert.False(t, s.IsFileExist("a"))
+		}
+	}
+}
+
+func TestBatch_CanonicalNames(t *testing.T) {
+	for _, s := range testStores(t, "TestBatch_CanonicalNames") {
+		b := &Batch{Parallelism: 4}
+		b.CreateFile("a")
+		b.Write("./a", []byte("first"), 0)
+		b.Write("/a", []byte("second"), 0)
+		b.Truncate("a", 6)
+		res := make([]byte, 6)
+		b.Read("a//", res, 0)
+
+		for _, err := range b.Run(s) {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, "second", string(res))
+	}
+}
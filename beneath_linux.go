@@ -0,0 +1,110 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// number of openat2, same on architectures sharing generic syscall table
+	sysOpenat2 = 437
+	// resolution fails if it leaves directory, by "..", absolute paths or symbolic links
+	resolveBeneath = 0x08
+	// opens path only to resolve it, without permission to read it
+	oPath = 0x200000
+)
+
+// set if kernel does not support openat2, before 5.6, or seccomp filter denies it
+var openat2Unsupported int32
+
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+func openat2(dirfd int, name string, how *openHow) (int, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return -1, err
+	}
+
+	fd, _, errno := syscall.Syscall6(sysOpenat2, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(how)), unsafe.Sizeof(*how), 0, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// openBeneath opens name under root by openat2, so neither ".." nor symbolic links lead out of root.
+// falls back to openChecked where openat2 is not supported.
+func openBeneath(root string, name string, flag int, perm os.FileMode) (*os.File, error) {
+	if atomic.LoadInt32(&openat2Unsupported) != 0 {
+		return openChecked(root, name, flag, perm)
+	}
+
+	how := &openHow{flags: uint64(flag | syscall.O_CLOEXEC), resolve: resolveBeneath}
+	if flag & os.O_CREATE != 0 {
+		how.mode = uint64(perm.Perm())
+	}
+
+	fd, err := openat2Under(root, name, how)
+	if unsupported(err) {
+		atomic.StoreInt32(&openat2Unsupported, 1)
+		return openChecked(root, name, flag, perm)
+	} else if err != nil {
+		return nil, &os.PathError{Op: "openat2", Path: root + name, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), root + name), nil
+}
+
+// checkBeneath checks name resolves beneath root, or its nearest existing parent if it is not existed.
+func checkBeneath(root string, name string) error {
+	if atomic.LoadInt32(&openat2Unsupported) != 0 {
+		return checkResolved(root, name)
+	}
+
+	how := &openHow{flags: oPath | syscall.O_CLOEXEC, resolve: resolveBeneath}
+	for {
+		fd, err := openat2Under(root, name, how)
+		if err == nil {
+			syscall.Close(fd)
+			return nil
+		} else if unsupported(err) {
+			atomic.StoreInt32(&openat2Unsupported, 1)
+			return checkResolved(root, name)
+		} else if err != syscall.ENOENT || name == "." {
+			return err
+		}
+		name = filepath.Dir(name)
+	}
+}
+
+// unsupported returns true if err of openat2 tells it is not available.
+// seccomp filters of container runtimes older than openat2 deny it by EPERM, not ENOSYS.
+func unsupported(err error) bool {
+	return err == syscall.ENOSYS || err == syscall.EPERM
+}
+
+// openat2Under opens name relative to directory root by how,
+// links leading out of root fail with escapesStoreErr.
+func openat2Under(root string, name string, how *openHow) (int, error) {
+	dir, err := os.Open(root)
+	if err != nil {
+		return -1, err
+	}
+	defer dir.Close()
+
+	fd, err := openat2(int(dir.Fd()), name, how)
+	if err == syscall.EXDEV {
+		err = escapesStoreErr
+	}
+	return fd, err
+}
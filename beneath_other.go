@@ -0,0 +1,15 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package store
+
+import "os"
+
+// openBeneath opens name under root after checked by checkResolved, openat2 is not supported.
+func openBeneath(root string, name string, flag int, perm os.FileMode) (*os.File, error) {
+	return openChecked(root, name, flag, perm)
+}
+
+// checkBeneath checks name resolves beneath root, or its nearest existing parent if it is not existed.
+func checkBeneath(root string, name string) error {
+	return checkResolved(root, name)
+}
@@ -0,0 +1,1047 @@
+package store
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+type CacheEviction int
+
+const (
+	// evict least recently used block
+	LRU CacheEviction = iota + 1
+	// evict least frequently used block, least recently used of same frequency
+	LFU
+)
+
+type CacheMode int
+
+var (
+	// file is changed while cache lock is released, so operation is retried
+	cacheChangedErr = errors.New("cached file changed")
+	// file is read from backing store
+	uncachedErr = errors.New("file is not cached")
+)
+
+const (
+	// writes go to backing store, and invalidate cached blocks
+	WriteThrough CacheMode = iota + 1
+	// writes go to cache, and are written back when evicted or flushed
+	WriteBack
+)
+
+/**
+ CachePolicy of cached store.
+ Budget is bytes of cache store used at most. BlockSize is size of cached blocks,
+ zero caches whole files. zero Eviction and Mode mean LRU and WriteThrough.
+ */
+type CachePolicy struct {
+	Budget    int64
+	BlockSize int64
+	Eviction  CacheEviction
+	Mode      CacheMode
+}
+
+type CacheStats struct {
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	WriteBacks uint64
+	// bytes of cached blocks
+	Used int64
+}
+
+/**
+ Store caching blocks of files of slow backing store in faster cache store.
+ reads are served from cache, missed blocks are read through into it,
+ and blocks are evicted by policy to keep cache within byte budget.
+ in write-back mode, writes are buffered in cache until evicted or flushed,
+ and are lost on crash. other mutations flush buffered writes of file first.
+ */
+type CachedStore interface {
+	Store
+	// Flush writes all buffered writes back to backing store.
+	Flush() error
+	Stats() CacheStats
+}
+
+type cachedStore struct {
+	Store
+	cache  *cache
+	prefix string
+}
+
+/**
+ cache is index of cached blocks, shared by views of sub stores.
+ mu guards the index, and is released while backing store is read for missed blocks,
+ and while mutations are applied to backing store.
+ mutations of same file are serialized by locks, and bump stamp of file after applied,
+ so blocks read while file is mutated are not cached.
+ */
+type cache struct {
+	mu       sync.Mutex
+	backing  Store
+	s        Store
+	policy   CachePolicy
+	files    map[string]*cachedFile
+	// files with expiry set through cache are not cached,
+	// so they are absent as soon as expired in backing store
+	expiring map[string]bool
+	order    cacheOrder
+	tick     uint64
+	stats    CacheStats
+	locks    stripedLock
+	// changes of files of each stripe of locks
+	stamps [lockStripes]uint64
+	// missed blocks being read by entry, closed when read
+	loading map[string]chan struct{}
+}
+
+type cachedFile struct {
+	blocks map[int64]*cacheBlock
+	// logical size of file, and size of file in backing store,
+	// which is smaller while writes extending file are buffered
+	size        int64
+	backingSize int64
+	dirty       int
+	// missed blocks being read, file is not released until read
+	loading int
+}
+
+type cacheBlock struct {
+	file   string
+	index  int64
+	length int64
+	dirty  bool
+	freq   uint64
+	tick   uint64
+	// position in order, -1 if not in order
+	pos int
+}
+
+// cacheOrder is heap of blocks, first block is evicted first.
+type cacheOrder struct {
+	blocks []*cacheBlock
+	lfu    bool
+}
+
+// Cached returns store caching files of backing in cache, by policy.
+// cache store is owned by returned store, files left in it are removed.
+func Cached(backing Store, cache Store, policy CachePolicy) CachedStore {
+	if policy.Eviction == 0 {
+		policy.Eviction = LRU
+	}
+
+	if policy.Mode == 0 {
+		policy.Mode = WriteThrough
+	}
+
+	for info := range cache.FileIter() {
+		cache.RemoveFile(info.Name())
+	}
+
+	return &cachedStore{
+		Store: backing,
+		cache: newCache(backing, cache, policy),
+	}
+}
+
+func newCache(backing Store, s Store, policy CachePolicy) *cache {
+	return &cache{
+		backing:  backing,
+		s:        s,
+		policy:   policy,
+		files:    make(map[string]*cachedFile),
+		expiring: make(map[string]bool),
+		order:    cacheOrder{blocks: make([]*cacheBlock, 0), lfu: policy.Eviction == LFU},
+		loading:  make(map[string]chan struct{}),
+	}
+}
+
+func (cs *cachedStore) SubStore(subpath string) Store {
+	// canonical, so files of sub stores reached by aliases share cached blocks
+	subpath = cleanSubPath(subpath)
+
+	prefix := cs.prefix
+	if subpath != "" {
+		prefix += subpath + "/"
+	}
+
+	return &cachedStore{
+		Store:  cs.Store.SubStore(subpath),
+		cache:  cs.cache,
+		prefix: prefix,
+	}
+}
+
+func (cs *cachedStore) FileIter() <-chan FileInfo {
+	files := cs.Store.FileIter()
+	if files == nil {
+		return nil
+	}
+
+	ch := make(chan FileInfo)
+	go func() {
+		for info := range files {
+			if size, ok := cs.cache.dirtySize(cs.prefix + info.Name()); ok {
+				info = &fileInfo{info.Name(), size, info.Generation()}
+			}
+			ch <- info
+		}
+
+		close(ch)
+	}()
+
+	return ch
+}
+
+// FileInfo returns size including buffered writes, but generation of backing file.
+func (cs *cachedStore) FileInfo(filename string) (FileInfo, error) {
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := cs.key("FileInfo", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if size, ok := cs.cache.dirtySize(name); ok {
+		return &fileInfo{info.Name(), size, info.Generation()}, nil
+	}
+	return info, nil
+}
+
+func (cs *cachedStore) Read(filename string, res []byte, startOffset int64) error {
+	filename, err := cleanFileName("Read", filename)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err := cs.readCached(filename, res, startOffset)
+		if err == uncachedErr {
+			return cs.Store.Read(filename, res, startOffset)
+		} else if err != cacheChangedErr {
+			return err
+		}
+	}
+}
+
+// readCached reads res at startOffset of file of canonical filename from cached blocks.
+// fails with uncachedErr if file is not cached, and with cacheChangedErr if file is changed while block is read.
+func (cs *cachedStore) readCached(filename string, res []byte, startOffset int64) error {
+	c := cs.cache
+	name := cs.prefix + filename
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.expiring[name] {
+		return uncachedErr
+	}
+
+	f, err := c.open(name)
+	if err != nil {
+		return err
+	}
+	defer c.release(name, f)
+
+	end := startOffset + int64(len(res))
+	if end > f.size {
+		end = f.size
+	}
+
+	if !c.cacheable(f.size) {
+		return uncachedErr
+	}
+
+	for pos := startOffset; pos < end; {
+		b, err := c.block(name, f, pos / c.blockSize())
+		if err != nil {
+			return err
+		}
+
+		start := b.index * c.blockSize()
+		n := minInt64(start + b.length, end) - pos
+		if n <= 0 {
+			// changed in backing store since cached
+			return io.EOF
+		}
+
+		if err := c.s.Read(b.entry(), res[pos - startOffset:pos - startOffset + n], pos - start); err != nil {
+			return err
+		}
+		pos += n
+	}
+
+	if end < startOffset + int64(len(res)) {
+		// same as os.File.ReadAt
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (cs *cachedStore) Write(filename string, data []byte, startOffset int64) error {
+	if len(data) == 0 {
+		return cs.Store.Write(filename, data, startOffset)
+	}
+
+	c := cs.cache
+	name, err := cs.key("Write", filename)
+	if err != nil {
+		return err
+	}
+
+	m := c.locks.lock(name)
+	defer m.Unlock()
+
+	c.mu.Lock()
+	expiring := c.expiring[name]
+	if !expiring && c.policy.Mode == WriteBack {
+		buffered, err := c.buffer(name, data, startOffset)
+		if buffered || err != nil {
+			c.mu.Unlock()
+			if err != nil && err != io.EOF && !IsCorrupted(err) {
+				err = &os.PathError{Op: "Write", Path: filename, Err: err}
+			}
+			return err
+		}
+	}
+	c.mu.Unlock()
+
+	err = cs.Store.Write(filename, data, startOffset)
+	if expiring {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// blocks read while written are not cached
+	c.bump(name)
+
+	f := c.files[name]
+	if err != nil || f == nil {
+		// nothing cached
+		return err
+	}
+
+	// blocks overlapping data, and last block if extended, are stale
+	end := startOffset + int64(len(data))
+	first, last := startOffset / c.blockSize(), (end - 1) / c.blockSize()
+	if end > f.size && f.size > 0 {
+		first = minInt64(first, (f.size - 1) / c.blockSize())
+	}
+
+	for index, b := range f.blocks {
+		if index >= first && index <= last {
+			if err := c.drop(f, b); err != nil {
+				return err
+			}
+		}
+	}
+
+	f.size = maxInt64(f.size, end)
+	f.backingSize = maxInt64(f.backingSize, end)
+	return nil
+}
+
+func (cs *cachedStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	if ifGeneration == anyGeneration {
+		return cs.Write(filename, data, startOffset)
+	}
+
+	return cs.through("WriteIf", filename, true, func(filename string) error {
+		return cs.Store.WriteIf(filename, data, startOffset, ifGeneration)
+	})
+}
+
+func (cs *cachedStore) Clear(filename string, startOffset int64, size int64) error {
+	return cs.through("Clear", filename, true, func(filename string) error {
+		return cs.Store.Clear(filename, startOffset, size)
+	})
+}
+
+func (cs *cachedStore) Truncate(filename string, size int64) error {
+	return cs.through("Truncate", filename, true, func(filename string) error {
+		return cs.Store.Truncate(filename, size)
+	})
+}
+
+// ReadV reads ranges through cache.
+func (cs *cachedStore) ReadV(filename string, ranges []Range, parallelism int) error {
+	return readV(cs, filename, ranges, parallelism)
+}
+
+// WriteV writes extents through cache, buffered in write-back mode.
+func (cs *cachedStore) WriteV(filename string, extents []Extent) error {
+	return writeV(cs, filename, extents)
+}
+
+// Mmap gives view of copy of file read through cache, which may hold writes not in backing store.
+func (cs *cachedStore) Mmap(filename string) (vfs.ReadOnlyMapping, error) {
+	return readMapping(cs, filename)
+}
+
+// replaceFile discards cached blocks and buffered writes of file, as content is replaced.
+func (cs *cachedStore) replaceFile(filename string, data []byte) error {
+	return cs.through("Replace", filename, false, func(filename string) error {
+		return replaceFile(cs.Store, filename, data)
+	})
+}
+
+func (cs *cachedStore) CreateFile(filename string) error {
+	return cs.through("CreateFile", filename, false, func(filename string) error {
+		return cs.cache.setExpiring(cs.prefix + filename, false, cs.Store.CreateFile(filename))
+	})
+}
+
+func (cs *cachedStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	return cs.through("CreateFileWithTTL", filename, false, func(filename string) error {
+		return cs.cache.setExpiring(cs.prefix + filename, ttl > 0, cs.Store.CreateFileWithTTL(filename, ttl))
+	})
+}
+
+func (cs *cachedStore) SetExpiry(filename string, expiry time.Time) error {
+	return cs.through("SetExpiry", filename, true, func(filename string) error {
+		return cs.cache.setExpiring(cs.prefix + filename, !expiry.IsZero(), cs.Store.SetExpiry(filename, expiry))
+	})
+}
+
+func (cs *cachedStore) CreateIfNotExists(filename string) error {
+	return cs.through("CreateIfNotExists", filename, false, func(filename string) error {
+		return cs.cache.setExpiring(cs.prefix + filename, false, cs.Store.CreateIfNotExists(filename))
+	})
+}
+
+func (cs *cachedStore) RemoveFile(filename string) error {
+	return cs.through("RemoveFile", filename, false, func(filename string) error {
+		return cs.cache.setExpiring(cs.prefix + filename, false, cs.Store.RemoveFile(filename))
+	})
+}
+
+func (cs *cachedStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	return cs.through("RemoveIfMatch", filename, false, func(filename string) error {
+		return cs.cache.setExpiring(cs.prefix + filename, false, cs.Store.RemoveIfMatch(filename, ifGeneration))
+	})
+}
+
+// Snapshot flushes buffered writes, so they are in snapshot.
+func (cs *cachedStore) Snapshot(name string) error {
+	if err := cs.Flush(); err != nil {
+		return err
+	}
+	return cs.Store.Snapshot(name)
+}
+
+func (cs *cachedStore) Flush() error {
+	c := cs.cache
+
+	c.mu.Lock()
+	names := make([]string, 0, len(c.files))
+	for name, f := range c.files {
+		if f.dirty > 0 {
+			names = append(names, name)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, name := range names {
+		if err := c.flushFile(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveDir drops cached blocks of each file, if recursive.
+func (cs *cachedStore) RemoveDir(dirname string, recursive bool) error {
+	if recursive {
+		if err := removeDirFiles(cs, dirname); err != nil {
+			return err
+		}
+	}
+	return cs.Store.RemoveDir(dirname, recursive)
+}
+
+// Sync writes buffered writes of file back, and commits it in backing store.
+func (cs *cachedStore) Sync(filename string) error {
+	name, err := cs.key("Sync", filename)
+	if err != nil {
+		return err
+	}
+
+	if err := cs.cache.flushFile(name); err != nil {
+		return err
+	}
+	return cs.Store.Sync(filename)
+}
+
+// SyncAll writes all buffered writes back, and commits them in backing store.
+func (cs *cachedStore) SyncAll() error {
+	if err := cs.Flush(); err != nil {
+		return err
+	}
+	return cs.Store.SyncAll()
+}
+
+// Close flushes buffered writes, and closes backing and cache stores.
+func (cs *cachedStore) Close() error {
+	err := cs.Flush()
+	if closeErr := cs.cache.backing.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := cs.cache.s.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (cs *cachedStore) Stats() CacheStats {
+	cs.cache.mu.Lock()
+	defer cs.cache.mu.Unlock()
+
+	return cs.cache.stats
+}
+
+// scrub verifies backing store, not to be deceived by cached blocks.
+func (cs *cachedStore) scrub(r *scrubRun) error {
+	if err := cs.Flush(); err != nil {
+		return err
+	}
+
+	if r.s != Store(cs) {
+		return scrubStore(r, cs.Store)
+	}
+
+	view := *r
+	view.s = cs.Store
+	return scrubStore(&view, cs.Store)
+}
+
+// removeExpired discards cached blocks and buffered writes of expired files.
+func (cs *cachedStore) removeExpired(fn func(name string) error) error {
+	return removeExpired(cs.Store, func(name string) error {
+		err := cs.through("RemoveExpired", name, false, func(name string) error {
+			return cs.cache.setExpiring(cs.prefix + name, false, expiredRemoval(cs.Store, name)())
+		})
+		if err != nil && err != recreatedErr {
+			return err
+		}
+		return fn(name)
+	})
+}
+
+func (cs *cachedStore) walkFiles(fn func(name string) error) error {
+	return walkFiles(cs.Store, fn)
+}
+
+// key returns name of file in cache, canonicalized so aliases of file share its cached blocks.
+func (cs *cachedStore) key(op string, filename string) (string, error) {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return "", err
+	}
+	return cs.prefix + filename, nil
+}
+
+// through applies mutation to backing store with canonical name of file, and invalidates cached blocks of file.
+// buffered writes are flushed before mutation if keep, or discarded after it otherwise,
+// as mutation replaces content of file. they are not evicted while mutation is applied.
+func (cs *cachedStore) through(op string, filename string, keep bool, mutation func(filename string) error) error {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return err
+	}
+
+	c := cs.cache
+	name := cs.prefix + filename
+
+	m := c.locks.lock(name)
+	defer m.Unlock()
+
+	c.mu.Lock()
+	f := c.files[name]
+	if keep {
+		if err := c.flush(name, f); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	} else if f != nil {
+		for _, b := range f.blocks {
+			if b.dirty && b.pos >= 0 {
+				heap.Remove(&c.order, b.pos)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	err = mutation(filename)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// blocks read while mutated are not cached, and ones read before are stale
+	c.bump(name)
+
+	if f = c.files[name]; f == nil {
+		return err
+	}
+
+	for _, b := range f.blocks {
+		if b.dirty {
+			if err != nil {
+				// kept as mutation failed
+				if b.pos < 0 {
+					heap.Push(&c.order, b)
+				}
+				continue
+			}
+
+			b.dirty = false
+			f.dirty--
+		}
+
+		if dropErr := c.drop(f, b); dropErr != nil && err == nil {
+			err = dropErr
+		}
+	}
+
+	c.release(name, f)
+	return err
+}
+
+// buffer writes data into cached blocks of file name, or returns false if file does not fit in cache,
+// and its buffered writes are written back then. called with lock held.
+func (c *cache) buffer(name string, data []byte, startOffset int64) (bool, error) {
+	for {
+		f, err := c.open(name)
+		if err == cacheChangedErr {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+
+		if !c.cacheable(maxInt64(f.size, startOffset + int64(len(data)))) {
+			err := c.flush(name, f)
+			c.release(name, f)
+			return false, err
+		}
+
+		err = c.writeBack(name, f, data, startOffset)
+		c.release(name, f)
+		if err != cacheChangedErr {
+			return true, err
+		}
+	}
+}
+
+// writeBack writes data into cached blocks, which are written back later.
+// fails with cacheChangedErr if file is changed while block is read, then it is written again.
+func (c *cache) writeBack(name string, f *cachedFile, data []byte, startOffset int64) error {
+	end := startOffset + int64(len(data))
+	size := maxInt64(f.size, end)
+
+	if end > f.size && f.size > 0 {
+		// extend last block with zeros
+		index := (f.size - 1) / c.blockSize()
+		length := minInt64(c.blockSize(), size - index * c.blockSize())
+		if b, ok := f.blocks[index]; ok && index < startOffset / c.blockSize() && b.length < length {
+			if err := c.extend(name, f, b, length); err != nil {
+				return err
+			}
+		}
+	}
+
+	for pos := startOffset; pos < end; {
+		b, err := c.block(name, f, pos / c.blockSize())
+		if err != nil {
+			return err
+		}
+
+		start := b.index * c.blockSize()
+		n := minInt64(start + c.blockSize(), end) - pos
+
+		if pos + n > start + b.length {
+			if err := c.extend(name, f, b, pos + n - start); err != nil {
+				return err
+			}
+		}
+
+		if err := c.s.Write(b.entry(), data[pos - startOffset:pos - startOffset + n], pos - start); err != nil {
+			return err
+		}
+
+		if !b.dirty {
+			b.dirty = true
+			f.dirty++
+		}
+		pos += n
+	}
+
+	f.size = maxInt64(f.size, size)
+	return nil
+}
+
+// open returns cached file of name, with size read from backing store if not cached.
+// called with lock held, which is released while size is read.
+// fails with cacheChangedErr if file is changed meanwhile.
+func (c *cache) open(name string) (*cachedFile, error) {
+	if f, ok := c.files[name]; ok {
+		return f, nil
+	}
+
+	stamp := c.stamp(name)
+	c.mu.Unlock()
+	info, err := c.backing.FileInfo(name)
+	c.mu.Lock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := c.files[name]; ok {
+		// opened meanwhile
+		return f, nil
+	}
+
+	if c.stamp(name) != stamp {
+		return nil, cacheChangedErr
+	}
+
+	f := &cachedFile{blocks: make(map[int64]*cacheBlock), size: info.Size(), backingSize: info.Size()}
+	c.files[name] = f
+	return f, nil
+}
+
+// setExpiring marks file name expiring or not, if mutation setting expiry succeeded with err.
+func (c *cache) setExpiring(name string, expiring bool, err error) error {
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if expiring {
+		c.expiring[name] = true
+	} else {
+		delete(c.expiring, name)
+	}
+	return nil
+}
+
+// release forgets file without cached blocks.
+func (c *cache) release(name string, f *cachedFile) {
+	if len(f.blocks) == 0 && f.dirty == 0 && f.loading == 0 && c.files[name] == f {
+		delete(c.files, name)
+	}
+}
+
+// stamp returns count of changes of files in stripe of name.
+func (c *cache) stamp(name string) uint64 {
+	return c.stamps[stripe(name)]
+}
+
+// bump counts change of file name, after it is applied to backing store.
+func (c *cache) bump(name string) {
+	c.stamps[stripe(name)]++
+}
+
+// block returns cached block of file, reading it through from backing store if missed.
+// called with lock held, which is released while missed block is read,
+// and concurrent misses of same block wait for the read, then fail with cacheChangedErr.
+// fails with cacheChangedErr also if file is changed meanwhile, so block read is not cached.
+func (c *cache) block(name string, f *cachedFile, index int64) (*cacheBlock, error) {
+	if b, ok := f.blocks[index]; ok {
+		c.stats.Hits++
+		c.touch(b)
+		if b.pos >= 0 {
+			// not in order while file is mutated
+			heap.Fix(&c.order, b.pos)
+		}
+		return b, nil
+	}
+
+	b := &cacheBlock{file: name, index: index, pos: -1}
+	if done, ok := c.loading[b.entry()]; ok {
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+		return nil, cacheChangedErr
+	}
+
+	c.stats.Misses++
+
+	start := index * c.blockSize()
+	length := minInt64(c.blockSize(), f.size - start)
+	if length < 0 {
+		length = 0
+	}
+	backingSize := f.backingSize
+	stamp := c.stamp(name)
+
+	done := make(chan struct{})
+	c.loading[b.entry()] = done
+	f.loading++
+	c.mu.Unlock()
+
+	// written back blocks may be beyond end of backing file, read as zeros
+	data := make([]byte, length)
+	var err error
+	if n := minInt64(length, backingSize - start); n > 0 {
+		if err = c.backing.Read(name, data[:n], start); err == io.EOF {
+			err = nil
+		}
+	}
+
+	c.mu.Lock()
+	delete(c.loading, b.entry())
+	close(done)
+	f.loading--
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.stamp(name) != stamp || c.files[name] != f || f.backingSize != backingSize ||
+		minInt64(c.blockSize(), f.size - start) > length {
+		return nil, cacheChangedErr
+	}
+
+	if cached, ok := f.blocks[index]; ok {
+		// written meanwhile
+		return cached, nil
+	}
+
+	if err := c.s.CreateFile(b.entry()); err != nil {
+		return nil, err
+	}
+
+	if err := c.s.Write(b.entry(), data, 0); err != nil {
+		c.s.RemoveFile(b.entry())
+		return nil, err
+	}
+
+	f.blocks[index] = b
+	if err := c.admit(b, length); err != nil {
+		// not in order, removed here
+		delete(f.blocks, index)
+		c.s.RemoveFile(b.entry())
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// extend grows cached block to length, filled with zeros.
+func (c *cache) extend(name string, f *cachedFile, b *cacheBlock, length int64) error {
+	if err := c.s.Write(b.entry(), make([]byte, length - b.length), b.length); err != nil {
+		return err
+	}
+
+	heap.Remove(&c.order, b.pos)
+	if !b.dirty {
+		b.dirty = true
+		f.dirty++
+	}
+
+	if err := c.admit(b, length - b.length); err != nil {
+		heap.Push(&c.order, b)
+		return err
+	}
+	return nil
+}
+
+// admit accounts grow bytes of block, which is not in order, evicting other blocks
+// to keep within budget, then puts block in order.
+func (c *cache) admit(b *cacheBlock, grow int64) error {
+	b.length += grow
+	c.stats.Used += grow
+
+	for c.stats.Used > c.policy.Budget && c.order.Len() > 0 {
+		if err := c.evict(c.order.blocks[0]); err != nil {
+			b.length -= grow
+			c.stats.Used -= grow
+			return err
+		}
+	}
+
+	c.touch(b)
+	heap.Push(&c.order, b)
+	return nil
+}
+
+func (c *cache) evict(b *cacheBlock) error {
+	f := c.files[b.file]
+
+	if b.dirty {
+		if err := c.writeBackBlock(f, b); err != nil {
+			return err
+		}
+	}
+
+	if err := c.drop(f, b); err != nil {
+		return err
+	}
+
+	c.stats.Evictions++
+	c.release(b.file, f)
+	return nil
+}
+
+// drop removes clean block from cache.
+func (c *cache) drop(f *cachedFile, b *cacheBlock) error {
+	if b.pos >= 0 {
+		heap.Remove(&c.order, b.pos)
+	}
+
+	delete(f.blocks, b.index)
+	c.stats.Used -= b.length
+	return c.s.RemoveFile(b.entry())
+}
+
+// flushFile writes back dirty blocks of file name, not while it is mutated.
+func (c *cache) flushFile(name string) error {
+	m := c.locks.lock(name)
+	defer m.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.flush(name, c.files[name])
+}
+
+// flush writes back dirty blocks of file.
+func (c *cache) flush(name string, f *cachedFile) error {
+	if f == nil || f.dirty == 0 {
+		return nil
+	}
+
+	for _, b := range f.blocks {
+		if b.dirty {
+			if err := c.writeBackBlock(f, b); err != nil {
+				return err
+			}
+		}
+	}
+
+	if f.size > f.backingSize {
+		// extended by writes of evicted blocks
+		if err := c.backing.Truncate(name, f.size); err != nil {
+			return err
+		}
+		f.backingSize = f.size
+	}
+
+	return nil
+}
+
+func (c *cache) writeBackBlock(f *cachedFile, b *cacheBlock) error {
+	data := make([]byte, b.length)
+	if err := c.s.Read(b.entry(), data, 0); err != nil {
+		return err
+	}
+
+	start := b.index * c.blockSize()
+	if err := c.backing.Write(b.file, data, start); err != nil {
+		return err
+	}
+
+	b.dirty = false
+	f.dirty--
+	f.backingSize = maxInt64(f.backingSize, start + b.length)
+	c.stats.WriteBacks++
+	return nil
+}
+
+// dirtySize returns logical size of file with buffered writes.
+func (c *cache) dirtySize(name string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.files[name]; ok && f.dirty > 0 {
+		return f.size, true
+	}
+	return 0, false
+}
+
+// cacheable returns true if blocks of file of size fit in budget.
+func (c *cache) cacheable(size int64) bool {
+	if c.policy.BlockSize > 0 {
+		return c.policy.BlockSize <= c.policy.Budget
+	}
+	return size <= c.policy.Budget
+}
+
+// blockSize returns size of blocks, whole file is a block if BlockSize is zero.
+func (c *cache) blockSize() int64 {
+	if c.policy.BlockSize > 0 {
+		return c.policy.BlockSize
+	}
+	return math.MaxInt64
+}
+
+func (c *cache) touch(b *cacheBlock) {
+	c.tick++
+	b.tick = c.tick
+	b.freq++
+}
+
+// entry returns name of block in cache store.
+func (b *cacheBlock) entry() string {
+	sum := sha256.Sum256([]byte(b.file + "\x00" + strconv.FormatInt(b.index, 10)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (o *cacheOrder) Len() int {
+	return len(o.blocks)
+}
+
+func (o *cacheOrder) Less(i, j int) bool {
+	a, b := o.blocks[i], o.blocks[j]
+	if o.lfu && a.freq != b.freq {
+		return a.freq < b.freq
+	}
+	return a.tick < b.tick
+}
+
+func (o *cacheOrder) Swap(i, j int) {
+	o.blocks[i], o.blocks[j] = o.blocks[j], o.blocks[i]
+	o.blocks[i].pos = i
+	o.blocks[j].pos = j
+}
+
+func (o *cacheOrder) Push(x interface{}) {
+	b := x.(*cacheBlock)
+	b.pos = len(o.blocks)
+	o.blocks = append(o.blocks, b)
+}
+
+func (o *cacheOrder) Pop() interface{} {
+	b := o.blocks[len(o.blocks) - 1]
+	o.blocks = o.blocks[:len(o.blocks) - 1]
+	b.pos = -1
+	return b
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
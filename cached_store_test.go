@@ -0,0 +1,205 @@
+package store
+
+import (
+	"io"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCache(t *testing.T, name string) Store {
+	cache, err := NewMemoryStore("/" + name + "_cache")
+	assert.Nil(t, err)
+	return cache
+}
+
+func TestCached_ReadThrough(t *testing.T) {
+	for i, s := range testStores(t, "TestCached_ReadThrough") {
+		cs := Cached(s, testCache(t, "TestCached_ReadThrough" + string(rune('a' + i))), CachePolicy{Budget: 10})
+		res := make([]byte, 4)
+
+		for _, filename := range []string{"a", "b", "c"} {
+			assert.Nil(t, cs.CreateFile(filename))
+			assert.Nil(t, cs.Write(filename, []byte(filename + "123"), 0))
+		}
+
+		assert.Nil(t, cs.Read("a", res, 0))
+		assert.Nil(t, cs.Read("a", res, 0))
+		assert.Nil(t, cs.Read("b", res, 0))
+		assert.Equal(t, CacheStats{Hits: 1, Misses: 2, Used: 8}, cs.Stats())
+
+		// least recently used a is evicted
+		assert.Nil(t, cs.Read("c", res, 0))
+		assert.Nil(t, cs.Read("a", res, 0))
+		assert.Equal(t, "a123", string(res))
+		assert.Equal(t, CacheStats{Hits: 1, Misses: 4, Evictions: 2, Used: 8}, cs.Stats())
+
+		// write invalidates cached file
+		assert.Nil(t, cs.Write("a", []byte("xyz"), 2))
+		res = make([]byte, 6)
+		assert.Equal(t, io.EOF, cs.Read("a", res, 0))
+		assert.Equal(t, "a1xyz\x00", string(res))
+
+		assert.Nil(t, cs.RemoveFile("a"))
+		assert.NotNil(t, cs.Read("a", res, 0))
+
+		// file over budget is read from backing store
+		big := make([]byte, 11)
+		assert.Nil(t, cs.CreateFile("big"))
+		assert.Nil(t, cs.Write("big", []byte("big"), 8))
+		assert.Nil(t, cs.Read("big", big, 0))
+		assert.Equal(t, "big", string(big[8:]))
+		assert.Equal(t, int64(4), cs.Stats().Used)
+	}
+}
+
+func TestCached_Blocks(t *testing.T) {
+	for i, s := range testStores(t, "TestCached_Blocks") {
+		cs := Cached(s, testCache(t, "TestCached_Blocks" + string(rune('a' + i))),
+			CachePolicy{Budget: 8, BlockSize: 4, Eviction: LFU})
+
+		cs.CreateFile("file")
+		cs.Write("file", []byte("0123456789ab"), 0)
+
+		res := make([]byte, 2)
+		assert.Nil(t, cs.Read("file", res, 0))
+		assert.Nil(t, cs.Read("file", res, 2))
+		assert.Nil(t, cs.Read("file", res, 4))
+
+		// least frequently used second block is evicted
+		assert.Nil(t, cs.Read("file", res, 8))
+		assert.Equal(t, "89", string(res))
+		assert.Nil(t, cs.Read("file", res, 0))
+		assert.Equal(t, CacheStats{Hits: 2, Misses: 3, Evictions: 1, Used: 8}, cs.Stats())
+
+		// read across blocks
+		res = make([]byte, 8)
+		assert.Equal(t, io.EOF, cs.Read("file", res, 6))
+		assert.Equal(t, "6789ab", string(res[:6]))
+
+		// write invalidates overlapped blocks only
+		assert.Nil(t, cs.Write("file", []byte("x"), 9))
+		assert.Equal(t, int64(4), cs.Stats().Used)
+		assert.Nil(t, cs.Read("file", res[:4], 8))
+		assert.Equal(t, "8xab", string(res[:4]))
+	}
+}
+
+func TestCached_WriteBack(t *testing.T) {
+	for i, s := range testStores(t, "TestCached_WriteBack") {
+		cs := Cached(s, testCache(t, "TestCached_WriteBack" + string(rune('a' + i))),
+			CachePolicy{Budget: 8, BlockSize: 4, Mode: WriteBack})
+
+		assert.Nil(t, cs.CreateFile("file"))
+		assert.Nil(t, cs.Write("file", []byte("0123"), 0))
+		assert.Nil(t, cs.Write("file", []byte("45"), 6))
+
+		// buffered in cache
+		info, _ := s.FileInfo("file")
+		assert.Equal(t, int64(0), info.Size())
+		info, _ = cs.FileInfo("file")
+		assert.Equal(t, int64(8), info.Size())
+
+		res := make([]byte, 8)
+		assert.Nil(t, cs.Read("file", res, 0))
+		assert.Equal(t, "0123\x00\x0045", string(res))
+
+		// evicted block is written back
+		assert.Nil(t, cs.Write("file", []byte("89"), 8))
+		assert.Equal(t, uint64(1), cs.Stats().WriteBacks)
+		info, _ = s.FileInfo("file")
+		assert.Equal(t, int64(4), info.Size())
+
+		assert.Nil(t, cs.Flush())
+		info, _ = s.FileInfo("file")
+		assert.Equal(t, int64(10), info.Size())
+
+		res = make([]byte, 10)
+		assert.Nil(t, s.Read("file", res, 0))
+		assert.Equal(t, "0123\x00\x004589", string(res))
+
+		// truncate flushes buffered writes first
+		assert.Nil(t, cs.Write("file", []byte("x"), 0))
+		assert.Nil(t, cs.Truncate("file", 2))
+		assert.Nil(t, s.Read("file", res[:2], 0))
+		assert.Equal(t, "x1", string(res[:2]))
+
+		// buffered writes of removed file are discarded
+		assert.Nil(t, cs.Write("file", []byte("y"), 0))
+		assert.Nil(t, cs.RemoveFile("file"))
+		assert.Nil(t, cs.Flush())
+		assert.False(t, s.IsFileExist("file"))
+
+		assert.NotNil(t, cs.Write("missing", []byte("y"), 0))
+	}
+}
+
+type readHookedStore struct {
+	Store
+	read func(filename string)
+}
+
+func (s *readHookedStore) Read(filename string, res []byte, startOffset int64) error {
+	s.read(filename)
+	return s.Store.Read(filename, res, startOffset)
+}
+
+func TestCached_ConcurrentMiss(t *testing.T) {
+	s, _ := NewMemoryStore("/TestCached_ConcurrentMiss")
+	for _, filename := range []string{"a", "b"} {
+		assert.Nil(t, s.CreateFile(filename))
+		assert.Nil(t, s.Write(filename, []byte(filename + "123"), 0))
+	}
+
+	reading, release := make(chan struct{}), make(chan struct{})
+	reads := 0
+	hooked := &readHookedStore{Store: s, read: func(filename string) {
+		if filename == "a" {
+			reads++
+			close(reading)
+			<-release
+		}
+	}}
+	cs := Cached(hooked, testCache(t, "TestCached_ConcurrentMiss"), CachePolicy{Budget: 16})
+
+	results := make(chan string, 2)
+	read := func() {
+		res := make([]byte, 4)
+		assert.Nil(t, cs.Read("a", res, 0))
+		results <- string(res)
+	}
+	go read()
+	<-reading
+	go read()
+
+	// other files are read while missed block is read
+	res := make([]byte, 4)
+	assert.Nil(t, cs.Read("b", res, 0))
+	assert.Equal(t, "b123", string(res))
+
+	close(release)
+	assert.Equal(t, "a123", <-results)
+	assert.Equal(t, "a123", <-results)
+	assert.Equal(t, 1, reads)
+}
+
+func TestCached_Aliases(t *testing.T) {
+	for i, mode := range []CacheMode{WriteThrough, WriteBack} {
+		s := NewFileSystemStore(path).SubStore("TestCached_Aliases")
+		cs := Cached(s, testCache(t, "TestCached_Aliases" + string(rune('a' + i))), CachePolicy{Budget: 16, Mode: mode})
+		res := make([]byte, 4)
+
+		// writes through aliases invalidate blocks cached by canonical name
+		assert.Nil(t, cs.CreateFile("f"))
+		assert.Nil(t, cs.Write("f", []byte("aaaa"), 0))
+		assert.Nil(t, cs.Read("f", res, 0))
+		assert.Nil(t, cs.Write("./f", []byte("bbbb"), 0))
+		assert.Nil(t, cs.Read("f", res, 0))
+		assert.Equal(t, "bbbb", string(res))
+
+		assert.Nil(t, cs.SubStore("./sub/").CreateFile("f"))
+		assert.Nil(t, cs.SubStore("sub").Write("f", []byte("cccc"), 0))
+		assert.Nil(t, cs.Read("sub//f", res, 0))
+		assert.Equal(t, "cccc", string(res))
+		assert.Nil(t, cs.Close())
+	}
+}
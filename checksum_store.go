@@ -0,0 +1,940 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+type ChecksumAlgorithm uint8
+
+const (
+	CRC32C ChecksumAlgorithm = iota + 1
+	SHA256
+)
+
+const (
+	checksumsStore           = hiddenPrefix + "checksums"
+	defaultChecksumBlockSize = 64 * 1024
+
+	// algorithm(1) blockSize(8) keyLength(2) | key | crc32 of preceding bytes(4)
+	checksumHeaderSize = 11
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	orphanedChecksumsErr = errors.New("checksums of missing file")
+)
+
+/**
+ ChecksumOptions of checksum store.
+ zero value means CRC32C of every 64KiB block.
+ */
+type ChecksumOptions struct {
+	Algorithm ChecksumAlgorithm
+	BlockSize int64
+}
+
+/**
+ CorruptionError is returned when data does not match its checksum.
+ Block is index of corrupted block, -1 if checksums themselves are corrupted.
+ */
+type CorruptionError struct {
+	Path     string
+	Block    int64
+	Expected string
+	Actual   string
+}
+
+/**
+ FileInfo of checksum store, with checksum of whole file.
+ checksum is formatted as "<algorithm>:<hex>", empty if file is not tracked.
+ */
+type ChecksumFileInfo interface {
+	FileInfo
+	Checksum() string
+}
+
+/**
+ Store keeping checksums of every block of files in hidden area of underlying store.
+ checksums are updated on mutations, and verified on Read.
+ files created bypassing this store are not verified until mutated through it.
+ checksums of changed blocks are written before data, keeping previous ones,
+ so block written partly by interrupted mutation is still verified by either of them.
+ */
+type ChecksumStore interface {
+	Store
+	// Verify reads whole file and checks all blocks.
+	Verify(filename string) error
+}
+
+type checksumStore struct {
+	Store
+	checksums *checksums
+	prefix    string
+}
+
+type checksums struct {
+	s         Store
+	algorithm ChecksumAlgorithm
+	blockSize int64
+	locks     stripedLock
+}
+
+/**
+ blockSums is header of checksums of a file.
+ checksums file is encoded as header, followed by an entry of each block at fixed offset,
+ so checksums of blocks are read and written in place.
+ entry is encoded as latest(sum) previous(sum) crc32 of preceding bytes(4).
+ */
+type blockSums struct {
+	key       string
+	algorithm ChecksumAlgorithm
+	blockSize int64
+	// offset of entries in checksums file
+	entries int64
+	// number of entries in checksums file, may be more than blocks of file
+	count int64
+}
+
+type blockSum struct {
+	latest   []byte
+	previous []byte
+}
+
+type checksumFileInfo struct {
+	FileInfo
+	checksum string
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Block < 0 {
+		return fmt.Sprintf("%s: corrupted checksums", e.Path)
+	}
+	return fmt.Sprintf("%s: block %d corrupted: expected checksum %s, actual %s",
+		e.Path, e.Block, e.Expected, e.Actual)
+}
+
+// IsCorrupted returns true if err is a CorruptionError.
+func IsCorrupted(err error) bool {
+	_, ok := err.(*CorruptionError)
+	return ok
+}
+
+func (a ChecksumAlgorithm) String() string {
+	switch a {
+	case CRC32C:
+		return "crc32c"
+	case SHA256:
+		return "sha256"
+	}
+	return "unknown"
+}
+
+func (a ChecksumAlgorithm) sum(data []byte) []byte {
+	switch a {
+	case SHA256:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	default:
+		sum := make([]byte, 4)
+		binary.BigEndian.PutUint32(sum, crc32.Checksum(data, castagnoli))
+		return sum
+	}
+}
+
+func (a ChecksumAlgorithm) size() int {
+	if a == SHA256 {
+		return sha256.Size
+	}
+	return 4
+}
+
+func (f *checksumFileInfo) Checksum() string {
+	return f.checksum
+}
+
+func NewChecksumStore(s Store, options ChecksumOptions) ChecksumStore {
+	if options.Algorithm == 0 {
+		options.Algorithm = CRC32C
+	}
+
+	if options.BlockSize <= 0 {
+		options.BlockSize = defaultChecksumBlockSize
+	}
+
+	return &checksumStore{
+		Store: s,
+		checksums: &checksums{
+			s:         s.SubStore(checksumsStore),
+			algorithm: options.Algorithm,
+			blockSize: options.BlockSize,
+		},
+	}
+}
+
+func (cs *checksumStore) SubStore(subpath string) Store {
+	// canonical, so files of sub stores reached by aliases share checksums
+	subpath = cleanSubPath(subpath)
+
+	prefix := cs.prefix
+	if subpath != "" {
+		prefix += subpath + "/"
+	}
+
+	return &checksumStore{
+		Store:     cs.Store.SubStore(subpath),
+		checksums: cs.checksums,
+		prefix:    prefix,
+	}
+}
+
+func (cs *checksumStore) FileInfo(filename string) (FileInfo, error) {
+	key, err := cs.key("FileInfo", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	m := cs.checksums.locks.lock(key)
+	defer m.Unlock()
+
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := cs.checksums.load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &checksumFileInfo{FileInfo: info}
+	if bs != nil {
+		sums, err := cs.checksums.read(bs, 0, minInt64(bs.count, bs.blocks(info.Size())))
+		if err != nil {
+			return nil, err
+		}
+		res.checksum = bs.algorithm.String() + ":" + hex.EncodeToString(bs.fileSum(sums))
+	}
+
+	return res, nil
+}
+
+func (cs *checksumStore) Read(filename string, res []byte, startOffset int64) error {
+	key, err := cs.key("Read", filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.checksums.locks.lock(key)
+	defer m.Unlock()
+
+	bs, err := cs.checksums.load(key)
+	if err != nil {
+		return err
+	} else if bs == nil {
+		// not tracked
+		return cs.Store.Read(filename, res, startOffset)
+	}
+
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	end := startOffset + int64(len(res))
+	if end > info.Size() {
+		end = info.Size()
+	}
+
+	if startOffset >= end {
+		return io.EOF
+	}
+
+	// read and verify whole blocks covering requested range
+	first := startOffset / bs.blockSize
+	last := (end - 1) / bs.blockSize
+	blockStart := first * bs.blockSize
+	blockEnd := (last + 1) * bs.blockSize
+	if blockEnd > info.Size() {
+		blockEnd = info.Size()
+	}
+
+	sums, err := cs.checksums.read(bs, first, last + 1 - first)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, blockEnd - blockStart)
+	if err := cs.Store.Read(filename, data, blockStart); err != nil {
+		return err
+	}
+
+	if err := bs.verify(first, sums, data); err != nil {
+		return err
+	}
+
+	copy(res, data[startOffset - blockStart:])
+
+	if end < startOffset + int64(len(res)) {
+		// same as os.File.ReadAt
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (cs *checksumStore) Verify(filename string) error {
+	key, err := cs.key("Verify", filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.checksums.locks.lock(key)
+	defer m.Unlock()
+
+	bs, err := cs.checksums.load(key)
+	if err != nil || bs == nil {
+		return err
+	}
+
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	sums, err := cs.checksums.read(bs, 0, bs.blocks(info.Size()))
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, bs.blockSize)
+	for block := range sums {
+		n := bs.blockLen(int64(block), info.Size())
+		if err := cs.Store.Read(filename, data[:n], int64(block) * bs.blockSize); err != nil {
+			return err
+		}
+
+		if err := bs.verify(int64(block), sums[block:block + 1], data[:n]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Mmap verifies whole data of mapping once, so reads from it need not be verified.
+func (cs *checksumStore) Mmap(filename string) (vfs.ReadOnlyMapping, error) {
+	key, err := cs.key("Mmap", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	m := cs.checksums.locks.lock(key)
+	defer m.Unlock()
+
+	bs, err := cs.checksums.load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping, err := cs.Store.Mmap(filename)
+	if err != nil || bs == nil {
+		return mapping, err
+	}
+
+	sums, err := cs.checksums.read(bs, 0, bs.blocks(int64(len(mapping.Bytes()))))
+	if err == nil {
+		err = bs.verify(0, sums, mapping.Bytes())
+	}
+
+	if err != nil {
+		mapping.Close()
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// RemoveDir removes checksums of each file, if recursive.
+func (cs *checksumStore) RemoveDir(dirname string, recursive bool) error {
+	if recursive {
+		if err := removeDirFiles(cs, dirname); err != nil {
+			return err
+		}
+	}
+	return cs.Store.RemoveDir(dirname, recursive)
+}
+
+// Sync commits checksums of file, and file.
+// checksums are committed first, so committed data is never left without them.
+func (cs *checksumStore) Sync(filename string) error {
+	key, err := cs.key("Sync", filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.checksums.locks.lock(key)
+	defer m.Unlock()
+
+	name := cs.checksums.name(key)
+	if cs.checksums.s.IsFileExist(name) {
+		if err := cs.checksums.s.Sync(name); err != nil {
+			return err
+		}
+	}
+
+	return cs.Store.Sync(filename)
+}
+
+func (cs *checksumStore) Write(filename string, data []byte, startOffset int64) error {
+	changes := []fileChange{{offset: startOffset, length: int64(len(data)), data: data}}
+	return cs.update("Write", filename, changes, -1, func() error {
+		return cs.Store.Write(filename, data, startOffset)
+	})
+}
+
+// ReadV verifies ranges like Read.
+func (cs *checksumStore) ReadV(filename string, ranges []Range, parallelism int) error {
+	return readV(cs, filename, ranges, parallelism)
+}
+
+func (cs *checksumStore) WriteV(filename string, extents []Extent) error {
+	return cs.update("WriteV", filename, extentChanges(extents), -1, func() error {
+		return cs.Store.WriteV(filename, extents)
+	})
+}
+
+func (cs *checksumStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	changes := []fileChange{{offset: startOffset, length: int64(len(data)), data: data}}
+	return cs.update("WriteIf", filename, changes, -1, func() error {
+		return cs.Store.WriteIf(filename, data, startOffset, ifGeneration)
+	})
+}
+
+func (cs *checksumStore) Clear(filename string, startOffset int64, size int64) error {
+	changes := []fileChange{{offset: startOffset, length: size}}
+	return cs.update("Clear", filename, changes, -1, func() error {
+		return cs.Store.Clear(filename, startOffset, size)
+	})
+}
+
+func (cs *checksumStore) Truncate(filename string, size int64) error {
+	return cs.update("Truncate", filename, nil, size, func() error {
+		return cs.Store.Truncate(filename, size)
+	})
+}
+
+func (cs *checksumStore) CreateFile(filename string) error {
+	return cs.create("CreateFile", filename, func() error {
+		return cs.Store.CreateFile(filename)
+	})
+}
+
+func (cs *checksumStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	return cs.create("CreateFileWithTTL", filename, func() error {
+		return cs.Store.CreateFileWithTTL(filename, ttl)
+	})
+}
+
+func (cs *checksumStore) CreateIfNotExists(filename string) error {
+	return cs.create("CreateIfNotExists", filename, func() error {
+		return cs.Store.CreateIfNotExists(filename)
+	})
+}
+
+func (cs *checksumStore) RemoveFile(filename string) error {
+	return cs.remove("RemoveFile", filename, func() error {
+		return cs.Store.RemoveFile(filename)
+	})
+}
+
+func (cs *checksumStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	return cs.remove("RemoveIfMatch", filename, func() error {
+		return cs.Store.RemoveIfMatch(filename, ifGeneration)
+	})
+}
+
+func (cs *checksumStore) Watch(path string, recursive bool) (<-chan vfs.Event, func(), error) {
+	events, cancel, err := cs.Store.Watch(path, recursive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// hide changes of checksums
+	return relayEvents(events, cancel, func(name string) (string, bool) {
+		return name, !isHidden(name)
+	})
+}
+
+func (cs *checksumStore) create(op string, filename string, create func() error) error {
+	key, err := cs.key(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.checksums.locks.lock(key)
+	defer m.Unlock()
+
+	if err := create(); err != nil {
+		return err
+	}
+
+	return cs.checksums.replace(key, nil)
+}
+
+func (cs *checksumStore) remove(op string, filename string, remove func() error) error {
+	key, err := cs.key(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.checksums.locks.lock(key)
+	defer m.Unlock()
+
+	if err := remove(); err != nil {
+		return err
+	}
+
+	return cs.checksums.remove(key)
+}
+
+// update applies mutation of changes to file, resizing it to size, or to end of changes if size is negative.
+// checksums of changed blocks are computed from changes and written before mutation,
+// blocks added or removed by change of file size are updated too.
+func (cs *checksumStore) update(op string, filename string, changes []fileChange, size int64, mutation func() error) error {
+	key, err := cs.key(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.checksums.locks.lock(key)
+	defer m.Unlock()
+
+	bs, err := cs.checksums.load(key)
+	if err != nil {
+		return err
+	}
+
+	if bs == nil {
+		// not tracked yet, compute all blocks after mutation
+		if err := mutation(); err != nil {
+			return err
+		}
+		return cs.track(filename, key)
+	}
+
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	oldSize := info.Size()
+	if size < 0 {
+		size = oldSize
+		for _, change := range changes {
+			size = maxInt64(size, change.offset + change.length)
+		}
+	}
+
+	oldBlocks, blocks := bs.blocks(oldSize), bs.blocks(size)
+	dirty := make(map[int64]bool)
+
+	// last blocks of old and new size may be resized, and blocks without checksums are added
+	if size != oldSize {
+		for block := minInt64(oldBlocks, blocks) - 1; block < blocks; block++ {
+			dirty[block] = true
+		}
+	}
+
+	for block := bs.count; block < blocks; block++ {
+		dirty[block] = true
+	}
+
+	for _, change := range changes {
+		end := minInt64(change.offset + change.length, size)
+		for block := change.offset / bs.blockSize; change.offset < end && block <= (end - 1) / bs.blockSize; block++ {
+			dirty[block] = true
+		}
+	}
+	delete(dirty, -1)
+
+	if len(dirty) > 0 {
+		if err := cs.prepare(filename, bs, dirty, oldSize, size, changes); err != nil {
+			return err
+		}
+	}
+
+	if err := mutation(); err != nil {
+		return err
+	}
+
+	if blocks < bs.count {
+		// entries of removed blocks are dropped after the blocks are
+		cs.checksums.s.Truncate(cs.checksums.name(key), bs.entries + blocks * bs.entrySize())
+	}
+
+	return nil
+}
+
+// prepare writes checksums of dirty blocks after changes resizing file from oldSize to size,
+// keeping latest checksums of them as previous ones.
+func (cs *checksumStore) prepare(filename string, bs *blockSums, dirty map[int64]bool,
+	oldSize int64, size int64, changes []fileChange) error {
+	first, last := int64(-1), int64(-1)
+	for block := range dirty {
+		if first < 0 || block < first {
+			first = block
+		}
+		if block > last {
+			last = block
+		}
+	}
+
+	sums := make([]blockSum, last + 1 - first)
+	if kept := minInt64(last + 1, bs.count) - first; kept > 0 {
+		read, err := cs.checksums.read(bs, first, kept)
+		if err != nil {
+			return err
+		}
+		copy(sums, read)
+	}
+
+	data := make([]byte, bs.blockSize)
+	for block := range dirty {
+		off := block * bs.blockSize
+		n := bs.blockLen(block, size)
+
+		// content is read unless whole block is written by a change
+		if !coveredByChange(changes, off, n) {
+			if kept := minInt64(oldSize - off, n); kept > 0 {
+				if err := cs.Store.Read(filename, data[:kept], off); err != nil {
+					return err
+				}
+			}
+		}
+		applyChanges(data[:n], off, oldSize, size, changes)
+
+		sum := &sums[block - first]
+		sum.previous = sum.latest
+		sum.latest = bs.algorithm.sum(data[:n])
+		if sum.previous == nil {
+			sum.previous = sum.latest
+		}
+	}
+
+	return cs.checksums.write(bs, first, sums)
+}
+
+// track computes checksums of all blocks of file not tracked yet.
+func (cs *checksumStore) track(filename string, key string) error {
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	bs := cs.checksums.newBlockSums(key)
+	sums := make([]blockSum, bs.blocks(info.Size()))
+
+	data := make([]byte, bs.blockSize)
+	for block := range sums {
+		n := bs.blockLen(int64(block), info.Size())
+		if err := cs.Store.Read(filename, data[:n], int64(block) * bs.blockSize); err != nil {
+			return err
+		}
+
+		sum := bs.algorithm.sum(data[:n])
+		sums[block] = blockSum{latest: sum, previous: sum}
+	}
+
+	return cs.checksums.replace(key, sums)
+}
+
+// coveredByChange returns true if n bytes at off are written by one of changes.
+func coveredByChange(changes []fileChange, off int64, n int64) bool {
+	for _, change := range changes {
+		if change.offset <= off && off + n <= change.offset + change.length {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checksums) newBlockSums(key string) *blockSums {
+	return &blockSums{
+		key:       key,
+		algorithm: c.algorithm,
+		blockSize: c.blockSize,
+		entries:   int64(checksumHeaderSize + len(key) + 4),
+	}
+}
+
+// name returns name of checksums file of key.
+// key is hashed, so name is short enough for any key, key is kept in header.
+func (c *checksums) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// load returns header of checksums of key, nil if not tracked.
+func (c *checksums) load(key string) (*blockSums, error) {
+	name := c.name(key)
+	if !c.s.IsFileExist(name) {
+		return nil, nil
+	}
+
+	bs, err := c.header(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if bs == nil || bs.key != key {
+		return nil, &CorruptionError{Path: key, Block: -1}
+	}
+
+	return bs, nil
+}
+
+// header decodes header of checksums file of name, nil if corrupted.
+func (c *checksums) header(name string) (*blockSums, error) {
+	info, err := c.s.FileInfo(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() < checksumHeaderSize + 4 {
+		return nil, nil
+	}
+
+	data := make([]byte, checksumHeaderSize)
+	if err := c.s.Read(name, data, 0); err != nil {
+		return nil, err
+	}
+
+	size := int64(checksumHeaderSize + int(binary.LittleEndian.Uint16(data[9:])) + 4)
+	if info.Size() < size {
+		return nil, nil
+	}
+
+	data = append(data, make([]byte, size - checksumHeaderSize)...)
+	if err := c.s.Read(name, data[checksumHeaderSize:], checksumHeaderSize); err != nil {
+		return nil, err
+	}
+
+	body := data[:size - 4]
+	if crc32.Checksum(body, castagnoli) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, nil
+	}
+
+	bs := &blockSums{
+		key:       string(body[checksumHeaderSize:]),
+		algorithm: ChecksumAlgorithm(body[0]),
+		blockSize: int64(binary.LittleEndian.Uint64(body[1:])),
+		entries:   size,
+	}
+
+	if bs.blockSize <= 0 {
+		return nil, nil
+	}
+
+	// entry torn by interrupted append is not counted
+	bs.count = (info.Size() - size) / bs.entrySize()
+	return bs, nil
+}
+
+// read returns checksums of n blocks from first.
+func (c *checksums) read(bs *blockSums, first int64, n int64) ([]blockSum, error) {
+	if first + n > bs.count {
+		return nil, &CorruptionError{Path: bs.key, Block: -1}
+	}
+
+	sums := make([]blockSum, n)
+	if n <= 0 {
+		return sums, nil
+	}
+
+	size := int64(bs.algorithm.size())
+	data := make([]byte, n * bs.entrySize())
+	if err := c.s.Read(c.name(bs.key), data, bs.entries + first * bs.entrySize()); err != nil {
+		return nil, err
+	}
+
+	for i := range sums {
+		entry := data[int64(i) * bs.entrySize():]
+		if crc32.Checksum(entry[:2 * size], castagnoli) != binary.LittleEndian.Uint32(entry[2 * size:]) {
+			return nil, &CorruptionError{Path: bs.key, Block: -1}
+		}
+		sums[i] = blockSum{latest: entry[:size], previous: entry[size:2 * size]}
+	}
+
+	return sums, nil
+}
+
+// write writes checksums of blocks from first in place.
+func (c *checksums) write(bs *blockSums, first int64, sums []blockSum) error {
+	data := encodeBlockSums(bs, sums)
+	if err := c.s.Write(c.name(bs.key), data, bs.entries + first * bs.entrySize()); err != nil {
+		return err
+	}
+
+	bs.count = maxInt64(bs.count, first + int64(len(sums)))
+	return nil
+}
+
+// replace replaces checksums of key with sums of all blocks atomically.
+func (c *checksums) replace(key string, sums []blockSum) error {
+	bs := c.newBlockSums(key)
+
+	data := make([]byte, checksumHeaderSize, bs.entries)
+	data[0] = byte(bs.algorithm)
+	binary.LittleEndian.PutUint64(data[1:], uint64(bs.blockSize))
+	binary.LittleEndian.PutUint16(data[9:], uint16(len(key)))
+	data = append(data, key...)
+	data = data[:bs.entries]
+	binary.LittleEndian.PutUint32(data[bs.entries - 4:], crc32.Checksum(data[:bs.entries - 4], castagnoli))
+
+	return replaceFile(c.s, c.name(key), append(data, encodeBlockSums(bs, sums)...))
+}
+
+func (c *checksums) remove(key string) error {
+	name := c.name(key)
+	if !c.s.IsFileExist(name) {
+		return nil
+	}
+	return c.s.RemoveFile(name)
+}
+
+// blocks returns number of blocks of file of size.
+func (bs *blockSums) blocks(size int64) int64 {
+	return (size + bs.blockSize - 1) / bs.blockSize
+}
+
+// blockLen returns length of block in file of size.
+func (bs *blockSums) blockLen(block int64, size int64) int64 {
+	if (block + 1) * bs.blockSize > size {
+		return size - block * bs.blockSize
+	}
+	return bs.blockSize
+}
+
+// entrySize returns size of checksums entry of a block.
+func (bs *blockSums) entrySize() int64 {
+	return int64(2 * bs.algorithm.size() + 4)
+}
+
+// verify checks data of consecutive blocks starting at block first, against their checksums.
+// block matching either latest or previous checksum is not corrupted.
+func (bs *blockSums) verify(first int64, sums []blockSum, data []byte) error {
+	for off := int64(0); off < int64(len(data)); off += bs.blockSize {
+		block := first + off / bs.blockSize
+		end := off + bs.blockSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+
+		if block - first >= int64(len(sums)) {
+			return &CorruptionError{Path: bs.key, Block: -1}
+		}
+
+		sum := sums[block - first]
+		actual := bs.algorithm.sum(data[off:end])
+		if !bytes.Equal(actual, sum.latest) && !bytes.Equal(actual, sum.previous) {
+			return &CorruptionError{
+				Path:     bs.key,
+				Block:    block,
+				Expected: hex.EncodeToString(sum.latest),
+				Actual:   hex.EncodeToString(actual),
+			}
+		}
+	}
+
+	return nil
+}
+
+// fileSum returns checksum of whole file, computed over latest checksums of blocks.
+func (bs *blockSums) fileSum(sums []blockSum) []byte {
+	all := make([]byte, 0, len(sums) * bs.algorithm.size())
+	for _, sum := range sums {
+		all = append(all, sum.latest...)
+	}
+	return bs.algorithm.sum(all)
+}
+
+func encodeBlockSums(bs *blockSums, sums []blockSum) []byte {
+	size := bs.algorithm.size()
+	data := make([]byte, int64(len(sums)) * bs.entrySize())
+
+	for i, sum := range sums {
+		entry := data[int64(i) * bs.entrySize():]
+		copy(entry, sum.latest)
+		copy(entry[size:], sum.previous)
+		binary.LittleEndian.PutUint32(entry[2 * size:], crc32.Checksum(entry[:2 * size], castagnoli))
+	}
+
+	return data
+}
+
+// scrub checks checksums left for missing files too.
+func (cs *checksumStore) scrub(r *scrubRun) error {
+	if err := scrubStore(r, cs.Store); err != nil {
+		return err
+	}
+
+	for info := range cs.checksums.s.FileIter() {
+		bs, err := cs.checksums.header(info.Name())
+		if err != nil || bs == nil || !strings.HasPrefix(bs.key, cs.prefix) {
+			continue
+		}
+
+		key := bs.key
+		filename := strings.TrimPrefix(key, cs.prefix)
+		if cs.Store.IsFileExist(filename) {
+			continue
+		}
+
+		r.problem(ScrubInconsistentMeta, filename, orphanedChecksumsErr, func() error {
+			m := cs.checksums.locks.lock(key)
+			defer m.Unlock()
+
+			if cs.Store.IsFileExist(filename) {
+				// created after checked
+				return nil
+			}
+			return cs.checksums.remove(key)
+		})
+	}
+
+	return r.ctx.Err()
+}
+
+// removeExpired removes checksums of expired files too.
+func (cs *checksumStore) removeExpired(fn func(name string) error) error {
+	return removeExpired(cs.Store, func(name string) error {
+		if err := cs.remove("RemoveExpired", name, expiredRemoval(cs.Store, name)); err != nil && err != recreatedErr {
+			return err
+		}
+		return fn(name)
+	})
+}
+
+func (cs *checksumStore) walkFiles(fn func(name string) error) error {
+	return walkFiles(cs.Store, fn)
+}
+
+// key returns key of checksums of file, canonicalized so aliases of file share its checksums.
+func (cs *checksumStore) key(op string, filename string) (string, error) {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return "", err
+	}
+	return cs.prefix + filename, nil
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumStore_ReadVerify(t *testing.T) {
+	for _, s := range testStores(t, "TestChecksumStore_ReadVerify") {
+		for _, algorithm := range []ChecksumAlgorithm{CRC32C, SHA256} {
+			cs := NewChecksumStore(s, ChecksumOptions{Algorithm: algorithm, BlockSize: 4})
+			filename := "file_" + algorithm.String()
+
+			assert.Nil(t, cs.CreateFile(filename))
+			assert.Nil(t, cs.Write(filename, []byte("0123456789"), 0))
+			assert.Nil(t, cs.Write(filename, []byte("ab"), 3))
+			assert.Nil(t, cs.Verify(filename))
+
+			res := make([]byte, 5)
+			assert.Nil(t, cs.Read(filename, res, 2))
+			assert.Equal(t, "2ab56", string(res))
+
+			// read past end
+			res = make([]byte, 4)
+			assert.Equal(t, io.EOF, cs.Read(filename, res, 8))
+			assert.Equal(t, "89", string(res[:2]))
+
+			info, err := cs.FileInfo(filename)
+			assert.Nil(t, err)
+			assert.True(t, strings.HasPrefix(info.(ChecksumFileInfo).Checksum(), algorithm.String() + ":"))
+
+			// bit rot, bypassing checksum store
+			s.Write(filename, []byte("x"), 5)
+
+			err = cs.Read(filename, res, 4)
+			assert.True(t, IsCorrupted(err))
+			assert.Equal(t, int64(1), err.(*CorruptionError).Block)
+			assert.True(t, IsCorrupted(cs.Verify(filename)))
+
+			// other blocks are still readable
+			assert.Nil(t, cs.Read(filename, res, 0))
+			assert.Equal(t, "012a", string(res))
+
+			assert.Nil(t, cs.RemoveFile(filename))
+		}
+	}
+}
+
+func TestChecksumStore_Update(t *testing.T) {
+	for _, s := range testStores(t, "TestChecksumStore_Update") {
+		cs := NewChecksumStore(s, ChecksumOptions{BlockSize: 4})
+		filename := "file"
+
+		assert.Nil(t, cs.CreateFile(filename))
+		assert.Nil(t, cs.Write(filename, []byte("0123456789"), 0))
+		info, _ := cs.FileInfo(filename)
+		checksum := info.(ChecksumFileInfo).Checksum()
+
+		assert.Nil(t, cs.Clear(filename, 2, 4))
+		assert.Nil(t, cs.Verify(filename))
+
+		assert.Nil(t, cs.Truncate(filename, 5))
+		assert.Nil(t, cs.Verify(filename))
+		assert.Nil(t, cs.Truncate(filename, 13))
+		assert.Nil(t, cs.Verify(filename))
+
+		info, _ = cs.FileInfo(filename)
+		assert.NotEqual(t, checksum, info.(ChecksumFileInfo).Checksum())
+
+		// same content, same checksum
+		other := "other"
+		assert.Nil(t, cs.CreateFile(other))
+		assert.Nil(t, cs.Write(other, []byte("01"), 0))
+		assert.Nil(t, cs.Truncate(other, 13))
+		otherInfo, _ := cs.FileInfo(other)
+		assert.Equal(t, info.(ChecksumFileInfo).Checksum(), otherInfo.(ChecksumFileInfo).Checksum())
+
+		// file created bypassing checksum store is tracked from first mutation
+		untracked := "untracked"
+		s.CreateFile(untracked)
+		s.Write(untracked, []byte("0123456789"), 0)
+		info, _ = cs.FileInfo(untracked)
+		assert.Equal(t, "", info.(ChecksumFileInfo).Checksum())
+
+		assert.Nil(t, cs.Write(untracked, []byte("a"), 9))
+		assert.Nil(t, cs.Verify(untracked))
+		info, _ = cs.FileInfo(untracked)
+		assert.NotEqual(t, "", info.(ChecksumFileInfo).Checksum())
+
+		// checksums are not iterated
+		cnt := 0
+		for range s.FileIter() {
+			cnt++
+		}
+		assert.Equal(t, 3, cnt)
+	}
+}
+
+func TestChecksumStore_SubStore(t *testing.T) {
+	for _, s := range testStores(t, "TestChecksumStore_SubStore") {
+		cs := NewChecksumStore(s, ChecksumOptions{BlockSize: 4})
+		sub := cs.SubStore("sub")
+
+		assert.Nil(t, sub.CreateFile("file"))
+		assert.Nil(t, sub.Write("file", []byte("012345"), 0))
+
+		s.Write("sub/file", []byte("x"), 0)
+		assert.True(t, IsCorrupted(cs.Verify("sub/file")))
+		assert.True(t, IsCorrupted(sub.Read("file", make([]byte, 2), 0)))
+	}
+}
+
+func TestChecksumStore_Interrupted(t *testing.T) {
+	for _, s := range testStores(t, "TestChecksumStore_Interrupted") {
+		cs := NewChecksumStore(s, ChecksumOptions{BlockSize: 4})
+		filename := strings.Repeat("f", 250)
+
+		assert.Nil(t, cs.CreateFile(filename))
+		assert.Nil(t, cs.Write(filename, []byte("0123456789"), 0))
+		assert.Nil(t, cs.Write(filename, []byte("ab"), 5))
+
+		// block left with content before interrupted write is verified by previous checksum
+		s.Write(filename, []byte("56"), 5)
+		assert.Nil(t, cs.Verify(filename))
+		res := make([]byte, 4)
+		assert.Nil(t, cs.Read(filename, res, 4))
+		assert.Equal(t, "4567", string(res))
+
+		// torn block matches neither
+		s.Write(filename, []byte("a"), 5)
+		assert.True(t, IsCorrupted(cs.Verify(filename)))
+
+		// checksums of removed blocks are dropped, so grown blocks are zeros
+		assert.Nil(t, cs.Truncate(filename, 2))
+		assert.Nil(t, cs.Truncate(filename, 9))
+		assert.Nil(t, cs.Verify(filename))
+		res = make([]byte, 9)
+		assert.Nil(t, cs.Read(filename, res, 0))
+		assert.Equal(t, "01\x00\x00\x00\x00\x00\x00\x00", string(res))
+	}
+}
+
+func TestChecksumStore_Aliases(t *testing.T) {
+	cs := NewChecksumStore(NewFileSystemStore(path).SubStore("TestChecksumStore_Aliases"), ChecksumOptions{BlockSize: 4})
+
+	// writes through aliases update checksums of canonical name
+	assert.Nil(t, cs.CreateFile("f"))
+	assert.Nil(t, cs.Write("f", []byte("aaaa"), 0))
+	assert.Nil(t, cs.Write("./f", []byte("bbbb"), 0))
+	assert.Nil(t, cs.SubStore("./sub/").CreateFile("f"))
+	assert.Nil(t, cs.Write("sub//f", []byte("cc"), 0))
+
+	res := make([]byte, 4)
+	assert.Nil(t, cs.Read("f", res, 0))
+	assert.Equal(t, "bbbb", string(res))
+	assert.Nil(t, cs.Verify("/f"))
+	assert.Nil(t, cs.SubStore("sub").Read("f", res[:2], 0))
+	assert.Equal(t, "cc", string(res[:2]))
+}
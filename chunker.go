@@ -0,0 +1,63 @@
+package store
+
+const (
+	// sizes of content-defined chunks
+	minChunkSize = 2 * 1024
+	avgChunkSize = 8 * 1024
+	maxChunkSize = 64 * 1024
+
+	// boundary is where high bits of rolling hash are zero, once per avgChunkSize on average.
+	// high bits depend on last 64 bytes, low bits only on last few bytes.
+	chunkBoundaryMask = uint64(avgChunkSize - 1) << 51
+)
+
+// random values of bytes, rolled into gear hash.
+var gearTable = newGearTable()
+
+// newGearTable generates fixed table by splitmix64,
+// so same content is chunked same in all processes.
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+
+	seed := uint64(0x6b617961742d6364)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return table
+}
+
+// chunkBoundary returns length of first content-defined chunk of data.
+// if data ends before boundary is found, returns len(data) if eof, 0 otherwise,
+// meaning more data is needed.
+func chunkBoundary(data []byte, eof bool) int {
+	if len(data) <= minChunkSize {
+		if eof {
+			return len(data)
+		}
+		return 0
+	}
+
+	var hash uint64
+	end := len(data)
+	if end > maxChunkSize {
+		end = maxChunkSize
+	}
+
+	// bytes before minChunkSize do not make boundary, but are rolled into hash
+	for i := minChunkSize - 64; i < end; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if i >= minChunkSize && hash & chunkBoundaryMask == 0 {
+			return i + 1
+		}
+	}
+
+	if end == maxChunkSize || eof {
+		return end
+	}
+	return 0
+}
@@ -0,0 +1,283 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+)
+
+/**
+ Codec compresses blocks of compressed store.
+ ID is recorded with each block, so blocks are decoded by the codec encoded them.
+ */
+type Codec interface {
+	ID() uint8
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+const (
+	rawCodecID uint8 = iota
+	gzipCodecID
+	snappyCodecID
+	lzhCodecID
+)
+
+const (
+	lzHashBits  = 14
+	lzMinMatch  = 4
+	lzMaxOffset = 1 << 16
+
+	lzLiteral = 0
+	lzCopy    = 1
+)
+
+var (
+	// deflate in gzip format, best ratio but slowest
+	Gzip Codec = gzipCodec{}
+	// byte oriented LZ77 without entropy coding, fastest
+	Snappy Codec = snappyCodec{}
+	// LZ77 of Snappy followed by Huffman coding, like zstd
+	LZH Codec = lzhCodec{}
+)
+
+var (
+	corruptedBlockErr = errors.New("corrupted compressed block")
+	unknownCodecErr   = errors.New("unknown codec")
+)
+
+// codecs by ID, to decode blocks encoded by other codec than configured.
+var codecs = map[uint8]Codec{
+	rawCodecID:    rawCodec{},
+	gzipCodecID:   Gzip,
+	snappyCodecID: Snappy,
+	lzhCodecID:    LZH,
+}
+
+// rawCodec keeps block as is, used when block does not compress.
+type rawCodec struct{}
+
+type gzipCodec struct{}
+
+type snappyCodec struct{}
+
+type lzhCodec struct{}
+
+func (rawCodec) ID() uint8 {
+	return rawCodecID
+}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+func (rawCodec) Compress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+func (rawCodec) Decompress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+func (gzipCodec) ID() uint8 {
+	return gzipCodecID
+}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+func (snappyCodec) ID() uint8 {
+	return snappyCodecID
+}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) Compress(src []byte) ([]byte, error) {
+	return lzCompress(src), nil
+}
+
+func (snappyCodec) Decompress(src []byte) ([]byte, error) {
+	return lzDecompress(src)
+}
+
+func (lzhCodec) ID() uint8 {
+	return lzhCodecID
+}
+
+func (lzhCodec) Name() string {
+	return "lzh"
+}
+
+func (lzhCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.HuffmanOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(lzCompress(src)); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (lzhCodec) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return lzDecompress(data)
+}
+
+// lzCompress encodes src as length of src followed by elements,
+// literal: tag(1) length(uvarint) bytes, copy: tag(1) length(uvarint) offset(uvarint).
+// matches are found by hash of 4 bytes, like snappy.
+func lzCompress(src []byte) []byte {
+	dst := make([]byte, 0, len(src) / 2 + 16)
+	dst = appendUvarint(dst, uint64(len(src)))
+
+	// positions + 1 of last occurrences of hashes, 0 means none
+	table := make([]int, 1 << lzHashBits)
+	literal := 0
+
+	for i := 0; i + lzMinMatch <= len(src); {
+		h := lzHash(src[i:])
+		candidate := table[h] - 1
+		table[h] = i + 1
+
+		if candidate < 0 || i - candidate > lzMaxOffset ||
+			!bytes.Equal(src[candidate:candidate + lzMinMatch], src[i:i + lzMinMatch]) {
+			i++
+			continue
+		}
+
+		n := lzMinMatch
+		for i + n < len(src) && src[candidate + n] == src[i + n] {
+			n++
+		}
+
+		dst = appendLiteral(dst, src[literal:i])
+		dst = append(dst, lzCopy)
+		dst = appendUvarint(dst, uint64(n))
+		dst = appendUvarint(dst, uint64(i - candidate))
+
+		i += n
+		literal = i
+	}
+
+	return appendLiteral(dst, src[literal:])
+}
+
+func lzDecompress(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, corruptedBlockErr
+	}
+	src = src[n:]
+
+	// corrupted size should not allocate much
+	capacity := size
+	if limit := uint64(len(src)) * 256; capacity > limit {
+		capacity = limit
+	}
+
+	dst := make([]byte, 0, capacity)
+	for len(src) > 0 {
+		tag := src[0]
+		length, n := binary.Uvarint(src[1:])
+		if n <= 0 || uint64(len(dst)) + length > size {
+			return nil, corruptedBlockErr
+		}
+		src = src[1 + n:]
+
+		switch tag {
+		case lzLiteral:
+			if uint64(len(src)) < length {
+				return nil, corruptedBlockErr
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+		case lzCopy:
+			offset, n := binary.Uvarint(src)
+			if n <= 0 || offset == 0 || offset > uint64(len(dst)) {
+				return nil, corruptedBlockErr
+			}
+			src = src[n:]
+
+			// byte by byte, copy may overlap itself
+			start := len(dst) - int(offset)
+			for i := 0; i < int(length); i++ {
+				dst = append(dst, dst[start + i])
+			}
+		default:
+			return nil, corruptedBlockErr
+		}
+	}
+
+	if uint64(len(dst)) != size {
+		return nil, corruptedBlockErr
+	}
+
+	return dst, nil
+}
+
+func lzHash(b []byte) uint32 {
+	return (binary.LittleEndian.Uint32(b) * 0x1e35a7bd) >> (32 - lzHashBits)
+}
+
+func appendLiteral(dst []byte, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+
+	dst = append(dst, lzLiteral)
+	dst = appendUvarint(dst, uint64(len(literal)))
+	return append(dst, literal...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	return append(dst, buf[:n]...)
+}
@@ -0,0 +1,865 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+const (
+	// index of compressed file is kept in this hidden directory next to the file,
+	// so it is cloned with the file into snapshots.
+	compressedIndexDir = hiddenPrefix + "compressed"
+
+	compressedBlockSize    = 64 * 1024
+	compressedIndexVersion = 1
+
+	// snapshot of index, followed by records of blocks changed after it:
+	// version(1) blockSize(8) size(8) end(8) count(8) | offset(8) length(4) codec(1) ... | crc32(4)
+	compressedHeaderSize = 33
+	compressedEntrySize  = 13
+	// size(8) end(8) count(8) changes(4) | index(8) offset(8) length(4) codec(1) ... | crc32(4)
+	compressedRecordHeaderSize = 28
+	compressedRecordEntrySize  = 21
+)
+
+var (
+	corruptedCompressedIndexErr = errors.New("corrupted compressed index")
+)
+
+/**
+ Store compressing files of underlying store in independently decodable blocks.
+ each logical block is compressed by codec and appended to the underlying file,
+ and index of blocks is kept in hidden directory next to the file.
+ blocks changed by mutation are appended to index as record, and index is replaced
+ by its snapshot once records outgrow it. record torn by crash is dropped when loaded.
+ overwritten blocks leave garbage, which is compacted when it exceeds live blocks.
+ */
+type compressedStore struct {
+	Store
+	compression *compression
+	prefix      string
+}
+
+type compression struct {
+	codec Codec
+	locks stripedLock
+}
+
+// compressedBlock is location of a block in underlying file.
+// block of zero length is a hole, read as zeros.
+type compressedBlock struct {
+	offset int64
+	length uint32
+	codec  uint8
+}
+
+type compressedIndex struct {
+	blockSize int64
+	// logical size of file
+	size int64
+	// end of blocks written in underlying file
+	end    int64
+	blocks []compressedBlock
+	// blocks changed since saved
+	changed map[int64]bool
+	// length of snapshot in index file, and of snapshot and records following it
+	snapshot int64
+	length   int64
+}
+
+// Compressed returns store compressing files of s by codec.
+// Read is random-access, only blocks covering read range are decompressed.
+// sizes of files are logical, uncompressed sizes.
+// files written bypassing this store are read as is, until mutated through it.
+func Compressed(s Store, codec Codec) Store {
+	return &compressedStore{
+		Store:       s,
+		compression: &compression{codec: codec},
+	}
+}
+
+func (cs *compressedStore) SubStore(subpath string) Store {
+	subpath = cleanSubPath(subpath)
+	prefix := cs.prefix
+	if subpath != "" {
+		prefix += subpath + "/"
+	}
+
+	return &compressedStore{
+		Store:       cs.Store.SubStore(subpath),
+		compression: cs.compression,
+		prefix:      prefix,
+	}
+}
+
+func (cs *compressedStore) FileIter() <-chan FileInfo {
+	files := cs.Store.FileIter()
+	if files == nil {
+		return nil
+	}
+
+	ch := make(chan FileInfo)
+	go func() {
+		for info := range files {
+			if logical, err := cs.FileInfo(info.Name()); err == nil {
+				info = logical
+			}
+			ch <- info
+		}
+
+		close(ch)
+	}()
+
+	return ch
+}
+
+func (cs *compressedStore) FileInfo(filename string) (FileInfo, error) {
+	filename, err := cleanFileName("FileInfo", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	m := cs.lock(filename)
+	defer m.Unlock()
+
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := cs.loadIndex(filename)
+	if err != nil {
+		return nil, err
+	} else if idx == nil {
+		// not compressed
+		return info, nil
+	}
+
+	return &fileInfo{info.Name(), idx.size, info.Generation()}, nil
+}
+
+func (cs *compressedStore) Read(filename string, res []byte, startOffset int64) error {
+	filename, err := cleanFileName("Read", filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.lock(filename)
+	defer m.Unlock()
+
+	idx, err := cs.loadIndex(filename)
+	if err != nil {
+		return err
+	} else if idx == nil {
+		// not compressed
+		return cs.Store.Read(filename, res, startOffset)
+	}
+
+	end := startOffset + int64(len(res))
+	if end > idx.size {
+		end = idx.size
+	}
+
+	for pos := startOffset; pos < end; {
+		i := pos / idx.blockSize
+		blockStart := i * idx.blockSize
+		chunkEnd := blockStart + idx.blockSize
+		if chunkEnd > end {
+			chunkEnd = end
+		}
+
+		data, err := cs.readBlock(filename, idx, i)
+		if err != nil {
+			return err
+		}
+
+		// block may be shorter than logical size, rest is zeros
+		dst := res[pos - startOffset:chunkEnd - startOffset]
+		n := 0
+		if pos - blockStart < int64(len(data)) {
+			n = copy(dst, data[pos - blockStart:])
+		}
+		for j := n; j < len(dst); j++ {
+			dst[j] = 0
+		}
+
+		pos = chunkEnd
+	}
+
+	if end < startOffset + int64(len(res)) {
+		// same as os.File.ReadAt
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (cs *compressedStore) Write(filename string, data []byte, startOffset int64) error {
+	return cs.WriteIf(filename, data, startOffset, anyGeneration)
+}
+
+func (cs *compressedStore) ReadV(filename string, ranges []Range, parallelism int) error {
+	return readV(cs, filename, ranges, parallelism)
+}
+
+func (cs *compressedStore) WriteV(filename string, extents []Extent) error {
+	return writeV(cs, filename, extents)
+}
+
+func (cs *compressedStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	return cs.mutate("Write", filename, ifGeneration, func(filename string, idx *compressedIndex) error {
+		return cs.writeRange(filename, idx, data, startOffset, int64(len(data)))
+	})
+}
+
+func (cs *compressedStore) Clear(filename string, startOffset int64, size int64) error {
+	return cs.mutate("Clear", filename, anyGeneration, func(filename string, idx *compressedIndex) error {
+		return cs.writeRange(filename, idx, nil, startOffset, size)
+	})
+}
+
+// Mmap gives view of decompressed copy of file.
+func (cs *compressedStore) Mmap(filename string) (vfs.ReadOnlyMapping, error) {
+	return readMapping(cs, filename)
+}
+
+// Preallocate checks file exists only, size of compressed data is not known ahead.
+func (cs *compressedStore) Preallocate(filename string, size int64) error {
+	if !cs.IsFileExist(filename) {
+		return &os.PathError{Op: "Preallocate", Path: filename, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// Sync commits compressed data of file, and its index.
+func (cs *compressedStore) Sync(filename string) error {
+	filename, err := cleanFileName("Sync", filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.lock(filename)
+	defer m.Unlock()
+
+	if err := cs.Store.Sync(filename); err != nil {
+		return err
+	}
+
+	dir, name := cs.indexStore(filename)
+	if !dir.IsFileExist(name) {
+		return nil
+	}
+	return dir.Sync(name)
+}
+
+func (cs *compressedStore) Truncate(filename string, size int64) error {
+	return cs.mutate("Truncate", filename, anyGeneration, func(filename string, idx *compressedIndex) error {
+		if size >= idx.size {
+			idx.size = size
+			return nil
+		}
+
+		blocks := (size + idx.blockSize - 1) / idx.blockSize
+		if int64(len(idx.blocks)) > blocks {
+			idx.blocks = idx.blocks[:blocks]
+		}
+
+		// cut last block, not to expose truncated data when file grows again
+		if last := blocks - 1; last >= 0 && last < int64(len(idx.blocks)) {
+			data, err := cs.readBlock(filename, idx, last)
+			if err != nil {
+				return err
+			}
+
+			if n := size - last * idx.blockSize; int64(len(data)) > n {
+				if err := cs.writeBlock(filename, idx, last, data[:n]); err != nil {
+					return err
+				}
+			}
+		}
+
+		idx.size = size
+		return nil
+	})
+}
+
+func (cs *compressedStore) CreateFile(filename string) error {
+	return cs.create("CreateFile", filename, func() error {
+		return cs.Store.CreateFile(filename)
+	})
+}
+
+func (cs *compressedStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	return cs.create("CreateFileWithTTL", filename, func() error {
+		return cs.Store.CreateFileWithTTL(filename, ttl)
+	})
+}
+
+func (cs *compressedStore) CreateIfNotExists(filename string) error {
+	return cs.create("CreateIfNotExists", filename, func() error {
+		return cs.Store.CreateIfNotExists(filename)
+	})
+}
+
+func (cs *compressedStore) RemoveFile(filename string) error {
+	return cs.remove("RemoveFile", filename, func() error {
+		return cs.Store.RemoveFile(filename)
+	})
+}
+
+func (cs *compressedStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	return cs.remove("RemoveIfMatch", filename, func() error {
+		return cs.Store.RemoveIfMatch(filename, ifGeneration)
+	})
+}
+
+func (cs *compressedStore) Watch(path string, recursive bool) (<-chan vfs.Event, func(), error) {
+	events, cancel, err := cs.Store.Watch(path, recursive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// hide changes of indexes
+	return relayEvents(events, cancel, func(name string) (string, bool) {
+		return name, !isHidden(name)
+	})
+}
+
+// OpenSnapshot returns snapshot decompressing files, indexes are cloned with files.
+func (cs *compressedStore) OpenSnapshot(name string) (Store, error) {
+	snapshot, err := cs.Store.OpenSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return Compressed(snapshot, cs.compression.codec), nil
+}
+
+func (cs *compressedStore) scrub(r *scrubRun) error {
+	return scrubStore(r, cs.Store)
+}
+
+// removeExpired removes indexes of expired files too.
+func (cs *compressedStore) removeExpired(fn func(name string) error) error {
+	return removeExpired(cs.Store, func(name string) error {
+		if err := cs.remove("RemoveExpired", name, expiredRemoval(cs.Store, name)); err != nil && err != recreatedErr {
+			return err
+		}
+		return fn(name)
+	})
+}
+
+func (cs *compressedStore) walkFiles(fn func(name string) error) error {
+	return walkFiles(cs.Store, fn)
+}
+
+func (cs *compressedStore) lock(filename string) *sync.Mutex {
+	return cs.compression.locks.lock(cs.prefix + filename)
+}
+
+func (cs *compressedStore) create(op string, filename string, create func() error) error {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.lock(filename)
+	defer m.Unlock()
+
+	if err := create(); err != nil {
+		return err
+	}
+
+	return cs.replaceIndex(filename, &compressedIndex{blockSize: compressedBlockSize})
+}
+
+func (cs *compressedStore) remove(op string, filename string, remove func() error) error {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.lock(filename)
+	defer m.Unlock()
+
+	if err := remove(); err != nil {
+		return err
+	}
+
+	dir, name := cs.indexStore(filename)
+	if !dir.IsFileExist(name) {
+		return nil
+	}
+	return dir.RemoveFile(name)
+}
+
+// mutate applies mutation to index of filename holding lock of it.
+// file not compressed yet is compressed first.
+func (cs *compressedStore) mutate(op string, filename string, ifGeneration uint64, mutation func(filename string, idx *compressedIndex) error) error {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := cs.lock(filename)
+	defer m.Unlock()
+
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return &os.PathError{Op: op, Path: filename, Err: err}
+	}
+
+	if ifGeneration != anyGeneration && info.Generation() != ifGeneration {
+		return &PreconditionFailedError{Op: op, Path: filename, Expected: ifGeneration, Actual: info.Generation()}
+	}
+
+	idx, err := cs.loadIndex(filename)
+	if err != nil {
+		return err
+	} else if idx == nil {
+		if idx, err = cs.compress(filename, info.Size()); err != nil {
+			return err
+		}
+	}
+
+	if err := mutation(filename, idx); err != nil {
+		return err
+	}
+
+	var live int64
+	for _, block := range idx.blocks {
+		live += int64(block.length)
+	}
+
+	if garbage := idx.end - live; garbage > live && garbage >= compressedBlockSize {
+		return cs.compact(filename, idx)
+	}
+
+	return cs.saveIndex(filename, idx)
+}
+
+// compress appends blocks of uncompressed file, which become garbage to be compacted.
+func (cs *compressedStore) compress(filename string, size int64) (*compressedIndex, error) {
+	idx := &compressedIndex{blockSize: compressedBlockSize, end: size}
+
+	data := make([]byte, idx.blockSize)
+	for i := int64(0); i * idx.blockSize < size; i++ {
+		n := size - i * idx.blockSize
+		if n > idx.blockSize {
+			n = idx.blockSize
+		}
+
+		if err := cs.Store.Read(filename, data[:n], i * idx.blockSize); err != nil {
+			return nil, err
+		}
+
+		if err := cs.writeBlock(filename, idx, i, data[:n]); err != nil {
+			return nil, err
+		}
+	}
+
+	idx.size = size
+	return idx, nil
+}
+
+// writeRange writes data into range of size at off, or zeros if data is nil.
+func (cs *compressedStore) writeRange(filename string, idx *compressedIndex, data []byte, off int64, size int64) error {
+	end := off + size
+	newSize := idx.size
+	if end > newSize {
+		newSize = end
+	}
+
+	for pos := off; pos < end; {
+		i := pos / idx.blockSize
+		blockStart := i * idx.blockSize
+		chunkEnd := blockStart + idx.blockSize
+		if chunkEnd > end {
+			chunkEnd = end
+		}
+
+		blockLen := newSize - blockStart
+		if blockLen > idx.blockSize {
+			blockLen = idx.blockSize
+		}
+
+		block := make([]byte, blockLen)
+		old, err := cs.readBlock(filename, idx, i)
+		if err != nil {
+			return err
+		}
+		copy(block, old)
+
+		if data != nil {
+			copy(block[pos - blockStart:], data[pos - off:chunkEnd - off])
+		} else {
+			for j := pos - blockStart; j < chunkEnd - blockStart; j++ {
+				block[j] = 0
+			}
+		}
+
+		if err := cs.writeBlock(filename, idx, i, block); err != nil {
+			return err
+		}
+
+		pos = chunkEnd
+	}
+
+	idx.size = newSize
+	return nil
+}
+
+// readBlock returns decompressed data of block i, nil if hole.
+func (cs *compressedStore) readBlock(filename string, idx *compressedIndex, i int64) ([]byte, error) {
+	if i >= int64(len(idx.blocks)) || idx.blocks[i].length == 0 {
+		return nil, nil
+	}
+
+	block := idx.blocks[i]
+	codec, ok := codecs[block.codec]
+	if block.codec == cs.compression.codec.ID() {
+		codec, ok = cs.compression.codec, true
+	}
+
+	if !ok {
+		return nil, &os.PathError{Op: "Read", Path: filename, Err: unknownCodecErr}
+	}
+
+	data := make([]byte, block.length)
+	if err := cs.Store.Read(filename, data, block.offset); err != nil {
+		return nil, err
+	}
+
+	res, err := codec.Decompress(data)
+	if err != nil {
+		return nil, &os.PathError{Op: "Read", Path: filename, Err: err}
+	}
+
+	return res, nil
+}
+
+// writeBlock compresses data and appends it as block i.
+func (cs *compressedStore) writeBlock(filename string, idx *compressedIndex, i int64, data []byte) error {
+	for int64(len(idx.blocks)) <= i {
+		idx.blocks = append(idx.blocks, compressedBlock{})
+	}
+
+	if isZero(data) {
+		idx.set(i, compressedBlock{})
+		return nil
+	}
+
+	codec := cs.compression.codec
+	compressed, err := codec.Compress(data)
+	if err != nil {
+		return err
+	}
+
+	if len(compressed) >= len(data) {
+		// does not compress
+		codec, compressed = codecs[rawCodecID], data
+	}
+
+	if err := cs.Store.Write(filename, compressed, idx.end); err != nil {
+		return err
+	}
+
+	idx.set(i, compressedBlock{offset: idx.end, length: uint32(len(compressed)), codec: codec.ID()})
+	idx.end += int64(len(compressed))
+	return nil
+}
+
+// compact moves live blocks to head of underlying file, dropping garbage.
+// live blocks are copied to tail first and index is saved, then moved to head,
+// so index is valid whenever compaction is interrupted.
+func (cs *compressedStore) compact(filename string, idx *compressedIndex) error {
+	tail := idx.end
+
+	for i, block := range idx.blocks {
+		if block.length == 0 {
+			continue
+		}
+
+		data := make([]byte, block.length)
+		if err := cs.Store.Read(filename, data, block.offset); err != nil {
+			return err
+		}
+
+		if err := cs.Store.Write(filename, data, idx.end); err != nil {
+			return err
+		}
+
+		idx.blocks[i].offset = idx.end
+		idx.end += int64(block.length)
+	}
+
+	if err := cs.replaceIndex(filename, idx); err != nil {
+		return err
+	}
+
+	// live blocks are not more than garbage, so head and tail do not overlap
+	live := idx.end - tail
+	data := make([]byte, compressedBlockSize)
+	for off := int64(0); off < live; off += int64(len(data)) {
+		n := live - off
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+
+		if err := cs.Store.Read(filename, data[:n], tail + off); err != nil {
+			return err
+		}
+
+		if err := cs.Store.Write(filename, data[:n], off); err != nil {
+			return err
+		}
+	}
+
+	for i := range idx.blocks {
+		if idx.blocks[i].length != 0 {
+			idx.blocks[i].offset -= tail
+		}
+	}
+	idx.end = live
+
+	if err := cs.replaceIndex(filename, idx); err != nil {
+		return err
+	}
+
+	return cs.Store.Truncate(filename, live)
+}
+
+// indexStore returns store and name of index of filename.
+func (cs *compressedStore) indexStore(filename string) (Store, string) {
+	i := strings.LastIndex(filename, "/")
+	return cs.Store.SubStore(filename[:i + 1] + compressedIndexDir), filename[i + 1:]
+}
+
+// loadIndex returns index of filename, nil if file is not compressed.
+func (cs *compressedStore) loadIndex(filename string) (*compressedIndex, error) {
+	dir, name := cs.indexStore(filename)
+	if !dir.IsFileExist(name) {
+		return nil, nil
+	}
+
+	info, err := dir.FileInfo(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, info.Size())
+	if err := dir.Read(name, data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	idx, ok := decodeCompressedIndex(data)
+	if !ok {
+		return nil, &os.PathError{Op: "Read", Path: filename, Err: corruptedCompressedIndexErr}
+	}
+
+	return idx, nil
+}
+
+// saveIndex appends record of blocks changed since index was saved to index file,
+// or replaces index file by snapshot of index, if records would outgrow it.
+func (cs *compressedStore) saveIndex(filename string, idx *compressedIndex) error {
+	record := encodeCompressedRecord(idx)
+	if idx.snapshot == 0 || idx.length + int64(len(record)) > 2 * idx.snapshot {
+		return cs.replaceIndex(filename, idx)
+	}
+
+	// torn record following is overwritten, it was dropped when loaded
+	dir, name := cs.indexStore(filename)
+	if err := dir.Write(name, record, idx.length); err != nil {
+		return err
+	}
+
+	idx.length += int64(len(record))
+	idx.changed = nil
+	return nil
+}
+
+// replaceIndex replaces index file by snapshot of index atomically.
+func (cs *compressedStore) replaceIndex(filename string, idx *compressedIndex) error {
+	dir, name := cs.indexStore(filename)
+	data := encodeCompressedIndex(idx)
+	if err := replaceFile(dir, name, data); err != nil {
+		return err
+	}
+
+	idx.snapshot, idx.length, idx.changed = int64(len(data)), int64(len(data)), nil
+	return nil
+}
+
+// set sets block i, which is saved by next record.
+func (idx *compressedIndex) set(i int64, block compressedBlock) {
+	if idx.changed == nil {
+		idx.changed = make(map[int64]bool)
+	}
+	idx.blocks[i] = block
+	idx.changed[i] = true
+}
+
+func encodeCompressedIndex(idx *compressedIndex) []byte {
+	data := make([]byte, compressedHeaderSize + len(idx.blocks) * compressedEntrySize + 4)
+
+	data[0] = compressedIndexVersion
+	binary.LittleEndian.PutUint64(data[1:], uint64(idx.blockSize))
+	binary.LittleEndian.PutUint64(data[9:], uint64(idx.size))
+	binary.LittleEndian.PutUint64(data[17:], uint64(idx.end))
+	binary.LittleEndian.PutUint64(data[25:], uint64(len(idx.blocks)))
+
+	for i, block := range idx.blocks {
+		entry := data[compressedHeaderSize + i * compressedEntrySize:]
+		binary.LittleEndian.PutUint64(entry[0:], uint64(block.offset))
+		binary.LittleEndian.PutUint32(entry[8:], block.length)
+		entry[12] = block.codec
+	}
+
+	body := data[:len(data) - 4]
+	binary.LittleEndian.PutUint32(data[len(body):], crc32.ChecksumIEEE(body))
+	return data
+}
+
+// encodeCompressedRecord returns record of blocks of idx changed since saved.
+// blocks cut by truncate are dropped by count of blocks.
+func encodeCompressedRecord(idx *compressedIndex) []byte {
+	changed := make([]int64, 0, len(idx.changed))
+	for i := range idx.changed {
+		if i < int64(len(idx.blocks)) {
+			changed = append(changed, i)
+		}
+	}
+
+	data := make([]byte, compressedRecordHeaderSize + len(changed) * compressedRecordEntrySize + 4)
+	binary.LittleEndian.PutUint64(data[0:], uint64(idx.size))
+	binary.LittleEndian.PutUint64(data[8:], uint64(idx.end))
+	binary.LittleEndian.PutUint64(data[16:], uint64(len(idx.blocks)))
+	binary.LittleEndian.PutUint32(data[24:], uint32(len(changed)))
+
+	for n, i := range changed {
+		block := idx.blocks[i]
+		entry := data[compressedRecordHeaderSize + n * compressedRecordEntrySize:]
+		binary.LittleEndian.PutUint64(entry[0:], uint64(i))
+		binary.LittleEndian.PutUint64(entry[8:], uint64(block.offset))
+		binary.LittleEndian.PutUint32(entry[16:], block.length)
+		entry[20] = block.codec
+	}
+
+	body := data[:len(data) - 4]
+	binary.LittleEndian.PutUint32(data[len(body):], crc32.ChecksumIEEE(body))
+	return data
+}
+
+// decodeCompressedIndex returns index of snapshot and records following it in data,
+// up to first record torn or corrupted.
+func decodeCompressedIndex(data []byte) (*compressedIndex, bool) {
+	if len(data) < compressedHeaderSize + 4 || data[0] != compressedIndexVersion {
+		return nil, false
+	}
+
+	count := binary.LittleEndian.Uint64(data[25:])
+	if count > uint64(len(data) - compressedHeaderSize - 4) / compressedEntrySize {
+		return nil, false
+	}
+
+	snapshot := compressedHeaderSize + int(count) * compressedEntrySize + 4
+	body := data[:snapshot - 4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, false
+	}
+
+	idx := &compressedIndex{
+		blockSize: int64(binary.LittleEndian.Uint64(body[1:])),
+		size:      int64(binary.LittleEndian.Uint64(body[9:])),
+		end:       int64(binary.LittleEndian.Uint64(body[17:])),
+		blocks:    make([]compressedBlock, 0, count),
+		snapshot:  int64(snapshot),
+	}
+
+	if idx.blockSize <= 0 {
+		return nil, false
+	}
+
+	for off := compressedHeaderSize; off < len(body); off += compressedEntrySize {
+		idx.blocks = append(idx.blocks, compressedBlock{
+			offset: int64(binary.LittleEndian.Uint64(body[off:])),
+			length: binary.LittleEndian.Uint32(body[off + 8:]),
+			codec:  body[off + 12],
+		})
+	}
+
+	off := snapshot
+	for {
+		n, ok := idx.apply(data[off:])
+		if !ok {
+			break
+		}
+		off += n
+	}
+
+	idx.length = int64(off)
+	return idx, true
+}
+
+// apply applies record at head of data to idx, returns length of record,
+// or false if data does not begin with complete record.
+func (idx *compressedIndex) apply(data []byte) (int, bool) {
+	if len(data) < compressedRecordHeaderSize + 4 {
+		return 0, false
+	}
+
+	changes := binary.LittleEndian.Uint32(data[24:])
+	if uint64(changes) > uint64(len(data) - compressedRecordHeaderSize - 4) / compressedRecordEntrySize {
+		return 0, false
+	}
+
+	n := compressedRecordHeaderSize + int(changes) * compressedRecordEntrySize + 4
+	body := data[:n - 4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return 0, false
+	}
+
+	idx.size = int64(binary.LittleEndian.Uint64(body[0:]))
+	idx.end = int64(binary.LittleEndian.Uint64(body[8:]))
+
+	count := int64(binary.LittleEndian.Uint64(body[16:]))
+	if count < int64(len(idx.blocks)) {
+		idx.blocks = idx.blocks[:count]
+	}
+	for int64(len(idx.blocks)) < count {
+		idx.blocks = append(idx.blocks, compressedBlock{})
+	}
+
+	for off := compressedRecordHeaderSize; off < len(body); off += compressedRecordEntrySize {
+		i := int64(binary.LittleEndian.Uint64(body[off:]))
+		if i >= count {
+			continue
+		}
+
+		idx.blocks[i] = compressedBlock{
+			offset: int64(binary.LittleEndian.Uint64(body[off + 8:])),
+			length: binary.LittleEndian.Uint32(body[off + 16:]),
+			codec:  body[off + 20],
+		}
+	}
+
+	return n, true
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
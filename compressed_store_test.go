@@ -0,0 +1,228 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec(t *testing.T) {
+	logs := bytes.Repeat([]byte("2024-01-01 INFO request served in 12ms\n"), 1000)
+	random := make([]byte, 1000)
+	rand.Read(random)
+
+	for _, codec := range []Codec{Gzip, Snappy, LZH} {
+		for _, data := range [][]byte{logs, random, []byte("a"), {}} {
+			compressed, err := codec.Compress(data)
+			assert.Nil(t, err)
+
+			res, err := codec.Decompress(compressed)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(data, res), codec.Name())
+		}
+
+		compressed, _ := codec.Compress(logs)
+		assert.True(t, len(compressed) * 10 < len(logs), codec.Name())
+	}
+
+	_, err := Snappy.Decompress([]byte{10, lzCopy, 4, 1})
+	assert.NotNil(t, err)
+}
+
+func TestCompressed_ReadWrite(t *testing.T) {
+	for _, s := range testStores(t, "TestCompressed_ReadWrite") {
+		for _, codec := range []Codec{Gzip, Snappy, LZH} {
+			cs := Compressed(s, codec)
+			filename := "file_" + codec.Name()
+
+			data := bytes.Repeat([]byte("0123456789abcdef"), compressedBlockSize / 8)
+			assert.Nil(t, cs.CreateFile(filename))
+			assert.Nil(t, cs.Write(filename, data, 0))
+
+			info, err := cs.FileInfo(filename)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(len(data)), info.Size())
+
+			raw, _ := s.FileInfo(filename)
+			assert.True(t, raw.Size() * 10 < info.Size())
+
+			// random access across blocks
+			res := make([]byte, 32)
+			assert.Nil(t, cs.Read(filename, res, compressedBlockSize - 16))
+			assert.Equal(t, data[compressedBlockSize - 16:compressedBlockSize + 16], res)
+
+			// overwrite across blocks
+			assert.Nil(t, cs.Write(filename, []byte("xxxx"), compressedBlockSize - 2))
+			assert.Nil(t, cs.Read(filename, res[:8], compressedBlockSize - 4))
+			assert.Equal(t, "cdxxxx23", string(res[:8]))
+
+			// write after end leaves hole
+			assert.Nil(t, cs.Write(filename, []byte("end"), int64(len(data)) + 10))
+			assert.Nil(t, cs.Read(filename, res[:13], int64(len(data))))
+			assert.Equal(t, append(make([]byte, 10), "end"...), res[:13])
+
+			// read past end
+			assert.Equal(t, io.EOF, cs.Read(filename, res, int64(len(data)) + 1))
+
+			for info := range cs.FileIter() {
+				if info.Name() == filename {
+					assert.Equal(t, int64(len(data)) + 13, info.Size())
+				}
+			}
+		}
+	}
+}
+
+func TestCompressed_ClearTruncate(t *testing.T) {
+	for _, s := range testStores(t, "TestCompressed_ClearTruncate") {
+		cs := Compressed(s, Snappy)
+		filename := "file"
+
+		cs.CreateFile(filename)
+		cs.Write(filename, []byte("0123456789"), 0)
+
+		assert.Nil(t, cs.Clear(filename, 2, 3))
+		res := make([]byte, 10)
+		cs.Read(filename, res, 0)
+		assert.Equal(t, "01\x00\x00\x0056789", string(res))
+
+		// truncated data is not exposed when file grows again
+		assert.Nil(t, cs.Truncate(filename, 6))
+		assert.Nil(t, cs.Truncate(filename, 10))
+		cs.Read(filename, res, 0)
+		assert.Equal(t, "01\x00\x00\x005\x00\x00\x00\x00", string(res))
+
+		info, _ := cs.FileInfo(filename)
+		assert.Equal(t, int64(10), info.Size())
+
+		assert.Nil(t, cs.RemoveFile(filename))
+		assert.False(t, cs.IsFileExist(filename))
+	}
+}
+
+func TestCompressed_Compact(t *testing.T) {
+	for _, s := range testStores(t, "TestCompressed_Compact") {
+		cs := Compressed(s, Snappy)
+		filename := "file"
+
+		data := make([]byte, compressedBlockSize)
+		cs.CreateFile(filename)
+
+		// incompressible block is rewritten, leaving garbage
+		for i := 0; i < 10; i++ {
+			rand.Read(data)
+			assert.Nil(t, cs.Write(filename, data, 0))
+		}
+
+		raw, _ := s.FileInfo(filename)
+		assert.True(t, raw.Size() <= 2 * compressedBlockSize)
+
+		res := make([]byte, compressedBlockSize)
+		assert.Nil(t, cs.Read(filename, res, 0))
+		assert.Equal(t, data, res)
+	}
+}
+
+func TestCompressed_Uncompressed(t *testing.T) {
+	for _, s := range testStores(t, "TestCompressed_Uncompressed") {
+		filename := "file"
+		s.CreateFile(filename)
+		s.Write(filename, []byte("0123456789"), 0)
+
+		// written bypassing compressed store, read as is
+		cs := Compressed(s, Gzip)
+		res := make([]byte, 10)
+		assert.Nil(t, cs.Read(filename, res, 0))
+		assert.Equal(t, "0123456789", string(res))
+
+		// compressed by mutation
+		assert.Nil(t, cs.Write(filename, []byte("ab"), 10))
+		res = make([]byte, 12)
+		assert.Nil(t, cs.Read(filename, res, 0))
+		assert.Equal(t, "0123456789ab", string(res))
+	}
+}
+
+func TestCompressed_Snapshot(t *testing.T) {
+	for _, s := range testStores(t, "TestCompressed_Snapshot") {
+		cs := Compressed(s, LZH).SubStore("sub")
+		cs.CreateFile("file")
+		cs.Write("file", []byte("test"), 0)
+
+		assert.Nil(t, cs.Snapshot("snap"))
+		cs.Write("file", []byte("1234"), 0)
+
+		snap, err := cs.OpenSnapshot("snap")
+		assert.Nil(t, err)
+
+		res := make([]byte, 4)
+		assert.Nil(t, snap.Read("file", res, 0))
+		assert.Equal(t, "test", string(res))
+	}
+}
+
+func TestCompressed_IndexRecords(t *testing.T) {
+	for _, s := range testStores(t, "TestCompressed_IndexRecords") {
+		cs := Compressed(s, Snappy)
+		data := bytes.Repeat([]byte("0123456789abcdef"), compressedBlockSize / 2)
+		assert.Nil(t, cs.CreateFile("file"))
+		assert.Nil(t, cs.Write("file", data, 0))
+
+		dir, name := cs.(*compressedStore).indexStore("file")
+		snapshot, err := dir.FileInfo(name)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(compressedHeaderSize + 8 * compressedEntrySize + 4), snapshot.Size())
+
+		// changed block is appended, not rewriting index
+		assert.Nil(t, cs.Write("file", []byte("xx"), compressedBlockSize))
+		info, _ := dir.FileInfo(name)
+		assert.Equal(t, snapshot.Size() + compressedRecordHeaderSize + compressedRecordEntrySize + 4, info.Size())
+
+		// torn record is dropped, and overwritten by next one
+		assert.Nil(t, dir.Write(name, []byte{1, 2, 3}, info.Size()))
+		assert.Nil(t, cs.Truncate("file", compressedBlockSize + 4))
+		assert.Nil(t, cs.Write("file", []byte("yy"), 2))
+
+		res := make([]byte, 4)
+		assert.Nil(t, cs.Read("file", res, compressedBlockSize))
+		assert.Equal(t, "xx23", string(res))
+		assert.Nil(t, cs.Read("file", res, 0))
+		assert.Equal(t, "01yy", string(res[:4]))
+
+		fi, _ := cs.FileInfo("file")
+		assert.Equal(t, int64(compressedBlockSize + 4), fi.Size())
+	}
+}
+
+func TestCompressed_Aliases(t *testing.T) {
+	for _, s := range testStores(t, "TestCompressed_Aliases") {
+		cs := Compressed(s, Snappy)
+		assert.Nil(t, cs.CreateFile("file"))
+
+		// writes through aliases wait for lock of canonical name
+		m := cs.(*compressedStore).lock("file")
+		done := make(chan error)
+		go func() {
+			done <- cs.Write("./file", []byte("data"), 0)
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+			t.Error("write through alias did not wait for lock")
+			m.Unlock()
+		case <-time.After(50 * time.Millisecond):
+			m.Unlock()
+			err = <-done
+		}
+		assert.Nil(t, err)
+
+		res := make([]byte, 4)
+		assert.Nil(t, cs.Read("/file", res, 0))
+		assert.Equal(t, "data", string(res))
+		assert.NotNil(t, cs.Write("../file", []byte("x"), 0))
+	}
+}
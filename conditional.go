@@ -0,0 +1,43 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// generation passed by unconditional mutations, matches any generation.
+const anyGeneration = ^uint64(0)
+
+/**
+ PreconditionFailedError is returned by conditional mutations
+ when generation of the file does not match expected one.
+ Actual is 0 if file does not exist.
+ */
+type PreconditionFailedError struct {
+	Op       string
+	Path     string
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *PreconditionFailedError) Error() string {
+	return fmt.Sprintf("%s: %s: precondition failed: expected generation %d, actual %d",
+		e.Op, e.Path, e.Expected, e.Actual)
+}
+
+// IsPreconditionFailed returns true if err is a PreconditionFailedError.
+func IsPreconditionFailed(err error) bool {
+	_, ok := err.(*PreconditionFailedError)
+	return ok
+}
+
+// nextGeneration returns generation following prev.
+// generation is based on current time, so a file recreated after removal
+// does not reuse generation of removed one.
+func nextGeneration(prev uint64) uint64 {
+	now := uint64(time.Now().UnixNano())
+	if now > prev {
+		return now
+	}
+	return prev + 1
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+func TestStore_WriteIf(t *testing.T) {
+	for _, s := range testStores(t, "TestStore_WriteIf") {
+		filename := "TestStore_WriteIf"
+
+		assert.Nil(t, s.CreateIfNotExists(filename))
+		assert.True(t, IsPreconditionFailed(s.CreateIfNotExists(filename)))
+
+		info, _ := s.FileInfo(filename)
+		generation := info.Generation()
+		assert.NotEqual(t, uint64(0), generation)
+
+		assert.Nil(t, s.WriteIf(filename, []byte("test"), 0, generation))
+
+		// generation is changed by the write above
+		err := s.WriteIf(filename, []byte("1234"), 0, generation)
+		assert.True(t, IsPreconditionFailed(err))
+
+		res := make([]byte, 4)
+		s.Read(filename, res, 0)
+		assert.Equal(t, "test", string(res))
+
+		info, _ = s.FileInfo(filename)
+		assert.True(t, info.Generation() > generation)
+
+		assert.True(t, IsPreconditionFailed(s.RemoveIfMatch(filename, generation)))
+		assert.Nil(t, s.RemoveIfMatch(filename, info.Generation()))
+		assert.False(t, s.IsFileExist(filename))
+	}
+}
+
+func TestStore_GenerationOnMutation(t *testing.T) {
+	for _, s := range testStores(t, "TestStore_GenerationOnMutation") {
+		filename := "TestStore_GenerationOnMutation"
+		s.CreateFile(filename)
+
+		generations := map[uint64]bool{}
+		generation := func() uint64 {
+			info, _ := s.FileInfo(filename)
+			return info.Generation()
+		}
+
+		generations[generation()] = true
+		s.Write(filename, []byte("test"), 0)
+		generations[generation()] = true
+		s.Clear(filename, 0, 2)
+		generations[generation()] = true
+		s.Truncate(filename, 1)
+		generations[generation()] = true
+
+		assert.Equal(t, 4, len(generations))
+	}
+}
+
+func TestFileSystemStore_GenerationInPlace(t *testing.T) {
+	s := NewFileSystemStore(path).SubStore("TestFileSystemStore_GenerationInPlace")
+	filename := "file"
+	metaPath := vfs.MetaPath(path + "/TestFileSystemStore_GenerationInPlace/" + filename)
+	assert.Nil(t, s.CreateFile(filename))
+
+	info, _ := s.FileInfo(filename)
+	generation := info.Generation()
+	assert.Nil(t, s.Write(filename, []byte("test"), 0))
+
+	// mutations update metadata in place, not replacing it
+	meta, err := os.Open(metaPath)
+	assert.Nil(t, err)
+	defer meta.Close()
+	assert.Nil(t, s.Write(filename, []byte("data"), 0))
+	assert.Nil(t, s.Truncate(filename, 2))
+
+	before, _ := meta.Stat()
+	after, err := os.Stat(metaPath)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(before, after))
+
+	info, _ = s.FileInfo(filename)
+	assert.True(t, info.Generation() > generation)
+	generation = info.Generation()
+
+	// metadata replaced by SetExpiry is updated by later mutations
+	expiry := time.Now().Add(time.Hour)
+	assert.Nil(t, s.SetExpiry(filename, expiry))
+	assert.Nil(t, s.Write(filename, []byte("x"), 0))
+
+	m, err := vfs.ReadFileMeta(path + "/TestFileSystemStore_GenerationInPlace/" + filename)
+	assert.Nil(t, err)
+	assert.True(t, m.Generation > generation)
+	assert.Equal(t, expiry.UnixNano(), m.Expiry.UnixNano())
+	info, _ = s.FileInfo(filename)
+	assert.Equal(t, m.Generation, info.Generation())
+}
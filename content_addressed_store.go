@@ -0,0 +1,811 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+const (
+	casStore  = hiddenPrefix + "cas"
+	casChunks = "chunks"
+	casPins   = "pins"
+	casRefs   = "refs"
+
+	manifestVersion = 1
+
+	// version(1) size(8) count(4) | hash(32) length(4) ... | crc32(4)
+	manifestHeaderSize = 13
+	manifestEntrySize  = sha256.Size + 4
+)
+
+var (
+	notManifestErr      = errors.New("not a manifest of content addressed store")
+	illegalChunkHashErr = errors.New("illegal chunk hash")
+)
+
+/**
+ Store keeping content of files once by hash.
+ files are split into content-defined chunks by rolling hash, each chunk is kept once
+ in hidden area, and files are manifests of chunks with reference counts.
+ identical content under different names, or shared parts of files, are stored once.
+ chunks are shared by snapshots too, which clone manifests without counting references,
+ so chunks are removed by GC when no longer reachable, not when counts drop to zero.
+ */
+type ContentAddressedStore interface {
+	Store
+	// Chunks returns hashes of chunks of filename, in order.
+	Chunks(filename string) ([]string, error)
+	// Refs returns number of references to chunk of hash by files written through this store.
+	// counts leaked by crash, or by files expired, are dropped with chunks by GC.
+	Refs(hash string) (uint64, error)
+	// Pin keeps chunk of hash from GC, even if no file references it.
+	Pin(hash string) error
+	Unpin(hash string) error
+	// GC removes chunks not reachable from files, snapshots or pins.
+	GC(ctx context.Context, options GCOptions) (*GCReport, error)
+}
+
+type contentAddressedStore struct {
+	Store
+	cas *cas
+}
+
+// cas is chunks shared by views of sub stores and snapshots.
+// mutations are serialized, reads run concurrently.
+type cas struct {
+	mu     sync.RWMutex
+	// whole store, walked by GC
+	s      Store
+	dir    Store
+	chunks Store
+	pins   Store
+	refs   Store
+
+	// serializes GC runs
+	gcMu   sync.Mutex
+	// chunks stored or pinned while GC runs, kept even if not marked
+	fresh  map[[sha256.Size]byte]bool
+}
+
+type chunkRef struct {
+	hash   [sha256.Size]byte
+	length uint32
+}
+
+type manifest struct {
+	size   int64
+	chunks []chunkRef
+	// offsets of chunks, offsets[i] is start of chunks[i]
+	offsets []int64
+}
+
+func NewContentAddressedStore(s Store) ContentAddressedStore {
+	root := s.SubStore(casStore)
+
+	return &contentAddressedStore{
+		Store: s,
+		cas: &cas{
+			s:      s,
+			dir:    root,
+			chunks: root.SubStore(casChunks),
+			pins:   root.SubStore(casPins),
+			refs:   root.SubStore(casRefs),
+		},
+	}
+}
+
+func (cs *contentAddressedStore) SubStore(subpath string) Store {
+	subpath = strings.Trim(subpath, "/")
+
+	return &contentAddressedStore{
+		Store: cs.Store.SubStore(subpath),
+		cas:   cs.cas,
+	}
+}
+
+func (cs *contentAddressedStore) FileIter() <-chan FileInfo {
+	files := cs.Store.FileIter()
+	if files == nil {
+		return nil
+	}
+
+	ch := make(chan FileInfo)
+	go func() {
+		for info := range files {
+			if logical, err := cs.FileInfo(info.Name()); err == nil {
+				info = logical
+			}
+			ch <- info
+		}
+
+		close(ch)
+	}()
+
+	return ch
+}
+
+func (cs *contentAddressedStore) FileInfo(filename string) (FileInfo, error) {
+	cs.cas.mu.RLock()
+	defer cs.cas.mu.RUnlock()
+
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := cs.loadManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{info.Name(), m.size, info.Generation()}, nil
+}
+
+func (cs *contentAddressedStore) Read(filename string, res []byte, startOffset int64) error {
+	cs.cas.mu.RLock()
+	defer cs.cas.mu.RUnlock()
+
+	m, err := cs.loadManifest(filename)
+	if err != nil {
+		return err
+	}
+
+	return cs.readRange(m, res, startOffset)
+}
+
+func (cs *contentAddressedStore) Write(filename string, data []byte, startOffset int64) error {
+	return cs.WriteIf(filename, data, startOffset, anyGeneration)
+}
+
+func (cs *contentAddressedStore) ReadV(filename string, ranges []Range, parallelism int) error {
+	return readV(cs, filename, ranges, parallelism)
+}
+
+func (cs *contentAddressedStore) WriteV(filename string, extents []Extent) error {
+	return writeV(cs, filename, extents)
+}
+
+func (cs *contentAddressedStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	return cs.mutate("Write", filename, ifGeneration, func(m *manifest) (*manifest, error) {
+		end := startOffset + int64(len(data))
+		return cs.rewrite(m, startOffset, end, maxInt64(m.size, end), data)
+	})
+}
+
+func (cs *contentAddressedStore) Clear(filename string, startOffset int64, size int64) error {
+	return cs.mutate("Clear", filename, anyGeneration, func(m *manifest) (*manifest, error) {
+		end := startOffset + size
+		return cs.rewrite(m, startOffset, end, maxInt64(m.size, end), nil)
+	})
+}
+
+// Mmap gives view of copy of file, assembled from its chunks.
+func (cs *contentAddressedStore) Mmap(filename string) (vfs.ReadOnlyMapping, error) {
+	return readMapping(cs, filename)
+}
+
+// Preallocate checks file exists only, data is kept in chunks shared by files.
+func (cs *contentAddressedStore) Preallocate(filename string, size int64) error {
+	if !cs.IsFileExist(filename) {
+		return &os.PathError{Op: "Preallocate", Path: filename, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// Sync commits chunks stored, then manifest of file referencing them.
+func (cs *contentAddressedStore) Sync(filename string) error {
+	if err := cs.cas.chunks.SyncAll(); err != nil {
+		return err
+	}
+	return cs.Store.Sync(filename)
+}
+
+func (cs *contentAddressedStore) Truncate(filename string, size int64) error {
+	return cs.mutate("Truncate", filename, anyGeneration, func(m *manifest) (*manifest, error) {
+		if size > m.size {
+			return cs.rewrite(m, m.size, size, size, nil)
+		}
+		return cs.rewrite(m, size, size, size, nil)
+	})
+}
+
+func (cs *contentAddressedStore) CreateFile(filename string) error {
+	return cs.create(filename, func() error {
+		return cs.Store.CreateFile(filename)
+	})
+}
+
+func (cs *contentAddressedStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	return cs.create(filename, func() error {
+		return cs.Store.CreateFileWithTTL(filename, ttl)
+	})
+}
+
+func (cs *contentAddressedStore) CreateIfNotExists(filename string) error {
+	return cs.create(filename, func() error {
+		return cs.Store.CreateIfNotExists(filename)
+	})
+}
+
+func (cs *contentAddressedStore) RemoveFile(filename string) error {
+	return cs.remove(filename, func() error {
+		return cs.Store.RemoveFile(filename)
+	})
+}
+
+func (cs *contentAddressedStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	return cs.remove(filename, func() error {
+		return cs.Store.RemoveIfMatch(filename, ifGeneration)
+	})
+}
+
+func (cs *contentAddressedStore) Watch(path string, recursive bool) (<-chan vfs.Event, func(), error) {
+	events, cancel, err := cs.Store.Watch(path, recursive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// hide changes of chunks
+	return relayEvents(events, cancel, func(name string) (string, bool) {
+		return name, !isHidden(name)
+	})
+}
+
+// Snapshot clones manifests, chunks are shared with snapshot.
+func (cs *contentAddressedStore) Snapshot(name string) error {
+	cs.cas.mu.Lock()
+	defer cs.cas.mu.Unlock()
+
+	return cs.Store.Snapshot(name)
+}
+
+// OpenSnapshot returns snapshot reading chunks shared with this store.
+func (cs *contentAddressedStore) OpenSnapshot(name string) (Store, error) {
+	snapshot, err := cs.Store.OpenSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newReadOnlyStore(&contentAddressedStore{Store: snapshot, cas: cs.cas}), nil
+}
+
+func (cs *contentAddressedStore) Chunks(filename string) ([]string, error) {
+	cs.cas.mu.RLock()
+	defer cs.cas.mu.RUnlock()
+
+	m, err := cs.loadManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, len(m.chunks))
+	for i, ref := range m.chunks {
+		hashes[i] = hex.EncodeToString(ref.hash[:])
+	}
+
+	return hashes, nil
+}
+
+func (cs *contentAddressedStore) Refs(hash string) (uint64, error) {
+	h, err := parseChunkHash("Refs", hash)
+	if err != nil {
+		return 0, err
+	}
+
+	cs.cas.mu.RLock()
+	defer cs.cas.mu.RUnlock()
+
+	return cs.cas.loadRefs(hex.EncodeToString(h[:]))
+}
+
+func (cs *contentAddressedStore) Pin(hash string) error {
+	h, err := parseChunkHash("Pin", hash)
+	if err != nil {
+		return err
+	}
+
+	cs.cas.mu.Lock()
+	defer cs.cas.mu.Unlock()
+
+	name := hex.EncodeToString(h[:])
+	if !cs.cas.pins.IsFileExist(name) {
+		if err := cs.cas.pins.CreateFile(name); err != nil {
+			return err
+		}
+	}
+
+	cs.cas.touch(h)
+	return nil
+}
+
+func (cs *contentAddressedStore) Unpin(hash string) error {
+	h, err := parseChunkHash("Unpin", hash)
+	if err != nil {
+		return err
+	}
+
+	cs.cas.mu.Lock()
+	defer cs.cas.mu.Unlock()
+
+	name := hex.EncodeToString(h[:])
+	if !cs.cas.pins.IsFileExist(name) {
+		return nil
+	}
+	return cs.cas.pins.RemoveFile(name)
+}
+
+func (cs *contentAddressedStore) GC(ctx context.Context, options GCOptions) (*GCReport, error) {
+	return cs.cas.gc(ctx, options)
+}
+
+func (cs *contentAddressedStore) scrub(r *scrubRun) error {
+	return scrubStore(r, cs.Store)
+}
+
+// removeExpired removes expired manifests, their chunks are removed by GC.
+func (cs *contentAddressedStore) removeExpired(fn func(name string) error) error {
+	return removeExpired(cs.Store, fn)
+}
+
+func (cs *contentAddressedStore) walkFiles(fn func(name string) error) error {
+	return walkFiles(cs.Store, fn)
+}
+
+func (cs *contentAddressedStore) create(filename string, create func() error) error {
+	cs.cas.mu.Lock()
+	defer cs.cas.mu.Unlock()
+
+	old := cs.oldManifest(filename)
+	if err := create(); err != nil {
+		return err
+	}
+
+	if err := cs.saveManifest(filename, &manifest{}); err != nil {
+		return err
+	}
+	return cs.cas.addRefs(refDeltas(old, &manifest{}), -1)
+}
+
+// remove releases references of chunks of removed file, chunks are removed by GC.
+func (cs *contentAddressedStore) remove(filename string, remove func() error) error {
+	cs.cas.mu.Lock()
+	defer cs.cas.mu.Unlock()
+
+	old := cs.oldManifest(filename)
+	if err := remove(); err != nil {
+		return err
+	}
+	return cs.cas.addRefs(refDeltas(old, &manifest{}), -1)
+}
+
+// oldManifest returns manifest of filename replaced or removed, empty if none.
+func (cs *contentAddressedStore) oldManifest(filename string) *manifest {
+	if !cs.Store.IsFileExist(filename) {
+		return &manifest{}
+	}
+
+	m, err := cs.loadManifest(filename)
+	if err != nil {
+		return &manifest{}
+	}
+	return m
+}
+
+// mutate replaces manifest of filename by result of mutation.
+// new chunks are stored, and references added, before manifest is saved,
+// and references of old chunks are released after,
+// so chunks and counts may leak by crash, until removed by GC, but are never lost.
+func (cs *contentAddressedStore) mutate(op string, filename string, ifGeneration uint64,
+	mutation func(m *manifest) (*manifest, error)) error {
+	cs.cas.mu.Lock()
+	defer cs.cas.mu.Unlock()
+
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return &os.PathError{Op: op, Path: filename, Err: err}
+	}
+
+	if ifGeneration != anyGeneration && info.Generation() != ifGeneration {
+		return &PreconditionFailedError{Op: op, Path: filename, Expected: ifGeneration, Actual: info.Generation()}
+	}
+
+	old, err := cs.loadManifest(filename)
+	if err != nil {
+		return err
+	}
+
+	m, err := mutation(old)
+	if err != nil {
+		return err
+	}
+
+	deltas := refDeltas(old, m)
+	if err := cs.cas.addRefs(deltas, 1); err != nil {
+		return err
+	}
+
+	if err := cs.saveManifest(filename, m); err != nil {
+		return err
+	}
+	return cs.cas.addRefs(deltas, -1)
+}
+
+// rewrite returns manifest of content of m with data written at off, resized to size.
+// range of off to end is zeroed if data is nil, zeros are made by pieces of chunks cut.
+// chunks are cut again from chunk containing off, until cut meets boundary of old chunk
+// after end of data. chunks after the boundary are same as old ones.
+// new chunks are stored before returned.
+func (cs *contentAddressedStore) rewrite(m *manifest, off int64, end int64, size int64, data []byte) (*manifest, error) {
+	first := 0
+	if m.size > 0 {
+		pos := off
+		if pos >= m.size {
+			// last chunk was cut by end of file, not by boundary
+			pos = m.size - 1
+		}
+		first = m.chunkAt(pos)
+	}
+
+	res := &manifest{size: size, chunks: append([]chunkRef{}, m.chunks[:first]...)}
+
+	// old boundaries after which chunks are reused
+	boundaries := make(map[int64]int)
+	for i := first + 1; i < len(m.chunks); i++ {
+		boundaries[m.offsets[i]] = i
+	}
+
+	pos := int64(0)
+	if first < len(m.offsets) {
+		pos = m.offsets[first]
+	}
+
+	buf := make([]byte, 0, 2 * maxChunkSize)
+	for pos < size {
+		// fill buffer with new content
+		if need := int64(2 * maxChunkSize - len(buf)); need > 0 {
+			at := pos + int64(len(buf))
+			if need > size - at {
+				need = size - at
+			}
+
+			if need > 0 {
+				p := make([]byte, need)
+				if err := cs.content(m, p, at, off, end, data); err != nil {
+					return nil, err
+				}
+				buf = append(buf, p...)
+			}
+		}
+
+		n := chunkBoundary(buf, pos + int64(len(buf)) == size)
+		ref, err := cs.cas.store(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		res.chunks = append(res.chunks, ref)
+		buf = buf[n:]
+		pos += int64(n)
+
+		if i, ok := boundaries[pos]; ok && pos >= end && size == m.size {
+			// chunks are cut same as old ones from here
+			res.chunks = append(res.chunks, m.chunks[i:]...)
+			break
+		}
+	}
+
+	res.index()
+	return res, nil
+}
+
+// content reads new content at, which is data written at off over content of m,
+// or zeros up to end if data is nil.
+func (cs *contentAddressedStore) content(m *manifest, p []byte, at int64, off int64, end int64, data []byte) error {
+	if at < m.size {
+		n := m.size - at
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+
+		if err := cs.readRange(m, p[:n], at); err != nil {
+			return err
+		}
+	}
+
+	// overlap of p and data
+	from, to := maxInt64(at, off), at + int64(len(p))
+	if to > end {
+		to = end
+	}
+
+	for i := from; data == nil && i < to; i++ {
+		p[i - at] = 0
+	}
+	if from < to && data != nil {
+		copy(p[from - at:to - at], data[from - off:to - off])
+	}
+
+	return nil
+}
+
+func (cs *contentAddressedStore) readRange(m *manifest, res []byte, startOffset int64) error {
+	end := startOffset + int64(len(res))
+	if end > m.size {
+		end = m.size
+	}
+
+	for pos := startOffset; pos < end; {
+		i := m.chunkAt(pos)
+		data, err := cs.cas.load(m.chunks[i])
+		if err != nil {
+			return err
+		}
+
+		n := copy(res[pos - startOffset:end - startOffset], data[pos - m.offsets[i]:])
+		pos += int64(n)
+	}
+
+	if end < startOffset + int64(len(res)) {
+		// same as os.File.ReadAt
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (cs *contentAddressedStore) loadManifest(filename string) (*manifest, error) {
+	info, err := cs.Store.FileInfo(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, info.Size())
+	if err := cs.Store.Read(filename, data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	m, ok := decodeManifest(data)
+	if !ok {
+		return nil, &os.PathError{Op: "Read", Path: filename, Err: notManifestErr}
+	}
+
+	return m, nil
+}
+
+// saveManifest replaces manifest of filename atomically, so crash leaves old or new one.
+func (cs *contentAddressedStore) saveManifest(filename string, m *manifest) error {
+	return replaceFile(cs.Store, filename, encodeManifest(m))
+}
+
+// IsNotManifest returns true if err is returned for file not written through content addressed store.
+func IsNotManifest(err error) bool {
+	if perr, ok := err.(*os.PathError); ok {
+		return perr.Err == notManifestErr
+	}
+	return false
+}
+
+// store keeps chunk if not kept yet.
+// chunks are replaced atomically, so chunk kept already is whole.
+// where underlying store can not replace files atomically, chunk may be left torn by crash,
+// so its content is verified by hash before trusted.
+func (c *cas) store(data []byte) (chunkRef, error) {
+	ref := chunkRef{hash: sha256.Sum256(data), length: uint32(len(data))}
+	name := hex.EncodeToString(ref.hash[:])
+
+	if !c.kept(ref) {
+		if err := replaceFile(c.chunks, name, data); err != nil {
+			return ref, err
+		}
+	}
+
+	c.touch(ref.hash)
+	return ref, nil
+}
+
+// kept returns true if whole chunk of ref is kept.
+func (c *cas) kept(ref chunkRef) bool {
+	name := hex.EncodeToString(ref.hash[:])
+	info, err := c.chunks.FileInfo(name)
+	if err != nil || info.Size() != int64(ref.length) {
+		return false
+	}
+
+	if _, ok := c.chunks.(replacer); ok {
+		return true
+	}
+
+	data, err := c.load(ref)
+	return err == nil && sha256.Sum256(data) == ref.hash
+}
+
+func (c *cas) load(ref chunkRef) ([]byte, error) {
+	data := make([]byte, ref.length)
+	if err := c.chunks.Read(hex.EncodeToString(ref.hash[:]), data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// refDeltas returns changes of reference counts of chunks, by manifest old replaced by m.
+// only chunks changed are counted again, not each chunk of file.
+func refDeltas(old *manifest, m *manifest) map[[sha256.Size]byte]int64 {
+	deltas := make(map[[sha256.Size]byte]int64)
+	for _, ref := range m.chunks {
+		deltas[ref.hash]++
+	}
+	for _, ref := range old.chunks {
+		deltas[ref.hash]--
+	}
+	return deltas
+}
+
+// addRefs adds deltas of sign to reference counts, added ones are applied before released ones.
+// called with mu locked.
+func (c *cas) addRefs(deltas map[[sha256.Size]byte]int64, sign int64) error {
+	for hash, delta := range deltas {
+		if delta * sign <= 0 {
+			continue
+		}
+
+		name := hex.EncodeToString(hash[:])
+		refs, err := c.loadRefs(name)
+		if err != nil {
+			return err
+		}
+
+		if delta < 0 && uint64(-delta) > refs {
+			// counts lost with chunk removed by GC
+			refs = 0
+		} else {
+			refs = uint64(int64(refs) + delta)
+		}
+
+		if err := c.saveRefs(name, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRefs returns reference count of chunk name, 0 if not referenced.
+func (c *cas) loadRefs(name string) (uint64, error) {
+	if !c.refs.IsFileExist(name) {
+		return 0, nil
+	}
+
+	data := make([]byte, 8)
+	if err := c.refs.Read(name, data, 0); err == io.EOF {
+		// left empty by crash when created
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// saveRefs writes count of chunk name, count of 8 bytes is not torn by crash.
+func (c *cas) saveRefs(name string, refs uint64) error {
+	if refs == 0 {
+		if !c.refs.IsFileExist(name) {
+			return nil
+		}
+		return c.refs.RemoveFile(name)
+	}
+
+	if !c.refs.IsFileExist(name) {
+		if err := c.refs.CreateFile(name); err != nil {
+			return err
+		}
+	}
+
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, refs)
+	return c.refs.Write(name, data, 0)
+}
+
+// touch keeps chunk from running GC, which may have missed references of it.
+// called with mu locked.
+func (c *cas) touch(hash [sha256.Size]byte) {
+	if c.fresh != nil {
+		c.fresh[hash] = true
+	}
+}
+
+func parseChunkHash(op string, hash string) ([sha256.Size]byte, error) {
+	var h [sha256.Size]byte
+
+	data, err := hex.DecodeString(hash)
+	if err != nil || len(data) != sha256.Size {
+		return h, &os.PathError{Op: op, Path: hash, Err: illegalChunkHashErr}
+	}
+
+	copy(h[:], data)
+	return h, nil
+}
+
+// index computes offsets of chunks.
+func (m *manifest) index() {
+	m.offsets = make([]int64, len(m.chunks))
+
+	var off int64
+	for i, ref := range m.chunks {
+		m.offsets[i] = off
+		off += int64(ref.length)
+	}
+}
+
+// chunkAt returns index of chunk containing pos.
+func (m *manifest) chunkAt(pos int64) int {
+	return sort.Search(len(m.offsets), func(i int) bool {
+		return m.offsets[i] > pos
+	}) - 1
+}
+
+func encodeManifest(m *manifest) []byte {
+	data := make([]byte, manifestHeaderSize + len(m.chunks) * manifestEntrySize + 4)
+
+	data[0] = manifestVersion
+	binary.LittleEndian.PutUint64(data[1:], uint64(m.size))
+	binary.LittleEndian.PutUint32(data[9:], uint32(len(m.chunks)))
+
+	for i, ref := range m.chunks {
+		entry := data[manifestHeaderSize + i * manifestEntrySize:]
+		copy(entry, ref.hash[:])
+		binary.LittleEndian.PutUint32(entry[sha256.Size:], ref.length)
+	}
+
+	body := data[:len(data) - 4]
+	binary.LittleEndian.PutUint32(data[len(body):], crc32.ChecksumIEEE(body))
+	return data
+}
+
+func decodeManifest(data []byte) (*manifest, bool) {
+	if len(data) < manifestHeaderSize + 4 || data[0] != manifestVersion {
+		return nil, false
+	}
+
+	body := data[:len(data) - 4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, false
+	}
+
+	count := int(binary.LittleEndian.Uint32(body[9:]))
+	if len(body) != manifestHeaderSize + count * manifestEntrySize {
+		return nil, false
+	}
+
+	m := &manifest{
+		size:   int64(binary.LittleEndian.Uint64(body[1:])),
+		chunks: make([]chunkRef, count),
+	}
+
+	for i := range m.chunks {
+		entry := body[manifestHeaderSize + i * manifestEntrySize:]
+		copy(m.chunks[i].hash[:], entry)
+		m.chunks[i].length = binary.LittleEndian.Uint32(entry[sha256.Size:])
+	}
+
+	m.index()
+	return m, true
+}
+
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func countFiles(s Store) int {
+	cnt := 0
+	for range s.FileIter() {
+		cnt++
+	}
+	return cnt
+}
+
+func TestChunkBoundary(t *testing.T) {
+	data := make([]byte, 1024 * 1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	cuts := func(data []byte) map[int]bool {
+		res := make(map[int]bool)
+		for pos := 0; pos < len(data); {
+			n := chunkBoundary(data[pos:], true)
+			assert.True(t, n > 0 && n <= maxChunkSize)
+			pos += n
+			res[pos] = true
+		}
+		return res
+	}
+
+	before := cuts(data)
+	assert.True(t, len(before) > len(data) / maxChunkSize)
+
+	// boundaries are defined by content, so insertion shifts only nearby boundaries
+	inserted := append(append(append([]byte{}, data[:1000]...), "inserted"...), data[1000:]...)
+	after := cuts(inserted)
+
+	same := 0
+	for cut := range before {
+		if after[cut + len("inserted")] {
+			same++
+		}
+	}
+	assert.True(t, same >= len(before) - 2)
+}
+
+func TestContentAddressedStore_Dedup(t *testing.T) {
+	for _, s := range testStores(t, "TestContentAddressedStore_Dedup") {
+		cs := NewContentAddressedStore(s)
+		chunks := s.SubStore(casStore).SubStore(casChunks)
+
+		data := make([]byte, 256 * 1024)
+		rand.New(rand.NewSource(2)).Read(data)
+
+		assert.Nil(t, cs.CreateFile("a"))
+		assert.Nil(t, cs.Write("a", data, 0))
+		cnt := countFiles(chunks)
+		assert.True(t, cnt > 1)
+
+		// identical artifact under other name is stored once
+		assert.Nil(t, cs.CreateFile("b"))
+		assert.Nil(t, cs.Write("b", data, 0))
+		assert.Equal(t, cnt, countFiles(chunks))
+
+		info, err := cs.FileInfo("b")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)), info.Size())
+
+		res := make([]byte, len(data))
+		assert.Nil(t, cs.Read("b", res, 0))
+		assert.True(t, bytes.Equal(data, res))
+
+		// small change adds few chunks
+		assert.Nil(t, cs.Write("b", []byte("changed"), 100 * 1024))
+		added := countFiles(chunks) - cnt
+		assert.True(t, added >= 1 && added <= 2)
+
+		copy(data[100 * 1024:], "changed")
+		assert.Nil(t, cs.Read("b", res, 0))
+		assert.True(t, bytes.Equal(data, res))
+
+		// chunks are counted once by each file referencing them
+		hashes, err := cs.Chunks("a")
+		assert.Nil(t, err)
+		refs, err := cs.Refs(hashes[0])
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(2), refs)
+
+		// chunks of removed file are kept while referenced by other file
+		assert.Nil(t, cs.RemoveFile("a"))
+		refs, _ = cs.Refs(hashes[0])
+		assert.Equal(t, uint64(1), refs)
+		report := collectGarbage(t, cs)
+		assert.Equal(t, added, report.Reclaimed)
+
+		assert.Nil(t, cs.Read("b", res, 0))
+		assert.True(t, bytes.Equal(data, res))
+
+		assert.Nil(t, cs.RemoveFile("b"))
+		refs, _ = cs.Refs(hashes[0])
+		assert.Equal(t, uint64(0), refs)
+		report = collectGarbage(t, cs)
+		assert.Equal(t, cnt, report.Reclaimed)
+		assert.Equal(t, 0, countFiles(chunks))
+		assert.Equal(t, 0, countFiles(s.SubStore(casStore).SubStore(casRefs)))
+	}
+}
+
+func TestContentAddressedStore_ReadWrite(t *testing.T) {
+	for _, s := range testStores(t, "TestContentAddressedStore_ReadWrite") {
+		cs := NewContentAddressedStore(s)
+		filename := "file"
+
+		assert.Nil(t, cs.CreateFile(filename))
+		assert.Nil(t, cs.Write(filename, []byte("0123456789"), 0))
+		assert.Nil(t, cs.Write(filename, []byte("ab"), 12))
+
+		res := make([]byte, 14)
+		assert.Nil(t, cs.Read(filename, res, 0))
+		assert.Equal(t, "0123456789\x00\x00ab", string(res))
+		assert.Equal(t, io.EOF, cs.Read(filename, res, 1))
+
+		assert.Nil(t, cs.Clear(filename, 0, 2))
+		assert.Nil(t, cs.Truncate(filename, 4))
+		res = make([]byte, 4)
+		assert.Nil(t, cs.Read(filename, res, 0))
+		assert.Equal(t, "\x00\x0023", string(res))
+
+		info, _ := cs.FileInfo(filename)
+		assert.Equal(t, int64(4), info.Size())
+
+		// not written through content addressed store
+		s.CreateFile("plain")
+		s.Write("plain", []byte("test"), 0)
+		assert.True(t, IsNotManifest(cs.Read("plain", res, 0)))
+
+		// snapshot of sub store shares chunks
+		sub := cs.SubStore("sub")
+		sub.CreateFile("file")
+		sub.Write("file", []byte("test"), 0)
+		assert.Nil(t, sub.Snapshot("snap"))
+
+		snapshot, err := sub.OpenSnapshot("snap")
+		assert.Nil(t, err)
+		assert.Nil(t, snapshot.Read("file", res, 0))
+		assert.Equal(t, "test", string(res))
+		assert.NotNil(t, snapshot.Write("file", []byte("test"), 0))
+	}
+}
+
+func TestContentAddressedStore_TornChunk(t *testing.T) {
+	for _, s := range testStores(t, "TestContentAddressedStore_TornChunk") {
+		// chunks in store not replacing files atomically are verified before trusted
+		c := &cas{chunks: &struct{ Store }{s.SubStore("chunks")}}
+		data := []byte("chunk")
+		ref, err := c.store(data)
+		assert.Nil(t, err)
+		assert.True(t, c.kept(ref))
+
+		assert.Nil(t, c.chunks.Write(hex.EncodeToString(ref.hash[:]), []byte{0}, 2))
+		assert.False(t, c.kept(ref))
+
+		_, err = c.store(data)
+		assert.Nil(t, err)
+		res, err := c.load(ref)
+		assert.Nil(t, err)
+		assert.Equal(t, data, res)
+	}
+}
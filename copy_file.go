@@ -0,0 +1,34 @@
+package store
+
+// size of buffer used to copy file between stores
+const copyBufferSize = 64 * 1024
+
+// copyFile copies content of srcName in src into dstName in dst.
+// dstName is created or truncated first.
+func copyFile(src Store, srcName string, dst Store, dstName string) error {
+	info, err := src.FileInfo(srcName)
+	if err != nil {
+		return err
+	}
+
+	if err := dst.CreateFile(dstName); err != nil {
+		return err
+	}
+
+	buf := make([]byte, copyBufferSize)
+	for off := int64(0); off < info.Size(); off += int64(len(buf)) {
+		if info.Size() - off < int64(len(buf)) {
+			buf = buf[:info.Size() - off]
+		}
+
+		if err := src.Read(srcName, buf, off); err != nil {
+			return err
+		}
+
+		if err := dst.Write(dstName, buf, off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	illegalDirNameErr    = errors.New("illegal directory name")
+	notDirectoryErr      = errors.New("not a directory")
+	directoryNotEmptyErr = errors.New("directory not empty")
+)
+
+type dirInfo struct {
+	name    string
+	files   int
+	dirs    int
+	modTime time.Time
+}
+
+func (d *dirInfo) Name() string {
+	return d.name
+}
+
+func (d *dirInfo) Files() int {
+	return d.files
+}
+
+func (d *dirInfo) Dirs() int {
+	return d.dirs
+}
+
+func (d *dirInfo) ModTime() time.Time {
+	return d.modTime
+}
+
+// checkDirName returns dirname trimmed of slashes, if it names directory of store.
+// internal data is not named, store itself is named by "" only if root is true.
+func checkDirName(op string, dirname string, root bool) (string, error) {
+	dirname = strings.Trim(dirname, "/")
+	if dirname == "" {
+		if root {
+			return "", nil
+		}
+		return "", &os.PathError{Op: op, Path: dirname, Err: illegalDirNameErr}
+	}
+
+	for _, segment := range strings.Split(dirname, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.HasPrefix(segment, hiddenPrefix) {
+			return "", &os.PathError{Op: op, Path: dirname, Err: illegalDirNameErr}
+		}
+	}
+	return dirname, nil
+}
+
+// checkParents checks dirname and its parents are not files, by isFile.
+func checkParents(op string, dirname string, isFile func(name string) bool) error {
+	segments := strings.Split(dirname, "/")
+	for i := range segments {
+		if name := strings.Join(segments[:i + 1], "/"); isFile(name) {
+			return &os.PathError{Op: op, Path: name, Err: notDirectoryErr}
+		}
+	}
+	return nil
+}
+
+// dirBase returns name of directory dirname, "" for store itself.
+func dirBase(dirname string) string {
+	dirname = strings.Trim(dirname, "/")
+	return dirname[strings.LastIndex(dirname, "/") + 1:]
+}
+
+// removeDirFiles removes files under dirname one by one through s,
+// for stores keeping state of each file, like journal, versions or usage.
+// nothing is removed if dirname is not existed, so error is given by RemoveDir of underlying store.
+func removeDirFiles(s Store, dirname string) error {
+	if _, err := checkDirName("RemoveDir", dirname, false); err != nil || !s.IsDirExist(dirname) {
+		return nil
+	}
+
+	sub := s.SubStore(dirname)
+
+	names := make([]string, 0)
+	if files := sub.FileIter(); files != nil {
+		for info := range files {
+			names = append(names, info.Name())
+		}
+	}
+
+	for _, name := range names {
+		if err := sub.RemoveFile(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	dirs, err := s.ListDirs(dirname)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := removeDirFiles(s, strings.Trim(dirname, "/") + "/" + dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Dirs(t *testing.T) {
+	for _, s := range testStores(t, "TestStore_Dirs") {
+		assert.Nil(t, s.Mkdir("a/b"))
+		assert.True(t, os.IsExist(errCause(s.Mkdir("a"))))
+		assert.True(t, s.IsDirExist("a"))
+		assert.True(t, s.IsDirExist("a/b/"))
+		assert.True(t, s.IsDirExist(""))
+		assert.False(t, s.IsDirExist("c"))
+
+		// internal data and traversal can not be named
+		assert.NotNil(t, s.Mkdir(".kayat_x"))
+		assert.NotNil(t, s.Mkdir("a/../b"))
+		assert.NotNil(t, s.Mkdir(""))
+
+		assert.Nil(t, s.CreateFile("file"))
+		assert.NotNil(t, s.Mkdir("file/x"))
+		assert.False(t, s.IsDirExist("file"))
+
+		// hidden sub stores are not listed
+		s.SubStore(".kayat_hidden")
+		assert.Nil(t, s.Mkdir("d"))
+		dirs, err := s.ListDirs("")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"a", "d"}, dirs)
+
+		dirs, err = s.ListDirs("a")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"b"}, dirs)
+
+		_, err = s.ListDirs("file")
+		assert.NotNil(t, err)
+
+		assert.Nil(t, s.SubStore("a").CreateFile("x"))
+		info, err := s.DirInfo("a")
+		assert.Nil(t, err)
+		assert.Equal(t, "a", info.Name())
+		assert.Equal(t, 1, info.Files())
+		assert.Equal(t, 1, info.Dirs())
+
+		info, err = s.DirInfo("")
+		assert.Nil(t, err)
+		assert.Equal(t, "", info.Name())
+		assert.Equal(t, 1, info.Files())
+		assert.Equal(t, 2, info.Dirs())
+
+		// directory having files is removed only if recursive
+		assert.NotNil(t, s.RemoveDir("a", false))
+		assert.Nil(t, s.RemoveDir("d", false))
+		assert.Nil(t, s.RemoveDir("a", true))
+		assert.False(t, s.IsDirExist("a"))
+		assert.False(t, s.IsFileExist("a/x"))
+		assert.True(t, os.IsNotExist(errCause(s.RemoveDir("a", true))))
+		assert.NotNil(t, s.RemoveDir("file", true))
+		assert.True(t, s.IsFileExist("file"))
+	}
+}
+
+func TestJournaledStore_RemoveDir(t *testing.T) {
+	m, err := NewMemoryStore("/TestJournaledStore_RemoveDir")
+	assert.Nil(t, err)
+
+	s, err := NewJournaledStore(m)
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.Mkdir("dir/sub"))
+	assert.Nil(t, s.SubStore("dir").CreateFile("a"))
+	assert.Nil(t, s.SubStore("dir/sub").CreateFile("b"))
+
+	since := s.LastSeq()
+	assert.Nil(t, s.RemoveDir("dir", true))
+	assert.False(t, s.IsDirExist("dir"))
+
+	it, err := s.Changes(since)
+	assert.Nil(t, err)
+
+	removed := make([]string, 0)
+	for it.Next() {
+		assert.Equal(t, ChangeRemove, it.Change().Op)
+		removed = append(removed, it.Change().Name)
+	}
+	assert.ElementsMatch(t, []string{"dir/a", "dir/sub/b"}, removed)
+}
+
+// errCause returns error wrapped by os.PathError.
+func errCause(err error) error {
+	if e, ok := err.(*os.PathError); ok {
+		return e.Err
+	}
+	return err
+}
@@ -0,0 +1,252 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+/**
+ Durability decides when file system store commits changes to stable storage.
+ changes not committed yet are written back by os, and can be lost by power loss.
+ */
+type Durability int
+
+const (
+	// changes are committed only by Sync and SyncAll
+	DurabilityNone Durability = iota
+	// files written are committed when their kept handles are closed, not after each operation:
+	// when evicted from handles kept by MaxOpenFiles, invalidated by mutations replacing or removing files,
+	// or by Close of store, which commits everything changed.
+	// files written stay uncommitted while their handles are kept, unless handles are not kept at all
+	DurabilityOnClose
+	// every mutation is committed before it returns
+	DurabilityEveryWrite
+	// mutations wait for changes of interval to be committed at once
+	DurabilityGroupCommit
+)
+
+// interval of group commit, if not given by options
+const defaultGroupCommitInterval = 10 * time.Millisecond
+
+/**
+ syncer tracks files and directories changed by file system store and its sub stores,
+ and commits them by durability.
+ syncing a file commits its metadata too.
+ */
+type syncer struct {
+	mu         sync.Mutex
+	durability Durability
+	interval   time.Duration
+	handles    *handlePool
+	// files changed and directories of which entries are changed, since synced
+	files map[string]bool
+	dirs  map[string]bool
+	// mutations waiting for next group commit
+	group *commitGroup
+}
+
+type commitGroup struct {
+	done chan struct{}
+	err  error
+}
+
+func newSyncer(durability Durability, interval time.Duration, handles *handlePool) *syncer {
+	if interval <= 0 {
+		interval = defaultGroupCommitInterval
+	}
+
+	// handles sync files written by them when closed
+	handles.syncOnClose = durability == DurabilityOnClose
+
+	return &syncer{
+		durability: durability,
+		interval:   interval,
+		handles:    handles,
+		files:      make(map[string]bool),
+		dirs:       make(map[string]bool),
+	}
+}
+
+// changes returns file at path and directory of its metadata,
+// and its directory too if entries of it are changed.
+func changes(path string, entries bool) ([]string, []string) {
+	dirs := []string{filepath.Join(filepath.Dir(path), metaDir)}
+	if entries {
+		dirs = append(dirs, filepath.Dir(path))
+	}
+	return []string{path}, dirs
+}
+
+// changed marks files and directories changed, to be synced later.
+// every change is synced by commit in DurabilityEveryWrite, so nothing is marked.
+func (s *syncer) changed(files []string, dirs []string) {
+	if s.durability == DurabilityEveryWrite {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range files {
+		s.files[f] = true
+	}
+	for _, d := range dirs {
+		s.dirs[d] = true
+	}
+}
+
+// removed forgets file at path removed, and marks directories of its entries changed.
+func (s *syncer) removed(path string) []string {
+	_, dirs := changes(path, true)
+
+	s.mu.Lock()
+	delete(s.files, path)
+	s.mu.Unlock()
+
+	s.changed(nil, dirs)
+	return dirs
+}
+
+// commit syncs changes marked by durability, returns after they are committed if required.
+// called without locks of files held, so waiting for group commit does not block other mutations.
+func (s *syncer) commit(files []string, dirs []string) error {
+	switch s.durability {
+	case DurabilityEveryWrite:
+		return s.sync(files, dirs)
+	case DurabilityGroupCommit:
+		s.mu.Lock()
+		g := s.group
+		if g == nil {
+			g = &commitGroup{done: make(chan struct{})}
+			s.group = g
+			time.AfterFunc(s.interval, s.groupCommit)
+		}
+		s.mu.Unlock()
+
+		<-g.done
+		return g.err
+	}
+	return nil
+}
+
+// groupCommit syncs all changes for mutations waiting for it.
+func (s *syncer) groupCommit() {
+	s.mu.Lock()
+	g := s.group
+	s.group = nil
+	files, dirs := s.take("")
+	s.mu.Unlock()
+
+	g.err = s.sync(files, dirs)
+	close(g.done)
+}
+
+// syncAll syncs changes under directory prefix, all changes if prefix is empty.
+func (s *syncer) syncAll(prefix string) error {
+	s.mu.Lock()
+	files, dirs := s.take(prefix)
+	s.mu.Unlock()
+
+	return s.sync(files, dirs)
+}
+
+// take returns changes under prefix, and forgets them.
+// called with lock held.
+func (s *syncer) take(prefix string) ([]string, []string) {
+	files, dirs := make([]string, 0), make([]string, 0)
+
+	for f := range s.files {
+		if strings.HasPrefix(f, prefix) {
+			files = append(files, f)
+			delete(s.files, f)
+		}
+	}
+
+	// directory of prefix itself is included
+	dirPrefix := filepath.Clean(prefix)
+	for d := range s.dirs {
+		if prefix == "" || strings.HasPrefix(d, prefix) || d == dirPrefix {
+			dirs = append(dirs, d)
+			delete(s.dirs, d)
+		}
+	}
+
+	return files, dirs
+}
+
+// sync syncs files, then directories, forgetting their marks.
+// files and directories removed meanwhile are skipped.
+func (s *syncer) sync(files []string, dirs []string) error {
+	s.mu.Lock()
+	for _, f := range files {
+		delete(s.files, f)
+	}
+	for _, d := range dirs {
+		delete(s.dirs, d)
+	}
+	s.mu.Unlock()
+
+	var first error
+	for _, path := range files {
+		f, err := s.handles.open(path)
+		if err == nil {
+			err = syncFile(f.File, path, s.handles.root)
+			f.Close()
+		}
+
+		if err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := vfs.SyncDir(dir); err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// syncFile syncs file f at path, and its metadata opened beneath root.
+func syncFile(f *os.File, path string, root string) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	meta, err := openUnder(root, vfs.MetaPath(path), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer meta.Close()
+
+	return meta.Sync()
+}
+
+// syncTree syncs files and directories under root, including root.
+func syncTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return vfs.SyncDir(path)
+		}
+
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return f.Sync()
+	})
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSystemStore_Sync(t *testing.T) {
+	s := NewFileSystemStore(path).SubStore("TestFileSystemStore_Sync")
+	syncer := s.(*fileSystemStore).syncer
+	filename := "file"
+
+	assert.Nil(t, s.CreateFile(filename))
+	assert.Nil(t, s.Write(filename, []byte("data"), 0))
+	assert.True(t, syncer.files[path + "/TestFileSystemStore_Sync/" + filename])
+
+	assert.Nil(t, s.Sync(filename))
+	assert.False(t, syncer.files[path + "/TestFileSystemStore_Sync/" + filename])
+	assert.NotNil(t, s.Sync("missing"))
+
+	assert.Nil(t, s.Write(filename, []byte("more"), 4))
+	assert.Nil(t, s.SubStore("sub").CreateFile(filename))
+	assert.Nil(t, s.SyncAll())
+	assert.Empty(t, syncer.files)
+	assert.Empty(t, syncer.dirs)
+}
+
+func TestFileSystemStore_Durability(t *testing.T) {
+	modes := []Durability{DurabilityNone, DurabilityOnClose, DurabilityEveryWrite, DurabilityGroupCommit}
+
+	for _, mode := range modes {
+		s := NewFileSystemStoreWithOptions(path, FileSystemOptions{Durability: mode, GroupCommitInterval: time.Millisecond}).
+			SubStore("TestFileSystemStore_Durability")
+		syncer := s.(*fileSystemStore).syncer
+
+		var wg sync.WaitGroup
+		for _, name := range []string{"a", "b", "c"} {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				assert.Nil(t, s.CreateFile(name))
+				assert.Nil(t, s.Write(name, []byte(name), 0))
+			}(name)
+		}
+		wg.Wait()
+
+		syncer.mu.Lock()
+		pending := len(syncer.files)
+		syncer.mu.Unlock()
+
+		switch mode {
+		case DurabilityNone, DurabilityOnClose:
+			// committed later
+			assert.Equal(t, 3, pending)
+		default:
+			// committed before mutations returned
+			assert.Equal(t, 0, pending)
+		}
+
+		res := make([]byte, 1)
+		assert.Nil(t, s.Read("b", res, 0))
+		assert.Equal(t, "b", string(res))
+
+		assert.Nil(t, s.Close())
+		if mode != DurabilityNone {
+			assert.Empty(t, syncer.files)
+		}
+		RemoveFileSystemStore(path + "/TestFileSystemStore_Durability")
+	}
+}
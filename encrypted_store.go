@@ -0,0 +1,989 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+const (
+	// header of encrypted file is kept in this hidden directory next to the file.
+	encryptedHeaderDir = hiddenPrefix + "encrypted"
+	// key of encrypted names is kept in this directory, in header directory of root of encrypted store
+	encryptedNamesKey     = hiddenPrefix + "names"
+	encryptedNamesKeyFile = "key"
+
+	encryptedHeaderVersion = 1
+	encryptedChunkSize     = 4096
+	encryptedNonceSize     = 12
+	encryptedTagSize       = 16
+	encryptedChunkStride   = encryptedNonceSize + encryptedChunkSize + encryptedTagSize
+	// chunks sealed by writeRange are written by batches of this many
+	encryptedBatchChunks = 16
+
+	// segments of names encrypted are sealed, 28 bytes longer, and base32 encoded,
+	// so longer segments would exceed 255 bytes limit of names of file systems
+	maxEncryptedNameLength = 131
+
+	dataKeySize = 32
+	fileIDSize  = 16
+)
+
+var (
+	notEncryptedErr         = errors.New("file is not encrypted")
+	corruptedHeaderErr      = errors.New("corrupted encryption header")
+	illegalEncryptedNameErr = errors.New("illegal encrypted name")
+	noSuchKeyErr            = errors.New("no such key")
+	encryptedNameTooLongErr = errors.New("name too long to encrypt")
+)
+
+// names are encoded by lower case base32 without padding, safe for file systems.
+var nameEncoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+/**
+ KeyProvider provides master keys, wrapping data keys of files.
+ keys are 16, 24 or 32 bytes of AES-128, AES-192 or AES-256.
+ */
+type KeyProvider interface {
+	// CurrentKey returns id and key wrapping new data keys.
+	CurrentKey() (string, []byte, error)
+	// Key returns key of id, to unwrap data keys wrapped by it.
+	Key(id string) ([]byte, error)
+}
+
+/**
+ StaticKeys is KeyProvider of keys in memory.
+ key is rotated by adding new key and making it Current.
+ */
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+type EncryptionOptions struct {
+	// encrypt names of files and sub stores, deterministically.
+	// segments of names are limited to maxEncryptedNameLength bytes,
+	// files and directories of longer names are not created.
+	EncryptNames bool
+}
+
+/**
+ Store encrypting files of underlying store with AES-GCM.
+ files are encrypted in chunks, each sealed with random nonce,
+ so random-offset reads and writes touch only chunks of the range.
+ each file has own data key, wrapped by master key of KeyProvider in header of the file.
+ files written bypassing this store are not readable through it.
+ */
+type EncryptedStore interface {
+	Store
+	// RotateKey re-wraps data key of filename by current master key.
+	RotateKey(filename string) error
+	// RotateKeys re-wraps data keys of files of this store, not of sub stores, by current master key.
+	RotateKeys() error
+}
+
+type encryptedStore struct {
+	Store
+	encryption *encryption
+	prefix     string
+}
+
+type encryption struct {
+	keys  KeyProvider
+	locks stripedLock
+	// nil, if names are not encrypted
+	names cipher.AEAD
+	// key of nonces of names
+	namesMac []byte
+}
+
+// encryptionHeader is header of encrypted file, encoded as
+// version(1) keyIDLength(1) keyID fileID(16) nonce(12) wrappedDataKey(32+16)
+type encryptionHeader struct {
+	keyID   string
+	fileID  []byte
+	dataKey []byte
+}
+
+// plainNames is encrypted store taking underlying names, scrubbed with names of underlying store.
+type plainNames struct {
+	*encryptedStore
+}
+
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, &os.PathError{Op: "Key", Path: id, Err: noSuchKeyErr}
+	}
+	return key, nil
+}
+
+// Encrypted returns store encrypting files of s by keys of keyProvider.
+func Encrypted(s Store, keyProvider KeyProvider, options EncryptionOptions) (EncryptedStore, error) {
+	e := &encryption{keys: keyProvider}
+
+	if options.EncryptNames {
+		key, err := loadNamesKey(s.SubStore(encryptedHeaderDir + "/" + encryptedNamesKey), keyProvider)
+		if err != nil {
+			return nil, err
+		}
+
+		// separate keys of encryption and nonces
+		block, err := aes.NewCipher(deriveKey(key, "names"))
+		if err != nil {
+			return nil, err
+		}
+
+		if e.names, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+		e.namesMac = deriveKey(key, "nonces")
+	}
+
+	return &encryptedStore{Store: s, encryption: e}, nil
+}
+
+func (es *encryptedStore) SubStore(subpath string) Store {
+	subpath = cleanSubPath(subpath)
+	prefix := es.prefix
+	if subpath != "" {
+		prefix += subpath + "/"
+	}
+
+	return &encryptedStore{
+		Store:      es.Store.SubStore(es.encryption.encryptPath(subpath)),
+		encryption: es.encryption,
+		prefix:     prefix,
+	}
+}
+
+func (es *encryptedStore) IsFileExist(filename string) bool {
+	filename, err := cleanFileName("IsFileExist", filename)
+	if err != nil {
+		return false
+	}
+
+	return es.Store.IsFileExist(es.encryption.encryptPath(filename))
+}
+
+func (es *encryptedStore) FileIter() <-chan FileInfo {
+	files := es.Store.FileIter()
+	if files == nil {
+		return nil
+	}
+
+	ch := make(chan FileInfo)
+	go func() {
+		for info := range files {
+			name, err := es.encryption.decryptPath(info.Name())
+			if err != nil {
+				// not written through this store
+				continue
+			}
+
+			ch <- &fileInfo{name, plainSize(info.Size()), info.Generation()}
+		}
+
+		close(ch)
+	}()
+
+	return ch
+}
+
+func (es *encryptedStore) FileInfo(filename string) (FileInfo, error) {
+	filename, err := cleanFileName("FileInfo", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := es.Store.FileInfo(es.encryption.encryptPath(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{filename[strings.LastIndex(filename, "/") + 1:], plainSize(info.Size()), info.Generation()}, nil
+}
+
+func (es *encryptedStore) Read(filename string, res []byte, startOffset int64) error {
+	filename, err := cleanFileName("Read", filename)
+	if err != nil {
+		return err
+	}
+
+	m := es.lock(filename)
+	defer m.Unlock()
+
+	name := es.encryption.encryptPath(filename)
+	header, err := es.loadHeader("Read", name)
+	if err != nil {
+		return err
+	}
+
+	info, err := es.Store.FileInfo(name)
+	if err != nil {
+		return err
+	}
+
+	size := plainSize(info.Size())
+	end := startOffset + int64(len(res))
+	if end > size {
+		end = size
+	}
+
+	for pos := startOffset; pos < end; {
+		i := pos / encryptedChunkSize
+		chunkStart := i * encryptedChunkSize
+
+		data, err := es.readChunk(name, header, i, size)
+		if err != nil {
+			return err
+		}
+
+		n := copy(res[pos - startOffset:end - startOffset], data[pos - chunkStart:])
+		pos += int64(n)
+	}
+
+	if end < startOffset + int64(len(res)) {
+		// same as os.File.ReadAt
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (es *encryptedStore) Write(filename string, data []byte, startOffset int64) error {
+	return es.WriteIf(filename, data, startOffset, anyGeneration)
+}
+
+func (es *encryptedStore) ReadV(filename string, ranges []Range, parallelism int) error {
+	return readV(es, filename, ranges, parallelism)
+}
+
+func (es *encryptedStore) WriteV(filename string, extents []Extent) error {
+	return writeV(es, filename, extents)
+}
+
+func (es *encryptedStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	return es.mutate("Write", filename, ifGeneration, func(name string, header *encryptionHeader, size int64) error {
+		return es.writeRange(name, header, size, data, startOffset, int64(len(data)))
+	})
+}
+
+func (es *encryptedStore) Clear(filename string, startOffset int64, size int64) error {
+	return es.mutate("Clear", filename, anyGeneration, func(name string, header *encryptionHeader, fileSize int64) error {
+		return es.writeRange(name, header, fileSize, nil, startOffset, size)
+	})
+}
+
+func (es *encryptedStore) Truncate(filename string, size int64) error {
+	return es.mutate("Truncate", filename, anyGeneration, func(name string, header *encryptionHeader, fileSize int64) error {
+		if size >= fileSize {
+			// zeros are encrypted too
+			return es.writeRange(name, header, fileSize, nil, fileSize, size - fileSize)
+		}
+
+		// re-encrypt last chunk cut by size
+		if size % encryptedChunkSize != 0 {
+			i := size / encryptedChunkSize
+			data, err := es.readChunk(name, header, i, fileSize)
+			if err != nil {
+				return err
+			}
+
+			sealed, err := es.sealChunk(nil, header, i, data[:size - i * encryptedChunkSize])
+			if err != nil {
+				return err
+			}
+
+			if err := es.Store.Write(name, sealed, i * encryptedChunkStride); err != nil {
+				return err
+			}
+		}
+
+		return es.Store.Truncate(name, encryptedSize(size))
+	})
+}
+
+func (es *encryptedStore) CreateFile(filename string) error {
+	return es.create("CreateFile", filename, func(name string) error {
+		return es.Store.CreateFile(name)
+	})
+}
+
+func (es *encryptedStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	return es.create("CreateFileWithTTL", filename, func(name string) error {
+		return es.Store.CreateFileWithTTL(name, ttl)
+	})
+}
+
+// Mmap gives view of decrypted copy of file.
+func (es *encryptedStore) Mmap(filename string) (vfs.ReadOnlyMapping, error) {
+	return readMapping(es, filename)
+}
+
+// Preallocate reserves space of encrypted data of size bytes.
+func (es *encryptedStore) Preallocate(filename string, size int64) error {
+	filename, err := cleanFileName("Preallocate", filename)
+	if err != nil {
+		return err
+	}
+
+	m := es.lock(filename)
+	defer m.Unlock()
+
+	return es.Store.Preallocate(es.encryption.encryptPath(filename), encryptedSize(size))
+}
+
+func (es *encryptedStore) Sync(filename string) error {
+	filename, err := cleanFileName("Sync", filename)
+	if err != nil {
+		return err
+	}
+
+	return es.Store.Sync(es.encryption.encryptPath(filename))
+}
+
+func (es *encryptedStore) Mkdir(dirname string) error {
+	dirname = strings.Trim(dirname, "/")
+	if err := es.encryption.checkPath("Mkdir", dirname); err != nil {
+		return err
+	}
+	return es.Store.Mkdir(es.encryption.encryptPath(dirname))
+}
+
+func (es *encryptedStore) RemoveDir(dirname string, recursive bool) error {
+	return es.Store.RemoveDir(es.encryption.encryptPath(strings.Trim(dirname, "/")), recursive)
+}
+
+// ListDirs returns decrypted names of directories, others not created through this store are skipped.
+func (es *encryptedStore) ListDirs(dirname string) ([]string, error) {
+	dirs, err := es.Store.ListDirs(es.encryption.encryptPath(strings.Trim(dirname, "/")))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if name, err := es.encryption.decryptPath(dir); err == nil {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (es *encryptedStore) IsDirExist(dirname string) bool {
+	return es.Store.IsDirExist(es.encryption.encryptPath(strings.Trim(dirname, "/")))
+}
+
+func (es *encryptedStore) DirInfo(dirname string) (DirInfo, error) {
+	info, err := es.Store.DirInfo(es.encryption.encryptPath(strings.Trim(dirname, "/")))
+	if err != nil {
+		return nil, err
+	}
+	return &dirInfo{name: dirBase(dirname), files: info.Files(), dirs: info.Dirs(), modTime: info.ModTime()}, nil
+}
+
+func (es *encryptedStore) SetExpiry(filename string, expiry time.Time) error {
+	filename, err := cleanFileName("SetExpiry", filename)
+	if err != nil {
+		return err
+	}
+
+	m := es.lock(filename)
+	defer m.Unlock()
+
+	return es.Store.SetExpiry(es.encryption.encryptPath(filename), expiry)
+}
+
+func (es *encryptedStore) CreateIfNotExists(filename string) error {
+	return es.create("CreateIfNotExists", filename, func(name string) error {
+		return es.Store.CreateIfNotExists(name)
+	})
+}
+
+func (es *encryptedStore) RemoveFile(filename string) error {
+	return es.remove("RemoveFile", filename, func(name string) error {
+		return es.Store.RemoveFile(name)
+	})
+}
+
+func (es *encryptedStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	return es.remove("RemoveIfMatch", filename, func(name string) error {
+		return es.Store.RemoveIfMatch(name, ifGeneration)
+	})
+}
+
+func (es *encryptedStore) Watch(path string, recursive bool) (<-chan vfs.Event, func(), error) {
+	events, cancel, err := es.Store.Watch(es.encryption.encryptPath(path), recursive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// hide changes of headers, and of files not written through this store
+	return relayEvents(events, cancel, func(name string) (string, bool) {
+		if isHidden(name) {
+			return name, false
+		}
+
+		name, err := es.encryption.decryptPath(name)
+		return name, err == nil
+	})
+}
+
+// OpenSnapshot returns snapshot decrypting files, headers are cloned with files.
+func (es *encryptedStore) OpenSnapshot(name string) (Store, error) {
+	snapshot, err := es.Store.OpenSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedStore{Store: snapshot, encryption: es.encryption}, nil
+}
+
+func (es *encryptedStore) RotateKey(filename string) error {
+	filename, err := cleanFileName("RotateKey", filename)
+	if err != nil {
+		return err
+	}
+
+	m := es.lock(filename)
+	defer m.Unlock()
+
+	name := es.encryption.encryptPath(filename)
+	header, err := es.loadHeader("RotateKey", name)
+	if err != nil {
+		return err
+	}
+
+	return es.saveHeader(name, header)
+}
+
+func (es *encryptedStore) RotateKeys() error {
+	if es.encryption.names != nil && es.prefix == "" {
+		key, err := loadNamesKey(es.Store.SubStore(encryptedHeaderDir + "/" + encryptedNamesKey), es.encryption.keys)
+		if err != nil {
+			return err
+		}
+
+		if err := saveNamesKey(es.Store.SubStore(encryptedHeaderDir + "/" + encryptedNamesKey), es.encryption.keys, key); err != nil {
+			return err
+		}
+	}
+
+	for info := range es.FileIter() {
+		if err := es.RotateKey(info.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scrub verifies files by underlying names, which are given by scrub of underlying store.
+func (es *encryptedStore) scrub(r *scrubRun) error {
+	if es.encryption.names == nil {
+		return scrubStore(r, es.Store)
+	}
+
+	view := *r
+	view.s = &plainNames{es}
+	return scrubStore(&view, es.Store)
+}
+
+// removeExpired removes headers of expired files too, and gives their decrypted names.
+func (es *encryptedStore) removeExpired(fn func(name string) error) error {
+	return removeExpired(es.Store, func(name string) error {
+		plain, err := es.encryption.decryptPath(name)
+		if err != nil {
+			// not written through encrypted store
+			return nil
+		}
+
+		err = es.remove("RemoveExpired", plain, func(name string) error {
+			return expiredRemoval(es.Store, name)()
+		})
+		if err != nil && err != recreatedErr {
+			return err
+		}
+		return fn(plain)
+	})
+}
+
+// walkFiles gives decrypted names of files of underlying store.
+func (es *encryptedStore) walkFiles(fn func(name string) error) error {
+	return walkFiles(es.Store, func(name string) error {
+		plain, err := es.encryption.decryptPath(name)
+		if err != nil {
+			// not written through encrypted store
+			return nil
+		}
+		return fn(plain)
+	})
+}
+
+func (es *encryptedStore) lock(filename string) *sync.Mutex {
+	return es.encryption.locks.lock(es.prefix + filename)
+}
+
+func (es *encryptedStore) create(op string, filename string, create func(name string) error) error {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return err
+	}
+
+	if err := es.encryption.checkPath(op, filename); err != nil {
+		return err
+	}
+
+	m := es.lock(filename)
+	defer m.Unlock()
+
+	name := es.encryption.encryptPath(filename)
+	if err := create(name); err != nil {
+		return err
+	}
+
+	header := &encryptionHeader{fileID: make([]byte, fileIDSize), dataKey: make([]byte, dataKeySize)}
+	if _, err := rand.Read(header.fileID); err != nil {
+		return err
+	}
+
+	if _, err := rand.Read(header.dataKey); err != nil {
+		return err
+	}
+
+	return es.saveHeader(name, header)
+}
+
+func (es *encryptedStore) remove(op string, filename string, remove func(name string) error) error {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := es.lock(filename)
+	defer m.Unlock()
+
+	name := es.encryption.encryptPath(filename)
+	if err := remove(name); err != nil {
+		return err
+	}
+
+	dir, base := es.headerStore(name)
+	if !dir.IsFileExist(base) {
+		return nil
+	}
+	return dir.RemoveFile(base)
+}
+
+// mutate applies mutation to file holding lock of it.
+// mutation is given underlying name, header and plain size of file.
+// header wrapped by old master key is re-wrapped by current one.
+func (es *encryptedStore) mutate(op string, filename string, ifGeneration uint64,
+	mutation func(name string, header *encryptionHeader, size int64) error) error {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := es.lock(filename)
+	defer m.Unlock()
+
+	name := es.encryption.encryptPath(filename)
+	info, err := es.Store.FileInfo(name)
+	if err != nil {
+		return &os.PathError{Op: op, Path: filename, Err: err}
+	}
+
+	if ifGeneration != anyGeneration && info.Generation() != ifGeneration {
+		return &PreconditionFailedError{Op: op, Path: filename, Expected: ifGeneration, Actual: info.Generation()}
+	}
+
+	header, err := es.loadHeader(op, name)
+	if err != nil {
+		return err
+	}
+
+	if id, _, err := es.encryption.keys.CurrentKey(); err == nil && id != header.keyID {
+		if err := es.saveHeader(name, header); err != nil {
+			return err
+		}
+	}
+
+	return mutation(name, header, plainSize(info.Size()))
+}
+
+// writeRange writes data into range of length at off, or zeros if data is nil.
+// gap between end of file and off is filled with zeros.
+// chunks are sealed and written by batches, so long ranges are not held in memory at once.
+func (es *encryptedStore) writeRange(name string, header *encryptionHeader, size int64, data []byte, off int64, length int64) error {
+	end := off + length
+	newSize := size
+	if end > newSize {
+		newSize = end
+	}
+
+	start := off
+	if start > size {
+		start = size
+	}
+
+	// first chunk of batch sealed in buf
+	first := start / encryptedChunkSize
+	buf := make([]byte, 0, encryptedBatchChunks * encryptedChunkStride)
+	chunk := make([]byte, encryptedChunkSize)
+
+	for i := first; i * encryptedChunkSize < end; i++ {
+		chunkStart := i * encryptedChunkSize
+		chunkLen := newSize - chunkStart
+		if chunkLen > encryptedChunkSize {
+			chunkLen = encryptedChunkSize
+		}
+
+		chunk := chunk[:chunkLen]
+		n := 0
+		if chunkStart < size {
+			old, err := es.readChunk(name, header, i, size)
+			if err != nil {
+				return err
+			}
+			n = copy(chunk, old)
+		}
+		for j := n; j < len(chunk); j++ {
+			chunk[j] = 0
+		}
+
+		// range of data in this chunk
+		from, to := off, chunkStart + chunkLen
+		if from < chunkStart {
+			from = chunkStart
+		}
+		if to > end {
+			to = end
+		}
+
+		if data != nil {
+			copy(chunk[from - chunkStart:to - chunkStart], data[from - off:])
+		} else {
+			for j := from; j < to; j++ {
+				chunk[j - chunkStart] = 0
+			}
+		}
+
+		var err error
+		if buf, err = es.sealChunk(buf, header, i, chunk); err != nil {
+			return err
+		}
+
+		if i + 1 - first == encryptedBatchChunks || (i + 1) * encryptedChunkSize >= end {
+			if err := es.Store.Write(name, buf, first * encryptedChunkStride); err != nil {
+				return err
+			}
+			first, buf = i + 1, buf[:0]
+		}
+	}
+
+	return nil
+}
+
+// readChunk returns decrypted chunk i of file of plain size.
+func (es *encryptedStore) readChunk(name string, header *encryptionHeader, i int64, size int64) ([]byte, error) {
+	n := size - i * encryptedChunkSize
+	if n > encryptedChunkSize {
+		n = encryptedChunkSize
+	}
+
+	raw := make([]byte, encryptedNonceSize + n + encryptedTagSize)
+	if err := es.Store.Read(name, raw, i * encryptedChunkStride); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(header.dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := aead.Open(nil, raw[:encryptedNonceSize], raw[encryptedNonceSize:], chunkAAD(header, i))
+	if err != nil {
+		// tampered or rotten
+		return nil, &CorruptionError{Path: name, Block: i}
+	}
+
+	return data, nil
+}
+
+// sealChunk appends data of chunk i encrypted with random nonce to dst.
+func (es *encryptedStore) sealChunk(dst []byte, header *encryptionHeader, i int64, data []byte) ([]byte, error) {
+	aead, err := newAEAD(header.dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, encryptedNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(append(dst, nonce...), nonce, data, chunkAAD(header, i)), nil
+}
+
+// headerStore returns store and name of header of underlying name.
+func (es *encryptedStore) headerStore(name string) (Store, string) {
+	i := strings.LastIndex(name, "/")
+	return es.Store.SubStore(name[:i + 1] + encryptedHeaderDir), name[i + 1:]
+}
+
+func (es *encryptedStore) loadHeader(op string, name string) (*encryptionHeader, error) {
+	dir, base := es.headerStore(name)
+	if !dir.IsFileExist(base) {
+		return nil, &os.PathError{Op: op, Path: name, Err: notEncryptedErr}
+	}
+
+	return readEncryptionHeader(dir, base, es.encryption.keys)
+}
+
+// saveHeader wraps data key by current master key and writes header.
+func (es *encryptedStore) saveHeader(name string, header *encryptionHeader) error {
+	dir, base := es.headerStore(name)
+	return writeEncryptionHeader(dir, base, es.encryption.keys, header)
+}
+
+func (p *plainNames) FileInfo(filename string) (FileInfo, error) {
+	name, err := p.encryption.decryptPath(filename)
+	if err != nil {
+		return nil, &os.PathError{Op: "FileInfo", Path: filename, Err: err}
+	}
+	return p.encryptedStore.FileInfo(name)
+}
+
+func (p *plainNames) Read(filename string, res []byte, startOffset int64) error {
+	name, err := p.encryption.decryptPath(filename)
+	if err != nil {
+		return &os.PathError{Op: "Read", Path: filename, Err: err}
+	}
+	return p.encryptedStore.Read(name, res, startOffset)
+}
+
+// encryptPath encrypts each segment of path, if names are encrypted.
+// same name is always encrypted into same name, so files are found by encrypted names.
+func (e *encryption) encryptPath(path string) string {
+	if e.names == nil || path == "" {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "" || isHidden(segment) {
+			continue
+		}
+
+		mac := hmac.New(sha256.New, e.namesMac)
+		mac.Write([]byte(segment))
+		nonce := mac.Sum(nil)[:encryptedNonceSize]
+
+		segments[i] = nameEncoding.EncodeToString(e.names.Seal(nonce, nonce, []byte(segment), nil))
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// checkPath checks segments of path are not too long to be encrypted, if names are encrypted.
+func (e *encryption) checkPath(op string, path string) error {
+	if e.names == nil {
+		return nil
+	}
+
+	for _, segment := range strings.Split(path, "/") {
+		if len(segment) > maxEncryptedNameLength && !isHidden(segment) {
+			return &os.PathError{Op: op, Path: path, Err: encryptedNameTooLongErr}
+		}
+	}
+	return nil
+}
+
+func (e *encryption) decryptPath(path string) (string, error) {
+	if e.names == nil || path == "" {
+		return path, nil
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "" || isHidden(segment) {
+			continue
+		}
+
+		data, err := nameEncoding.DecodeString(segment)
+		if err != nil || len(data) < encryptedNonceSize {
+			return "", illegalEncryptedNameErr
+		}
+
+		name, err := e.names.Open(nil, data[:encryptedNonceSize], data[encryptedNonceSize:], nil)
+		if err != nil {
+			return "", illegalEncryptedNameErr
+		}
+
+		segments[i] = string(name)
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+// loadNamesKey returns key of names kept in dir, creating it if not existed.
+func loadNamesKey(dir Store, keys KeyProvider) ([]byte, error) {
+	if dir.IsFileExist(encryptedNamesKeyFile) {
+		header, err := readEncryptionHeader(dir, encryptedNamesKeyFile, keys)
+		if err != nil {
+			return nil, err
+		}
+		return header.dataKey, nil
+	}
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, saveNamesKey(dir, keys, key)
+}
+
+func saveNamesKey(dir Store, keys KeyProvider, key []byte) error {
+	return writeEncryptionHeader(dir, encryptedNamesKeyFile, keys, &encryptionHeader{fileID: make([]byte, fileIDSize), dataKey: key})
+}
+
+func readEncryptionHeader(dir Store, name string, keys KeyProvider) (*encryptionHeader, error) {
+	info, err := dir.FileInfo(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, info.Size())
+	if err := dir.Read(name, data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(data) < 2 || data[0] != encryptedHeaderVersion ||
+		len(data) != 2 + int(data[1]) + fileIDSize + encryptedNonceSize + dataKeySize + encryptedTagSize {
+		return nil, &os.PathError{Op: "readEncryptionHeader", Path: name, Err: corruptedHeaderErr}
+	}
+
+	header := &encryptionHeader{keyID: string(data[2:2 + data[1]])}
+	data = data[2 + data[1]:]
+	header.fileID = data[:fileIDSize]
+	data = data[fileIDSize:]
+
+	master, err := keys.Key(header.keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+
+	// file id is authenticated with data key, so header is not swapped with other file
+	if header.dataKey, err = aead.Open(nil, data[:encryptedNonceSize], data[encryptedNonceSize:], header.fileID); err != nil {
+		return nil, &os.PathError{Op: "readEncryptionHeader", Path: name, Err: corruptedHeaderErr}
+	}
+
+	return header, nil
+}
+
+// writeEncryptionHeader wraps data key of header by current master key, and replaces header by it.
+func writeEncryptionHeader(dir Store, name string, keys KeyProvider, header *encryptionHeader) error {
+	id, master, err := keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+
+	aead, err := newAEAD(master)
+	if err != nil {
+		return err
+	}
+
+	data := []byte{encryptedHeaderVersion, byte(len(id))}
+	data = append(data, id...)
+	data = append(data, header.fileID...)
+
+	nonce := make([]byte, encryptedNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data = append(data, nonce...)
+	data = aead.Seal(data, nonce, header.dataKey, header.fileID)
+
+	// replaced atomically, not to lose data key when interrupted
+	if err := replaceFile(dir, name, data); err != nil {
+		return err
+	}
+
+	header.keyID = id
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkAAD binds chunk to its file and position, so chunks are not swapped.
+func chunkAAD(header *encryptionHeader, i int64) []byte {
+	aad := make([]byte, fileIDSize + 8)
+	copy(aad, header.fileID)
+	binary.LittleEndian.PutUint64(aad[fileIDSize:], uint64(i))
+	return aad
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// plainSize returns size of plain data of encrypted file of size.
+func plainSize(size int64) int64 {
+	chunks := size / encryptedChunkStride
+	plain := chunks * encryptedChunkSize
+
+	if rest := size % encryptedChunkStride; rest > encryptedNonceSize + encryptedTagSize {
+		plain += rest - encryptedNonceSize - encryptedTagSize
+	}
+
+	return plain
+}
+
+// encryptedSize returns size of encrypted file of plain size.
+func encryptedSize(size int64) int64 {
+	chunks := size / encryptedChunkSize
+	encrypted := chunks * encryptedChunkStride
+
+	if rest := size % encryptedChunkSize; rest > 0 {
+		encrypted += encryptedNonceSize + rest + encryptedTagSize
+	}
+
+	return encrypted
+}
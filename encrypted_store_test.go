@@ -0,0 +1,222 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeys() *StaticKeys {
+	return &StaticKeys{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 32),
+		},
+	}
+}
+
+func TestEncrypted_ReadWrite(t *testing.T) {
+	for _, s := range testStores(t, "TestEncrypted_ReadWrite") {
+		es, err := Encrypted(s, testKeys(), EncryptionOptions{})
+		assert.Nil(t, err)
+
+		filename := "file"
+		data := bytes.Repeat([]byte("secret"), encryptedChunkSize)
+
+		assert.Nil(t, es.CreateFile(filename))
+		assert.Nil(t, es.Write(filename, data, 0))
+
+		// not plaintext in underlying store
+		raw := make([]byte, 64)
+		s.Read(filename, raw, 0)
+		assert.False(t, strings.Contains(string(raw), "secret"))
+
+		info, err := es.FileInfo(filename)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)), info.Size())
+
+		// random access across chunks
+		res := make([]byte, 12)
+		assert.Nil(t, es.Read(filename, res, encryptedChunkSize - 4))
+		assert.Equal(t, data[encryptedChunkSize - 4:encryptedChunkSize + 8], res)
+
+		assert.Nil(t, es.Write(filename, []byte("xxxx"), encryptedChunkSize - 2))
+		assert.Nil(t, es.Read(filename, res[:6], encryptedChunkSize - 3))
+		assert.Equal(t, string(data[encryptedChunkSize - 3]) + "xxxx" + string(data[encryptedChunkSize + 2]), string(res[:6]))
+
+		// write after end fills zeros
+		end := int64(len(data))
+		assert.Nil(t, es.Write(filename, []byte("end"), end + 5))
+		assert.Nil(t, es.Read(filename, res[:8], end))
+		assert.Equal(t, "\x00\x00\x00\x00\x00end", string(res[:8]))
+		assert.Equal(t, io.EOF, es.Read(filename, res, end + 1))
+
+		assert.Nil(t, es.Clear(filename, 1, 2))
+		assert.Nil(t, es.Read(filename, res[:4], 0))
+		assert.Equal(t, "s\x00\x00r", string(res[:4]))
+
+		assert.Nil(t, es.Truncate(filename, 5))
+		assert.Nil(t, es.Truncate(filename, encryptedChunkSize + 1))
+		res = make([]byte, encryptedChunkSize + 1)
+		assert.Nil(t, es.Read(filename, res, 0))
+		assert.Equal(t, append([]byte("s\x00\x00re"), make([]byte, encryptedChunkSize - 4)...), res)
+
+		// grown by batches of chunks
+		size := int64(3 * encryptedBatchChunks * encryptedChunkSize + 7)
+		assert.Nil(t, es.Truncate(filename, size))
+		raw = make([]byte, 8)
+		assert.Nil(t, es.Read(filename, raw, size - 8))
+		assert.Equal(t, make([]byte, 8), raw)
+		rawInfo, _ := s.FileInfo(filename)
+		assert.Equal(t, encryptedSize(size), rawInfo.Size())
+		assert.Nil(t, es.Truncate(filename, encryptedChunkSize + 1))
+
+		// tampered chunk
+		s.Write(filename, []byte{0xff}, encryptedNonceSize + 1)
+		assert.True(t, IsCorrupted(es.Read(filename, res[:1], 0)))
+
+		// untouched chunk is still readable
+		assert.Nil(t, es.Read(filename, res[:1], encryptedChunkSize))
+
+		assert.Nil(t, es.RemoveFile(filename))
+		assert.False(t, es.IsFileExist(filename))
+	}
+}
+
+func TestEncrypted_RotateKey(t *testing.T) {
+	for _, s := range testStores(t, "TestEncrypted_RotateKey") {
+		keys := testKeys()
+		es, _ := Encrypted(s, keys, EncryptionOptions{EncryptNames: true})
+
+		es.CreateFile("file")
+		es.Write("file", []byte("test"), 0)
+
+		keys.Current = "k2"
+		assert.Nil(t, es.RotateKeys())
+
+		// old master key is not needed anymore
+		delete(keys.Keys, "k1")
+
+		res := make([]byte, 4)
+		assert.Nil(t, es.Read("file", res, 0))
+		assert.Equal(t, "test", string(res))
+
+		es, err := Encrypted(s, keys, EncryptionOptions{EncryptNames: true})
+		assert.Nil(t, err)
+		assert.Nil(t, es.Read("file", res, 0))
+		assert.Equal(t, "test", string(res))
+
+		// unknown master key
+		_, err = Encrypted(s, &StaticKeys{Current: "k3", Keys: map[string][]byte{"k3": make([]byte, 32)}}, EncryptionOptions{EncryptNames: true})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestEncrypted_Names(t *testing.T) {
+	for _, s := range testStores(t, "TestEncrypted_Names") {
+		es, _ := Encrypted(s, testKeys(), EncryptionOptions{EncryptNames: true})
+
+		sub := es.SubStore("customers")
+		assert.Nil(t, sub.CreateFile("alice"))
+		sub.Write("alice", []byte("test"), 0)
+
+		assert.True(t, es.IsFileExist("customers/alice"))
+		assert.False(t, s.IsFileExist("customers/alice"))
+
+		// names are not exposed in underlying store
+		cnt := 0
+		for info := range s.FileIter() {
+			assert.False(t, strings.Contains(info.Name(), "alice"))
+			cnt++
+		}
+
+		names := make([]string, 0)
+		for info := range sub.FileIter() {
+			names = append(names, info.Name())
+			assert.Equal(t, int64(4), info.Size())
+		}
+		assert.Equal(t, []string{"alice"}, names)
+
+		res := make([]byte, 4)
+		assert.Nil(t, es.Read("customers/alice", res, 0))
+		assert.Equal(t, "test", string(res))
+
+		// encrypted names are within limit of file systems
+		long := strings.Repeat("n", maxEncryptedNameLength)
+		assert.Nil(t, sub.CreateFile(long))
+		assert.True(t, len(es.(*encryptedStore).encryption.encryptPath(long)) <= 255)
+		assert.NotNil(t, sub.CreateFile(long + "n"))
+		assert.NotNil(t, es.Mkdir("dir/" + long + "n"))
+		assert.Nil(t, sub.RemoveFile(long))
+
+		report, err := Scrub(context.Background(), es, ScrubOptions{})
+		assert.Nil(t, err)
+		assert.True(t, report.Healthy())
+		assert.Equal(t, 1, report.Files)
+	}
+}
+
+func TestEncrypted_Aliases(t *testing.T) {
+	for _, s := range testStores(t, "TestEncrypted_Aliases") {
+		es, _ := Encrypted(s, testKeys(), EncryptionOptions{EncryptNames: true})
+
+		// aliases are encrypted into name of canonical one
+		assert.Nil(t, es.CreateFile("./file"))
+		assert.Nil(t, es.Write("/file", []byte("test"), 0))
+		assert.Nil(t, es.SubStore("./sub/").CreateFile("file"))
+		assert.Nil(t, es.Write("sub//file", []byte("sub"), 0))
+
+		res := make([]byte, 4)
+		assert.Nil(t, es.Read("file", res, 0))
+		assert.Equal(t, "test", string(res))
+		assert.Nil(t, es.Read("sub/file", res[:3], 0))
+		assert.Equal(t, "sub", string(res[:3]))
+
+		info, err := es.FileInfo("file/")
+		assert.Nil(t, err)
+		assert.Equal(t, "file", info.Name())
+		assert.NotNil(t, es.CreateFile("../file"))
+
+		names := make([]string, 0)
+		for info := range es.FileIter() {
+			names = append(names, info.Name())
+		}
+		assert.Equal(t, []string{"file"}, names)
+	}
+}
+
+func TestEncrypted_Dirs(t *testing.T) {
+	for _, s := range testStores(t, "TestEncrypted_Dirs") {
+		es, _ := Encrypted(s, testKeys(), EncryptionOptions{EncryptNames: true})
+
+		assert.Nil(t, es.Mkdir("customers/bob"))
+		assert.True(t, es.IsDirExist("customers/bob"))
+		assert.False(t, s.IsDirExist("customers"))
+
+		dirs, err := es.ListDirs("customers")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"bob"}, dirs)
+
+		info, err := es.DirInfo("customers/bob")
+		assert.Nil(t, err)
+		assert.Equal(t, "bob", info.Name())
+
+		assert.Nil(t, es.RemoveDir("customers", true))
+		assert.False(t, es.IsDirExist("customers"))
+	}
+}
+
+func TestEncrypted_NotEncrypted(t *testing.T) {
+	for _, s := range testStores(t, "TestEncrypted_NotEncrypted") {
+		s.CreateFile("plain")
+		s.Write("plain", []byte("test"), 0)
+
+		es, _ := Encrypted(s, testKeys(), EncryptionOptions{})
+		assert.NotNil(t, es.Read("plain", make([]byte, 4), 0))
+		assert.NotNil(t, es.Write("plain", []byte("test"), 0))
+	}
+}
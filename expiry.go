@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	notExpirableErr = errors.New("store can not remove expired files")
+	// stops clean up of expired file, which is created again after removed
+	recreatedErr    = errors.New("expired file created again")
+)
+
+// expirer is implemented by stores removing their expired files,
+// including files of sub stores and internal data, like snapshots.
+// wrapping stores clean up their data of removed files, before passing them to fn.
+type expirer interface {
+	removeExpired(fn func(name string) error) error
+}
+
+// removeExpired removes expired files of s, and calls fn with name of each, until fn returns error.
+func removeExpired(s Store, fn func(name string) error) error {
+	if e, ok := s.(expirer); ok {
+		return e.removeExpired(fn)
+	}
+	return notExpirableErr
+}
+
+// RemoveExpired removes expired files of s and its sub stores, and returns their names.
+func RemoveExpired(s Store) ([]string, error) {
+	removed := make([]string, 0)
+
+	err := removeExpired(s, func(name string) error {
+		if !isHidden(name) {
+			removed = append(removed, name)
+		}
+		return nil
+	})
+
+	return removed, err
+}
+
+// StartReaper runs RemoveExpired every interval in background, until returned stop function is called.
+// done is called with result of each run.
+func StartReaper(s Store, interval time.Duration, done func(removed []string, err error)) func() {
+	return runEvery(interval, func(ctx context.Context) {
+		removed, err := RemoveExpired(s)
+		if ctx.Err() == nil && done != nil {
+			done(removed, err)
+		}
+	})
+}
+
+// expiredRemoval returns removal of file name of s, which is already removed as expired,
+// so wrapping store cleans up its data of file by its own remove.
+// removal fails with recreatedErr if file exists again, not to clean up data of new file.
+func expiredRemoval(s Store, name string) func() error {
+	return func() error {
+		if s.IsFileExist(name) {
+			return recreatedErr
+		}
+		return nil
+	}
+}
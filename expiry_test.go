@@ -0,0 +1,91 @@
+package store
+
+import (
+	"sort"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+func TestStore_Expiry(t *testing.T) {
+	for _, s := range testStores(t, "TestStore_Expiry") {
+		assert.Nil(t, s.CreateFileWithTTL("ttl", time.Hour))
+		assert.Nil(t, s.CreateFile("file"))
+		assert.Nil(t, s.SubStore("sub").CreateFile("file"))
+		assert.Nil(t, s.Write("file", []byte("test"), 0))
+
+		assert.Nil(t, s.SetExpiry("file", time.Now().Add(-time.Second)))
+		assert.Nil(t, s.SetExpiry("sub/file", time.Now().Add(-time.Second)))
+		assert.NotNil(t, s.SetExpiry("none", time.Now()))
+
+		// expired files are absent before removed
+		assert.True(t, s.IsFileExist("ttl"))
+		assert.False(t, s.IsFileExist("file"))
+		_, err := s.FileInfo("file")
+		assert.NotNil(t, err)
+		assert.NotNil(t, s.Read("file", make([]byte, 4), 0))
+
+		// created again without expiry
+		assert.Nil(t, s.CreateIfNotExists("file"))
+		assert.True(t, s.IsFileExist("file"))
+
+		removed, err := RemoveExpired(s)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"sub/file"}, removed)
+
+		// clearing expiry
+		assert.Nil(t, s.SetExpiry("ttl", time.Time{}))
+		assert.Nil(t, s.SetExpiry("ttl", time.Now().Add(-time.Second)))
+		assert.False(t, s.IsFileExist("ttl"))
+	}
+}
+
+func TestStore_ExpiryClock(t *testing.T) {
+	clock := vfs.NewFakeClock(time.Now())
+	ms, err := NewMemoryStoreWithOptions("/TestStore_ExpiryClock", vfs.MemoryOptions{Clock: clock})
+	assert.Nil(t, err)
+	fs := NewFileSystemStoreWithOptions(path, FileSystemOptions{Clock: clock}).SubStore("TestStore_ExpiryClock")
+
+	for _, s := range []Store{ms, fs} {
+		clock.Set(time.Now())
+		assert.Nil(t, s.CreateFileWithTTL("a", time.Minute))
+		assert.Nil(t, s.CreateFileWithTTL("b", 2 * time.Minute))
+
+		clock.Advance(time.Minute)
+		assert.False(t, s.IsFileExist("a"))
+		assert.True(t, s.IsFileExist("b"))
+		assert.NotNil(t, s.Read("a", make([]byte, 0), 0))
+
+		clock.Advance(time.Minute)
+		removed, err := RemoveExpired(s)
+		assert.Nil(t, err)
+		sort.Strings(removed)
+		assert.Equal(t, []string{"a", "b"}, removed)
+	}
+}
+
+func TestStartReaper(t *testing.T) {
+	s, _ := NewMemoryStore("/TestStartReaper")
+	js, err := NewJournaledStore(s)
+	assert.Nil(t, err)
+
+	assert.Nil(t, js.CreateFileWithTTL("file", time.Millisecond))
+
+	results := make(chan []string, 1)
+	stop := StartReaper(js, 5 * time.Millisecond, func(removed []string, err error) {
+		assert.Nil(t, err)
+		if len(removed) > 0 {
+			results <- removed
+		}
+	})
+
+	assert.Equal(t, []string{"file"}, <-results)
+	stop()
+
+	// removal is recorded
+	changes := collectChanges(t, js, 0)
+	assert.Equal(t, 2, len(changes))
+	assert.Equal(t, ChangeRemove, changes[1].Op)
+	assert.Equal(t, "file", changes[1].Name)
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package store
+
+import (
+	"os"
+	"syscall"
+)
+
+// modes of fallocate, from linux/falloc.h
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+)
+
+// punchHole releases size bytes of f at off, which are read as zeros after.
+// zeros are written if file system does not support punching holes.
+func punchHole(f *os.File, off int64, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole | fallocKeepSize, off, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return writeZeros(f, off, size)
+	}
+	return err
+}
+
+// preallocate reserves space of f for size bytes, without changing its size.
+// nothing is reserved if file system does not support it.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
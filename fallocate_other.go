@@ -0,0 +1,15 @@
+//go:build !linux
+
+package store
+
+import "os"
+
+// holes can not be punched on this platform, zeros are written.
+func punchHole(f *os.File, off int64, size int64) error {
+	return writeZeros(f, off, size)
+}
+
+// space can not be reserved on this platform.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,48 @@
+package store
+
+/**
+ fileChange is range of file written by a mutation.
+ data is nil if range was cleared.
+ */
+type fileChange struct {
+	offset int64
+	length int64
+	data   []byte
+}
+
+// applyChanges turns res, holding content at off of file of size, into content after changes resizing file to newSize.
+// bytes out of changes are kept up to smaller of both sizes, and are zeros after.
+func applyChanges(res []byte, off int64, size int64, newSize int64, changes []fileChange) {
+	if keep := minInt64(size, newSize) - off; keep < int64(len(res)) {
+		zeroBytes(res[maxInt64(keep, 0):])
+	}
+
+	end := off + int64(len(res))
+	for _, change := range changes {
+		lo, hi := maxInt64(change.offset, off), minInt64(change.offset + change.length, end)
+		if lo >= hi {
+			continue
+		}
+
+		if change.data == nil {
+			zeroBytes(res[lo - off:hi - off])
+		} else {
+			copy(res[lo - off:hi - off], change.data[lo - change.offset:])
+		}
+	}
+}
+
+// extentChanges returns changes of writing extents.
+func extentChanges(extents []Extent) []fileChange {
+	changes := make([]fileChange, len(extents))
+	for i, extent := range extents {
+		changes[i] = fileChange{offset: extent.Offset, length: int64(len(extent.Data)), data: extent.Data}
+	}
+	return changes
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,18 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+const (
+	// metadata of files are kept in this sibling directory of files, by vfs.FileMeta.
+	metaDir = vfs.MetaDir
+
+	// prefix of temporary files of atomic writes by vfs.WriteFileAtomic.
+	// left only if write is interrupted.
+	tmpPrefix = vfs.TempPrefix
+)
+
+var orphanedFileMetaErr = errors.New("metadata of missing file")
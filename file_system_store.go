@@ -3,25 +3,90 @@ package store
 import (
 	"os"
 	"io/ioutil"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
 )
 
 type fileSystemStore struct {
 	path string
+	// names are resolved beneath root by ResolveBeneath, "" if not
+	root string
+	// shared with sub stores
+	handles *handlePool
+	syncer  *syncer
+	// gives time of expiry, system clock if nil
+	clock vfs.Clock
+}
+
+/**
+ FileSystemOptions of file system store.
+ MaxOpenFiles limits handles of files kept open between operations,
+ defaultMaxOpenFiles if zero, and handles are not kept if negative.
+ Durability decides when changes are committed to stable storage, DurabilityNone by default.
+ GroupCommitInterval is interval of DurabilityGroupCommit, defaultGroupCommitInterval if zero.
+ ResolveBeneath resolves names beneath directory of store, so symbolic links in it do not lead out of it.
+ files are opened by openat2 with RESOLVE_BENEATH on Linux, and links are checked before used elsewhere.
+ Clock gives time of files, like their expiry, system clock if nil.
+ */
+type FileSystemOptions struct {
+	MaxOpenFiles        int
+	Durability          Durability
+	GroupCommitInterval time.Duration
+	ResolveBeneath      bool
+	Clock               vfs.Clock
 }
 
+// size of zeros written at once, where holes can not be punched
+const zeroChunkSize = 64 * 1024
+
+// serializes mutations of same file in process,
+// mutations across processes are serialized by lockFile.
+var fileLocks stripedLock
+
 func NewFileSystemStore(path string) Store {
+	return NewFileSystemStoreWithOptions(path, FileSystemOptions{})
+}
+
+// NewFileSystemStoreWithOptions returns file system store keeping handles of files open by options,
+// until closed by Close.
+func NewFileSystemStoreWithOptions(path string, options FileSystemOptions) Store {
+	if !strings.HasSuffix(path, "/") {
+		path = path + "/"
+	}
+
+	var root string
+	if options.ResolveBeneath {
+		root = path
+	}
+
+	handles := newHandlePool(options.MaxOpenFiles, root)
+	return newFileSystemStore(path, root, handles, newSyncer(options.Durability, options.GroupCommitInterval, handles), options.Clock)
+}
+
+func newFileSystemStore(path string, root string, handles *handlePool, syncer *syncer, clock vfs.Clock) *fileSystemStore {
 	// check directory exists
 	// if not, create
 	if !strings.HasSuffix(path, "/") {
 		path = path + "/"
 	}
 
+	fs := &fileSystemStore{path: path, root: root, handles: handles, syncer: syncer, clock: clock}
+
+	// directory is not created out of root, through links
+	if fs.checkBeneath("SubStore", "") != nil {
+		return fs
+	}
+
 	if !isDirectoryExist(path) {
 		os.MkdirAll(path, os.ModePerm)
+		if syncer.durability != DurabilityNone {
+			vfs.SyncDir(filepath.Dir(filepath.Clean(path)))
+		}
 	}
 
-	fs := &fileSystemStore{path: path}
 	return fs
 }
 
@@ -29,15 +94,57 @@ func RemoveFileSystemStore(path string) {
 	os.RemoveAll(path)
 }
 
+// SubStore returns store of directory subpath, resolved like chroot does,
+// so ".." or absolute paths do not lead out of this store.
 func (fs *fileSystemStore) SubStore(subpath string) Store {
-	if strings.HasPrefix(subpath, "/") {
-		subpath = subpath[1:]
+	return newFileSystemStore(fs.path + cleanSubPath(subpath), fs.root, fs.handles, fs.syncer, fs.clock)
+}
+
+// Close commits changes by durability, and closes handles of files kept open by this store and its sub stores.
+// later operations open files again, without keeping them.
+func (fs *fileSystemStore) Close() error {
+	var err error
+	if fs.syncer.durability != DurabilityNone {
+		err = fs.syncer.syncAll("")
+	}
+
+	if closeErr := fs.handles.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Sync commits data and metadata of file, and entries of its directory, to stable storage.
+func (fs *fileSystemStore) Sync(filename string) error {
+	filename, err := fs.resolve("Sync", filename)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.openFile(filename)
+	if err != nil {
+		return &os.PathError{Op: "Sync", Path: fs.path + filename, Err: err}
+	}
+	f.Close()
+
+	files, dirs := changes(fs.path + filename, true)
+	if err := fs.syncer.sync(files, dirs); err != nil {
+		return &os.PathError{Op: "Sync", Path: fs.path + filename, Err: err}
 	}
-	return NewFileSystemStore(fs.path + subpath)
+	return nil
+}
+
+// SyncAll commits files of this store and its sub stores changed since synced.
+func (fs *fileSystemStore) SyncAll() error {
+	return fs.syncer.syncAll(fs.path)
 }
 
 func (fs *fileSystemStore) IsFileExist(filename string)	bool {
-	return isFileExist(fs.path + filename)
+	filename, err := fs.resolve("IsFileExist", filename)
+	if err != nil {
+		return false
+	}
+	return isFileExist(fs.path + filename) && !fs.isExpired(filename)
 }
 
 func (fs *fileSystemStore) FileIter() <-chan FileInfo {
@@ -51,9 +158,17 @@ func (fs *fileSystemStore) FileIter() <-chan FileInfo {
 		go func(files []os.FileInfo) {
 			for _, elem := range files {
 
+				if isHidden(elem.Name()) || elem.Name() == mountInfoFile {
+					// internal data and temporary files of atomic writes are not iterated
+					continue
+				}
+
 				if !elem.(os.FileInfo).IsDir() {
 					// iterate files, only
-					ch <- &fileInfo{elem.Name(), elem.Size()}
+					meta, _ := vfs.ReadFileMeta(fs.path + elem.Name())
+					if !meta.Expired(fs.now()) {
+						ch <- &fileInfo{elem.Name(), elem.Size(), meta.Generation}
+					}
 				}
 			}
 
@@ -65,64 +180,990 @@ func (fs *fileSystemStore) FileIter() <-chan FileInfo {
 }
 
 func (fs *fileSystemStore) FileInfo(filename string) (FileInfo, error) {
+	filename, err := fs.resolve("FileInfo", filename)
+	if err != nil {
+		return nil, err
+	}
+
 	info, err := os.Stat(fs.path + filename)
-	return info, err
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := vfs.ReadFileMeta(fs.path + filename)
+	if err != nil {
+		return nil, err
+	} else if meta.Expired(fs.now()) {
+		return nil, &os.PathError{Op: "FileInfo", Path: fs.path + filename, Err: os.ErrNotExist}
+	}
+
+	return &fileInfo{info.Name(), info.Size(), meta.Generation}, nil
+}
+
+func (fs *fileSystemStore) Mkdir(dirname string) error {
+	dirname, err := checkDirName("Mkdir", dirname, false)
+	if err != nil {
+		return err
+	} else if err := fs.checkBeneath("Mkdir", dirname); err != nil {
+		return err
+	}
+
+	path := fs.path + dirname
+	if _, err := os.Stat(path); err == nil {
+		return &os.PathError{Op: "Mkdir", Path: path, Err: os.ErrExist}
+	}
+
+	err = checkParents("Mkdir", dirname, func(name string) bool {
+		info, err := os.Stat(fs.path + name)
+		return err == nil && !info.IsDir()
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return err
+	}
+
+	dirs := []string{filepath.Dir(path)}
+	fs.syncer.changed(nil, dirs)
+	return fs.syncer.commit(nil, dirs)
+}
+
+func (fs *fileSystemStore) RemoveDir(dirname string, recursive bool) error {
+	dirname, err := checkDirName("RemoveDir", dirname, false)
+	if err != nil {
+		return err
+	}
+
+	path := fs.path + dirname
+	if _, err := fs.statDir("RemoveDir", dirname); err != nil {
+		return err
+	}
+
+	if !recursive {
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		// internal data, like metadata of files, is removed with directory
+		for _, info := range infos {
+			if !isHidden(info.Name()) && (info.IsDir() || !fs.isExpired(dirname + "/" + info.Name())) {
+				return &os.PathError{Op: "RemoveDir", Path: path, Err: directoryNotEmptyErr}
+			}
+		}
+	}
+
+	// snapshot does not see directory removed partly
+	m := fileLocks.lock(path)
+	fs.handles.invalidateDir(path)
+	err = os.RemoveAll(path)
+	// handles opened while removed are not kept
+	fs.handles.invalidateDir(path)
+	m.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	dirs := []string{filepath.Dir(path)}
+	fs.syncer.changed(nil, dirs)
+	return fs.syncer.commit(nil, dirs)
+}
+
+func (fs *fileSystemStore) ListDirs(dirname string) ([]string, error) {
+	dirname, err := checkDirName("ListDirs", dirname, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fs.statDir("ListDirs", dirname); err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(fs.path + dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, info := range infos {
+		if info.IsDir() && !isHidden(info.Name()) {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+func (fs *fileSystemStore) IsDirExist(dirname string) bool {
+	dirname, err := checkDirName("IsDirExist", dirname, true)
+	if err != nil {
+		return false
+	}
+
+	_, err = fs.statDir("IsDirExist", dirname)
+	return err == nil
+}
+
+func (fs *fileSystemStore) DirInfo(dirname string) (DirInfo, error) {
+	dirname, err := checkDirName("DirInfo", dirname, true)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := fs.statDir("DirInfo", dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(fs.path + dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &dirInfo{name: dirBase(dirname), modTime: dir.ModTime()}
+	for _, info := range infos {
+		name := info.Name()
+		switch {
+		case isHidden(name) || name == mountInfoFile:
+		case info.IsDir():
+			res.dirs++
+		case !fs.isExpired(strings.TrimPrefix(dirname + "/" + name, "/")):
+			res.files++
+		}
+	}
+	return res, nil
+}
+
+// statDir returns info of directory dirname, checked to be directory.
+func (fs *fileSystemStore) statDir(op string, dirname string) (os.FileInfo, error) {
+	if err := fs.checkBeneath(op, dirname); err != nil {
+		return nil, err
+	}
+
+	path := fs.path + dirname
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	} else if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, &os.PathError{Op: op, Path: path, Err: notDirectoryErr}
+	}
+	return info, nil
 }
 
 func (fs *fileSystemStore) Read(filename string, res []byte, startOffset int64) error {
+	filename, err := fs.resolve("Read", filename)
+	if err != nil {
+		return err
+	}
+
 	f, err := fs.openFile(filename)
 
 	if f != nil {
 		defer f.Close()
-		err := readBytes(f, res, startOffset)
+		err := readBytes(f.File, res, startOffset)
 		return err
 	} else {
 		return &os.PathError{Op: "Read", Path: fs.path + filename, Err: err}
 	}
 }
 
-func (fs *fileSystemStore) Write(filename string, data []byte, startOffset int64) error {
+// Mmap maps file by mmap where supported, so it sees later writes in place.
+func (fs *fileSystemStore) Mmap(filename string) (vfs.ReadOnlyMapping, error) {
+	filename, err := fs.resolve("Mmap", filename)
+	if err != nil {
+		return nil, err
+	}
+
 	f, err := fs.openFile(filename)
-	if f != nil {
-		defer f.Close()
-		err := writeBytes(f, data, startOffset)
+	if err != nil {
+		return nil, &os.PathError{Op: "Mmap", Path: fs.path + filename, Err: err}
+	}
+	defer f.Close()
+
+	m, err := vfs.MapFile(f.File)
+	if err != nil {
+		return nil, &os.PathError{Op: "Mmap", Path: fs.path + filename, Err: err}
+	}
+	return m, nil
+}
+
+func (fs *fileSystemStore) Write(filename string, data []byte, startOffset int64) error {
+	return fs.WriteIf(filename, data, startOffset, anyGeneration)
+}
+
+// WriteIf writes data only if generation of file is ifGeneration.
+func (fs *fileSystemStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	return fs.mutate("Write", filename, ifGeneration, func(f *os.File) error {
+		return writeBytes(f, data, startOffset)
+	})
+}
+
+func (fs *fileSystemStore) ReadV(filename string, ranges []Range, parallelism int) error {
+	filename, err := fs.resolve("ReadV", filename)
+	if err != nil {
 		return err
-	} else {
-		return &os.PathError{Op: "Write", Path: fs.path + filename, Err: err}
 	}
+
+	f, err := fs.openFile(filename)
+	if err != nil {
+		return &os.PathError{Op: "ReadV", Path: fs.path + filename, Err: err}
+	}
+	defer f.Close()
+
+	return readSpansWith(ranges, parallelism, func(data []byte, offset int64) error {
+		return readBytes(f.File, data, offset)
+	})
+}
+
+// WriteV writes extents under one lock, generation is changed once.
+func (fs *fileSystemStore) WriteV(filename string, extents []Extent) error {
+	return fs.mutate("WriteV", filename, anyGeneration, func(f *os.File) error {
+		return writeSpansWith(extents, func(data []byte, offset int64) error {
+			return writeBytes(f, data, offset)
+		})
+	})
 }
 
 func (fs *fileSystemStore) CreateFile(filename string) error {
-	f, err := os.Create(fs.path + filename)
+	return fs.create(filename, time.Time{})
+}
+
+// CreateFileWithTTL creates file expiring after ttl, expiry is kept in metadata of file.
+func (fs *fileSystemStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = fs.now().Add(ttl)
+	}
+	return fs.create(filename, expiry)
+}
+
+func (fs *fileSystemStore) create(filename string, expiry time.Time) error {
+	filename, err := fs.resolve("CreateFile", filename)
+	if err != nil {
+		return err
+	}
+
+	return fs.durably(fs.path + filename, true, func() error {
+		return fs.createLocked(filename, expiry)
+	})
+}
+
+func (fs *fileSystemStore) createLocked(filename string, expiry time.Time) error {
+	m := fileLocks.lock(fs.path + filename)
+	defer m.Unlock()
+
+	f, err := fs.open(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if f != nil {
 		defer f.Close()
 	}
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	// handle kept has expiry of truncated file
+	defer fs.handles.invalidate(fs.path + filename)
+
+	return fs.updateMeta(f, filename, func(meta *vfs.FileMeta) {
+		meta.Generation = nextGeneration(meta.Generation)
+		meta.Expiry = expiry
+	})
+}
+
+// replaceFile replaces content of file by temporary file renamed over it, creating file if not existed.
+// temporary file is synced first by durability other than DurabilityNone.
+func (fs *fileSystemStore) replaceFile(filename string, data []byte) error {
+	filename, err := fs.resolve("Replace", filename)
+	if err != nil {
+		return err
+	}
+
+	return fs.durably(fs.path + filename, true, func() error {
+		return fs.replaceLocked(filename, data)
+	})
+}
+
+func (fs *fileSystemStore) replaceLocked(filename string, data []byte) error {
+	m := fileLocks.lock(fs.path + filename)
+	defer m.Unlock()
+
+	if err := vfs.WriteFileAtomic(fs.path + filename, data, fs.syncer.durability != DurabilityNone); err != nil {
+		return &os.PathError{Op: "Replace", Path: fs.path + filename, Err: err}
+	}
+	// handle kept is of replaced file
+	fs.handles.invalidate(fs.path + filename)
+
+	f, err := fs.open(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return fs.updateMeta(f, filename, func(meta *vfs.FileMeta) {
+		meta.Generation = nextGeneration(meta.Generation)
+	})
+}
+
+func (fs *fileSystemStore) SetExpiry(filename string, expiry time.Time) error {
+	filename, err := fs.resolve("SetExpiry", filename)
+	if err != nil {
+		return err
+	}
+
+	return fs.durably(fs.path + filename, false, func() error {
+		return fs.setExpiryLocked(filename, expiry)
+	})
+}
+
+func (fs *fileSystemStore) setExpiryLocked(filename string, expiry time.Time) error {
+	m := fileLocks.lock(fs.path + filename)
+	defer m.Unlock()
+
+	f, err := fs.openFile(filename)
+	if err != nil {
+		return &os.PathError{Op: "SetExpiry", Path: fs.path + filename, Err: err}
+	}
+	defer f.Close()
+	// handle is kept open, so lock taken by updateMeta is released explicitly
+	defer unlockFile(f.File)
+	// handle kept has expiry read when opened
+	defer fs.handles.invalidate(fs.path + filename)
+
+	return fs.updateMeta(f.File, filename, func(meta *vfs.FileMeta) {
+		meta.Expiry = expiry
+	})
+}
+
+// CreateIfNotExists creates empty file, only if file does not exist.
+func (fs *fileSystemStore) CreateIfNotExists(filename string) error {
+	filename, err := fs.resolve("CreateIfNotExists", filename)
+	if err != nil {
+		return err
+	}
+
+	return fs.durably(fs.path + filename, true, func() error {
+		return fs.createIfNotExistsLocked(filename)
+	})
+}
+
+func (fs *fileSystemStore) createIfNotExistsLocked(filename string) error {
+	m := fileLocks.lock(fs.path + filename)
+	defer m.Unlock()
+
+	f, err := fs.open(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) && fs.isExpired(filename) {
+		// expired file is replaced, as if removed
+		fs.handles.invalidate(fs.path + filename)
+		if err := os.Remove(fs.path + filename); err != nil {
+			return err
+		}
+		fs.handles.invalidate(fs.path + filename)
+		f, err = fs.open(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	}
+
+	if os.IsExist(err) {
+		meta, _ := vfs.ReadFileMeta(fs.path + filename)
+		return &PreconditionFailedError{Op: "CreateIfNotExists", Path: fs.path + filename, Expected: 0, Actual: meta.Generation}
+	} else if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	return fs.updateMeta(f, filename, func(meta *vfs.FileMeta) {
+		meta.Generation = nextGeneration(meta.Generation)
+		meta.Expiry = time.Time{}
+	})
 }
 
 func (fs *fileSystemStore) RemoveFile(filename string) error {
-	return os.Remove(fs.path + filename)
+	return fs.RemoveIfMatch(filename, anyGeneration)
+}
+
+// RemoveIfMatch removes file only if generation of file is ifGeneration.
+func (fs *fileSystemStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	filename, err := fs.resolve("RemoveIfMatch", filename)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.removeIfMatchLocked(filename, ifGeneration); err != nil {
+		return err
+	}
+	return fs.syncer.commit(nil, fs.syncer.removed(fs.path + filename))
+}
+
+func (fs *fileSystemStore) removeIfMatchLocked(filename string, ifGeneration uint64) error {
+	m := fileLocks.lock(fs.path + filename)
+	defer m.Unlock()
+
+	if ifGeneration != anyGeneration {
+		f, err := fs.openFile(filename)
+		if err != nil {
+			return &os.PathError{Op: "RemoveIfMatch", Path: fs.path + filename, Err: err}
+		}
+		defer f.Close()
+
+		if err := lockFile(f.File); err != nil {
+			return err
+		}
+		defer unlockFile(f.File)
+
+		if err := fs.checkGeneration("RemoveIfMatch", filename, ifGeneration); err != nil {
+			return err
+		}
+	}
+
+	// handle is closed, not to keep removed file, or to fail removal where open files can not be removed.
+	// handles opened while removed are not kept either
+	fs.handles.invalidate(fs.path + filename)
+	if err := os.Remove(fs.path + filename); err != nil {
+		return err
+	}
+	fs.handles.invalidate(fs.path + filename)
+
+	return vfs.RemoveFileMeta(fs.path + filename)
 }
 
 func (fs *fileSystemStore) Clear(filename string, startOffset int64, size int64) error {
+	return fs.mutate("Clear", filename, anyGeneration, func(f *os.File) error {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		// range beyond end extends file by hole, like writing zeros
+		end := startOffset + size
+		if end > info.Size() {
+			if err := f.Truncate(end); err != nil {
+				return err
+			}
+			end = info.Size()
+		}
+
+		if startOffset >= end {
+			return nil
+		}
+		return punchHole(f, startOffset, end - startOffset)
+	})
+}
+
+// Preallocate reserves disk space of file for size bytes, size of file is not changed.
+func (fs *fileSystemStore) Preallocate(filename string, size int64) error {
+	filename, err := fs.resolve("Preallocate", filename)
+	if err != nil {
+		return err
+	}
+
 	f, err := fs.openFile(filename)
-	if f != nil {
-		defer f.Close()
-		data := make([]byte, size)
-		return writeBytes(f, data, startOffset)
-	} else {
-		return &os.PathError{Op: "Clear", Path: fs.path + filename, Err: err}
+	if err != nil {
+		return &os.PathError{Op: "Preallocate", Path: fs.path + filename, Err: err}
 	}
+	defer f.Close()
+
+	if err := preallocate(f.File, size); err != nil {
+		return &os.PathError{Op: "Preallocate", Path: fs.path + filename, Err: err}
+	}
+
+	files, _ := changes(fs.path + filename, false)
+	fs.syncer.changed(files, nil)
+	return fs.syncer.commit(files, nil)
 }
 
 func (fs *fileSystemStore) Truncate(filename string, size int64) (err error) {
-	return os.Truncate(fs.path + filename, size)
+	filename, err = fs.resolve("Truncate", filename)
+	if err != nil {
+		return err
+	}
+
+	// truncated file is opened again by next operation
+	defer fs.handles.invalidate(fs.path + filename)
+
+	return fs.mutate("Truncate", filename, anyGeneration, func(f *os.File) error {
+		return f.Truncate(size)
+	})
+}
+
+// Watch emits changes of files under path, driven by inotify or polling.
+// event paths are relative to this store.
+func (fs *fileSystemStore) Watch(path string, recursive bool) (<-chan vfs.Event, func(), error) {
+	path, err := cleanName("Watch", path, true)
+	if err != nil {
+		return nil, nil, err
+	} else if err := fs.checkBeneath("Watch", path); err != nil {
+		return nil, nil, err
+	}
+
+	events, cancel, err := vfs.WatchPath(fs.path + path, recursive)
+	if err != nil {
+		return nil, nil, &os.PathError{Op: "Watch", Path: fs.path + path, Err: err}
+	}
+
+	// internal data like metadata of files are hidden
+	return relayEvents(events, cancel, func(name string) (string, bool) {
+		if path == "" {
+			return name, !isHidden(name)
+		} else if name == "" {
+			return path, true
+		}
+		return path + "/" + name, !isHidden(name)
+	})
+}
+
+// Snapshot clones files of this store and its sub stores into read-only snapshot.
+// file data are shared by reflink where file system supports it, copied otherwise.
+// hard links are not used, since files are modified in place.
+// mutations of files in this process wait until files are cloned, so no file is cloned partly written,
+// mutations of other processes are not blocked.
+func (fs *fileSystemStore) Snapshot(name string) error {
+	if err := checkSnapshotName("Snapshot", name); err != nil {
+		return err
+	}
+
+	dst := fs.path + snapshotStore + "/" + name
+	if isFileExist(dst) {
+		return &os.PathError{Op: "Snapshot", Path: dst, Err: snapshotExistsErr}
+	}
+
+	// clone into temporary directory first, not to expose incomplete snapshot
+	tmp := fs.path + snapshotStore + "/" + hiddenPrefix + name
+	os.RemoveAll(tmp)
+
+	unlock := fileLocks.lockAll()
+	err := vfs.CloneTree(fs.path, tmp, skipSnapshot)
+	unlock()
+
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	// snapshot is committed before renamed, so it is complete once seen
+	if fs.syncer.durability != DurabilityNone {
+		if err := syncTree(tmp); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+
+	fs.handles.invalidateDir(dst)
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+
+	dirs := []string{fs.path + snapshotStore}
+	fs.syncer.changed(nil, dirs)
+	return fs.syncer.commit(nil, dirs)
+}
+
+func (fs *fileSystemStore) ListSnapshots() ([]string, error) {
+	infos, err := ioutil.ReadDir(fs.path + snapshotStore)
+	if os.IsNotExist(err) {
+		return make([]string, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, info := range infos {
+		if info.IsDir() && !isHidden(info.Name()) {
+			names = append(names, info.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func (fs *fileSystemStore) OpenSnapshot(name string) (Store, error) {
+	if err := checkSnapshotName("OpenSnapshot", name); err != nil {
+		return nil, err
+	}
+
+	path := fs.path + snapshotStore + "/" + name
+	if !isDirectoryExist(path) {
+		return nil, &os.PathError{Op: "OpenSnapshot", Path: path, Err: noSuchSnapshotErr}
+	}
+
+	return newReadOnlyStore(NewFileSystemStoreWithOptions(path, FileSystemOptions{ResolveBeneath: fs.root != "", Clock: fs.clock})), nil
+}
+
+func (fs *fileSystemStore) DeleteSnapshot(name string) error {
+	if err := checkSnapshotName("DeleteSnapshot", name); err != nil {
+		return err
+	}
+
+	path := fs.path + snapshotStore + "/" + name
+	if !isDirectoryExist(path) {
+		return &os.PathError{Op: "DeleteSnapshot", Path: path, Err: noSuchSnapshotErr}
+	}
+
+	fs.handles.invalidateDir(path)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	fs.handles.invalidateDir(path)
+
+	dirs := []string{fs.path + snapshotStore}
+	fs.syncer.changed(nil, dirs)
+	return fs.syncer.commit(nil, dirs)
+}
+
+// scrub verifies files of this store and its sub stores,
+// and checks metadata and temporary files left in directories.
+func (fs *fileSystemStore) scrub(r *scrubRun) error {
+	root := filepath.Clean(fs.path)
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if ctxErr := r.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
+
+		if os.IsNotExist(err) {
+			// removed while walking
+			return nil
+		} else if err != nil {
+			r.problem(ScrubUnreadable, rel, err, nil)
+			return nil
+		} else if rel == "." {
+			return nil
+		}
+
+		name := info.Name()
+		parent := filepath.Base(filepath.Dir(path))
+
+		switch {
+		case strings.HasPrefix(name, tmpPrefix) ||
+			(parent == snapshotStore && info.IsDir() && strings.HasPrefix(name, hiddenPrefix)):
+			// left by interrupted writeFileAtomic or Snapshot
+			if time.Since(info.ModTime()) >= orphanedTempAge {
+				r.problem(ScrubOrphanedTemp, rel, nil, func() error {
+					return os.RemoveAll(path)
+				})
+			}
+
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		case name == mountInfoFile:
+			if isStaleMountInfo(path) {
+				r.problem(ScrubStaleMountInfo, rel, nil, func() error {
+					return os.Remove(path)
+				})
+			}
+		case info.IsDir():
+		case parent == metaDir:
+			fs.scrubFileMeta(r, rel)
+		case !isHidden(rel):
+			return r.verify(rel)
+		}
+
+		return nil
+	})
+}
+
+// scrubFileMeta checks metadata file rel, relative to this store.
+func (fs *fileSystemStore) scrubFileMeta(r *scrubRun, rel string) {
+	// dir/.kayat_meta/name is metadata of dir/name
+	filename := filepath.ToSlash(filepath.Join(filepath.Dir(filepath.Dir(rel)), filepath.Base(rel)))
+
+	if !isFileExist(fs.path + filename) {
+		r.problem(ScrubInconsistentMeta, rel, orphanedFileMetaErr, func() error {
+			m := fileLocks.lock(fs.path + filename)
+			defer m.Unlock()
+
+			if isFileExist(fs.path + filename) {
+				// created after checked
+				return nil
+			}
+			return vfs.RemoveFileMeta(fs.path + filename)
+		})
+		return
+	}
+
+	if _, err := vfs.ReadFileMeta(fs.path + filename); err != nil {
+		r.problem(ScrubInconsistentMeta, rel, err, func() error {
+			m := fileLocks.lock(fs.path + filename)
+			defer m.Unlock()
+
+			// metadata kept open with handle is replaced
+			defer fs.handles.invalidate(fs.path + filename)
+			return vfs.WriteFileMeta(fs.path + filename, vfs.FileMeta{Generation: nextGeneration(0)})
+		})
+	}
 }
 
+func (fs *fileSystemStore) walkFiles(fn func(name string) error) error {
+	root := filepath.Clean(fs.path)
 
-func (fs *fileSystemStore) openFile(filename string) (*os.File, error) {
-	return os.OpenFile(fs.path + filename, os.O_RDWR, os.ModeAppend)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed while walking
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := info.Name()
+		if info.IsDir() {
+			if name == metaDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(name, tmpPrefix) || name == mountInfoFile {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		if fs.isExpired(filepath.ToSlash(rel)) {
+			return nil
+		}
+		return fn(filepath.ToSlash(rel))
+	})
+}
+
+// removeExpired removes expired files of this store and its sub stores, with their metadata.
+func (fs *fileSystemStore) removeExpired(fn func(name string) error) error {
+	root := filepath.Clean(fs.path)
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed while walking
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := info.Name()
+		if info.IsDir() {
+			if name == metaDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(name, tmpPrefix) || name == mountInfoFile {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		removed, err := fs.removeIfExpired(filepath.ToSlash(rel))
+		if err != nil || !removed {
+			return err
+		}
+		return fn(filepath.ToSlash(rel))
+	})
+}
+
+func (fs *fileSystemStore) removeIfExpired(filename string) (bool, error) {
+	m := fileLocks.lock(fs.path + filename)
+	defer m.Unlock()
+
+	if !fs.isExpired(filename) {
+		return false, nil
+	}
+
+	fs.handles.invalidate(fs.path + filename)
+	if err := os.Remove(fs.path + filename); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	fs.handles.invalidate(fs.path + filename)
+	if err := vfs.RemoveFileMeta(fs.path + filename); err != nil {
+		return false, err
+	}
+
+	// reaper does not wait for group commit, removal is committed with next one
+	dirs := fs.syncer.removed(fs.path + filename)
+	if fs.syncer.durability == DurabilityEveryWrite {
+		return true, fs.syncer.sync(nil, dirs)
+	}
+	return true, nil
+}
+
+// now returns time of clock of store.
+func (fs *fileSystemStore) now() time.Time {
+	if fs.clock == nil {
+		return time.Now()
+	}
+	return fs.clock.Now()
+}
+
+// isExpired returns true if file is expired, but not removed yet.
+func (fs *fileSystemStore) isExpired(filename string) bool {
+	meta, err := vfs.ReadFileMeta(fs.path + filename)
+	return err == nil && meta.Expired(fs.now())
+}
+
+// isStaleMountInfo returns true if mount info marker at path names other directory than its own,
+// like a marker copied or moved with its directory.
+func isStaleMountInfo(path string) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	mounted, err := filepath.Abs(string(data))
+	if err != nil {
+		return false
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(path))
+	return err == nil && mounted != dir
+}
+
+// mutate applies mutation to file holding lock of it, and bumps generation.
+// if ifGeneration is not anyGeneration, mutation is applied only if generation matches.
+// change is committed by durability after lock is released.
+func (fs *fileSystemStore) mutate(op string, filename string, ifGeneration uint64, mutation func(f *os.File) error) error {
+	filename, err := fs.resolve(op, filename)
+	if err != nil {
+		return err
+	}
+
+	return fs.durably(fs.path + filename, false, func() error {
+		return fs.mutateLocked(op, filename, ifGeneration, mutation)
+	})
+}
+
+func (fs *fileSystemStore) mutateLocked(op string, filename string, ifGeneration uint64, mutation func(f *os.File) error) error {
+	m := fileLocks.lock(fs.path + filename)
+	defer m.Unlock()
+
+	f, err := fs.openFile(filename)
+	if err != nil {
+		return &os.PathError{Op: op, Path: fs.path + filename, Err: err}
+	}
+	defer f.Close()
+
+	if err := lockFile(f.File); err != nil {
+		return &os.PathError{Op: op, Path: fs.path + filename, Err: err}
+	}
+	// handle is kept open, so lock is not released by closing it
+	defer unlockFile(f.File)
+
+	if err := fs.checkGeneration(op, filename, ifGeneration); err != nil {
+		return err
+	}
+
+	// handle syncs write when closed, by DurabilityOnClose
+	f.written = true
+	if err := mutation(f.File); err != nil {
+		return err
+	}
+
+	return fs.bumpGeneration(f, filename)
+}
+
+// durably runs mutation of file at path, then marks it changed and commits it by durability.
+// entries is true if mutation creates or removes file.
+func (fs *fileSystemStore) durably(path string, entries bool, mutation func() error) error {
+	if err := mutation(); err != nil {
+		return err
+	}
+
+	files, dirs := changes(path, entries)
+	fs.syncer.changed(files, dirs)
+	return fs.syncer.commit(files, dirs)
+}
+
+func (fs *fileSystemStore) checkGeneration(op string, filename string, ifGeneration uint64) error {
+	if ifGeneration == anyGeneration {
+		return nil
+	}
+
+	meta, err := vfs.ReadFileMeta(fs.path + filename)
+	if err != nil {
+		return err
+	}
+
+	if meta.Generation != ifGeneration {
+		return &PreconditionFailedError{Op: op, Path: fs.path + filename, Expected: ifGeneration, Actual: meta.Generation}
+	}
+
+	return nil
+}
+
+// bumpGeneration updates generation of file of handle f, with lock of file held.
+// generation is rewritten in place through metadata kept open with f,
+// so mutations do not replace metadata. metadata of file without it is written whole.
+func (fs *fileSystemStore) bumpGeneration(f *fileHandle, filename string) error {
+	meta, err := f.openMeta()
+	if err != nil {
+		return err
+	} else if meta == nil {
+		return fs.updateMeta(f.File, filename, func(meta *vfs.FileMeta) {
+			meta.Generation = nextGeneration(meta.Generation)
+		})
+	}
+
+	return vfs.UpdateGeneration(meta, nextGeneration)
+}
+
+// updateMeta applies update to metadata of file f opened by caller.
+func (fs *fileSystemStore) updateMeta(f *os.File, filename string, update func(meta *vfs.FileMeta)) error {
+	if err := lockFile(f); err != nil {
+		return err
+	}
+
+	meta, err := vfs.ReadFileMeta(fs.path + filename)
+	if err != nil {
+		return err
+	}
+
+	update(&meta)
+	return vfs.WriteFileMeta(fs.path + filename, meta)
+}
+
+// openFile opens file by handle kept by pool, expired file is not existed.
+// expiry is read from metadata when handle is opened, which is invalidated when expiry is changed.
+// handle is given back by its Close.
+func (fs *fileSystemStore) openFile(filename string) (*fileHandle, error) {
+	f, err := fs.handles.open(fs.path + filename)
+	if err == nil && (vfs.FileMeta{Expiry: f.expiry}).Expired(fs.now()) {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return f, err
+}
+
+// resolve returns filename canonicalized by cleanFileName, checked by checkBeneath.
+// entry points resolve names given first, so they do not lead out of store.
+func (fs *fileSystemStore) resolve(op string, filename string) (string, error) {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return "", err
+	}
+	return filename, fs.checkBeneath(op, filename)
+}
+
+// checkBeneath checks name resolves beneath root by ResolveBeneath, following symbolic links.
+func (fs *fileSystemStore) checkBeneath(op string, name string) error {
+	if fs.root == "" {
+		return nil
+	}
+
+	rel := strings.TrimSuffix(fs.path[len(fs.root):] + name, "/")
+	if rel == "" {
+		return nil
+	}
+
+	if err := checkBeneath(fs.root, rel); err != nil {
+		return &os.PathError{Op: op, Path: fs.path + name, Err: err}
+	}
+	return nil
+}
+
+// open opens file by flag, beneath root by ResolveBeneath.
+func (fs *fileSystemStore) open(filename string, flag int, perm os.FileMode) (*os.File, error) {
+	return openUnder(fs.root, fs.path + filename, flag, perm)
 }
 
 func isFileExist(filename string) bool {
@@ -140,6 +1181,24 @@ func writeBytes(f *os.File, data []byte, startOffset int64) error {
 	return err
 }
 
+// writeZeros writes size zeros at off, by chunks not to allocate whole range.
+func writeZeros(f *os.File, off int64, size int64) error {
+	zeros := make([]byte, zeroChunkSize)
+	for size > 0 {
+		chunk := zeros
+		if int64(len(chunk)) > size {
+			chunk = chunk[:size]
+		}
+
+		if err := writeBytes(f, chunk, off); err != nil {
+			return err
+		}
+		off += int64(len(chunk))
+		size -= int64(len(chunk))
+	}
+	return nil
+}
+
 func readBytes(f *os.File, res[] byte, startOffset int64) error {
 	_, err := f.ReadAt(res, startOffset)
 	return err
@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"os"
 	"fmt"
+	"github.com/overtheleaves/kayat-store/vfs"
 )
 
 var path = "fs_test"
@@ -41,6 +42,25 @@ func TestFileSystemStore_FileIter(t *testing.T) {
 	assert.True(t, res[fmt.Sprintf("%s%d", filename, 3)])
 }
 
+func TestFileSystemStore_FileIterHidden(t *testing.T) {
+	root := path + "/TestFileSystemStore_FileIterHidden"
+	f := NewFileSystemStore(root)
+	assert.Nil(t, f.CreateFile("file"))
+
+	// files left by interrupted atomic writes, mount info and internal data are not iterated
+	for _, name := range []string{tmpPrefix + "file-1", mountInfoFile, hiddenPrefix + "data"} {
+		h, err := os.Create(root + "/" + name)
+		assert.Nil(t, err)
+		h.Close()
+	}
+
+	names := make([]string, 0)
+	for i := range f.FileIter() {
+		names = append(names, i.Name())
+	}
+	assert.Equal(t, []string{"file"}, names)
+}
+
 func TestFileSystemStore_WriteRead(t *testing.T) {
 	filename := "TestFileSystemStore_WriteRead"
 	f := NewFileSystemStore(path)
@@ -67,6 +87,36 @@ func TestFileSystemStore_Clear(t *testing.T) {
 	assert.Equal(t, "aaa\x00\x00\x00\x00\x00aa", string(res))
 }
 
+func TestFileSystemStore_ClearLarge(t *testing.T) {
+	filename := "TestFileSystemStore_ClearLarge"
+	f := NewFileSystemStore(path)
+	f.CreateFile(filename)
+
+	data := make([]byte, 3 * zeroChunkSize)
+	for i := range data {
+		data[i] = 'a'
+	}
+	assert.Nil(t, f.Write(filename, data, 0))
+
+	// range beyond end extends file
+	assert.Nil(t, f.Clear(filename, 1, 3 * zeroChunkSize))
+	info, err := f.FileInfo(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3 * zeroChunkSize + 1), info.Size())
+
+	res := make([]byte, 3 * zeroChunkSize + 1)
+	assert.Nil(t, f.Read(filename, res, 0))
+	assert.Equal(t, byte('a'), res[0])
+	assert.Equal(t, make([]byte, 3 * zeroChunkSize), res[1:])
+
+	// preallocation keeps size
+	assert.Nil(t, f.Preallocate(filename, 8 * zeroChunkSize))
+	info, err = f.FileInfo(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3 * zeroChunkSize + 1), info.Size())
+	assert.NotNil(t, f.Preallocate("TestFileSystemStore_ClearLargeNone", 1))
+}
+
 func TestFileSystemStore_ReadWhenFileNotExisted(t *testing.T) {
 	filename := "TestFileSystemStore_ReadWhenFileNotExisted"
 	f := NewFileSystemStore(path)
@@ -92,4 +142,22 @@ func TestFileSystemStore_ClearWhenFileNotExisted(t *testing.T) {
 
 	// error should be raised
 	assert.NotNil(t, f.Clear(filename, 0, 10))
-}
\ No newline at end of file
+}
+
+func TestFileSystemStore_Watch(t *testing.T) {
+	filename := "TestFileSystemStore_Watch"
+	f := NewFileSystemStore(path).SubStore("watch")
+
+	events, cancel, err := f.Watch("", true)
+	assert.Nil(t, err)
+	defer cancel()
+
+	f.CreateFile(filename)
+	assert.True(t, waitStoreEvent(events, filename, vfs.Create))
+
+	f.Write(filename, []byte("test"), 0)
+	assert.True(t, waitStoreEvent(events, filename, vfs.Write))
+
+	f.RemoveFile(filename)
+	assert.True(t, waitStoreEvent(events, filename, vfs.Remove))
+}
@@ -0,0 +1,289 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// unreachable chunks and since when, kept between runs of GC
+	casPending     = "pending"
+	pendingVersion = 1
+
+	// version(1) count(4) | hash(32) time(8) ... | crc32(4)
+	pendingHeaderSize = 5
+	pendingEntrySize  = sha256.Size + 8
+
+	defaultGCGrace = time.Hour
+)
+
+type GCOptions struct {
+	// unreachable chunks are removed once unreachable for Grace, found by runs of GC,
+	// not to race writers in other processes, whose chunks are stored before manifests.
+	// zero means an hour.
+	Grace time.Duration
+}
+
+type GCReport struct {
+	Started  time.Time
+	Finished time.Time
+	// number of manifests of files, snapshots and versions marked
+	Manifests int
+	// number of chunks reachable, and unreachable but in grace period
+	Live    int
+	Pending int
+	// number and bytes of chunks removed
+	Reclaimed      int
+	ReclaimedBytes int64
+}
+
+// StartGC runs GC of cs every interval in background, until returned stop function is called.
+// done is called with result of each GC.
+func StartGC(cs ContentAddressedStore, interval time.Duration, options GCOptions, done func(*GCReport, error)) func() {
+	return runEvery(interval, func(ctx context.Context) {
+		report, err := cs.GC(ctx, options)
+		if ctx.Err() == nil && done != nil {
+			done(report, err)
+		}
+	})
+}
+
+// gc marks chunks reachable from roots, which are manifests anywhere in store,
+// including snapshots and versions, and pinned chunks, then sweeps unreachable chunks.
+// marking runs concurrently with writes, chunks stored meanwhile are kept.
+func (c *cas) gc(ctx context.Context, options GCOptions) (*GCReport, error) {
+	grace := options.Grace
+	if grace == 0 {
+		grace = defaultGCGrace
+	}
+
+	c.gcMu.Lock()
+	defer c.gcMu.Unlock()
+
+	report := &GCReport{Started: time.Now()}
+
+	c.mu.Lock()
+	c.fresh = make(map[[sha256.Size]byte]bool)
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.fresh = nil
+		c.mu.Unlock()
+	}()
+
+	live, err := c.mark(ctx, report)
+	if err == nil {
+		err = c.sweep(ctx, live, grace, report)
+	}
+
+	report.Finished = time.Now()
+	return report, err
+}
+
+func (c *cas) mark(ctx context.Context, report *GCReport) (map[[sha256.Size]byte]bool, error) {
+	live := make(map[[sha256.Size]byte]bool)
+
+	err := walkFiles(c.s, func(name string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if skipMark(name) {
+			return nil
+		}
+
+		m, err := c.readManifest(name)
+		if err != nil || m == nil {
+			return err
+		}
+
+		report.Manifests++
+		for _, ref := range m.chunks {
+			live[ref.hash] = true
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for info := range c.pins.FileIter() {
+		if h, err := hex.DecodeString(info.Name()); err == nil && len(h) == sha256.Size {
+			var hash [sha256.Size]byte
+			copy(hash[:], h)
+			live[hash] = true
+		}
+	}
+
+	return live, nil
+}
+
+// sweep removes chunks unreachable for grace period, and keeps others unreachable as pending.
+func (c *cas) sweep(ctx context.Context, live map[[sha256.Size]byte]bool, grace time.Duration, report *GCReport) error {
+	names := make([]string, 0)
+	for info := range c.chunks.FileIter() {
+		names = append(names, info.Name())
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := c.loadPending()
+	next := make(map[[sha256.Size]byte]time.Time)
+	now := time.Now()
+
+	for _, name := range names {
+		h, err := hex.DecodeString(name)
+		if err != nil || len(h) != sha256.Size {
+			continue
+		}
+
+		var hash [sha256.Size]byte
+		copy(hash[:], h)
+
+		if live[hash] || c.fresh[hash] {
+			report.Live++
+			continue
+		}
+
+		since, ok := pending[hash]
+		if !ok {
+			since = now
+		}
+
+		if now.Sub(since) < grace {
+			next[hash] = since
+			report.Pending++
+			continue
+		}
+
+		info, err := c.chunks.FileInfo(name)
+		if err != nil {
+			continue
+		}
+
+		if err := c.chunks.RemoveFile(name); err != nil {
+			return err
+		}
+
+		// count leaked by crash, or left by files expired
+		if err := c.saveRefs(name, 0); err != nil {
+			return err
+		}
+
+		report.Reclaimed++
+		report.ReclaimedBytes += info.Size()
+	}
+
+	return c.savePending(next)
+}
+
+// readManifest returns manifest in file name, nil if file is not a manifest or removed.
+// manifests are read with mu locked, not to see manifests being saved.
+func (c *cas) readManifest(name string) (*manifest, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	dir, base := walkedFile(c.s, name)
+	info, err := dir.FileInfo(base)
+	if err != nil {
+		if !dir.IsFileExist(base) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	size := info.Size() - manifestHeaderSize - 4
+	if size < 0 || size % manifestEntrySize != 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, info.Size())
+	if err := dir.Read(base, data, 0); err != nil {
+		if err == io.EOF || !dir.IsFileExist(base) {
+			// changed by other process, new chunks are pending at least for grace period
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	m, _ := decodeManifest(data)
+	return m, nil
+}
+
+// skipMark returns true if name is internal data of stores, which never has manifests.
+func skipMark(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		switch segment {
+		case casStore, checksumsStore, compressedIndexDir, encryptedHeaderDir, journalStore, quotasStore:
+			return true
+		}
+	}
+	return false
+}
+
+// loadPending returns unreachable chunks found by last GC.
+// if lost or corrupted, grace period of chunks starts again.
+func (c *cas) loadPending() map[[sha256.Size]byte]time.Time {
+	pending := make(map[[sha256.Size]byte]time.Time)
+
+	info, err := c.dir.FileInfo(casPending)
+	if err != nil {
+		return pending
+	}
+
+	data := make([]byte, info.Size())
+	if err := c.dir.Read(casPending, data, 0); err != nil || len(data) < pendingHeaderSize + 4 || data[0] != pendingVersion {
+		return pending
+	}
+
+	body := data[:len(data) - 4]
+	count := int(binary.LittleEndian.Uint32(body[1:]))
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) ||
+		len(body) != pendingHeaderSize + count * pendingEntrySize {
+		return pending
+	}
+
+	for i := 0; i < count; i++ {
+		entry := body[pendingHeaderSize + i * pendingEntrySize:]
+
+		var hash [sha256.Size]byte
+		copy(hash[:], entry)
+		pending[hash] = time.Unix(0, int64(binary.LittleEndian.Uint64(entry[sha256.Size:])))
+	}
+
+	return pending
+}
+
+func (c *cas) savePending(pending map[[sha256.Size]byte]time.Time) error {
+	data := make([]byte, pendingHeaderSize + len(pending) * pendingEntrySize + 4)
+
+	data[0] = pendingVersion
+	binary.LittleEndian.PutUint32(data[1:], uint32(len(pending)))
+
+	i := 0
+	for hash, since := range pending {
+		entry := data[pendingHeaderSize + i * pendingEntrySize:]
+		copy(entry, hash[:])
+		binary.LittleEndian.PutUint64(entry[sha256.Size:], uint64(since.UnixNano()))
+		i++
+	}
+
+	body := data[:len(data) - 4]
+	binary.LittleEndian.PutUint32(data[len(body):], crc32.ChecksumIEEE(body))
+
+	// replaced atomically, not to restart grace periods of all chunks when interrupted
+	return replaceFile(c.dir, casPending, data)
+}
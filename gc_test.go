@@ -0,0 +1,134 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+// collectGarbage runs GC twice, first finding unreachable chunks, then removing them.
+func collectGarbage(t *testing.T, cs ContentAddressedStore) *GCReport {
+	options := GCOptions{Grace: time.Nanosecond}
+
+	_, err := cs.GC(context.Background(), options)
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond)
+
+	report, err := cs.GC(context.Background(), options)
+	assert.Nil(t, err)
+	return report
+}
+
+func TestGC_Roots(t *testing.T) {
+	for _, s := range testStores(t, "TestGC_Roots") {
+		cs := NewContentAddressedStore(s)
+		chunks := s.SubStore(casStore).SubStore(casChunks)
+
+		data := make([]byte, 64 * 1024)
+		rand.New(rand.NewSource(3)).Read(data)
+
+		sub := cs.SubStore("dir")
+		assert.Nil(t, sub.CreateFile("file"))
+		assert.Nil(t, sub.Write("file", data, 0))
+		cnt := countFiles(chunks)
+
+		// snapshot keeps chunks of removed file
+		assert.Nil(t, cs.Snapshot("snap"))
+		assert.Nil(t, sub.RemoveFile("file"))
+
+		report := collectGarbage(t, cs)
+		assert.Equal(t, 1, report.Manifests)
+		assert.Equal(t, cnt, report.Live)
+		assert.Equal(t, 0, report.Reclaimed)
+
+		snapshot, _ := cs.OpenSnapshot("snap")
+		res := make([]byte, len(data))
+		assert.Nil(t, snapshot.Read("dir/file", res, 0))
+		assert.True(t, bytes.Equal(data, res))
+
+		// pinned chunk is kept without any reference
+		assert.Nil(t, cs.CreateFile("pinned"))
+		assert.Nil(t, cs.Write("pinned", []byte("test"), 0))
+		hashes, err := cs.Chunks("pinned")
+		assert.Nil(t, err)
+		assert.Len(t, hashes, 1)
+
+		assert.Nil(t, cs.Pin(hashes[0]))
+		assert.Nil(t, cs.RemoveFile("pinned"))
+		assert.Nil(t, s.DeleteSnapshot("snap"))
+
+		report = collectGarbage(t, cs)
+		assert.Equal(t, 0, report.Manifests)
+		assert.Equal(t, 1, report.Live)
+		assert.Equal(t, cnt, report.Reclaimed)
+		assert.Equal(t, int64(len(data)), report.ReclaimedBytes)
+
+		assert.Nil(t, cs.Unpin(hashes[0]))
+		report = collectGarbage(t, cs)
+		assert.Equal(t, 1, report.Reclaimed)
+		assert.Equal(t, 0, countFiles(chunks))
+
+		assert.NotNil(t, cs.Pin("not a hash"))
+	}
+}
+
+func TestGC_Grace(t *testing.T) {
+	for _, s := range testStores(t, "TestGC_Grace") {
+		cs := NewContentAddressedStore(s)
+
+		cs.CreateFile("file")
+		cs.Write("file", []byte("test"), 0)
+		cs.RemoveFile("file")
+
+		// unreachable chunk is kept until unreachable for grace period
+		report, err := cs.GC(context.Background(), GCOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, report.Pending)
+		assert.Equal(t, 0, report.Reclaimed)
+
+		// grace period is kept by other GC, like in other process
+		other := NewContentAddressedStore(s)
+		report, err = other.GC(context.Background(), GCOptions{Grace: time.Hour})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, report.Pending)
+
+		time.Sleep(time.Millisecond)
+		report, err = other.GC(context.Background(), GCOptions{Grace: time.Millisecond})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, report.Pending)
+		assert.Equal(t, 1, report.Reclaimed)
+		assert.Equal(t, int64(4), report.ReclaimedBytes)
+	}
+}
+
+func TestStartGC(t *testing.T) {
+	for _, s := range testStores(t, "TestStartGC") {
+		cs := NewContentAddressedStore(s)
+		cs.CreateFile("file")
+		cs.Write("file", []byte("test"), 0)
+		cs.RemoveFile("file")
+
+		reports := make(chan *GCReport, 16)
+		stop := StartGC(cs, 10 * time.Millisecond, GCOptions{Grace: time.Nanosecond}, func(report *GCReport, err error) {
+			assert.Nil(t, err)
+			reports <- report
+		})
+
+		reclaimed := 0
+		for i := 0; i < 2; i++ {
+			select {
+			case report := <-reports:
+				reclaimed += report.Reclaimed
+			case <-time.After(5 * time.Second):
+				t.Fatal("GC not run")
+			}
+		}
+
+		stop()
+		assert.Equal(t, 1, reclaimed)
+	}
+}
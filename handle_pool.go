@@ -0,0 +1,254 @@
+package store
+
+import (
+	"container/list"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+// number of handles kept open by file system store, if not given by options
+const defaultMaxOpenFiles = 64
+
+/**
+ handlePool keeps handles of files open between operations, up to capacity,
+ closing least recently used handles first.
+ handles are shared by operations, and closed when last one gives it back.
+ handles are not checked to be of file at their path when taken,
+ store invalidates them when it removes, replaces or changes expiry of files, or replaces their metadata,
+ so files removed or renamed by other processes are not noticed while kept.
+ metadata of a file is kept open with its handle, so generation is updated in place by mutations.
+ */
+type handlePool struct {
+	mu       sync.Mutex
+	capacity int
+	handles  map[string]*fileHandle
+	// handles in pool, most recently used first
+	lru    *list.List
+	closed bool
+	// handles written are synced when closed, by DurabilityOnClose
+	syncOnClose bool
+	// files are opened beneath root by ResolveBeneath, "" if not
+	root string
+	// count of invalidations, handles opened meanwhile are not kept
+	invalidations uint64
+}
+
+/**
+ fileHandle is open file taken from handlePool.
+ Close gives it back to pool, file is closed when no longer kept and used.
+ */
+type fileHandle struct {
+	*os.File
+	pool *handlePool
+	path string
+	info os.FileInfo
+	refs int
+	// not kept by pool, closed by last Close
+	stale   bool
+	element *list.Element
+	// written by mutation, set with lock of file held
+	written bool
+	// expiry of file read from its metadata when opened, zero if not expiring
+	expiry time.Time
+	// metadata file opened by first mutation, with lock of file held
+	meta *os.File
+}
+
+// newHandlePool returns pool keeping up to capacity handles, none if capacity is negative.
+// files are opened beneath root, if not "".
+func newHandlePool(capacity int, root string) *handlePool {
+	if capacity == 0 {
+		capacity = defaultMaxOpenFiles
+	}
+	return &handlePool{capacity: capacity, handles: make(map[string]*fileHandle), lru: list.New(), root: root}
+}
+
+// open returns handle of file at path opened for read and write, kept open for later operations.
+func (p *handlePool) open(path string) (*fileHandle, error) {
+	p.mu.Lock()
+	h := p.handles[path]
+	if h != nil {
+		h.refs++
+		p.lru.MoveToFront(h.element)
+	}
+	invalidations := p.invalidations
+	p.mu.Unlock()
+
+	if h != nil {
+		return h, nil
+	}
+
+	f, err := openUnder(p.root, path, os.O_RDWR, os.ModeAppend)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// unreadable metadata is not expiring, like by isExpired
+	meta, _ := vfs.ReadFileMeta(path)
+	return p.put(&fileHandle{File: f, pool: p, path: path, info: info, refs: 1, expiry: meta.Expiry}, invalidations), nil
+}
+
+// put keeps newly opened handle h, evicting least recently used handles beyond capacity.
+// returns handle kept already, if opened meanwhile by other operation.
+// h is not kept if pool is invalidated since count of invalidations, as it may be of removed file.
+// evicted handles are closed after lock is released, as they may be synced by closeFile.
+func (p *handlePool) put(h *fileHandle, invalidations uint64) *fileHandle {
+	p.mu.Lock()
+
+	if p.closed || p.capacity < 0 || p.invalidations != invalidations {
+		h.stale = true
+		p.mu.Unlock()
+		return h
+	}
+
+	if kept := p.handles[h.path]; kept != nil && os.SameFile(kept.info, h.info) {
+		kept.refs++
+		p.lru.MoveToFront(kept.element)
+		p.mu.Unlock()
+		h.File.Close()
+		return kept
+	}
+
+	closing := make([]*fileHandle, 0)
+	if kept := p.handles[h.path]; kept != nil {
+		closing = p.remove(kept, closing)
+	}
+
+	h.element = p.lru.PushFront(h)
+	p.handles[h.path] = h
+
+	for p.lru.Len() > p.capacity {
+		closing = p.remove(p.lru.Back().Value.(*fileHandle), closing)
+	}
+	p.mu.Unlock()
+
+	// errors of closing evicted handles are not of operation taking h
+	p.closeFiles(closing)
+	return h
+}
+
+// invalidate closes handle kept for path, once it is not used.
+func (p *handlePool) invalidate(path string) {
+	p.mu.Lock()
+	p.invalidations++
+	closing := make([]*fileHandle, 0)
+	if h := p.handles[path]; h != nil {
+		closing = p.remove(h, closing)
+	}
+	p.mu.Unlock()
+
+	p.closeFiles(closing)
+}
+
+// invalidateDir closes handles kept for files under directory dir.
+func (p *handlePool) invalidateDir(dir string) {
+	p.mu.Lock()
+	p.invalidations++
+	closing := make([]*fileHandle, 0)
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	for path, h := range p.handles {
+		if strings.HasPrefix(path, dir) {
+			closing = p.remove(h, closing)
+		}
+	}
+	p.mu.Unlock()
+
+	p.closeFiles(closing)
+}
+
+// close closes all handles kept, later handles are closed by their Close.
+func (p *handlePool) close() error {
+	p.mu.Lock()
+	closing := make([]*fileHandle, 0)
+	for _, h := range p.handles {
+		closing = p.remove(h, closing)
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	return p.closeFiles(closing)
+}
+
+// remove stops keeping handle h, and appends it to closing if it is not used.
+// called with lock held, handles are closed by closeFiles after it is released.
+func (p *handlePool) remove(h *fileHandle, closing []*fileHandle) []*fileHandle {
+	delete(p.handles, h.path)
+	p.lru.Remove(h.element)
+	h.stale = true
+
+	if h.refs == 0 {
+		return append(closing, h)
+	}
+	return closing
+}
+
+// closeFiles closes handles no longer kept nor used, returns first error.
+func (p *handlePool) closeFiles(handles []*fileHandle) error {
+	var first error
+	for _, h := range handles {
+		if err := p.closeFile(h); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// closeFile closes file of handle h, syncing it first if required.
+// called without lock held, as syncing blocks other operations taking handles otherwise.
+func (p *handlePool) closeFile(h *fileHandle) error {
+	var err error
+	if p.syncOnClose && h.written {
+		err = syncFile(h.File, h.path, p.root)
+	}
+
+	if h.meta != nil {
+		if closeErr := h.meta.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if closeErr := h.File.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openMeta returns metadata file of handle, kept open with it, nil if file has no metadata.
+// called with lock of file held.
+func (h *fileHandle) openMeta() (*os.File, error) {
+	if h.meta == nil {
+		meta, err := openUnder(h.pool.root, vfs.MetaPath(h.path), os.O_RDWR, 0)
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		h.meta = meta
+	}
+	return h.meta, nil
+}
+
+// Close gives handle back to pool, and closes it if it is no longer kept and used.
+func (h *fileHandle) Close() error {
+	p := h.pool
+
+	p.mu.Lock()
+	h.refs--
+	closing := h.refs == 0 && h.stale
+	p.mu.Unlock()
+
+	if closing {
+		return p.closeFile(h)
+	}
+	return nil
+}
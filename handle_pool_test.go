@@ -0,0 +1,81 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSystemStore_HandlePool(t *testing.T) {
+	s := NewFileSystemStoreWithOptions(path, FileSystemOptions{MaxOpenFiles: 2}).SubStore("TestFileSystemStore_HandlePool")
+	handles := s.(*fileSystemStore).handles
+
+	for _, name := range []string{"a", "b", "c"} {
+		assert.Nil(t, s.CreateFile(name))
+		assert.Nil(t, s.Write(name, []byte(name), 0))
+	}
+
+	// least recently used handle is closed
+	assert.Equal(t, 2, handles.lru.Len())
+	assert.Nil(t, handles.handles[path + "/TestFileSystemStore_HandlePool/a"])
+
+	res := make([]byte, 1)
+	assert.Nil(t, s.Read("a", res, 0))
+	assert.Equal(t, "a", string(res))
+	assert.Equal(t, 2, handles.lru.Len())
+
+	// handle is closed by removal, and recreated file is opened again
+	assert.Nil(t, s.RemoveFile("a"))
+	assert.Nil(t, handles.handles[path + "/TestFileSystemStore_HandlePool/a"])
+	assert.Nil(t, s.CreateFile("a"))
+	assert.Nil(t, s.Write("a", []byte("x"), 0))
+	assert.Nil(t, s.Read("a", res, 0))
+	assert.Equal(t, "x", string(res))
+
+	// file replaced by store is opened again, without checking path for each operation
+	dir := path + "/TestFileSystemStore_HandlePool/"
+	assert.Nil(t, s.Read("b", res, 0))
+	assert.Nil(t, replaceFile(s, "b", []byte("c")))
+	assert.Nil(t, s.Read("b", res, 0))
+	assert.Equal(t, "c", string(res))
+
+	// file replaced behind store is not noticed while handle is kept
+	assert.Nil(t, s.Write("c", []byte("z"), 0))
+	assert.Nil(t, os.Rename(dir + "c", dir + "b"))
+	assert.Nil(t, s.Read("b", res, 0))
+	assert.Equal(t, "c", string(res))
+
+	// truncate closes handle
+	assert.Nil(t, s.Truncate("b", 0))
+	assert.Nil(t, handles.handles[dir + "b"])
+
+	// closed store opens files for each operation
+	assert.Nil(t, s.Close())
+	assert.Equal(t, 0, handles.lru.Len())
+	assert.Nil(t, s.Write("a", []byte("y"), 0))
+	assert.Nil(t, s.Read("a", res, 0))
+	assert.Equal(t, "y", string(res))
+	assert.Equal(t, 0, handles.lru.Len())
+}
+
+func TestHandlePool_Shared(t *testing.T) {
+	s := NewFileSystemStoreWithOptions(path, FileSystemOptions{MaxOpenFiles: 4}).SubStore("TestHandlePool_Shared")
+	defer s.Close()
+	assert.Nil(t, s.CreateFile("file"))
+
+	f1, err := s.(*fileSystemStore).openFile("file")
+	assert.Nil(t, err)
+	f2, err := s.(*fileSystemStore).openFile("file")
+	assert.Nil(t, err)
+	assert.True(t, f1 == f2)
+
+	// removed handle is closed by last Close
+	assert.Nil(t, s.RemoveFile("file"))
+	assert.Nil(t, f1.Close())
+	_, err = f2.Stat()
+	assert.Nil(t, err)
+	assert.Nil(t, f2.Close())
+	_, err = f2.Stat()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,18 @@
+package store
+
+import "strings"
+
+// prefix of names reserved for store internal data, like journal or versions.
+// internal data is kept in sub stores named with this prefix,
+// so it is not iterated by FileIter.
+const hiddenPrefix = ".kayat_"
+
+// isHidden returns true if any segment of name is reserved for internal data.
+func isHidden(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, hiddenPrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,378 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+)
+
+// Seq is sequence number of a change, increasing monotonically from 1.
+type Seq uint64
+
+type ChangeOp uint8
+
+const (
+	ChangeCreate ChangeOp = iota + 1
+	ChangeWrite
+	ChangeClear
+	ChangeTruncate
+	ChangeRemove
+
+	// record aborting change of Seq, whose mutation failed
+	changeAbort ChangeOp = 0xff
+)
+
+const (
+	journalStore = hiddenPrefix + "journal"
+	journalFile  = "changes"
+
+	// length(4) crc(4) | seq(8) op(1) offset(8) size(8) time(8) name
+	journalHeaderSize = 8
+	journalBodySize   = 33
+
+	// a mark of journal offset is kept every journalMarkInterval records,
+	// so Changes does not scan whole journal.
+	journalMarkInterval = 1024
+
+	// longest name recorded, longer length means corrupted record.
+	journalMaxNameSize = 64 * 1024
+)
+
+var (
+	corruptedJournalErr = errors.New("corrupted journal record")
+)
+
+var changeOpNames = map[ChangeOp]string{
+	ChangeCreate:   "CREATE",
+	ChangeWrite:    "WRITE",
+	ChangeClear:    "CLEAR",
+	ChangeTruncate: "TRUNCATE",
+	ChangeRemove:   "REMOVE",
+}
+
+/**
+ Change is a mutation recorded in journal.
+ Offset and Size are range of Write/Clear, and new size of Truncate.
+ */
+type Change struct {
+	Seq    Seq
+	Op     ChangeOp
+	Name   string
+	Offset int64
+	Size   int64
+	Time   time.Time
+}
+
+type ChangeIterator interface {
+	Next() bool
+	Change() Change
+	Err() error
+}
+
+type journalMark struct {
+	seq    Seq
+	offset int64
+}
+
+/**
+ journal is append-only change log kept in a store file.
+ change is appended and committed before its mutation, and is pending until the mutation is done.
+ changes are visible up to first pending one, and changes of failed mutations are aborted.
+ */
+type journal struct {
+	mu      sync.Mutex
+	s       Store
+	lastSeq Seq
+	size    int64
+	marks   []journalMark
+	// changes whose mutations are not done yet, in order of seq
+	pending []journalMark
+	aborted map[Seq]bool
+	// serializes mutations of same file, so their changes are in order of mutations
+	locks stripedLock
+
+	// serializes syncs, synced is size of journal committed
+	syncMu sync.Mutex
+	synced int64
+}
+
+type journalIterator struct {
+	r       *bufio.Reader
+	since   Seq
+	aborted map[Seq]bool
+	change  Change
+	err     error
+}
+
+func (op ChangeOp) String() string {
+	return changeOpNames[op]
+}
+
+// openJournal loads journal in s, creating it if not existed.
+// torn record at the tail, left by interrupted append, is truncated.
+func openJournal(s Store) (*journal, error) {
+	j := &journal{s: s, marks: make([]journalMark, 0), aborted: make(map[Seq]bool)}
+
+	if !s.IsFileExist(journalFile) {
+		if err := s.CreateFile(journalFile); err != nil {
+			return nil, err
+		}
+		return j, nil
+	}
+
+	info, err := s.FileInfo(journalFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(newStoreReader(s, journalFile, 0, info.Size()))
+	count := 0
+
+	for {
+		change, n, err := readChange(r)
+		if err != nil {
+			break
+		}
+
+		if change.Op == changeAbort {
+			j.aborted[change.Seq] = true
+			j.size += n
+			continue
+		}
+
+		if count % journalMarkInterval == 0 {
+			j.marks = append(j.marks, journalMark{seq: change.Seq, offset: j.size})
+		}
+
+		count++
+		j.lastSeq = change.Seq
+		j.size += n
+	}
+
+	if j.size < info.Size() {
+		if err := s.Truncate(journalFile, j.size); err != nil {
+			return nil, err
+		}
+	}
+
+	// changes pending at crash are kept, as their mutations may be applied
+	j.synced = j.size
+	return j, nil
+}
+
+// begin appends changes with next sequence numbers as pending, and returns offset of journal following them.
+func (j *journal) begin(changes []Change) (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	records := make([][]byte, len(changes))
+	data := make([]byte, 0)
+	for i := range changes {
+		changes[i].Seq = j.lastSeq + 1 + Seq(i)
+		changes[i].Time = time.Now()
+		records[i] = encodeChange(changes[i])
+		data = append(data, records[i]...)
+	}
+
+	if err := j.s.Write(journalFile, data, j.size); err != nil {
+		return 0, err
+	}
+
+	for i, change := range changes {
+		if (change.Seq - 1) % journalMarkInterval == 0 {
+			j.marks = append(j.marks, journalMark{seq: change.Seq, offset: j.size})
+		}
+
+		j.pending = append(j.pending, journalMark{seq: change.Seq, offset: j.size})
+		j.size += int64(len(records[i]))
+	}
+
+	j.lastSeq += Seq(len(changes))
+	return j.size, nil
+}
+
+// commit syncs journal up to end, so changes are kept before their mutations are applied.
+// concurrent commits share one sync.
+func (j *journal) commit(end int64) error {
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+
+	if j.synced >= end {
+		// synced by other commit
+		return nil
+	}
+
+	j.mu.Lock()
+	size := j.size
+	j.mu.Unlock()
+
+	if err := j.s.Sync(journalFile); err != nil {
+		return err
+	}
+
+	j.synced = size
+	return nil
+}
+
+// done ends pending changes, which are aborted if their mutation failed.
+// abort is not committed, since change of failed mutation is harmless.
+func (j *journal) done(changes []Change, ok bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	pending := j.pending[:0]
+	for _, p := range j.pending {
+		if p.seq < changes[0].Seq || p.seq > changes[len(changes) - 1].Seq {
+			pending = append(pending, p)
+		}
+	}
+	j.pending = pending
+
+	if ok {
+		return nil
+	}
+
+	data := make([]byte, 0)
+	for _, change := range changes {
+		data = append(data, encodeChange(Change{Seq: change.Seq, Op: changeAbort, Time: time.Now()})...)
+	}
+
+	if err := j.s.Write(journalFile, data, j.size); err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		j.aborted[change.Seq] = true
+	}
+	j.size += int64(len(data))
+	return nil
+}
+
+// visible returns offset of journal and last seq of changes, up to first pending change.
+// must be called with lock held.
+func (j *journal) visible() (int64, Seq) {
+	end, last := j.size, j.lastSeq
+	if len(j.pending) > 0 {
+		end, last = j.pending[0].offset, j.pending[0].seq - 1
+	}
+
+	for last > 0 && j.aborted[last] {
+		last--
+	}
+	return end, last
+}
+
+// changes returns iterator of changes after since, up to last visible change at the moment.
+func (j *journal) changes(since Seq) ChangeIterator {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var offset int64
+	for _, mark := range j.marks {
+		if mark.seq > since + 1 {
+			break
+		}
+		offset = mark.offset
+	}
+
+	aborted := make(map[Seq]bool, len(j.aborted))
+	for seq := range j.aborted {
+		aborted[seq] = true
+	}
+
+	end, _ := j.visible()
+	return &journalIterator{
+		r:       bufio.NewReader(newStoreReader(j.s, journalFile, offset, end)),
+		since:   since,
+		aborted: aborted,
+	}
+}
+
+func (it *journalIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	for {
+		change, _, err := readChange(it.r)
+		if err == io.EOF {
+			return false
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+
+		if change.Seq > it.since && change.Op != changeAbort && !it.aborted[change.Seq] {
+			it.change = change
+			return true
+		}
+	}
+}
+
+func (it *journalIterator) Change() Change {
+	return it.change
+}
+
+func (it *journalIterator) Err() error {
+	return it.err
+}
+
+func encodeChange(c Change) []byte {
+	if len(c.Name) > journalMaxNameSize {
+		c.Name = c.Name[:journalMaxNameSize]
+	}
+
+	record := make([]byte, journalHeaderSize + journalBodySize + len(c.Name))
+	body := record[journalHeaderSize:]
+
+	binary.LittleEndian.PutUint64(body[0:], uint64(c.Seq))
+	body[8] = byte(c.Op)
+	binary.LittleEndian.PutUint64(body[9:], uint64(c.Offset))
+	binary.LittleEndian.PutUint64(body[17:], uint64(c.Size))
+	binary.LittleEndian.PutUint64(body[25:], uint64(c.Time.UnixNano()))
+	copy(body[journalBodySize:], c.Name)
+
+	binary.LittleEndian.PutUint32(record[0:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(body))
+	return record
+}
+
+// readChange reads a record from r, returns change and size of the record.
+func readChange(r io.Reader) (Change, int64, error) {
+	header := make([]byte, journalHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = corruptedJournalErr
+		}
+		return Change{}, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:])
+	if length < journalBodySize || length > journalBodySize + journalMaxNameSize {
+		return Change{}, 0, corruptedJournalErr
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Change{}, 0, corruptedJournalErr
+	}
+
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(header[4:]) {
+		return Change{}, 0, corruptedJournalErr
+	}
+
+	change := Change{
+		Seq:    Seq(binary.LittleEndian.Uint64(body[0:])),
+		Op:     ChangeOp(body[8]),
+		Offset: int64(binary.LittleEndian.Uint64(body[9:])),
+		Size:   int64(binary.LittleEndian.Uint64(body[17:])),
+		Time:   time.Unix(0, int64(binary.LittleEndian.Uint64(body[25:]))),
+		Name:   string(body[journalBodySize:]),
+	}
+
+	return change, int64(journalHeaderSize) + int64(length), nil
+}
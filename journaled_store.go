@@ -0,0 +1,243 @@
+package store
+
+import (
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+/**
+ Store recording every mutation into append-only journal,
+ so consumers can checkpoint sequence of last change they handled,
+ and replay missed changes after downtime.
+ Change is recorded and committed before mutation, and is visible once mutation is done.
+ change of failed mutation is aborted, and change of mutation interrupted by crash is kept,
+ since the mutation may be applied.
+ changes of same file are recorded in order of mutations, named by canonical names of files.
+ Preallocate, SetExpiry and Mkdir are not recorded, as they change neither data nor size of files.
+ file expired by SetExpiry is recorded as removed once RemoveExpired removes it.
+ */
+type JournaledStore interface {
+	Store
+	// Changes returns changes recorded after since, pass 0 to read all.
+	Changes(since Seq) (ChangeIterator, error)
+	LastSeq() Seq
+}
+
+type journaledStore struct {
+	Store
+	journal *journal
+	prefix  string
+}
+
+// NewJournaledStore opens journal kept in hidden area of s.
+func NewJournaledStore(s Store) (JournaledStore, error) {
+	j, err := openJournal(s.SubStore(journalStore))
+	if err != nil {
+		return nil, err
+	}
+
+	return &journaledStore{Store: s, journal: j}, nil
+}
+
+func (js *journaledStore) Changes(since Seq) (ChangeIterator, error) {
+	return js.journal.changes(since), nil
+}
+
+// LastSeq returns seq of last visible change.
+func (js *journaledStore) LastSeq() Seq {
+	js.journal.mu.Lock()
+	defer js.journal.mu.Unlock()
+
+	_, last := js.journal.visible()
+	return last
+}
+
+func (js *journaledStore) SubStore(subpath string) Store {
+	subpath = cleanSubPath(subpath)
+	prefix := js.prefix
+	if subpath != "" {
+		prefix += subpath + "/"
+	}
+
+	return &journaledStore{
+		Store:   js.Store.SubStore(subpath),
+		journal: js.journal,
+		prefix:  prefix,
+	}
+}
+
+func (js *journaledStore) Write(filename string, data []byte, startOffset int64) error {
+	return js.record("Write", ChangeWrite, filename, startOffset, int64(len(data)), func() error {
+		return js.Store.Write(filename, data, startOffset)
+	})
+}
+
+func (js *journaledStore) Clear(filename string, startOffset int64, size int64) error {
+	return js.record("Clear", ChangeClear, filename, startOffset, size, func() error {
+		return js.Store.Clear(filename, startOffset, size)
+	})
+}
+
+func (js *journaledStore) CreateFile(filename string) error {
+	return js.record("CreateFile", ChangeCreate, filename, 0, 0, func() error {
+		return js.Store.CreateFile(filename)
+	})
+}
+
+func (js *journaledStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	return js.record("CreateFileWithTTL", ChangeCreate, filename, 0, 0, func() error {
+		return js.Store.CreateFileWithTTL(filename, ttl)
+	})
+}
+
+func (js *journaledStore) RemoveFile(filename string) error {
+	return js.record("RemoveFile", ChangeRemove, filename, 0, 0, func() error {
+		return js.Store.RemoveFile(filename)
+	})
+}
+
+// RemoveDir records removal of each file, if recursive.
+func (js *journaledStore) RemoveDir(dirname string, recursive bool) error {
+	if recursive {
+		if err := removeDirFiles(js, dirname); err != nil {
+			return err
+		}
+	}
+	return js.Store.RemoveDir(dirname, recursive)
+}
+
+func (js *journaledStore) Truncate(filename string, size int64) error {
+	return js.record("Truncate", ChangeTruncate, filename, 0, size, func() error {
+		return js.Store.Truncate(filename, size)
+	})
+}
+
+// WriteV records write of each extent.
+func (js *journaledStore) WriteV(filename string, extents []Extent) error {
+	name, err := js.name("WriteV", filename)
+	if err != nil {
+		return err
+	}
+
+	changes := make([]Change, len(extents))
+	for i, e := range extents {
+		changes[i] = Change{Op: ChangeWrite, Name: name, Offset: e.Offset, Size: int64(len(e.Data))}
+	}
+
+	return js.recordAll(changes, func() error {
+		return js.Store.WriteV(filename, extents)
+	})
+}
+
+func (js *journaledStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	return js.record("WriteIf", ChangeWrite, filename, startOffset, int64(len(data)), func() error {
+		return js.Store.WriteIf(filename, data, startOffset, ifGeneration)
+	})
+}
+
+func (js *journaledStore) CreateIfNotExists(filename string) error {
+	return js.record("CreateIfNotExists", ChangeCreate, filename, 0, 0, func() error {
+		return js.Store.CreateIfNotExists(filename)
+	})
+}
+
+func (js *journaledStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	return js.record("RemoveIfMatch", ChangeRemove, filename, 0, 0, func() error {
+		return js.Store.RemoveIfMatch(filename, ifGeneration)
+	})
+}
+
+func (js *journaledStore) Watch(path string, recursive bool) (<-chan vfs.Event, func(), error) {
+	events, cancel, err := js.Store.Watch(path, recursive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// hide changes of journal
+	return relayEvents(events, cancel, func(name string) (string, bool) {
+		return name, !isHidden(name)
+	})
+}
+
+// record commits change of mutation, and applies mutation.
+func (js *journaledStore) record(op string, change ChangeOp, filename string, offset int64, size int64, mutate func() error) error {
+	name, err := js.name(op, filename)
+	if err != nil {
+		return err
+	}
+
+	return js.recordAll([]Change{{Op: change, Name: name, Offset: offset, Size: size}}, mutate)
+}
+
+// name returns name of filename recorded in journal, canonicalized so changes through aliases of file
+// are recorded by one name, and serialized by one lock.
+func (js *journaledStore) name(op string, filename string) (string, error) {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return "", err
+	}
+	return js.prefix + filename, nil
+}
+
+// recordAll commits changes of mutation of one file before applying mutation,
+// changes are aborted if mutation fails.
+// mutations of same file are serialized, so order of their changes is same as order of mutations.
+func (js *journaledStore) recordAll(changes []Change, mutate func() error) error {
+	if len(changes) == 0 {
+		return mutate()
+	}
+
+	m := js.journal.locks.lock(changes[0].Name)
+	defer m.Unlock()
+
+	end, err := js.journal.begin(changes)
+	if err != nil {
+		return err
+	}
+
+	if err := js.journal.commit(end); err != nil {
+		js.journal.done(changes, false)
+		return err
+	}
+
+	err = mutate()
+	if derr := js.journal.done(changes, err == nil); err == nil {
+		err = derr
+	}
+	return err
+}
+
+// scrub checks records of journal too.
+func (js *journaledStore) scrub(r *scrubRun) error {
+	if err := scrubStore(r, js.Store); err != nil {
+		return err
+	}
+
+	it := js.journal.changes(0)
+	for it.Next() {
+	}
+
+	if err := it.Err(); err != nil {
+		r.problem(ScrubInconsistentMeta, journalStore + "/" + journalFile, err, nil)
+	}
+
+	return r.ctx.Err()
+}
+
+// removeExpired records removal of expired files.
+func (js *journaledStore) removeExpired(fn func(name string) error) error {
+	return removeExpired(js.Store, func(name string) error {
+		if !isHidden(name) {
+			err := js.record("RemoveExpired", ChangeRemove, name, 0, 0, expiredRemoval(js.Store, name))
+			if err != nil && err != recreatedErr {
+				return err
+			}
+		}
+		return fn(name)
+	})
+}
+
+func (js *journaledStore) walkFiles(fn func(name string) error) error {
+	return walkFiles(js.Store, fn)
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func collectChanges(t *testing.T, js JournaledStore, since Seq) []Change {
+	it, err := js.Changes(since)
+	assert.Nil(t, err)
+
+	res := make([]Change, 0)
+	for it.Next() {
+		res = append(res, it.Change())
+	}
+	assert.Nil(t, it.Err())
+
+	return res
+}
+
+func TestJournaledStore_Changes(t *testing.T) {
+	s, _ := NewMemoryStore("/TestJournaledStore_Changes")
+	js, err := NewJournaledStore(s)
+	assert.Nil(t, err)
+
+	js.CreateFile("file")
+	js.Write("file", []byte("test"), 0)
+	js.SubStore("sub").CreateFile("file")
+	js.Truncate("file", 2)
+	js.RemoveFile("file")
+	assert.NotNil(t, js.RemoveFile("file")) // failed mutation is not recorded
+
+	changes := collectChanges(t, js, 0)
+	assert.Equal(t, 5, len(changes))
+	assert.Equal(t, Seq(5), js.LastSeq())
+
+	expected := []ChangeOp{ChangeCreate, ChangeWrite, ChangeCreate, ChangeTruncate, ChangeRemove}
+	for i, change := range changes {
+		assert.Equal(t, Seq(i + 1), change.Seq)
+		assert.Equal(t, expected[i], change.Op)
+	}
+	assert.Equal(t, "sub/file", changes[2].Name)
+	assert.Equal(t, int64(4), changes[1].Size)
+
+	// resume from checkpoint
+	changes = collectChanges(t, js, 3)
+	assert.Equal(t, 2, len(changes))
+	assert.Equal(t, Seq(4), changes[0].Seq)
+
+	// journal is hidden from files
+	for i := range js.FileIter() {
+		assert.False(t, isHidden(i.Name()))
+	}
+}
+
+func TestJournaledStore_Aliases(t *testing.T) {
+	s, _ := NewMemoryStore("/TestJournaledStore_Aliases")
+	js, _ := NewJournaledStore(s)
+
+	// changes through aliases are recorded by canonical names
+	assert.Nil(t, js.CreateFile("/file"))
+	assert.Nil(t, js.Write("./file", []byte("test"), 0))
+	assert.Nil(t, js.WriteV("file//", []Extent{{Offset: 0, Data: []byte("a")}}))
+	assert.Nil(t, js.SubStore("./sub/").CreateFile("./file"))
+
+	// rejected names are not recorded
+	assert.NotNil(t, js.CreateFile("../file"))
+	assert.NotNil(t, js.CreateFile(journalStore + "/" + journalFile))
+
+	changes := collectChanges(t, js, 0)
+	assert.Equal(t, 4, len(changes))
+	for i, name := range []string{"file", "file", "file", "sub/file"} {
+		assert.Equal(t, name, changes[i].Name)
+	}
+}
+
+func TestJournaledStore_Reopen(t *testing.T) {
+	s := NewFileSystemStore(path).SubStore("TestJournaledStore_Reopen")
+	js, _ := NewJournaledStore(s)
+
+	for i := 0; i < journalMarkInterval + 10; i++ {
+		js.CreateFile("file")
+	}
+	last := js.LastSeq()
+
+	// torn record at the tail
+	hidden := s.SubStore(journalStore)
+	info, _ := hidden.FileInfo(journalFile)
+	hidden.Write(journalFile, []byte{0x20, 0, 0}, info.Size())
+
+	reopened, err := NewJournaledStore(s)
+	assert.Nil(t, err)
+	assert.Equal(t, last, reopened.LastSeq())
+
+	reopened.RemoveFile("file")
+	changes := collectChanges(t, reopened, last - 1)
+	assert.Equal(t, 2, len(changes))
+	assert.Equal(t, last + 1, changes[1].Seq)
+	assert.Equal(t, ChangeRemove, changes[1].Op)
+}
+
+type hookedStore struct {
+	Store
+	write func()
+}
+
+func (s *hookedStore) Write(filename string, data []byte, startOffset int64) error {
+	s.write()
+	return s.Store.Write(filename, data, startOffset)
+}
+
+func TestJournaledStore_Pending(t *testing.T) {
+	s, _ := NewMemoryStore("/TestJournaledStore_Pending")
+	hooked := &hookedStore{Store: s, write: func() {}}
+	js, err := NewJournaledStore(hooked)
+	assert.Nil(t, err)
+
+	assert.Nil(t, js.CreateFile("file"))
+	info, _ := s.SubStore(journalStore).FileInfo(journalFile)
+	created := info.Size()
+
+	// change is appended before mutation, and is not visible until mutation is done
+	hooked.write = func() {
+		info, _ := s.SubStore(journalStore).FileInfo(journalFile)
+		assert.True(t, info.Size() > created)
+		assert.Equal(t, Seq(1), js.LastSeq())
+		assert.Equal(t, 1, len(collectChanges(t, js, 0)))
+	}
+	assert.Nil(t, js.Write("file", []byte("test"), 0))
+	assert.Equal(t, Seq(2), js.LastSeq())
+
+	// change of failed mutation is aborted
+	assert.NotNil(t, js.WriteIf("file", []byte("test"), 0, 1))
+	assert.Equal(t, Seq(2), js.LastSeq())
+	assert.Nil(t, js.Truncate("file", 1))
+
+	changes := collectChanges(t, js, 0)
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, ChangeTruncate, changes[2].Op)
+	assert.Equal(t, Seq(4), changes[2].Seq)
+
+	// aborted change is still aborted after reopen
+	reopened, err := NewJournaledStore(s)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(collectChanges(t, reopened, 0)))
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package store
+
+import "os"
+
+// advisory file lock is not supported, only mutations in process are serialized.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -1,10 +1,759 @@
 package store
 
 import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/overtheleaves/kayat-store/vfs"
 )
 
+/**
+ Store on memory file system.
+ path is absolute directory of this store in file system, ends with "/".
+ */
 type memoryStore struct {
-	path string
-	root vfs.File
+	path  string
+	fs    vfs.VirtualFileSystem
+	locks *stripedLock
+	clock vfs.Clock
+}
+
+func NewMemoryStore(mountOnPath string) (Store, error) {
+	return NewMemoryStoreWithOptions(mountOnPath, vfs.MemoryOptions{})
+}
+
+// NewMemoryStoreWithOptions returns memory store limited by options,
+// mutations exceeding limits fail with error satisfying vfs.IsNoSpace.
+// options.Clock gives time of files, like their expiry, so tests need not wait for time to pass.
+func NewMemoryStoreWithOptions(mountOnPath string, options vfs.MemoryOptions) (Store, error) {
+	fs, err := vfs.NewMemoryFileSystemWithOptions(mountOnPath, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memoryStore{path: "/", fs: fs, locks: &stripedLock{}, clock: options.Clock}, nil
+}
+
+// subpath is resolved as on the file system store, so it stays inside this store.
+func (ms *memoryStore) SubStore(subpath string) Store {
+	subpath = cleanSubPath(subpath)
+	if subpath == "" {
+		return ms
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	path := ms.path + subpath + "/"
+	if !ms.fs.FileExisted(context, path) {
+		ms.fs.Mkdir(context, path)
+	}
+
+	return &memoryStore{path: path, fs: ms.fs, locks: ms.locks, clock: ms.clock}
+}
+
+func (ms *memoryStore) IsFileExist(filename string) bool {
+	filename, err := cleanFileName("IsFileExist", filename)
+	if err != nil {
+		return false
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	return ms.fs.FileExisted(context, ms.path + filename)
+}
+
+func (ms *memoryStore) FileIter() <-chan FileInfo {
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	stats, err := ms.fs.ListSegments(context, ms.path)
+	if err != nil {
+		return nil
+	}
+
+	ch := make(chan FileInfo)
+	go func(stats []vfs.FileStat) {
+		for _, stat := range stats {
+			if !stat.IsDir() {
+				// iterate files, only
+				ch <- &fileInfo{stat.Name(), stat.Size(), stat.Generation()}
+			}
+		}
+
+		close(ch)
+	}(stats)
+
+	return ch
+}
+
+func (ms *memoryStore) FileInfo(filename string) (FileInfo, error) {
+	filename, err := cleanFileName("FileInfo", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	f, err := ms.fs.OpenFile(context, ms.path + filename)
+	if err != nil {
+		return nil, err
+	}
+
+	stat := f.Stat()
+	return &fileInfo{stat.Name(), stat.Size(), stat.Generation()}, nil
+}
+
+func (ms *memoryStore) Mkdir(dirname string) error {
+	dirname, err := checkDirName("Mkdir", dirname, false)
+	if err != nil {
+		return err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	if ms.fs.FileExisted(context, ms.path + dirname) {
+		return &os.PathError{Op: "Mkdir", Path: ms.path + dirname, Err: os.ErrExist}
+	}
+
+	err = checkParents("Mkdir", dirname, func(name string) bool {
+		f, err := ms.fs.OpenFile(context, ms.path + name)
+		return err == nil && !f.Stat().IsDir()
+	})
+	if err != nil {
+		return err
+	}
+
+	return ms.fs.Mkdir(context, ms.path + dirname)
+}
+
+func (ms *memoryStore) RemoveDir(dirname string, recursive bool) error {
+	dirname, err := checkDirName("RemoveDir", dirname, false)
+	if err != nil {
+		return err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	if _, err := ms.statDir(context, "RemoveDir", dirname); err != nil {
+		return err
+	}
+
+	if !recursive {
+		stats, err := ms.fs.ListSegments(context, ms.path + dirname)
+		if err != nil {
+			return err
+		}
+
+		// internal data is removed with directory
+		for _, stat := range stats {
+			if !isHidden(stat.Name()) {
+				return &os.PathError{Op: "RemoveDir", Path: ms.path + dirname, Err: directoryNotEmptyErr}
+			}
+		}
+	}
+
+	return ms.fs.Remove(context, ms.path + dirname)
+}
+
+func (ms *memoryStore) ListDirs(dirname string) ([]string, error) {
+	dirname, err := checkDirName("ListDirs", dirname, true)
+	if err != nil {
+		return nil, err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	if _, err := ms.statDir(context, "ListDirs", dirname); err != nil {
+		return nil, err
+	}
+
+	stats, err := ms.fs.ListSegments(context, ms.path + dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, stat := range stats {
+		if stat.IsDir() && !isHidden(stat.Name()) {
+			names = append(names, stat.Name())
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (ms *memoryStore) IsDirExist(dirname string) bool {
+	dirname, err := checkDirName("IsDirExist", dirname, true)
+	if err != nil {
+		return false
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	_, err = ms.statDir(context, "IsDirExist", dirname)
+	return err == nil
+}
+
+func (ms *memoryStore) DirInfo(dirname string) (DirInfo, error) {
+	dirname, err := checkDirName("DirInfo", dirname, true)
+	if err != nil {
+		return nil, err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	dir, err := ms.statDir(context, "DirInfo", dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := ms.fs.ListSegments(context, ms.path + dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &dirInfo{name: dirBase(dirname), modTime: dir.ModTime()}
+	for _, stat := range stats {
+		switch {
+		case isHidden(stat.Name()):
+		case stat.IsDir():
+			res.dirs++
+		default:
+			res.files++
+		}
+	}
+	return res, nil
+}
+
+// statDir returns stat of directory dirname, checked to be directory.
+func (ms *memoryStore) statDir(context *vfs.Context, op string, dirname string) (vfs.FileStat, error) {
+	f, err := ms.fs.OpenFile(context, ms.path + dirname)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: ms.path + dirname, Err: os.ErrNotExist}
+	}
+
+	stat := f.Stat()
+	if !stat.IsDir() {
+		return nil, &os.PathError{Op: op, Path: ms.path + dirname, Err: notDirectoryErr}
+	}
+	return stat, nil
+}
+
+func (ms *memoryStore) Read(filename string, res []byte, startOffset int64) error {
+	filename, err := cleanFileName("Read", filename)
+	if err != nil {
+		return err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	f, err := ms.fs.OpenFile(context, ms.path + filename)
+	if err != nil {
+		return err
+	}
+
+	return readAt(f, res, startOffset)
+}
+
+func (ms *memoryStore) ReadV(filename string, ranges []Range, parallelism int) error {
+	filename, err := cleanFileName("ReadV", filename)
+	if err != nil {
+		return err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	f, err := ms.fs.OpenFile(context, ms.path + filename)
+	if err != nil {
+		return err
+	}
+
+	return readSpansWith(ranges, parallelism, func(data []byte, offset int64) error {
+		return readAt(f, data, offset)
+	})
+}
+
+// readAt reads res from f at off, failing with io.EOF if f ends before.
+func readAt(f vfs.File, res []byte, off int64) error {
+	n, err := f.ReadAt(res, off)
+	if err == nil && n < len(res) {
+		// same as os.File.ReadAt
+		err = io.EOF
+	}
+
+	return err
+}
+
+func (ms *memoryStore) Write(filename string, data []byte, startOffset int64) error {
+	return ms.WriteIf(filename, data, startOffset, anyGeneration)
+}
+
+// WriteIf writes data only if generation of file is ifGeneration.
+func (ms *memoryStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	return ms.mutate("Write", filename, ifGeneration, func(f vfs.File) error {
+		_, err := f.WriteAt(data, startOffset)
+		return err
+	})
+}
+
+// WriteV writes extents under one lock, generation is changed once.
+func (ms *memoryStore) WriteV(filename string, extents []Extent) error {
+	return ms.mutate("WriteV", filename, anyGeneration, func(f vfs.File) error {
+		spans := writeSpans(extents)
+		data, offs := make([][]byte, len(spans)), make([]int64, len(spans))
+		for i, s := range spans {
+			data[i], offs[i] = s.join(), s.offset
+		}
+		return f.WriteAtV(data, offs)
+	})
+}
+
+func (ms *memoryStore) Clear(filename string, startOffset int64, size int64) error {
+	return ms.mutate("Clear", filename, anyGeneration, func(f vfs.File) error {
+		// range beyond end extends file by hole, like writing zeros
+		if end := startOffset + size; end > f.Stat().Size() {
+			if err := f.Truncate(end); err != nil {
+				return err
+			}
+		}
+		return f.PunchHole(startOffset, size)
+	})
+}
+
+func (ms *memoryStore) CreateFile(filename string) error {
+	return ms.create("CreateFile", filename, 0)
+}
+
+func (ms *memoryStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	return ms.create("CreateFileWithTTL", filename, ttl)
+}
+
+func (ms *memoryStore) create(op string, filename string, ttl time.Duration) error {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := ms.locks.lock(ms.path + filename)
+	defer m.Unlock()
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	if ms.fs.FileExisted(context, ms.path + filename) {
+		// truncate existing file like os.Create
+		f, err := ms.fs.OpenFile(context, ms.path + filename)
+		if err != nil {
+			return err
+		}
+
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+
+		var expiry time.Time
+		if ttl > 0 {
+			expiry = ms.now().Add(ttl)
+		}
+		return ms.fs.SetExpiry(context, ms.path + filename, expiry)
+	}
+
+	_, err = ms.fs.CreateFileWithTTL(context, ms.path + filename, ttl)
+	return err
+}
+
+// replaceFile replaces data of file as one change, creating file if not existed.
+func (ms *memoryStore) replaceFile(filename string, data []byte) error {
+	filename, err := cleanFileName("Replace", filename)
+	if err != nil {
+		return err
+	}
+
+	m := ms.locks.lock(ms.path + filename)
+	defer m.Unlock()
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	f, err := ms.fs.OpenFile(context, ms.path + filename)
+	if err != nil {
+		if f, err = ms.fs.NewFile(context, ms.path + filename); err != nil {
+			return err
+		}
+	}
+	return f.Replace(data)
+}
+
+func (ms *memoryStore) SetExpiry(filename string, expiry time.Time) error {
+	filename, err := cleanFileName("SetExpiry", filename)
+	if err != nil {
+		return err
+	}
+
+	m := ms.locks.lock(ms.path + filename)
+	defer m.Unlock()
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	return ms.fs.SetExpiry(context, ms.path + filename, expiry)
+}
+
+// now returns time of clock of file system.
+func (ms *memoryStore) now() time.Time {
+	if ms.clock == nil {
+		return time.Now()
+	}
+	return ms.clock.Now()
+}
+
+// CreateIfNotExists creates empty file, only if file does not exist.
+func (ms *memoryStore) CreateIfNotExists(filename string) error {
+	filename, err := cleanFileName("CreateIfNotExists", filename)
+	if err != nil {
+		return err
+	}
+
+	m := ms.locks.lock(ms.path + filename)
+	defer m.Unlock()
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	if f, err := ms.fs.OpenFile(context, ms.path + filename); err == nil {
+		return &PreconditionFailedError{Op: "CreateIfNotExists", Path: ms.path + filename, Expected: 0, Actual: f.Stat().Generation()}
+	}
+
+	_, err = ms.fs.NewFile(context, ms.path + filename)
+	return err
+}
+
+func (ms *memoryStore) RemoveFile(filename string) error {
+	return ms.RemoveIfMatch(filename, anyGeneration)
+}
+
+// RemoveIfMatch removes file only if generation of file is ifGeneration.
+func (ms *memoryStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	filename, err := cleanFileName("RemoveIfMatch", filename)
+	if err != nil {
+		return err
+	}
+
+	m := ms.locks.lock(ms.path + filename)
+	defer m.Unlock()
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	if ifGeneration != anyGeneration {
+		f, err := ms.fs.OpenFile(context, ms.path + filename)
+		if err != nil {
+			return err
+		}
+
+		if err := ms.checkGeneration("RemoveIfMatch", filename, f, ifGeneration); err != nil {
+			return err
+		}
+	}
+
+	return ms.fs.Remove(context, ms.path + filename)
+}
+
+// Mmap returns view sharing data of file.
+func (ms *memoryStore) Mmap(filename string) (vfs.ReadOnlyMapping, error) {
+	filename, err := cleanFileName("Mmap", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	f, err := ms.fs.OpenFile(context, ms.path + filename)
+	if err != nil {
+		return nil, err
+	}
+	return f.Mmap()
+}
+
+// Preallocate checks file exists only, pages are allocated when written.
+func (ms *memoryStore) Preallocate(filename string, size int64) error {
+	filename, err := cleanFileName("Preallocate", filename)
+	if err != nil {
+		return err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	_, err = ms.fs.OpenFile(context, ms.path + filename)
+	return err
+}
+
+func (ms *memoryStore) Truncate(filename string, size int64) error {
+	return ms.mutate("Truncate", filename, anyGeneration, func(f vfs.File) error {
+		return f.Truncate(size)
+	})
+}
+
+// mutate applies mutation to file holding lock of it.
+// if ifGeneration is not anyGeneration, mutation is applied only if generation matches.
+func (ms *memoryStore) mutate(op string, filename string, ifGeneration uint64, mutation func(f vfs.File) error) error {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := ms.locks.lock(ms.path + filename)
+	defer m.Unlock()
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	f, err := ms.fs.OpenFile(context, ms.path + filename)
+	if err != nil {
+		return err
+	}
+
+	if err := ms.checkGeneration(op, filename, f, ifGeneration); err != nil {
+		return err
+	}
+
+	return mutation(f)
+}
+
+func (ms *memoryStore) checkGeneration(op string, filename string, f vfs.File, ifGeneration uint64) error {
+	if ifGeneration == anyGeneration {
+		return nil
+	}
+
+	if generation := f.Stat().Generation(); generation != ifGeneration {
+		return &PreconditionFailedError{Op: op, Path: ms.path + filename, Expected: ifGeneration, Actual: generation}
+	}
+
+	return nil
+}
+
+// Watch emits changes of files under path, events are synthesized by memory file system.
+// event paths are relative to this store.
+func (ms *memoryStore) Watch(path string, recursive bool) (<-chan vfs.Event, func(), error) {
+	context := ms.fs.Context()
+
+	events, cancel, err := ms.fs.Watch(context, ms.path + strings.Trim(path, "/"), recursive)
+	if err != nil {
+		ms.fs.ReleaseContext(context)
+		return nil, nil, err
+	}
+
+	return relayEvents(events, func() {
+		cancel()
+		ms.fs.ReleaseContext(context)
+	}, func(name string) (string, bool) {
+		name = strings.TrimPrefix(name, ms.path)
+		return name, !isHidden(name)
+	})
+}
+
+// Snapshot clones files of this store and its sub stores into read-only snapshot.
+// file data are shared copy-on-write by memory file system.
+// mutations wait until files are cloned, so snapshot is taken at one point of time.
+func (ms *memoryStore) Snapshot(name string) error {
+	if err := checkSnapshotName("Snapshot", name); err != nil {
+		return err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	dst := ms.path + snapshotStore + "/" + name
+	if ms.fs.FileExisted(context, dst) {
+		return &os.PathError{Op: "Snapshot", Path: dst, Err: snapshotExistsErr}
+	}
+
+	// whole tree is cloned at once, so incomplete snapshot is not exposed
+	unlock := ms.locks.lockAll()
+	defer unlock()
+
+	return ms.fs.CloneTree(context, ms.path, dst, skipSnapshot)
+}
+
+func (ms *memoryStore) ListSnapshots() ([]string, error) {
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	names := make([]string, 0)
+	if !ms.fs.FileExisted(context, ms.path + snapshotStore) {
+		return names, nil
+	}
+
+	stats, err := ms.fs.ListSegments(context, ms.path + snapshotStore)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stat := range stats {
+		if stat.IsDir() && !isHidden(stat.Name()) {
+			names = append(names, stat.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func (ms *memoryStore) OpenSnapshot(name string) (Store, error) {
+	if err := checkSnapshotName("OpenSnapshot", name); err != nil {
+		return nil, err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	path := ms.path + snapshotStore + "/" + name
+	if !ms.fs.FileExisted(context, path) {
+		return nil, &os.PathError{Op: "OpenSnapshot", Path: path, Err: noSuchSnapshotErr}
+	}
+
+	return newReadOnlyStore(&memoryStore{path: path + "/", fs: ms.fs, locks: ms.locks, clock: ms.clock}), nil
+}
+
+func (ms *memoryStore) DeleteSnapshot(name string) error {
+	if err := checkSnapshotName("DeleteSnapshot", name); err != nil {
+		return err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	path := ms.path + snapshotStore + "/" + name
+	if !ms.fs.FileExisted(context, path) {
+		return &os.PathError{Op: "DeleteSnapshot", Path: path, Err: noSuchSnapshotErr}
+	}
+
+	return ms.fs.Remove(context, path)
+}
+
+// Sync checks file exists only, memory files are not kept in storage.
+func (ms *memoryStore) Sync(filename string) error {
+	filename, err := cleanFileName("Sync", filename)
+	if err != nil {
+		return err
+	}
+
+	context := ms.fs.Context()
+	defer ms.fs.ReleaseContext(context)
+
+	_, err = ms.fs.OpenFile(context, ms.path + filename)
+	return err
+}
+
+func (ms *memoryStore) SyncAll() error {
+	return nil
+}
+
+// Close does nothing, memory files are not opened by handles.
+func (ms *memoryStore) Close() error {
+	return nil
+}
+
+// scrub verifies files of this store and its sub stores.
+// memory file system leaves no temporary files or metadata to check.
+func (ms *memoryStore) scrub(r *scrubRun) error {
+	return ms.scrubDir(r, "")
+}
+
+func (ms *memoryStore) scrubDir(r *scrubRun, dir string) error {
+	context := ms.fs.ContextWithParent(r.ctx)
+	stats, err := ms.fs.ListSegments(context, ms.path + dir)
+	ms.fs.ReleaseContext(context)
+
+	if err != nil {
+		if ctxErr := r.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		r.problem(ScrubUnreadable, dir, err, nil)
+		return nil
+	}
+
+	for _, stat := range stats {
+		if isHidden(stat.Name()) {
+			continue
+		}
+
+		if stat.IsDir() {
+			err = ms.scrubDir(r, dir + stat.Name() + "/")
+		} else {
+			err = r.verify(dir + stat.Name())
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeExpired removes expired files of this store and its sub stores.
+func (ms *memoryStore) removeExpired(fn func(name string) error) error {
+	context := ms.fs.Context()
+	removed, err := ms.fs.RemoveExpired(context, ms.path)
+	ms.fs.ReleaseContext(context)
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range removed {
+		if err := fn(strings.TrimPrefix(name, ms.path)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ms *memoryStore) walkFiles(fn func(name string) error) error {
+	return ms.walkDir("", fn)
+}
+
+func (ms *memoryStore) walkDir(dir string, fn func(name string) error) error {
+	context := ms.fs.Context()
+	stats, err := ms.fs.ListSegments(context, ms.path + dir)
+	if err != nil && dir != "" && !ms.fs.FileExisted(context, ms.path + dir) {
+		// removed while walking
+		err = nil
+	}
+	ms.fs.ReleaseContext(context)
+
+	if err != nil {
+		return err
+	}
+
+	for _, stat := range stats {
+		if stat.IsDir() {
+			err = ms.walkDir(dir + stat.Name() + "/", fn)
+		} else {
+			err = fn(dir + stat.Name())
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+func TestMemoryStore_CreateFile(t *testing.T) {
+	filename := "TestMemoryStore_CreateFile"
+	m, err := NewMemoryStore("/TestMemoryStore_CreateFile")
+	assert.Nil(t, err)
+
+	assert.Nil(t, m.CreateFile(filename))
+	assert.True(t, m.IsFileExist(filename))
+
+	assert.Nil(t, m.RemoveFile(filename))
+	assert.False(t, m.IsFileExist(filename))
+}
+
+func TestMemoryStore_WriteRead(t *testing.T) {
+	filename := "TestMemoryStore_WriteRead"
+	m, _ := NewMemoryStore("/TestMemoryStore_WriteRead")
+	m.CreateFile(filename)
+
+	assert.Nil(t, m.Write(filename, []byte("test"), 0))
+
+	res := make([]byte, 4)
+	assert.Nil(t, m.Read(filename, res, 0))
+	assert.Equal(t, "test", string(res))
+
+	info, err := m.FileInfo(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.Size())
+
+	assert.Nil(t, m.Clear(filename, 1, 2))
+	assert.Nil(t, m.Read(filename, res, 0))
+	assert.Equal(t, "t\x00\x00t", string(res))
+
+	assert.Nil(t, m.Truncate(filename, 2))
+	assert.NotNil(t, m.Read(filename, res, 0))
+}
+
+func TestMemoryStore_FileIter(t *testing.T) {
+	m, _ := NewMemoryStore("/TestMemoryStore_FileIter")
+	m.CreateFile("file1")
+	m.CreateFile("file2")
+	sub := m.SubStore("sub")
+	sub.CreateFile("file3")
+
+	res := map[string]bool{}
+	for i := range m.FileIter() {
+		res[i.Name()] = true
+	}
+
+	assert.Equal(t, map[string]bool{"file1": true, "file2": true}, res)
+	assert.True(t, sub.IsFileExist("file3"))
+	assert.True(t, m.IsFileExist("sub/file3"))
+}
+
+func TestMemoryStore_Traversal(t *testing.T) {
+	m, _ := NewMemoryStore("/TestMemoryStore_Traversal")
+	s := m.SubStore("store")
+
+	for _, name := range []string{"", "/", ".", "..", "../a", "a/../b", "a/..", "a\x00b", ".kayat_meta/file", "a/.kayat_x", hiddenPrefix} {
+		assert.NotNil(t, s.CreateFile(name), name)
+	}
+	assert.NotNil(t, s.CreateFile("../escaped"))
+	assert.NotNil(t, s.CreateFile(".kayat_journal/changes"))
+	assert.NotNil(t, s.CreateIfNotExists("a/../../escaped"))
+	assert.NotNil(t, s.Write("../escaped", []byte("data"), 0))
+	assert.NotNil(t, s.RemoveFile("../store"))
+	assert.False(t, m.IsFileExist("escaped"))
+	assert.False(t, s.IsFileExist("../store"))
+
+	// names are canonicalized
+	assert.Nil(t, s.CreateFile("/file"))
+	assert.Nil(t, s.Write("./file", []byte("data"), 0))
+	res := make([]byte, 4)
+	assert.Nil(t, s.Read("file", res, 0))
+	assert.Equal(t, "data", string(res))
+
+	// sub stores do not lead out of store
+	sub := s.SubStore("../../sub")
+	assert.Nil(t, sub.CreateFile("file"))
+	assert.True(t, s.IsFileExist("sub/file"))
+	assert.False(t, m.IsFileExist("sub/file"))
+}
+
+func TestMemoryStore_Watch(t *testing.T) {
+	m, _ := NewMemoryStore("/TestMemoryStore_Watch")
+	sub := m.SubStore("sub")
+
+	events, cancel, err := sub.Watch("", false)
+	assert.Nil(t, err)
+	defer cancel()
+
+	sub.CreateFile("file")
+	assert.True(t, waitStoreEvent(events, "file", vfs.Create))
+
+	sub.Write("file", []byte("test"), 0)
+	assert.True(t, waitStoreEvent(events, "file", vfs.Write))
+
+	sub.RemoveFile("file")
+	assert.True(t, waitStoreEvent(events, "file", vfs.Remove))
+}
+
+// waitStoreEvent receives events until an event on name with op arrives.
+func waitStoreEvent(events <-chan vfs.Event, name string, op vfs.EventOp) bool {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Path == name && ev.Op&op != 0 {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
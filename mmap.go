@@ -0,0 +1,21 @@
+package store
+
+import "github.com/overtheleaves/kayat-store/vfs"
+
+// readMapping returns view of copy of data of file of s, for stores which can not map data of files,
+// since it is transformed or cached.
+func readMapping(s Store, filename string) (vfs.ReadOnlyMapping, error) {
+	info, err := s.FileInfo(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, info.Size())
+	if len(data) > 0 {
+		if err := s.Read(filename, data, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return vfs.MapBytes(data), nil
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_Mmap(t *testing.T) {
+	for _, s := range testStores(t, "TestStore_Mmap") {
+		assert.Nil(t, s.CreateFile("file"))
+		assert.Nil(t, s.Write("file", []byte("index data"), 0))
+
+		m, err := s.Mmap("file")
+		assert.Nil(t, err)
+		assert.Equal(t, "index data", string(m.Bytes()))
+
+		// writes in place are seen
+		assert.Nil(t, s.Write("file", []byte("INDEX"), 0))
+		assert.Equal(t, "INDEX data", string(m.Bytes()))
+
+		assert.Nil(t, m.Close())
+		assert.Nil(t, m.Bytes())
+		assert.Nil(t, m.Close())
+
+		assert.Nil(t, s.CreateFile("empty"))
+		m, err = s.Mmap("empty")
+		assert.Nil(t, err)
+		assert.Empty(t, m.Bytes())
+
+		_, err = s.Mmap("none")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestChecksumStore_Mmap(t *testing.T) {
+	for _, s := range testStores(t, "TestChecksumStore_Mmap") {
+		cs := NewChecksumStore(s, ChecksumOptions{BlockSize: 4})
+		assert.Nil(t, cs.CreateFile("file"))
+		assert.Nil(t, cs.Write("file", []byte("0123456789"), 0))
+
+		m, err := cs.Mmap("file")
+		assert.Nil(t, err)
+		assert.Equal(t, "0123456789", string(m.Bytes()))
+		m.Close()
+
+		// corruption under checksum store is detected
+		assert.Nil(t, s.Write("file", []byte("x"), 5))
+		_, err = cs.Mmap("file")
+		assert.True(t, IsCorrupted(err))
+	}
+}
+
+func TestCompressedStore_Mmap(t *testing.T) {
+	for _, s := range testStores(t, "TestCompressedStore_Mmap") {
+		cs := Compressed(s, Snappy)
+		assert.Nil(t, cs.CreateFile("file"))
+		assert.Nil(t, cs.Write("file", []byte("aaaaaaaaaaaaaaaa"), 0))
+
+		m, err := cs.Mmap("file")
+		assert.Nil(t, err)
+		assert.Equal(t, "aaaaaaaaaaaaaaaa", string(m.Bytes()))
+		assert.Nil(t, m.Close())
+	}
+}
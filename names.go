@@ -0,0 +1,116 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	illegalFileNameErr = errors.New("illegal file name")
+	escapesStoreErr    = errors.New("path escapes store")
+)
+
+// cleanName returns name canonicalized relative to store, slashes are trimmed and
+// empty or "." segments are dropped, so "/a//./b/" names "a/b".
+// names with ".." segments, NUL or separators of other platforms are rejected, not to lead out of store,
+// and so are names of internal data, which is reached through hidden sub stores only.
+// store itself is named by "" only if root is true.
+func cleanName(op string, name string, root bool) (string, error) {
+	if strings.ContainsRune(name, 0) || (os.PathSeparator != '/' && strings.ContainsRune(name, os.PathSeparator)) {
+		return "", &os.PathError{Op: op, Path: name, Err: illegalFileNameErr}
+	}
+
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." || strings.HasPrefix(segment, hiddenPrefix) {
+			return "", &os.PathError{Op: op, Path: name, Err: illegalFileNameErr}
+		} else if segment != "" && segment != "." {
+			segments = append(segments, segment)
+		}
+	}
+
+	if len(segments) == 0 && !root {
+		return "", &os.PathError{Op: op, Path: name, Err: illegalFileNameErr}
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// cleanFileName returns filename canonicalized by cleanName, if it names file of store.
+func cleanFileName(op string, filename string) (string, error) {
+	return cleanName(op, filename, false)
+}
+
+// cleanSubPath returns subpath canonicalized like chroot does,
+// ".." of store itself is store itself, so sub store is always under store.
+func cleanSubPath(subpath string) string {
+	if os.PathSeparator != '/' {
+		subpath = strings.Replace(subpath, string(os.PathSeparator), "/", -1)
+	}
+
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(subpath, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments) - 1]
+			}
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// checkResolved checks name resolves beneath root, following symbolic links of existing part of it.
+// dangling symbolic links are rejected, as files created through them may be out of root.
+// used where openat2 is not supported, so links changed after checked are not detected.
+func checkResolved(root string, name string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(root, name)
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			rel, err := filepath.Rel(realRoot, real)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+				return escapesStoreErr
+			}
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if info, err := os.Lstat(path); err == nil && info.Mode() & os.ModeSymlink != 0 {
+			return escapesStoreErr
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return err
+		}
+		path = parent
+	}
+}
+
+// openUnder opens file at path by openBeneath, if root is not "" and path is under it.
+// paths of file system store and its sub stores are under root, as they are joined to it.
+func openUnder(root string, path string, flag int, perm os.FileMode) (*os.File, error) {
+	if root == "" || !strings.HasPrefix(path, root) {
+		return os.OpenFile(path, flag, perm)
+	}
+	return openBeneath(root, path[len(root):], flag, perm)
+}
+
+// openChecked opens name under root after checked by checkResolved.
+func openChecked(root string, name string, flag int, perm os.FileMode) (*os.File, error) {
+	if err := checkResolved(root, name); err != nil {
+		return nil, &os.PathError{Op: "open", Path: root + name, Err: err}
+	}
+	return os.OpenFile(root + name, flag, perm)
+}
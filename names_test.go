@@ -0,0 +1,107 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanName(t *testing.T) {
+	name, err := cleanFileName("test", "/a//./b/")
+	assert.Nil(t, err)
+	assert.Equal(t, "a/b", name)
+
+	for _, illegal := range []string{"", "/", ".", "..", "../a", "a/../b", "a/..", "a\x00b", ".kayat_meta/file", "a/.kayat_x", hiddenPrefix} {
+		_, err := cleanFileName("test", illegal)
+		assert.NotNil(t, err, illegal)
+	}
+
+	name, err = cleanName("test", "/", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "", name)
+
+	assert.Equal(t, "x", cleanSubPath("../../x"))
+	assert.Equal(t, "b", cleanSubPath("/a/../../b/."))
+	assert.Equal(t, "", cleanSubPath(".."))
+}
+
+func TestFileSystemStore_Traversal(t *testing.T) {
+	root := path + "/TestFileSystemStore_Traversal"
+	s := NewFileSystemStore(root).SubStore("store")
+
+	assert.NotNil(t, s.CreateFile("../escaped"))
+	assert.NotNil(t, s.CreateIfNotExists("a/../../escaped"))
+	assert.NotNil(t, s.Write("../escaped", []byte("data"), 0))
+	assert.NotNil(t, s.RemoveFile("../store"))
+	assert.False(t, isFileExist(root + "/escaped"))
+
+	// names are canonicalized
+	assert.Nil(t, s.CreateFile("/file"))
+	assert.Nil(t, s.Write("./file", []byte("data"), 0))
+	res := make([]byte, 4)
+	assert.Nil(t, s.Read("file", res, 0))
+	assert.Equal(t, "data", string(res))
+
+	// sub stores do not lead out of store
+	sub := s.SubStore("../../sub")
+	assert.Nil(t, sub.CreateFile("file"))
+	assert.True(t, s.IsFileExist("sub/file"))
+	assert.False(t, isFileExist(root + "/sub"))
+}
+
+func TestFileSystemStore_ResolveBeneath(t *testing.T) {
+	root := path + "/TestFileSystemStore_ResolveBeneath"
+	outside := NewFileSystemStore(root + "/outside")
+	assert.Nil(t, outside.CreateFile("secret"))
+
+	s := NewFileSystemStoreWithOptions(root + "/store", FileSystemOptions{ResolveBeneath: true})
+	assert.Nil(t, s.Mkdir("dir"))
+	assert.Nil(t, s.CreateFile("dir/file"))
+
+	absOutside, _ := filepath.Abs(root + "/outside")
+	if err := os.Symlink(absOutside, root + "/store/out"); err != nil {
+		t.Skip("symbolic links are not supported:", err)
+	}
+	assert.Nil(t, os.Symlink("../outside", root + "/store/relative"))
+	assert.Nil(t, os.Symlink("dir", root + "/store/in"))
+
+	// links in store are followed
+	assert.Nil(t, s.Write("in/file", []byte("data"), 0))
+	res := make([]byte, 4)
+	assert.Nil(t, s.Read("dir/file", res, 0))
+	assert.Equal(t, "data", string(res))
+
+	// links out of store are not
+	for _, link := range []string{"out", "relative"} {
+		assert.NotNil(t, s.Read(link + "/secret", res, 0))
+		assert.False(t, s.IsFileExist(link + "/secret"))
+		assert.NotNil(t, s.CreateFile(link + "/created"))
+		assert.NotNil(t, s.RemoveFile(link + "/secret"))
+		assert.False(t, s.SubStore(link).IsFileExist("secret"))
+	}
+	assert.False(t, outside.IsFileExist("created"))
+
+	// files changed are synced beneath store too
+	_, err := s.(*fileSystemStore).handles.open(root + "/store/out/secret")
+	assert.NotNil(t, err)
+	assert.NotNil(t, s.(*fileSystemStore).syncer.sync([]string{root + "/store/relative/secret"}, nil))
+	assert.False(t, outside.IsFileExist("created"))
+	assert.True(t, outside.IsFileExist("secret"))
+
+	// dangling link is not created through
+	assert.Nil(t, os.Symlink(absOutside + "/dangling", root + "/store/dangling"))
+	assert.NotNil(t, s.CreateFile("dangling"))
+	assert.False(t, outside.IsFileExist("dangling"))
+
+	// without option, links are followed anywhere
+	plain := NewFileSystemStore(root + "/store")
+	assert.True(t, plain.IsFileExist("out/secret"))
+
+	// fallback check gives same results
+	assert.Nil(t, checkResolved(root + "/store/", "in/file"))
+	assert.Equal(t, escapesStoreErr, checkResolved(root + "/store/", "out/secret"))
+	assert.Equal(t, escapesStoreErr, checkResolved(root + "/store/", "relative/missing"))
+	assert.Equal(t, escapesStoreErr, checkResolved(root + "/store/", "dangling"))
+}
@@ -0,0 +1,543 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	quotasStore = hiddenPrefix + "quota"
+	quotaFile   = "quotas"
+
+	// version(1) count(4), entries of pathLen(2) path maxBytes(8) maxFiles(8), crc32 of preceding bytes(4)
+	quotaVersion    = 1
+	quotaHeaderSize = 5
+)
+
+var (
+	corruptedQuotasErr  = errors.New("corrupted quotas")
+	illegalQuotaPathErr = errors.New("illegal quota path")
+)
+
+/**
+ Quota of a directory, including its sub directories.
+ zero means no limit.
+ */
+type Quota struct {
+	MaxBytes int64
+	MaxFiles int64
+}
+
+/**
+ Usage of a directory, including its sub directories.
+ */
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+/**
+ QuotaExceededError is returned when mutation would exceed quota.
+ Quota is path of directory of exceeded quota, Resource is "bytes" or "files".
+ */
+type QuotaExceededError struct {
+	Op       string
+	Path     string
+	Quota    string
+	Resource string
+	Limit    int64
+}
+
+/**
+ Store enforcing quotas of bytes and files on directories,
+ like SubStore given to each tenant.
+ usage is accounted on mutations through this store, after scanning all files once when opened,
+ so mutations bypassing it are accounted only when file is mutated through it again.
+ internal data in hidden area, like snapshots, is not accounted.
+ paths are relative to this store, "" is whole store.
+ */
+type QuotaStore interface {
+	Store
+	// SetQuota sets quota of path, zero Quota removes it.
+	// quota lower than current usage only rejects growth.
+	SetQuota(path string, quota Quota) error
+	Quota(path string) Quota
+	Usage(path string) Usage
+}
+
+type quotaStore struct {
+	Store
+	quotas *quotas
+	prefix string
+}
+
+type quotas struct {
+	mu     sync.Mutex
+	dir    Store
+	limits map[string]Quota
+	// usage of directories having files, "" is root
+	usage  map[string]*Usage
+	// sizes of files
+	files  map[string]int64
+	locks  stripedLock
+}
+
+func (e *QuotaExceededError) Error() string {
+	return e.Op + " " + e.Path + ": quota of \"" + e.Quota + "\" exceeded: " + e.Resource + " limit " + strconv.FormatInt(e.Limit, 10)
+}
+
+// IsQuotaExceeded returns true if err is, or is caused by, QuotaExceededError.
+func IsQuotaExceeded(err error) bool {
+	switch e := err.(type) {
+	case *QuotaExceededError:
+		return true
+	case *os.PathError:
+		return IsQuotaExceeded(e.Err)
+	}
+	return false
+}
+
+// NewQuotaStore loads quotas kept in hidden area of s, and scans all files of s for their usage.
+func NewQuotaStore(s Store) (QuotaStore, error) {
+	q := &quotas{
+		dir:    s.SubStore(quotasStore),
+		usage:  make(map[string]*Usage),
+		files:  make(map[string]int64),
+	}
+
+	limits, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	q.limits = limits
+
+	err = walkFiles(s, func(name string) error {
+		if isHidden(name) {
+			return nil
+		}
+
+		info, err := s.FileInfo(name)
+		if err != nil {
+			// removed while walking
+			return nil
+		}
+
+		q.account(name, info.Size(), 1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &quotaStore{Store: s, quotas: q}, nil
+}
+
+// SubStore returns store of subpath canonicalized by cleanSubPath,
+// so files are accounted by same names however they are reached.
+func (qs *quotaStore) SubStore(subpath string) Store {
+	subpath = cleanSubPath(subpath)
+	if subpath == "" {
+		return qs
+	}
+
+	return &quotaStore{
+		Store:  qs.Store.SubStore(subpath),
+		quotas: qs.quotas,
+		prefix: qs.prefix + subpath + "/",
+	}
+}
+
+func (qs *quotaStore) SetQuota(path string, quota Quota) error {
+	dir, err := qs.dirPath(path)
+	if err != nil {
+		return &os.PathError{Op: "SetQuota", Path: path, Err: illegalQuotaPathErr}
+	}
+	path = dir
+
+	q := qs.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	limits := make(map[string]Quota, len(q.limits) + 1)
+	for p, l := range q.limits {
+		limits[p] = l
+	}
+
+	if quota.MaxBytes > 0 || quota.MaxFiles > 0 {
+		limits[path] = quota
+	} else {
+		delete(limits, path)
+	}
+
+	if err := q.save(limits); err != nil {
+		return err
+	}
+
+	q.limits = limits
+	return nil
+}
+
+func (qs *quotaStore) Quota(path string) Quota {
+	path, err := qs.dirPath(path)
+	if err != nil {
+		return Quota{}
+	}
+
+	q := qs.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.limits[path]
+}
+
+// Usage returns totals of directory path, or of file if path is a file.
+func (qs *quotaStore) Usage(path string) Usage {
+	path, err := qs.dirPath(path)
+	if err != nil {
+		return Usage{}
+	}
+
+	q := qs.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if size, ok := q.files[path]; ok {
+		return Usage{Bytes: size, Files: 1}
+	}
+
+	if u, ok := q.usage[path]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+func (qs *quotaStore) Write(filename string, data []byte, startOffset int64) error {
+	return qs.mutate("Write", filename, false, func() int64 {
+		return startOffset + int64(len(data))
+	}, func(filename string) error {
+		return qs.Store.Write(filename, data, startOffset)
+	})
+}
+
+func (qs *quotaStore) WriteV(filename string, extents []Extent) error {
+	return qs.mutate("WriteV", filename, false, func() int64 {
+		_, to := extentsRange(extents)
+		return to
+	}, func(filename string) error {
+		return qs.Store.WriteV(filename, extents)
+	})
+}
+
+func (qs *quotaStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	return qs.mutate("WriteIf", filename, false, func() int64 {
+		return startOffset + int64(len(data))
+	}, func(filename string) error {
+		return qs.Store.WriteIf(filename, data, startOffset, ifGeneration)
+	})
+}
+
+func (qs *quotaStore) Clear(filename string, startOffset int64, size int64) error {
+	return qs.mutate("Clear", filename, false, func() int64 {
+		return startOffset + size
+	}, func(filename string) error {
+		return qs.Store.Clear(filename, startOffset, size)
+	})
+}
+
+func (qs *quotaStore) Truncate(filename string, size int64) error {
+	return qs.mutate("Truncate", filename, false, func() int64 {
+		return size
+	}, func(filename string) error {
+		return qs.Store.Truncate(filename, size)
+	})
+}
+
+func (qs *quotaStore) replaceFile(filename string, data []byte) error {
+	return qs.mutate("Replace", filename, true, func() int64 {
+		return int64(len(data))
+	}, func(filename string) error {
+		return replaceFile(qs.Store, filename, data)
+	})
+}
+
+func (qs *quotaStore) CreateFile(filename string) error {
+	return qs.mutate("CreateFile", filename, true, nil, func(filename string) error {
+		return qs.Store.CreateFile(filename)
+	})
+}
+
+func (qs *quotaStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	return qs.mutate("CreateFileWithTTL", filename, true, nil, func(filename string) error {
+		return qs.Store.CreateFileWithTTL(filename, ttl)
+	})
+}
+
+func (qs *quotaStore) CreateIfNotExists(filename string) error {
+	return qs.mutate("CreateIfNotExists", filename, true, nil, func(filename string) error {
+		return qs.Store.CreateIfNotExists(filename)
+	})
+}
+
+// RemoveDir releases usage of each file, if recursive.
+func (qs *quotaStore) RemoveDir(dirname string, recursive bool) error {
+	if recursive {
+		if err := removeDirFiles(qs, dirname); err != nil {
+			return err
+		}
+	}
+	return qs.Store.RemoveDir(dirname, recursive)
+}
+
+func (qs *quotaStore) RemoveFile(filename string) error {
+	return qs.mutate("RemoveFile", filename, false, nil, func(filename string) error {
+		return qs.Store.RemoveFile(filename)
+	})
+}
+
+func (qs *quotaStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	return qs.mutate("RemoveIfMatch", filename, false, nil, func(filename string) error {
+		return qs.Store.RemoveIfMatch(filename, ifGeneration)
+	})
+}
+
+// mutate reserves growth of file to size returned by resize, and new file if create,
+// applies mutation to canonical name of file, then accounts file as it is after mutation.
+// files of hidden sub stores, reached by wrapping stores for their internal data, are not accounted.
+func (qs *quotaStore) mutate(op string, filename string, create bool, resize func() int64, mutation func(filename string) error) error {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return err
+	}
+
+	name := qs.prefix + filename
+	if isHidden(qs.prefix) {
+		return mutation(filename)
+	}
+
+	q := qs.quotas
+	m := q.locks.lock(name)
+	defer m.Unlock()
+
+	q.mu.Lock()
+	size, exists := q.files[name]
+
+	var bytes, files int64
+	if resize != nil {
+		bytes = resize() - size
+		if bytes < 0 {
+			bytes = 0
+		}
+	}
+	if create && !exists {
+		files = 1
+	}
+
+	if err := q.reserve(op, name, bytes, files); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	q.mu.Unlock()
+
+	err = mutation(filename)
+
+	// mutation may be applied partially even if failed
+	info, ierr := qs.Store.FileInfo(filename)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.account(name, -bytes, -files)
+	size, exists = q.files[name]
+	switch {
+	case ierr == nil && exists:
+		q.account(name, info.Size() - size, 0)
+	case ierr == nil:
+		q.account(name, info.Size(), 1)
+	case exists:
+		q.account(name, -size, -1)
+	}
+
+	return err
+}
+
+// reserve accounts bytes and files to be added to name, if they fit in quotas of its directories.
+// called with q.mu locked.
+func (q *quotas) reserve(op string, name string, bytes int64, files int64) error {
+	if bytes > 0 || files > 0 {
+		for _, dir := range parentDirs(name) {
+			quota, ok := q.limits[dir]
+			if !ok {
+				continue
+			}
+
+			var u Usage
+			if du, ok := q.usage[dir]; ok {
+				u = *du
+			}
+
+			if bytes > 0 && quota.MaxBytes > 0 && u.Bytes + bytes > quota.MaxBytes {
+				return &QuotaExceededError{Op: op, Path: name, Quota: dir, Resource: "bytes", Limit: quota.MaxBytes}
+			}
+			if files > 0 && quota.MaxFiles > 0 && u.Files + files > quota.MaxFiles {
+				return &QuotaExceededError{Op: op, Path: name, Quota: dir, Resource: "files", Limit: quota.MaxFiles}
+			}
+		}
+	}
+
+	q.account(name, bytes, files)
+	return nil
+}
+
+// account adds bytes and files to usage of file name and its directories.
+// file is forgotten when files gets it to 0.
+func (q *quotas) account(name string, bytes int64, files int64) {
+	if bytes == 0 && files == 0 {
+		return
+	}
+
+	size, exists := q.files[name]
+	switch {
+	case exists && files < 0:
+		delete(q.files, name)
+	case exists || files > 0:
+		q.files[name] = size + bytes
+	}
+
+	for _, dir := range parentDirs(name) {
+		u, ok := q.usage[dir]
+		if !ok {
+			u = &Usage{}
+			q.usage[dir] = u
+		}
+
+		u.Bytes += bytes
+		u.Files += files
+		if u.Bytes == 0 && u.Files == 0 {
+			delete(q.usage, dir)
+		}
+	}
+}
+
+// parentDirs returns directories containing name, from root "".
+func parentDirs(name string) []string {
+	dirs := []string{""}
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	return dirs
+}
+
+// dirPath returns path relative to root of quotas, canonicalized by cleanName.
+func (qs *quotaStore) dirPath(path string) (string, error) {
+	path, err := cleanName("Quota", path, true)
+	return strings.Trim(qs.prefix + path, "/"), err
+}
+
+func (q *quotas) load() (map[string]Quota, error) {
+	limits := make(map[string]Quota)
+
+	info, err := q.dir.FileInfo(quotaFile)
+	if err != nil {
+		// no quotas set yet
+		return limits, nil
+	}
+
+	corrupted := &os.PathError{Op: "NewQuotaStore", Path: quotasStore + "/" + quotaFile, Err: corruptedQuotasErr}
+	if info.Size() < quotaHeaderSize + 4 {
+		return nil, corrupted
+	}
+
+	data := make([]byte, info.Size())
+	if err := q.dir.Read(quotaFile, data, 0); err != nil {
+		return nil, err
+	}
+
+	if data[0] != quotaVersion {
+		return nil, corrupted
+	}
+
+	body := data[:len(data) - 4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, corrupted
+	}
+
+	count := int(binary.LittleEndian.Uint32(body[1:]))
+	entry := body[quotaHeaderSize:]
+	for i := 0; i < count; i++ {
+		if len(entry) < 2 {
+			return nil, corrupted
+		}
+
+		n := int(binary.LittleEndian.Uint16(entry))
+		if len(entry) < 2 + n + 16 {
+			return nil, corrupted
+		}
+
+		limits[string(entry[2:2 + n])] = Quota{
+			MaxBytes: int64(binary.LittleEndian.Uint64(entry[2 + n:])),
+			MaxFiles: int64(binary.LittleEndian.Uint64(entry[2 + n + 8:])),
+		}
+		entry = entry[2 + n + 16:]
+	}
+
+	if len(entry) != 0 {
+		return nil, corrupted
+	}
+	return limits, nil
+}
+
+func (q *quotas) save(limits map[string]Quota) error {
+	data := make([]byte, quotaHeaderSize)
+	data[0] = quotaVersion
+	binary.LittleEndian.PutUint32(data[1:], uint32(len(limits)))
+
+	for path, quota := range limits {
+		entry := make([]byte, 2 + len(path) + 16)
+		binary.LittleEndian.PutUint16(entry, uint16(len(path)))
+		copy(entry[2:], path)
+		binary.LittleEndian.PutUint64(entry[2 + len(path):], uint64(quota.MaxBytes))
+		binary.LittleEndian.PutUint64(entry[2 + len(path) + 8:], uint64(quota.MaxFiles))
+		data = append(data, entry...)
+	}
+
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(data))
+	data = append(data, sum...)
+
+	if !q.dir.IsFileExist(quotaFile) {
+		if err := q.dir.CreateFile(quotaFile); err != nil {
+			return err
+		}
+	}
+
+	if err := q.dir.Write(quotaFile, data, 0); err != nil {
+		return err
+	}
+	return q.dir.Truncate(quotaFile, int64(len(data)))
+}
+
+func (qs *quotaStore) scrub(r *scrubRun) error {
+	return scrubStore(r, qs.Store)
+}
+
+// removeExpired releases usage of expired files.
+func (qs *quotaStore) removeExpired(fn func(name string) error) error {
+	return removeExpired(qs.Store, func(name string) error {
+		qs.mutate("RemoveExpired", name, false, nil, func(string) error {
+			return nil
+		})
+		return fn(name)
+	})
+}
+
+func (qs *quotaStore) walkFiles(fn func(name string) error) error {
+	return walkFiles(qs.Store, fn)
+}
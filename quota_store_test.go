@@ -0,0 +1,87 @@
+package store
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaStore_Quota(t *testing.T) {
+	for _, s := range testStores(t, "TestQuotaStore_Quota") {
+		qs, err := NewQuotaStore(s)
+		assert.Nil(t, err)
+
+		assert.Nil(t, qs.SetQuota("tenant", Quota{MaxBytes: 8, MaxFiles: 2}))
+		tenant := qs.SubStore("tenant")
+
+		assert.Nil(t, tenant.CreateFile("a"))
+		assert.Nil(t, tenant.Write("a", []byte("1234"), 0))
+		assert.Nil(t, tenant.SubStore("dir").CreateFile("b"))
+
+		err = tenant.CreateFile("c")
+		assert.True(t, IsQuotaExceeded(err))
+		assert.Equal(t, "files", err.(*QuotaExceededError).Resource)
+		assert.False(t, tenant.IsFileExist("c"))
+
+		assert.True(t, IsQuotaExceeded(tenant.Write("a", []byte("12345"), 4)))
+		assert.Nil(t, tenant.Write("a", []byte("5678"), 4))
+		assert.True(t, IsQuotaExceeded(tenant.Truncate("a", 9)))
+		assert.True(t, IsQuotaExceeded(tenant.Clear("a", 8, 1)))
+		assert.Nil(t, tenant.Truncate("a", 2))
+
+		assert.Equal(t, Usage{Bytes: 2, Files: 2}, qs.Usage("tenant"))
+		assert.Equal(t, Usage{Bytes: 0, Files: 1}, qs.Usage("tenant/dir"))
+		assert.Equal(t, Usage{Bytes: 2, Files: 1}, qs.Usage("tenant/a"))
+
+		// other directories are not limited
+		assert.Nil(t, qs.CreateFile("other"))
+		assert.Nil(t, qs.Write("other", []byte("123456789"), 0))
+		assert.Equal(t, Usage{Bytes: 11, Files: 3}, qs.Usage(""))
+
+		assert.Nil(t, tenant.SubStore("dir").RemoveFile("b"))
+		assert.Equal(t, Usage{}, qs.Usage("tenant/dir"))
+		assert.Nil(t, tenant.CreateFile("c"))
+
+		// quotas are kept, usage is scanned again
+		assert.Nil(t, qs.Snapshot("snap"))
+		qs, err = NewQuotaStore(s)
+		assert.Nil(t, err)
+		assert.Equal(t, Quota{MaxBytes: 8, MaxFiles: 2}, qs.Quota("tenant"))
+		assert.Equal(t, Usage{Bytes: 2, Files: 2}, qs.Usage("tenant"))
+		assert.Equal(t, Usage{Bytes: 11, Files: 3}, qs.Usage(""))
+
+		assert.Nil(t, qs.SetQuota("tenant", Quota{}))
+		assert.Nil(t, qs.SubStore("tenant").CreateFile("d"))
+		assert.NotNil(t, qs.SetQuota(".kayat_quota", Quota{MaxFiles: 1}))
+	}
+}
+
+func TestQuotaStore_Names(t *testing.T) {
+	for _, s := range testStores(t, "TestQuotaStore_Names") {
+		qs, err := NewQuotaStore(s)
+		assert.Nil(t, err)
+		assert.Nil(t, qs.SetQuota("./x/", Quota{MaxBytes: 10}))
+		assert.Equal(t, Quota{MaxBytes: 10}, qs.Quota("x"))
+		assert.Nil(t, qs.Mkdir("x"))
+
+		// names reaching same file are accounted as same file
+		assert.Nil(t, qs.CreateFile("./x/f"))
+		for _, name := range []string{"./x/f", "/x/f", "x//f"} {
+			assert.NotNil(t, qs.CreateIfNotExists(name), name)
+			assert.True(t, IsQuotaExceeded(qs.Write(name, make([]byte, 100), 0)), name)
+			assert.Nil(t, qs.Write(name, []byte("1234"), 0), name)
+		}
+		assert.Equal(t, Usage{Bytes: 4, Files: 1}, qs.Usage("x"))
+		assert.Equal(t, Usage{Bytes: 4, Files: 1}, qs.Usage("/x/./f"))
+
+		sub := qs.SubStore("./x/")
+		assert.True(t, IsQuotaExceeded(sub.Write("f", make([]byte, 100), 0)))
+		assert.True(t, IsQuotaExceeded(qs.SubStore("y/../x").Write("f", make([]byte, 100), 0)))
+
+		// internal data can not be named
+		assert.NotNil(t, qs.CreateFile("x/.kayat_y"))
+		assert.NotNil(t, qs.Write("x/.kayat_y", make([]byte, 100), 0))
+		assert.NotNil(t, qs.CreateFile("x/../f"))
+		assert.Equal(t, Usage{Bytes: 4, Files: 1}, qs.Usage("x"))
+		assert.Equal(t, Usage{}, qs.Usage("x/.kayat_y"))
+	}
+}
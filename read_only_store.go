@@ -0,0 +1,105 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+var (
+	readOnlyStoreErr = errors.New("read-only store")
+)
+
+/**
+ Store rejecting all mutations, like opened snapshot.
+ */
+type readOnlyStore struct {
+	Store
+}
+
+func newReadOnlyStore(s Store) Store {
+	return &readOnlyStore{Store: s}
+}
+
+func (rs *readOnlyStore) SubStore(subpath string) Store {
+	return newReadOnlyStore(rs.Store.SubStore(subpath))
+}
+
+func (rs *readOnlyStore) Write(filename string, data []byte, startOffset int64) error {
+	return &os.PathError{Op: "Write", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) Clear(filename string, startOffset int64, size int64) error {
+	return &os.PathError{Op: "Clear", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) CreateFile(filename string) error {
+	return &os.PathError{Op: "CreateFile", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) RemoveFile(filename string) error {
+	return &os.PathError{Op: "RemoveFile", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) Mkdir(dirname string) error {
+	return &os.PathError{Op: "Mkdir", Path: dirname, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) RemoveDir(dirname string, recursive bool) error {
+	return &os.PathError{Op: "RemoveDir", Path: dirname, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) Truncate(filename string, size int64) error {
+	return &os.PathError{Op: "Truncate", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) Preallocate(filename string, size int64) error {
+	return &os.PathError{Op: "Preallocate", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	return &os.PathError{Op: "CreateFileWithTTL", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) SetExpiry(filename string, expiry time.Time) error {
+	return &os.PathError{Op: "SetExpiry", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) WriteV(filename string, extents []Extent) error {
+	return &os.PathError{Op: "WriteV", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	return &os.PathError{Op: "WriteIf", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) CreateIfNotExists(filename string) error {
+	return &os.PathError{Op: "CreateIfNotExists", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	return &os.PathError{Op: "RemoveIfMatch", Path: filename, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) Snapshot(name string) error {
+	return &os.PathError{Op: "Snapshot", Path: name, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) DeleteSnapshot(name string) error {
+	return &os.PathError{Op: "DeleteSnapshot", Path: name, Err: readOnlyStoreErr}
+}
+
+func (rs *readOnlyStore) scrub(r *scrubRun) error {
+	// nothing is repaired in read-only store
+	r.options.Repair = false
+	return scrubStore(r, rs.Store)
+}
+
+// removeExpired removes nothing, expired files of read-only store are absent only.
+func (rs *readOnlyStore) removeExpired(fn func(name string) error) error {
+	return nil
+}
+
+func (rs *readOnlyStore) walkFiles(fn func(name string) error) error {
+	return walkFiles(rs.Store, fn)
+}
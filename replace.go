@@ -0,0 +1,26 @@
+package store
+
+// replacer is implemented by stores replacing content of file atomically.
+type replacer interface {
+	replaceFile(filename string, data []byte) error
+}
+
+// replaceFile replaces content of filename in s by data, creating file if not existed.
+// readers, and crashes by durability of s, see either old or new content if s is replacer.
+// otherwise data is written over file and file is cut to it, which may be seen apart.
+func replaceFile(s Store, filename string, data []byte) error {
+	if r, ok := s.(replacer); ok {
+		return r.replaceFile(filename, data)
+	}
+
+	if !s.IsFileExist(filename) {
+		if err := s.CreateFile(filename); err != nil {
+			return err
+		}
+	}
+
+	if err := s.Write(filename, data, 0); err != nil {
+		return err
+	}
+	return s.Truncate(filename, int64(len(data)))
+}
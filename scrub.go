@@ -0,0 +1,268 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type ScrubProblemKind uint8
+
+const (
+	// data does not match its checksum
+	ScrubCorrupted ScrubProblemKind = iota + 1
+	// file cannot be read
+	ScrubUnreadable
+	// temporary file left by interrupted atomic write or snapshot
+	ScrubOrphanedTemp
+	// .vfs_mount_info marker of a mount not on its directory anymore
+	ScrubStaleMountInfo
+	// metadata or checksums unreadable, or left for missing file
+	ScrubInconsistentMeta
+)
+
+const (
+	// marker file of vfs mount, see vfs.NewWrapperFileSystem
+	mountInfoFile = ".vfs_mount_info"
+
+	// temporary files younger than this may belong to writes in progress
+	orphanedTempAge = time.Hour
+
+	scrubChunkSize = 64 * 1024
+)
+
+var scrubProblemKindNames = map[ScrubProblemKind]string{
+	ScrubCorrupted:        "CORRUPTED",
+	ScrubUnreadable:       "UNREADABLE",
+	ScrubOrphanedTemp:     "ORPHANED_TEMP",
+	ScrubStaleMountInfo:   "STALE_MOUNT_INFO",
+	ScrubInconsistentMeta: "INCONSISTENT_META",
+}
+
+/**
+ ScrubOptions of Scrub.
+ zero value only reports problems, reading as fast as possible.
+ */
+type ScrubOptions struct {
+	// fix problems which can be fixed, like removing orphaned files
+	Repair bool
+	// limit of bytes read per second, 0 means unlimited
+	BytesPerSecond int64
+}
+
+/**
+ ScrubProblem found by Scrub.
+ Path is relative to scrubbed store.
+ */
+type ScrubProblem struct {
+	Kind     ScrubProblemKind
+	Path     string
+	Err      error
+	Repaired bool
+}
+
+type ScrubReport struct {
+	Started  time.Time
+	Finished time.Time
+	// number and bytes of files verified
+	Files    int
+	Bytes    int64
+	Problems []ScrubProblem
+}
+
+// scrubber is implemented by stores checking their internal data.
+type scrubber interface {
+	scrub(r *scrubRun) error
+}
+
+// scrubRun is state of a Scrub, shared by layers of wrapped stores.
+type scrubRun struct {
+	ctx     context.Context
+	s       Store
+	options ScrubOptions
+	report  *ScrubReport
+	buf     []byte
+}
+
+func (k ScrubProblemKind) String() string {
+	return scrubProblemKindNames[k]
+}
+
+func (p ScrubProblem) String() string {
+	if p.Err != nil {
+		return fmt.Sprintf("%s %s: %v", p.Kind, p.Path, p.Err)
+	}
+	return fmt.Sprintf("%s %s", p.Kind, p.Path)
+}
+
+// Healthy returns true if no problem is found, or all problems are repaired.
+func (r *ScrubReport) Healthy() bool {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// Scrub walks all files of s and its sub stores, and verifies them by reading whole content.
+// if s keeps checksums, corrupted data is detected.
+// internal data of stores, like metadata and temporary files, is checked too.
+// Scrub stops when ctx is done, returning report so far with error of ctx.
+func Scrub(ctx context.Context, s Store, options ScrubOptions) (*ScrubReport, error) {
+	r := &scrubRun{
+		ctx:     ctx,
+		s:       s,
+		options: options,
+		report:  &ScrubReport{Started: time.Now(), Problems: make([]ScrubProblem, 0)},
+		buf:     make([]byte, scrubChunkSize),
+	}
+
+	err := scrubStore(r, s)
+	r.report.Finished = time.Now()
+	return r.report, err
+}
+
+// StartScrubber runs Scrub every interval in background, until returned stop function is called.
+// done is called with result of each Scrub.
+func StartScrubber(s Store, interval time.Duration, options ScrubOptions, done func(*ScrubReport, error)) func() {
+	return runEvery(interval, func(ctx context.Context) {
+		report, err := Scrub(ctx, s, options)
+		if ctx.Err() == nil && done != nil {
+			done(report, err)
+		}
+	})
+}
+
+// runEvery calls run every interval in background, until returned stop function is called.
+// ctx of run is done when stopped, and stop waits for run to return.
+func runEvery(interval time.Duration, run func(ctx context.Context)) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			run(ctx)
+		}
+	}()
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// scrubStore scrubs s, which is r.s or a store wrapped by it.
+func scrubStore(r *scrubRun, s Store) error {
+	if sc, ok := s.(scrubber); ok {
+		return sc.scrub(r)
+	}
+
+	// unknown store, verify top level files only
+	for info := range s.FileIter() {
+		if err := r.verify(info.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// problem adds problem to report, and fixes it by repair if repair mode.
+func (r *scrubRun) problem(kind ScrubProblemKind, path string, err error, repair func() error) {
+	p := ScrubProblem{Kind: kind, Path: path, Err: err}
+
+	if r.options.Repair && repair != nil {
+		if rerr := repair(); rerr == nil {
+			p.Repaired = true
+		} else if p.Err == nil {
+			p.Err = rerr
+		}
+	}
+
+	r.report.Problems = append(r.report.Problems, p)
+}
+
+// verify reads whole file through scrubbed store.
+// only errors of ctx are returned, others are reported as problems.
+func (r *scrubRun) verify(filename string) error {
+	info, err := r.s.FileInfo(filename)
+	if err != nil {
+		if IsCorrupted(err) {
+			r.problem(ScrubCorrupted, filename, err, nil)
+		} else {
+			r.problem(ScrubUnreadable, filename, err, nil)
+		}
+		return r.ctx.Err()
+	}
+
+	for off := int64(0); off < info.Size(); off += int64(len(r.buf)) {
+		if err := r.throttle(); err != nil {
+			return err
+		}
+
+		n := info.Size() - off
+		if n > int64(len(r.buf)) {
+			n = int64(len(r.buf))
+		}
+
+		err := r.s.Read(filename, r.buf[:n], off)
+		if err == io.EOF {
+			// truncated while scrubbing
+			break
+		} else if IsCorrupted(err) {
+			r.problem(ScrubCorrupted, filename, err, nil)
+			break
+		} else if err != nil {
+			r.problem(ScrubUnreadable, filename, err, nil)
+			break
+		}
+
+		r.report.Bytes += n
+	}
+
+	r.report.Files++
+	return r.ctx.Err()
+}
+
+// throttle waits until bytes read so far are within rate limit.
+func (r *scrubRun) throttle() error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+
+	if r.options.BytesPerSecond <= 0 {
+		return nil
+	}
+
+	expected := time.Duration(float64(r.report.Bytes) / float64(r.options.BytesPerSecond) * float64(time.Second))
+	wait := expected - time.Since(r.report.Started)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+func problemKinds(report *ScrubReport) []ScrubProblemKind {
+	kinds := make([]ScrubProblemKind, 0)
+	for _, p := range report.Problems {
+		kinds = append(kinds, p.Kind)
+	}
+	return kinds
+}
+
+func TestScrub_Corrupted(t *testing.T) {
+	for _, s := range testStores(t, "TestScrub_Corrupted") {
+		cs := NewChecksumStore(s, ChecksumOptions{BlockSize: 4})
+
+		cs.CreateFile("file")
+		cs.Write("file", []byte("0123456789"), 0)
+		sub := cs.SubStore("sub")
+		sub.CreateFile("file")
+		sub.Write("file", []byte("0123"), 0)
+
+		report, err := Scrub(context.Background(), cs, ScrubOptions{})
+		assert.Nil(t, err)
+		assert.True(t, report.Healthy())
+		assert.Equal(t, 2, report.Files)
+		assert.Equal(t, int64(14), report.Bytes)
+
+		// bit rot, bypassing checksum store
+		s.Write("sub/file", []byte("x"), 1)
+
+		report, err = Scrub(context.Background(), cs, ScrubOptions{Repair: true})
+		assert.Nil(t, err)
+		assert.False(t, report.Healthy())
+		assert.Len(t, report.Problems, 1)
+		assert.Equal(t, ScrubCorrupted, report.Problems[0].Kind)
+		assert.Equal(t, "sub/file", report.Problems[0].Path)
+
+		// checksums left for missing file
+		s.RemoveFile("file")
+
+		report, _ = Scrub(context.Background(), cs, ScrubOptions{Repair: true})
+		assert.Equal(t, []ScrubProblemKind{ScrubCorrupted, ScrubInconsistentMeta}, problemKinds(report))
+		assert.True(t, report.Problems[1].Repaired)
+
+		report, _ = Scrub(context.Background(), cs, ScrubOptions{})
+		assert.Equal(t, []ScrubProblemKind{ScrubCorrupted}, problemKinds(report))
+	}
+}
+
+func TestScrub_FileSystemStore(t *testing.T) {
+	s := NewFileSystemStore(path).SubStore("TestScrub_FileSystemStore")
+	dir := path + "/TestScrub_FileSystemStore/"
+
+	s.CreateFile("file")
+	s.Write("file", []byte("test"), 0)
+
+	// orphaned temporary file of interrupted atomic write
+	old := time.Now().Add(-2 * orphanedTempAge)
+	tmp := dir + metaDir + "/" + tmpPrefix + "file-1"
+	ioutil.WriteFile(tmp, []byte("test"), os.ModePerm)
+	os.Chtimes(tmp, old, old)
+
+	// temporary file of write in progress
+	ioutil.WriteFile(dir + metaDir + "/" + tmpPrefix + "file-2", []byte("test"), os.ModePerm)
+
+	// metadata of missing file
+	vfs.WriteFileMeta(dir + "missing", vfs.FileMeta{Generation: 1})
+
+	// stale mount info copied from other directory
+	ioutil.WriteFile(dir + mountInfoFile, []byte("/other/mount"), os.ModePerm)
+
+	report, err := Scrub(context.Background(), s, ScrubOptions{})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []ScrubProblemKind{ScrubOrphanedTemp, ScrubInconsistentMeta, ScrubStaleMountInfo}, problemKinds(report))
+	assert.False(t, report.Healthy())
+	assert.Equal(t, 1, report.Files)
+
+	report, err = Scrub(context.Background(), s, ScrubOptions{Repair: true})
+	assert.Nil(t, err)
+	assert.Len(t, report.Problems, 3)
+	assert.True(t, report.Healthy())
+
+	report, err = Scrub(context.Background(), s, ScrubOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+	assert.True(t, isFileExist(dir + metaDir + "/" + tmpPrefix + "file-2"))
+
+	// corrupted metadata is rewritten
+	ioutil.WriteFile(dir + metaDir + "/file", []byte{0}, os.ModePerm)
+	report, _ = Scrub(context.Background(), s, ScrubOptions{Repair: true})
+	assert.Equal(t, []ScrubProblemKind{ScrubInconsistentMeta}, problemKinds(report))
+	assert.True(t, report.Healthy())
+
+	info, err := s.FileInfo("file")
+	assert.Nil(t, err)
+	assert.NotEqual(t, uint64(0), info.Generation())
+}
+
+func TestScrub_Throttle(t *testing.T) {
+	s, _ := NewMemoryStore("/TestScrub_Throttle")
+	s.CreateFile("file")
+	s.Write("file", make([]byte, scrubChunkSize * 3), 0)
+
+	// 2 chunks per second, waits for 2 chunks read before last chunk
+	start := time.Now()
+	report, err := Scrub(context.Background(), s, ScrubOptions{BytesPerSecond: scrubChunkSize * 2})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(scrubChunkSize * 3), report.Bytes)
+	assert.True(t, time.Since(start) >= 900 * time.Millisecond)
+
+	// cancelled while throttled
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	_, err = Scrub(ctx, s, ScrubOptions{BytesPerSecond: 1})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestStartScrubber(t *testing.T) {
+	s, _ := NewMemoryStore("/TestStartScrubber")
+	s.CreateFile("file")
+
+	reports := make(chan *ScrubReport, 10)
+	stop := StartScrubber(s, 10 * time.Millisecond, ScrubOptions{}, func(report *ScrubReport, err error) {
+		assert.Nil(t, err)
+		reports <- report
+	})
+
+	select {
+	case report := <-reports:
+		assert.Equal(t, 1, report.Files)
+	case <-time.After(time.Second):
+		t.Error("scrubber did not run")
+	}
+
+	stop()
+}
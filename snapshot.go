@@ -0,0 +1,34 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// snapshots of a store are kept in this sub store.
+const snapshotStore = hiddenPrefix + "snapshots"
+
+var (
+	illegalSnapshotNameErr = errors.New("illegal snapshot name")
+	snapshotExistsErr      = errors.New("snapshot exists")
+	noSuchSnapshotErr      = errors.New("no such snapshot")
+)
+
+func checkSnapshotName(op string, name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return &os.PathError{Op: op, Path: name, Err: illegalSnapshotNameErr}
+	}
+	return nil
+}
+
+// skipSnapshot returns true if name is not cloned into snapshots.
+// history of store, snapshots themselves, chunks shared with snapshots and temporary files
+// are skipped, but other internal data, like metadata or indexes of files, is cloned with files.
+func skipSnapshot(name string) bool {
+	switch name {
+	case snapshotStore, journalStore, versionStore, casStore, mountInfoFile:
+		return true
+	}
+	return strings.HasPrefix(name, tmpPrefix)
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStores(t *testing.T, name string) []Store {
+	m, err := NewMemoryStore("/" + name)
+	assert.Nil(t, err)
+
+	return []Store{m, NewFileSystemStore(path).SubStore(name)}
+}
+
+func TestStore_Snapshot(t *testing.T) {
+	for _, s := range testStores(t, "TestStore_Snapshot") {
+		s.CreateFile("file")
+		s.Write("file", []byte("test"), 0)
+		s.SubStore("sub").CreateFile("file")
+
+		assert.Nil(t, s.Snapshot("snap"))
+		assert.NotNil(t, s.Snapshot("snap"))   // snapshot exists err
+		assert.NotNil(t, s.Snapshot("a/b"))    // illegal name err
+
+		// writers continue
+		s.Write("file", []byte("1234"), 0)
+		s.RemoveFile("sub/file")
+
+		names, err := s.ListSnapshots()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"snap"}, names)
+
+		snap, err := s.OpenSnapshot("snap")
+		assert.Nil(t, err)
+
+		res := make([]byte, 4)
+		assert.Nil(t, snap.Read("file", res, 0))
+		assert.Equal(t, "test", string(res))
+		assert.True(t, snap.IsFileExist("sub/file"))
+
+		// snapshot is read-only
+		assert.NotNil(t, snap.Write("file", []byte("1234"), 0))
+		assert.NotNil(t, snap.RemoveFile("file"))
+
+		assert.Nil(t, s.DeleteSnapshot("snap"))
+		assert.NotNil(t, s.DeleteSnapshot("snap"))
+		_, err = s.OpenSnapshot("snap")
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,32 @@
+package store
+
+import "io"
+
+// storeReader reads file of store sequentially from off until end.
+type storeReader struct {
+	s        Store
+	filename string
+	off      int64
+	end      int64
+}
+
+func newStoreReader(s Store, filename string, off int64, end int64) *storeReader {
+	return &storeReader{s: s, filename: filename, off: off, end: end}
+}
+
+func (r *storeReader) Read(p []byte) (int, error) {
+	if r.off >= r.end {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.end - r.off {
+		p = p[:r.end - r.off]
+	}
+
+	if err := r.s.Read(r.filename, p, r.off); err != nil {
+		return 0, err
+	}
+
+	r.off += int64(len(p))
+	return len(p), nil
+}
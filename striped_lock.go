@@ -0,0 +1,40 @@
+package store
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const lockStripes = 64
+
+// stripedLock serializes mutations of same key, using fixed number of mutexes.
+type stripedLock struct {
+	stripes [lockStripes]sync.Mutex
+}
+
+func (l *stripedLock) lock(key string) *sync.Mutex {
+	m := &l.stripes[stripe(key)]
+	m.Lock()
+	return m
+}
+
+// stripe returns index of stripe of key.
+func stripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % lockStripes)
+}
+
+// lockAll locks all keys, and returns function unlocking them.
+// stripes are locked in order, and holders of one do not lock another, so it does not deadlock.
+func (l *stripedLock) lockAll() func() {
+	for i := range l.stripes {
+		l.stripes[i].Lock()
+	}
+
+	return func() {
+		for i := range l.stripes {
+			l.stripes[i].Unlock()
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+/**
+ Range of file to read by ReadV, Data is filled with data at Offset.
+ */
+type Range struct {
+	Offset int64
+	Data   []byte
+}
+
+/**
+ Extent of file to write by WriteV, Data is written at Offset.
+ */
+type Extent struct {
+	Offset int64
+	Data   []byte
+}
+
+// span is contiguous range of file covering adjacent ranges.
+type span struct {
+	offset int64
+	size   int64
+	parts  [][]byte
+}
+
+// data returns buffer of whole span, parts are used as is if span has only one part.
+func (s *span) data() []byte {
+	if len(s.parts) == 1 {
+		return s.parts[0]
+	}
+	return make([]byte, s.size)
+}
+
+// join returns data of parts in one buffer.
+func (s *span) join() []byte {
+	data := s.data()
+	if len(s.parts) == 1 {
+		return data
+	}
+
+	var off int64
+	for _, part := range s.parts {
+		off += int64(copy(data[off:], part))
+	}
+	return data
+}
+
+// fill copies data of whole span into its parts.
+func (s *span) fill(data []byte) {
+	if len(s.parts) == 1 {
+		return
+	}
+
+	var off int64
+	for _, part := range s.parts {
+		off += int64(copy(part, data[off:]))
+	}
+}
+
+// readSpans returns spans of ranges, ranges adjacent after sorted by offset are coalesced.
+func readSpans(ranges []Range) []*span {
+	sorted := make([]Range, len(ranges))
+	copy(sorted, ranges)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+
+	spans := make([]*span, 0)
+	for _, r := range sorted {
+		spans = appendSpan(spans, r.Offset, r.Data)
+	}
+	return spans
+}
+
+// writeSpans returns spans of extents, extents adjacent in order are coalesced,
+// so overlapping extents are still written in order.
+func writeSpans(extents []Extent) []*span {
+	spans := make([]*span, 0)
+	for _, e := range extents {
+		spans = appendSpan(spans, e.Offset, e.Data)
+	}
+	return spans
+}
+
+func appendSpan(spans []*span, offset int64, data []byte) []*span {
+	if len(data) == 0 {
+		return spans
+	}
+
+	if n := len(spans); n > 0 && spans[n - 1].offset + spans[n - 1].size == offset {
+		last := spans[n - 1]
+		last.parts = append(last.parts, data)
+		last.size += int64(len(data))
+		return spans
+	}
+
+	return append(spans, &span{offset: offset, size: int64(len(data)), parts: [][]byte{data}})
+}
+
+// extentsRange returns range covering extents.
+func extentsRange(extents []Extent) (from int64, to int64) {
+	for i, e := range extents {
+		end := e.Offset + int64(len(e.Data))
+		if i == 0 || e.Offset < from {
+			from = e.Offset
+		}
+		if end > to {
+			to = end
+		}
+	}
+	return from, to
+}
+
+// readSpansWith reads spans of ranges by read, by up to parallelism goroutines.
+func readSpansWith(ranges []Range, parallelism int, read func(data []byte, offset int64) error) error {
+	spans := readSpans(ranges)
+
+	return parallel(len(spans), parallelism, func(i int) error {
+		s := spans[i]
+		data := s.data()
+		if err := read(data, s.offset); err != nil {
+			return err
+		}
+
+		s.fill(data)
+		return nil
+	})
+}
+
+// writeSpansWith writes spans of extents by write in order.
+func writeSpansWith(extents []Extent, write func(data []byte, offset int64) error) error {
+	for _, s := range writeSpans(extents) {
+		if err := write(s.join(), s.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readV reads ranges of file of s by Read, for stores reading through transformation.
+func readV(s Store, filename string, ranges []Range, parallelism int) error {
+	return readSpansWith(ranges, parallelism, func(data []byte, offset int64) error {
+		return s.Read(filename, data, offset)
+	})
+}
+
+// writeV writes extents of file of s by Write, for stores writing through transformation.
+func writeV(s Store, filename string, extents []Extent) error {
+	return writeSpansWith(extents, func(data []byte, offset int64) error {
+		return s.Write(filename, data, offset)
+	})
+}
+
+// parallel runs fn for 0 to n - 1 by up to parallelism goroutines, and returns first error.
+// fn is run in order by calling goroutine if parallelism is 1 or less.
+func parallel(n int, parallelism int, fn func(i int) error) error {
+	if parallelism <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if parallelism > n {
+		parallelism = n
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+		next  int
+	)
+
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				i := next
+				next++
+				stop := first != nil
+				mu.Unlock()
+
+				if stop || i >= n {
+					return
+				}
+
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return first
+}
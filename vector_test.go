@@ -0,0 +1,58 @@
+package store
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_ReadVWriteV(t *testing.T) {
+	for _, s := range testStores(t, "TestStore_ReadVWriteV") {
+		for _, w := range []Store{s, NewChecksumStore(s.SubStore("checksum"), ChecksumOptions{BlockSize: 4})} {
+			assert.Nil(t, w.CreateFile("file"))
+
+			// adjacent extents are written at once, overlapping ones in order
+			assert.Nil(t, w.WriteV("file", []Extent{
+				{Offset: 0, Data: []byte("0123")},
+				{Offset: 4, Data: []byte("4567")},
+				{Offset: 10, Data: []byte("ab")},
+				{Offset: 2, Data: []byte("xy")},
+			}))
+
+			res := make([]byte, 12)
+			assert.Nil(t, w.Read("file", res, 0))
+			assert.Equal(t, "01xy4567\x00\x00ab", string(res))
+
+			for _, parallelism := range []int{1, 4} {
+				ranges := []Range{
+					{Offset: 10, Data: make([]byte, 2)},
+					{Offset: 0, Data: make([]byte, 2)},
+					{Offset: 2, Data: make([]byte, 3)},
+					{Offset: 6, Data: make([]byte, 1)},
+				}
+				assert.Nil(t, w.ReadV("file", ranges, parallelism))
+				assert.Equal(t, "ab", string(ranges[0].Data))
+				assert.Equal(t, "01", string(ranges[1].Data))
+				assert.Equal(t, "xy4", string(ranges[2].Data))
+				assert.Equal(t, "6", string(ranges[3].Data))
+			}
+
+			assert.NotNil(t, w.ReadV("file", []Range{{Offset: 11, Data: make([]byte, 2)}}, 1))
+			assert.NotNil(t, w.ReadV("none", []Range{{Offset: 0, Data: make([]byte, 1)}}, 1))
+			assert.NotNil(t, w.WriteV("none", []Extent{{Offset: 0, Data: []byte("a")}}))
+		}
+	}
+}
+
+func TestJournaledStore_WriteV(t *testing.T) {
+	s, _ := NewMemoryStore("/TestJournaledStore_WriteV")
+	js, err := NewJournaledStore(s)
+	assert.Nil(t, err)
+
+	assert.Nil(t, js.CreateFile("file"))
+	assert.Nil(t, js.WriteV("file", []Extent{{Offset: 0, Data: []byte("ab")}, {Offset: 8, Data: []byte("c")}}))
+
+	changes := collectChanges(t, js, 1)
+	assert.Equal(t, 2, len(changes))
+	assert.Equal(t, int64(8), changes[1].Offset)
+	assert.Equal(t, int64(1), changes[1].Size)
+}
@@ -0,0 +1,766 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+const (
+	versionStore = hiddenPrefix + "versions"
+	versionIndex = "index"
+
+	// id(8) size(8) time(8) flags(1) base(8)
+	versionRecordSize = 33
+	deleteMarkerFlag  = 1
+	// content is kept whole in data file of base
+	fullVersionFlag = 2
+
+	// generation(8) size(8) count(4) | offset(8) length(8) cleared(1) ...
+	versionChangesHeaderSize = 20
+	versionChangeSize        = 17
+)
+
+var (
+	noSuchVersionErr    = errors.New("no such version")
+	deleteMarkerErr     = errors.New("version is a delete marker")
+	corruptedVersionErr = errors.New("corrupted version index")
+	corruptedChangesErr = errors.New("corrupted version changes")
+)
+
+/**
+ VersionPolicy decides how many prior versions are kept.
+ zero value keeps all versions forever.
+ */
+type VersionPolicy struct {
+	// keep at most MaxVersions prior versions per file, 0 means unlimited
+	MaxVersions int
+	// drop versions older than Retention, 0 means forever
+	Retention time.Duration
+}
+
+/**
+ Version is prior content of a file, captured when it was overwritten.
+ delete marker records that file was removed at Time.
+ */
+type Version struct {
+	ID           uint64
+	Size         int64
+	Time         time.Time
+	DeleteMarker bool
+}
+
+/**
+ Store keeping prior versions of files in hidden area of underlying store.
+ Write, Clear, Truncate, CreateFile and RemoveFile of existing file
+ capture content of the file as a version, before mutation.
+ content is copied whole only for first version of the file, or if the file was changed bypassing the store,
+ other versions keep changes of the mutation only, and are rebuilt from the nearest whole copy.
+ */
+type VersionedStore interface {
+	Store
+	// ListVersions returns versions of filename, newest first.
+	ListVersions(filename string) ([]Version, error)
+	ReadVersion(filename string, id uint64, res []byte, startOffset int64) error
+	// Restore replaces content of filename with the version.
+	// current content is captured as a version first.
+	Restore(filename string, id uint64) error
+}
+
+type versionedStore struct {
+	Store
+	versions *versions
+	prefix   string
+}
+
+/**
+ versionRecord is Version with where its content is kept.
+ content of full version is data file of base,
+ content of others is content of previous version with changes of its mutation applied.
+ */
+type versionRecord struct {
+	Version
+	full bool
+	base uint64
+}
+
+/**
+ versionChanges are changes of a mutation turning content of a version into content of the next one.
+ bytes out of changes are kept up to smaller of both sizes, and are zeros after.
+ encoded as generation(8) size(8) count(4) | offset(8) length(8) cleared(1) ... | data of written changes.
+ */
+type versionChanges struct {
+	// generation of file after mutation, which tells the file was not changed since
+	generation uint64
+	size       int64
+	changes    []fileChange
+}
+
+type versions struct {
+	// versions of a file are captured and read holding lock of its key
+	locks  stripedLock
+	s      Store
+	policy VersionPolicy
+}
+
+func NewVersionedStore(s Store, policy VersionPolicy) VersionedStore {
+	return &versionedStore{
+		Store: s,
+		versions: &versions{
+			s:      s.SubStore(versionStore),
+			policy: policy,
+		},
+	}
+}
+
+func (vs *versionedStore) SubStore(subpath string) Store {
+	subpath = cleanSubPath(subpath)
+	prefix := vs.prefix
+	if subpath != "" {
+		prefix += subpath + "/"
+	}
+
+	return &versionedStore{
+		Store:    vs.Store.SubStore(subpath),
+		versions: vs.versions,
+		prefix:   prefix,
+	}
+}
+
+func (vs *versionedStore) Write(filename string, data []byte, startOffset int64) error {
+	changes := []fileChange{{offset: startOffset, length: int64(len(data)), data: data}}
+	return vs.mutate("Write", filename, false, changes, func() error {
+		return vs.Store.Write(filename, data, startOffset)
+	})
+}
+
+func (vs *versionedStore) Clear(filename string, startOffset int64, size int64) error {
+	changes := []fileChange{{offset: startOffset, length: size}}
+	return vs.mutate("Clear", filename, false, changes, func() error {
+		return vs.Store.Clear(filename, startOffset, size)
+	})
+}
+
+func (vs *versionedStore) Truncate(filename string, size int64) error {
+	return vs.mutate("Truncate", filename, false, nil, func() error {
+		return vs.Store.Truncate(filename, size)
+	})
+}
+
+func (vs *versionedStore) CreateFile(filename string) error {
+	return vs.mutate("CreateFile", filename, false, nil, func() error {
+		return vs.Store.CreateFile(filename)
+	})
+}
+
+func (vs *versionedStore) CreateFileWithTTL(filename string, ttl time.Duration) error {
+	return vs.mutate("CreateFileWithTTL", filename, false, nil, func() error {
+		return vs.Store.CreateFileWithTTL(filename, ttl)
+	})
+}
+
+func (vs *versionedStore) RemoveFile(filename string) error {
+	return vs.mutate("RemoveFile", filename, true, nil, func() error {
+		return vs.Store.RemoveFile(filename)
+	})
+}
+
+// RemoveDir keeps versions of each file removed, if recursive.
+func (vs *versionedStore) RemoveDir(dirname string, recursive bool) error {
+	if recursive {
+		if err := removeDirFiles(vs, dirname); err != nil {
+			return err
+		}
+	}
+	return vs.Store.RemoveDir(dirname, recursive)
+}
+
+// WriteV captures one version before extents are written.
+func (vs *versionedStore) WriteV(filename string, extents []Extent) error {
+	return vs.mutate("WriteV", filename, false, extentChanges(extents), func() error {
+		return vs.Store.WriteV(filename, extents)
+	})
+}
+
+func (vs *versionedStore) WriteIf(filename string, data []byte, startOffset int64, ifGeneration uint64) error {
+	if err := vs.checkGeneration("Write", filename, ifGeneration); err != nil {
+		return err
+	}
+
+	changes := []fileChange{{offset: startOffset, length: int64(len(data)), data: data}}
+	return vs.mutate("WriteIf", filename, false, changes, func() error {
+		return vs.Store.WriteIf(filename, data, startOffset, ifGeneration)
+	})
+}
+
+func (vs *versionedStore) CreateIfNotExists(filename string) error {
+	// nothing to capture, if created
+	return vs.Store.CreateIfNotExists(filename)
+}
+
+func (vs *versionedStore) RemoveIfMatch(filename string, ifGeneration uint64) error {
+	if err := vs.checkGeneration("RemoveIfMatch", filename, ifGeneration); err != nil {
+		return err
+	}
+
+	return vs.mutate("RemoveIfMatch", filename, true, nil, func() error {
+		return vs.Store.RemoveIfMatch(filename, ifGeneration)
+	})
+}
+
+func (vs *versionedStore) Watch(path string, recursive bool) (<-chan vfs.Event, func(), error) {
+	events, cancel, err := vs.Store.Watch(path, recursive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// hide changes of versions
+	return relayEvents(events, cancel, func(name string) (string, bool) {
+		return name, !isHidden(name)
+	})
+}
+
+func (vs *versionedStore) ListVersions(filename string) ([]Version, error) {
+	key, err := vs.key("ListVersions", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	m := vs.versions.locks.lock(key)
+	defer m.Unlock()
+
+	list, err := vs.versions.load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Version, len(list))
+	for i, v := range list {
+		res[len(list) - 1 - i] = v.Version
+	}
+
+	return res, nil
+}
+
+func (vs *versionedStore) ReadVersion(filename string, id uint64, res []byte, startOffset int64) error {
+	key, err := vs.key("ReadVersion", filename)
+	if err != nil {
+		return err
+	}
+
+	m := vs.versions.locks.lock(key)
+	defer m.Unlock()
+
+	list, i, err := vs.versions.find(key, id)
+	if err != nil {
+		return err
+	}
+
+	if list[i].DeleteMarker {
+		return &os.PathError{Op: "ReadVersion", Path: filename, Err: deleteMarkerErr}
+	}
+
+	return vs.versions.read(key, list, i, res, startOffset)
+}
+
+func (vs *versionedStore) Restore(filename string, id uint64) error {
+	key, err := vs.key("Restore", filename)
+	if err != nil {
+		return err
+	}
+
+	m := vs.versions.locks.lock(key)
+	defer m.Unlock()
+
+	list, i, err := vs.versions.find(key, id)
+	if err != nil {
+		return err
+	}
+
+	if list[i].DeleteMarker {
+		return &os.PathError{Op: "Restore", Path: filename, Err: deleteMarkerErr}
+	}
+
+	if vs.Store.IsFileExist(filename) {
+		if _, err := vs.versions.capture(vs.Store, filename, key); err != nil {
+			return err
+		}
+
+		// capture may prune the version, or fold it into next one
+		if list, i, err = vs.versions.find(key, id); err != nil {
+			return err
+		}
+	}
+
+	// changes of restore are not kept, so next version is copied whole
+	if err := vs.Store.CreateFile(filename); err != nil {
+		return err
+	}
+
+	buf := make([]byte, copyBufferSize)
+	for off := int64(0); off < list[i].Size; off += int64(len(buf)) {
+		if list[i].Size - off < int64(len(buf)) {
+			buf = buf[:list[i].Size - off]
+		}
+
+		if err := vs.versions.read(key, list, i, buf, off); err != nil {
+			return err
+		}
+
+		if err := vs.Store.Write(filename, buf, off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mutate captures current content of filename and applies mutation, changes are what mutation writes.
+// if remove, delete marker is added after mutation.
+func (vs *versionedStore) mutate(op string, filename string, remove bool, changes []fileChange, mutation func() error) error {
+	key, err := vs.key(op, filename)
+	if err != nil {
+		return err
+	}
+
+	m := vs.versions.locks.lock(key)
+	defer m.Unlock()
+
+	var id uint64
+	if vs.Store.IsFileExist(filename) {
+		if id, err = vs.versions.capture(vs.Store, filename, key); err != nil {
+			return err
+		}
+	}
+
+	if err := mutation(); err != nil {
+		return err
+	}
+
+	if remove {
+		return vs.versions.addDeleteMarker(key)
+	}
+
+	if id != 0 {
+		// mutation is done, if changes are not saved, next version is copied whole
+		vs.versions.saveChanges(vs.Store, filename, key, id, changes)
+	}
+
+	return nil
+}
+
+// key returns key of versions of filename, canonicalized so aliases of file share its versions.
+func (vs *versionedStore) key(op string, filename string) (string, error) {
+	filename, err := cleanFileName(op, filename)
+	if err != nil {
+		return "", err
+	}
+	return vs.prefix + filename, nil
+}
+
+// checkGeneration fails early, not to capture version for mutation that will fail.
+func (vs *versionedStore) checkGeneration(op string, filename string, ifGeneration uint64) error {
+	info, err := vs.Store.FileInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	if info.Generation() != ifGeneration {
+		return &PreconditionFailedError{Op: op, Path: filename, Expected: ifGeneration, Actual: info.Generation()}
+	}
+
+	return nil
+}
+
+// dir returns sub store keeping versions of key.
+// key is hashed, so name of sub store is short enough for any key.
+func (v *versions) dir(key string) Store {
+	sum := sha256.Sum256([]byte(key))
+	return v.s.SubStore(hex.EncodeToString(sum[:]))
+}
+
+func (v *versions) load(key string) ([]versionRecord, error) {
+	dir := v.dir(key)
+	if !dir.IsFileExist(versionIndex) {
+		return make([]versionRecord, 0), nil
+	}
+
+	info, err := dir.FileInfo(versionIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() % versionRecordSize != 0 {
+		return nil, &os.PathError{Op: "ListVersions", Path: key, Err: corruptedVersionErr}
+	}
+
+	data := make([]byte, info.Size())
+	if err := dir.Read(versionIndex, data, 0); err != nil {
+		return nil, err
+	}
+
+	list := make([]versionRecord, 0, len(data) / versionRecordSize)
+	for off := 0; off < len(data); off += versionRecordSize {
+		record := data[off:]
+		list = append(list, versionRecord{
+			Version: Version{
+				ID:           binary.LittleEndian.Uint64(record[0:]),
+				Size:         int64(binary.LittleEndian.Uint64(record[8:])),
+				Time:         time.Unix(0, int64(binary.LittleEndian.Uint64(record[16:]))),
+				DeleteMarker: record[24] & deleteMarkerFlag != 0,
+			},
+			full: record[24] & fullVersionFlag != 0,
+			base: binary.LittleEndian.Uint64(record[25:]),
+		})
+	}
+
+	return list, nil
+}
+
+// save replaces index of key atomically.
+func (v *versions) save(key string, list []versionRecord) error {
+	data := make([]byte, len(list) * versionRecordSize)
+	for i, version := range list {
+		record := data[i * versionRecordSize:]
+		binary.LittleEndian.PutUint64(record[0:], version.ID)
+		binary.LittleEndian.PutUint64(record[8:], uint64(version.Size))
+		binary.LittleEndian.PutUint64(record[16:], uint64(version.Time.UnixNano()))
+		if version.DeleteMarker {
+			record[24] |= deleteMarkerFlag
+		}
+		if version.full {
+			record[24] |= fullVersionFlag
+		}
+		binary.LittleEndian.PutUint64(record[25:], version.base)
+	}
+
+	return replaceFile(v.dir(key), versionIndex, data)
+}
+
+// find returns versions of key and index of version id in them.
+func (v *versions) find(key string, id uint64) ([]versionRecord, int, error) {
+	list, err := v.load(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i, version := range list {
+		if version.ID == id {
+			return list, i, nil
+		}
+	}
+
+	return nil, 0, &os.PathError{Op: "FindVersion", Path: key, Err: noSuchVersionErr}
+}
+
+// capture adds current content of filename in s as new version of key, and returns its id.
+// content is copied whole, unless it is content of last version with its changes applied.
+func (v *versions) capture(s Store, filename string, key string) (uint64, error) {
+	list, err := v.load(key)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := s.FileInfo(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	dir := v.dir(key)
+	id := nextVersionID(list)
+	if dir.IsFileExist(versionChangesName(id)) {
+		// left by versions pruned before
+		if err := dir.RemoveFile(versionChangesName(id)); err != nil {
+			return 0, err
+		}
+	}
+
+	record := versionRecord{Version: Version{ID: id, Size: info.Size(), Time: time.Now()}}
+	if !v.follows(dir, list, info) {
+		if err := copyFile(s, filename, dir, versionDataName(id)); err != nil {
+			return 0, err
+		}
+		record.full, record.base = true, id
+	}
+
+	list = append(list, record)
+	return id, v.save(key, v.prune(key, list))
+}
+
+// follows returns true if file of info is content of last version of list with its changes applied.
+// changes keep generation of the file after them, so the file was not changed since if it is same.
+func (v *versions) follows(dir Store, list []versionRecord, info FileInfo) bool {
+	if len(list) == 0 || list[len(list) - 1].DeleteMarker || info.Generation() == 0 {
+		return false
+	}
+
+	header := make([]byte, 16)
+	if err := dir.Read(versionChangesName(list[len(list) - 1].ID), header, 0); err != nil {
+		return false
+	}
+
+	return binary.LittleEndian.Uint64(header[0:]) == info.Generation() &&
+		int64(binary.LittleEndian.Uint64(header[8:])) == info.Size()
+}
+
+// saveChanges keeps changes of mutation of filename in s, following version id of key.
+func (v *versions) saveChanges(s Store, filename string, key string, id uint64, changes []fileChange) error {
+	info, err := s.FileInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	size := versionChangesHeaderSize + len(changes) * versionChangeSize
+	for _, change := range changes {
+		size += len(change.data)
+	}
+
+	data := make([]byte, versionChangesHeaderSize, size)
+	binary.LittleEndian.PutUint64(data[0:], info.Generation())
+	binary.LittleEndian.PutUint64(data[8:], uint64(info.Size()))
+	binary.LittleEndian.PutUint32(data[16:], uint32(len(changes)))
+
+	for _, change := range changes {
+		entry := make([]byte, versionChangeSize)
+		binary.LittleEndian.PutUint64(entry[0:], uint64(change.offset))
+		binary.LittleEndian.PutUint64(entry[8:], uint64(change.length))
+		if change.data == nil {
+			entry[16] = 1
+		}
+		data = append(data, entry...)
+	}
+
+	for _, change := range changes {
+		data = append(data, change.data...)
+	}
+
+	return replaceFile(v.dir(key), versionChangesName(id), data)
+}
+
+func loadVersionChanges(dir Store, id uint64) (*versionChanges, error) {
+	name := versionChangesName(id)
+	info, err := dir.FileInfo(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, info.Size())
+	if err := dir.Read(name, data, 0); err != nil {
+		return nil, err
+	}
+
+	if len(data) < versionChangesHeaderSize {
+		return nil, &os.PathError{Op: "ReadVersion", Path: name, Err: corruptedChangesErr}
+	}
+
+	c := &versionChanges{
+		generation: binary.LittleEndian.Uint64(data[0:]),
+		size:       int64(binary.LittleEndian.Uint64(data[8:])),
+		changes:    make([]fileChange, binary.LittleEndian.Uint32(data[16:])),
+	}
+
+	at := int64(versionChangesHeaderSize + len(c.changes) * versionChangeSize)
+	if at > int64(len(data)) {
+		return nil, &os.PathError{Op: "ReadVersion", Path: name, Err: corruptedChangesErr}
+	}
+
+	for i := range c.changes {
+		entry := data[versionChangesHeaderSize + i * versionChangeSize:]
+		change := fileChange{
+			offset: int64(binary.LittleEndian.Uint64(entry[0:])),
+			length: int64(binary.LittleEndian.Uint64(entry[8:])),
+		}
+
+		if entry[16] == 0 {
+			if change.length < 0 || at + change.length > int64(len(data)) {
+				return nil, &os.PathError{Op: "ReadVersion", Path: name, Err: corruptedChangesErr}
+			}
+			change.data = data[at:at + change.length]
+			at += change.length
+		}
+
+		c.changes[i] = change
+	}
+
+	return c, nil
+}
+
+// apply turns res, holding content at off of size, into content with changes applied.
+func (c *versionChanges) apply(res []byte, off int64, size int64) {
+	applyChanges(res, off, size, c.size, c.changes)
+}
+
+// read reads content of version i of list at off into res, failing with io.EOF if version ends before.
+// content is read from nearest full version before, and changes following it are applied.
+func (v *versions) read(key string, list []versionRecord, i int, res []byte, off int64) error {
+	head := i
+	for head >= 0 && !list[head].full {
+		head--
+	}
+	if head < 0 {
+		return &os.PathError{Op: "ReadVersion", Path: key, Err: corruptedVersionErr}
+	}
+
+	dir := v.dir(key)
+	name := versionDataName(list[head].base)
+	info, err := dir.FileInfo(name)
+	if err != nil {
+		return err
+	}
+
+	// data file may be folded partly into next version, by interrupted prune
+	size := list[head].Size
+	n := minInt64(minInt64(size, info.Size()) - off, int64(len(res)))
+	if n > 0 {
+		if err := dir.Read(name, res[:n], off); err != nil {
+			return err
+		}
+	}
+	zeroBytes(res[maxInt64(n, 0):])
+
+	for j := head; j < i; j++ {
+		changes, err := loadVersionChanges(dir, list[j].ID)
+		if err != nil {
+			return err
+		}
+
+		changes.apply(res, off, size)
+		size = changes.size
+	}
+
+	if off + int64(len(res)) > list[i].Size {
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (v *versions) addDeleteMarker(key string) error {
+	list, err := v.load(key)
+	if err != nil {
+		return err
+	}
+
+	list = append(list, versionRecord{Version: Version{ID: nextVersionID(list), Time: time.Now(), DeleteMarker: true}})
+	return v.save(key, v.prune(key, list))
+}
+
+// prune removes versions out of policy, list is ordered oldest first.
+// if next version is rebuilt from dropped one, dropped content is folded into next one.
+func (v *versions) prune(key string, list []versionRecord) []versionRecord {
+	dropped := 0
+
+	if v.policy.MaxVersions > 0 && len(list) > v.policy.MaxVersions {
+		dropped = len(list) - v.policy.MaxVersions
+	}
+
+	if v.policy.Retention > 0 {
+		deadline := time.Now().Add(-v.policy.Retention)
+		i := sort.Search(len(list), func(i int) bool {
+			return !list[i].Time.Before(deadline)
+		})
+		if i > dropped {
+			dropped = i
+		}
+	}
+
+	dir := v.dir(key)
+	for i := 0; i < dropped; i++ {
+		version := list[i]
+
+		if version.full && i + 1 < len(list) && !list[i + 1].full && !list[i + 1].DeleteMarker {
+			if err := fold(dir, version); err != nil {
+				// kept, pruned again by next capture
+				dropped = i
+				break
+			}
+			list[i + 1].full, list[i + 1].base = true, version.base
+		} else if version.full {
+			dir.RemoveFile(versionDataName(version.base))
+		}
+
+		if !version.DeleteMarker {
+			dir.RemoveFile(versionChangesName(version.ID))
+		}
+	}
+
+	return list[dropped:]
+}
+
+// fold applies changes following full version to its data file, which becomes content of next version.
+// applying changes again gives same content, so next version is read right even if fold is interrupted.
+func fold(dir Store, version versionRecord) error {
+	changes, err := loadVersionChanges(dir, version.ID)
+	if err != nil {
+		return err
+	}
+
+	name := versionDataName(version.base)
+	if err := dir.Truncate(name, changes.size); err != nil {
+		return err
+	}
+
+	for _, change := range changes.changes {
+		if change.data != nil {
+			err = dir.Write(name, change.data, change.offset)
+		} else if end := minInt64(change.offset + change.length, changes.size); change.offset < end {
+			err = dir.Clear(name, change.offset, end - change.offset)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func nextVersionID(list []versionRecord) uint64 {
+	if len(list) == 0 {
+		return 1
+	}
+	return list[len(list) - 1].ID + 1
+}
+
+func versionDataName(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+func versionChangesName(id uint64) string {
+	return strconv.FormatUint(id, 10) + ".changes"
+}
+
+func (vs *versionedStore) scrub(r *scrubRun) error {
+	return scrubStore(r, vs.Store)
+}
+
+// removeExpired marks expired files deleted, their content is not captured.
+func (vs *versionedStore) removeExpired(fn func(name string) error) error {
+	return removeExpired(vs.Store, func(name string) error {
+		if !isHidden(name) {
+			m := vs.versions.locks.lock(vs.prefix + name)
+			err := expiredRemoval(vs.Store, name)()
+			if err == nil {
+				err = vs.versions.addDeleteMarker(vs.prefix + name)
+			}
+			m.Unlock()
+
+			if err != nil && err != recreatedErr {
+				return err
+			}
+		}
+		return fn(name)
+	})
+}
+
+func (vs *versionedStore) walkFiles(fn func(name string) error) error {
+	return walkFiles(vs.Store, fn)
+}
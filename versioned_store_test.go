@@ -0,0 +1,150 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionedStore_ListVersions(t *testing.T) {
+	filename := "TestVersionedStore_ListVersions"
+	s, _ := NewMemoryStore("/TestVersionedStore_ListVersions")
+	vs := NewVersionedStore(s, VersionPolicy{})
+
+	vs.CreateFile(filename)
+	vs.Write(filename, []byte("v1"), 0)
+	vs.Write(filename, []byte("v2"), 0)
+	vs.Truncate(filename, 1)
+
+	versions, err := vs.ListVersions(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(versions))
+
+	// newest first
+	res := make([]byte, 2)
+	assert.Nil(t, vs.ReadVersion(filename, versions[0].ID, res, 0))
+	assert.Equal(t, "v2", string(res))
+	assert.Nil(t, vs.ReadVersion(filename, versions[1].ID, res, 0))
+	assert.Equal(t, "v1", string(res))
+	assert.Equal(t, int64(0), versions[2].Size)
+
+	// hidden area is not iterated
+	for i := range vs.FileIter() {
+		assert.Equal(t, filename, i.Name())
+	}
+}
+
+func TestVersionedStore_RemoveAndRestore(t *testing.T) {
+	filename := "TestVersionedStore_RemoveAndRestore"
+	s := NewFileSystemStore(path).SubStore("TestVersionedStore_RemoveAndRestore")
+	vs := NewVersionedStore(s, VersionPolicy{})
+
+	vs.CreateFile(filename)
+	vs.Write(filename, []byte("test"), 0)
+	assert.Nil(t, vs.RemoveFile(filename))
+	assert.False(t, vs.IsFileExist(filename))
+
+	versions, _ := vs.ListVersions(filename)
+	assert.Equal(t, 3, len(versions))
+	assert.True(t, versions[0].DeleteMarker)
+	assert.NotNil(t, vs.Restore(filename, versions[0].ID))
+
+	assert.Nil(t, vs.Restore(filename, versions[1].ID))
+	res := make([]byte, 4)
+	assert.Nil(t, vs.Read(filename, res, 0))
+	assert.Equal(t, "test", string(res))
+
+	assert.NotNil(t, vs.ReadVersion(filename, 100, res, 0))
+}
+
+func TestVersionedStore_MaxVersions(t *testing.T) {
+	filename := "TestVersionedStore_MaxVersions"
+	s, _ := NewMemoryStore("/TestVersionedStore_MaxVersions")
+	vs := NewVersionedStore(s, VersionPolicy{MaxVersions: 2})
+
+	vs.CreateFile(filename)
+	for _, data := range []string{"v1", "v2", "v3", "v4"} {
+		vs.Write(filename, []byte(data), 0)
+	}
+
+	versions, _ := vs.ListVersions(filename)
+	assert.Equal(t, 2, len(versions))
+
+	res := make([]byte, 2)
+	assert.Nil(t, vs.ReadVersion(filename, versions[1].ID, res, 0))
+	assert.Equal(t, "v2", string(res))
+}
+
+func TestVersionedStore_Changes(t *testing.T) {
+	filename := strings.Repeat("f", 250)
+	s, _ := NewMemoryStore("/TestVersionedStore_Changes")
+	vs := NewVersionedStore(s, VersionPolicy{MaxVersions: 3}).(*versionedStore)
+
+	vs.CreateFile(filename)
+	assert.Nil(t, vs.Write(filename, []byte("abcdef"), 0))
+	assert.Nil(t, vs.Write(filename, []byte("XY"), 2))
+	assert.Nil(t, vs.Truncate(filename, 3))
+	assert.Nil(t, vs.Write(filename, []byte("gh"), 6))
+
+	// only first version is copied whole
+	list, err := vs.versions.load(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(list))
+	full := 0
+	for _, version := range list {
+		if version.full {
+			full++
+		}
+	}
+	assert.Equal(t, 1, full)
+
+	// content of pruned versions is folded into oldest one kept
+	versions, _ := vs.ListVersions(filename)
+	res := make([]byte, 6)
+	assert.Nil(t, vs.ReadVersion(filename, versions[2].ID, res, 0))
+	assert.Equal(t, "abcdef", string(res))
+	assert.Nil(t, vs.ReadVersion(filename, versions[1].ID, res, 0))
+	assert.Equal(t, "abXYef", string(res))
+	assert.NotNil(t, vs.ReadVersion(filename, versions[0].ID, res, 0))
+	assert.Nil(t, vs.ReadVersion(filename, versions[0].ID, res[:3], 0))
+	assert.Equal(t, "abX", string(res[:3]))
+
+	// file changed bypassing the store is copied whole
+	assert.Nil(t, s.Write(filename, []byte("zz"), 0))
+	assert.Nil(t, vs.Write(filename, []byte("q"), 0))
+	versions, _ = vs.ListVersions(filename)
+	assert.Nil(t, vs.ReadVersion(filename, versions[0].ID, res[:3], 0))
+	assert.Equal(t, "zzX", string(res[:3]))
+
+	// restored version is folded by pruning of capture
+	assert.Nil(t, vs.Restore(filename, versions[1].ID))
+	info, _ := vs.FileInfo(filename)
+	assert.Equal(t, int64(3), info.Size())
+	assert.Nil(t, vs.Read(filename, res[:3], 0))
+	assert.Equal(t, "abX", string(res[:3]))
+}
+
+func TestVersionedStore_Aliases(t *testing.T) {
+	for _, s := range testStores(t, "TestVersionedStore_Aliases") {
+		vs := NewVersionedStore(s, VersionPolicy{})
+
+		// mutations through aliases keep one history
+		assert.Nil(t, vs.CreateFile("file"))
+		assert.Nil(t, vs.Write("./file", []byte("v1"), 0))
+		assert.Nil(t, vs.Write("/file", []byte("v2"), 0))
+		assert.Nil(t, vs.SubStore("./sub/").CreateFile("file"))
+		assert.Nil(t, vs.Write("sub//file", []byte("v1"), 0))
+
+		versions, err := vs.ListVersions("file")
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(versions))
+		res := make([]byte, 2)
+		assert.Nil(t, vs.ReadVersion("./file", versions[0].ID, res, 0))
+		assert.Equal(t, "v1", string(res))
+
+		versions, _ = vs.SubStore("sub").(VersionedStore).ListVersions("file")
+		assert.Equal(t, 1, len(versions))
+		_, err = vs.ListVersions("../file")
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build linux
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns access time of os file info, modification time if not known.
+func accessTime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Sec, st.Atim.Nsec)
+	}
+	return info.ModTime()
+}
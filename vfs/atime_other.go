@@ -0,0 +1,13 @@
+//go:build !linux
+
+package vfs
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns modification time of os file info, access time is not known on this platform.
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
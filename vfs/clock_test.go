@@ -0,0 +1,45 @@
+package vfs
+
+import (
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFileSystem_Clock(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(created)
+	fs, err := NewMemoryFileSystemWithOptions("/TestMemFileSystem_Clock", MemoryOptions{Clock: clock})
+	assert.Nil(t, err)
+
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+
+	f, err := fs.NewFile(context, "/dir/file")
+	assert.Nil(t, err)
+	assert.True(t, created.Equal(f.Stat().ModTime()))
+	assert.True(t, created.Equal(f.Stat().AccessTime()))
+
+	segs, err := fs.ListSegments(context, "/")
+	assert.Nil(t, err)
+	assert.True(t, created.Equal(segs[0].ModTime()))
+
+	// write updates modification and access time
+	clock.Advance(time.Second)
+	_, err = f.WriteAt([]byte("test"), 2)
+	assert.Nil(t, err)
+	assert.True(t, created.Add(time.Second).Equal(f.Stat().ModTime()))
+	assert.True(t, created.Add(time.Second).Equal(f.Stat().AccessTime()))
+
+	// read updates access time only
+	clock.Advance(time.Second)
+	_, err = f.ReadAt(make([]byte, 2), 0)
+	assert.Nil(t, err)
+	assert.True(t, created.Add(time.Second).Equal(f.Stat().ModTime()))
+	assert.True(t, created.Add(2 * time.Second).Equal(f.Stat().AccessTime()))
+
+	clock.Advance(time.Second)
+	assert.Nil(t, f.Truncate(1))
+	assert.True(t, created.Add(3 * time.Second).Equal(f.Stat().ModTime()))
+	assert.True(t, created.Add(3 * time.Second).Equal(f.Stat().AccessTime()))
+}
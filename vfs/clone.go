@@ -0,0 +1,71 @@
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CloneFile copies os file src into dst.
+// data blocks are shared by reflink where file system supports it,
+// otherwise data is copied.
+func CloneFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if reflink(out, in) == nil {
+		return nil
+	}
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// CloneTree clones os directory src into dst by CloneFile.
+// entries that skip returns true, and their children, are not cloned.
+func CloneTree(src string, dst string, skip func(name string) bool) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return CloneFile(src, dst)
+	}
+
+	if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range infos {
+		if skip != nil && skip(i.Name()) {
+			continue
+		}
+
+		if err := CloneTree(filepath.Join(src, i.Name()), filepath.Join(dst, i.Name()), skip); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
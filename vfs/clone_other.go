@@ -0,0 +1,12 @@
+//go:build !linux
+
+package vfs
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(dst *os.File, src *os.File) error {
+	return errors.New("reflink is not supported on this platform")
+}
@@ -0,0 +1,123 @@
+package vfs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ Context is a session on a VirtualFileSystem.
+ It keeps the files opened through it and carries a context.Context,
+ so deadline and cancellation of the caller propagate into long operations.
+ A Context must be released with VirtualFileSystem.ReleaseContext when done.
+ */
+type Context struct {
+	parent   context.Context
+	mu       sync.Mutex
+	files    map[*contextFile]bool
+	released bool
+}
+
+func newContext(parent context.Context) *Context {
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	return &Context{
+		parent: parent,
+		files:  make(map[*contextFile]bool),
+	}
+}
+
+func (c *Context) Deadline() (deadline time.Time, ok bool) {
+	return c.parent.Deadline()
+}
+
+func (c *Context) Done() <-chan struct{} {
+	return c.parent.Done()
+}
+
+func (c *Context) Err() error {
+	return c.parent.Err()
+}
+
+func (c *Context) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// OpenFiles returns the number of files held open by this context.
+func (c *Context) OpenFiles() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.files)
+}
+
+/**
+ contextFile is file opened through a context.
+ closing it removes it from open-file table of context, so it is not closed again by release.
+ */
+type contextFile struct {
+	File
+	context *Context
+	closed  int32
+}
+
+func (f *contextFile) Close() error {
+	if !atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		return nil
+	}
+
+	f.context.untrack(f)
+	return f.File.Close()
+}
+
+// track registers file into open-file table, and returns file to be given to caller.
+// returns false if context is already released.
+func (c *Context) track(file File) (File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.released {
+		return nil, false
+	}
+
+	f := &contextFile{File: file, context: c}
+	c.files[f] = true
+	return f, true
+}
+
+// untrack removes closed file from open-file table.
+func (c *Context) untrack(f *contextFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.files, f)
+}
+
+func (c *Context) isReleased() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.released
+}
+
+// release closes all files opened through this context.
+// returns false if context was already released.
+func (c *Context) release() bool {
+	c.mu.Lock()
+	if c.released {
+		c.mu.Unlock()
+		return false
+	}
+
+	c.released = true
+	files := c.files
+	c.files = make(map[*contextFile]bool)
+	c.mu.Unlock()
+
+	for file := range files {
+		file.Close()
+	}
+
+	return true
+}
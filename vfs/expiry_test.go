@@ -0,0 +1,98 @@
+package vfs
+
+import (
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualFileSystem_Expiry(t *testing.T) {
+	fss, _ := GetVirtualFileSystems(__dir_name_ + "/TestVirtualFileSystem_Expiry")
+
+	for _, fs := range fss {
+		context := fs.Context()
+
+		_, err := fs.CreateFileWithTTL(context, "/a", time.Hour)
+		assert.Nil(t, err)
+		_, err = fs.NewFile(context, "/dir/b")
+		assert.Nil(t, err)
+		_, err = fs.NewFile(context, "/c")
+		assert.Nil(t, err)
+
+		assert.Nil(t, fs.SetExpiry(context, "/dir/b", time.Now().Add(-time.Second)))
+		assert.Nil(t, fs.SetExpiry(context, "/c", time.Now().Add(-time.Second)))
+		assert.NotNil(t, fs.SetExpiry(context, "/dir", time.Now()))
+
+		// expired files are absent before removed
+		assert.True(t, fs.FileExisted(context, "/a"))
+		assert.False(t, fs.FileExisted(context, "/dir/b"))
+		_, err = fs.OpenFile(context, "/dir/b")
+		assert.NotNil(t, err)
+		segs, err := fs.ListSegments(context, "/dir")
+		assert.Nil(t, err)
+		assert.Empty(t, segs)
+
+		// creating expired file replaces it
+		_, err = fs.NewFile(context, "/c")
+		assert.Nil(t, err)
+		assert.True(t, fs.FileExisted(context, "/c"))
+
+		removed, err := fs.RemoveExpired(context, "/")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"/dir/b"}, removed)
+		assert.True(t, fs.FileExisted(context, "/dir"))
+
+		fs.Remove(context, "/a")
+		fs.Remove(context, "/c")
+		fs.Remove(context, "/dir")
+		fs.ReleaseContext(context)
+	}
+}
+
+func TestWrapperFileSystem_ExpiryMeta(t *testing.T) {
+	mount := __dir_name_ + "/TestWrapperFileSystem_ExpiryMeta"
+	fs, err := NewWrapperFileSystem(mount)
+	assert.Nil(t, err)
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+
+	// expiry is kept in metadata of files shared with stores, keeping generation
+	_, err = fs.NewFile(context, "/file")
+	assert.Nil(t, err)
+	assert.Nil(t, WriteFileMeta(mount + "/file", FileMeta{Generation: 3}))
+
+	expiry := time.Now().Add(time.Hour)
+	assert.Nil(t, fs.SetExpiry(context, "/file", expiry))
+	meta, err := ReadFileMeta(mount + "/file")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), meta.Generation)
+	assert.Equal(t, expiry.UnixNano(), meta.Expiry.UnixNano())
+
+	// metadata is removed with file
+	assert.Nil(t, fs.Remove(context, "/file"))
+	meta, err = ReadFileMeta(mount + "/file")
+	assert.Nil(t, err)
+	assert.Equal(t, FileMeta{}, meta)
+}
+
+func TestMemFileSystem_ExpiryClock(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	fs, err := NewMemoryFileSystemWithOptions("/TestMemFileSystem_ExpiryClock", MemoryOptions{Clock: clock})
+	assert.Nil(t, err)
+
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+
+	_, err = fs.CreateFileWithTTL(context, "/a", time.Minute)
+	assert.Nil(t, err)
+
+	clock.Advance(time.Minute - 1)
+	assert.True(t, fs.FileExisted(context, "/a"))
+
+	clock.Advance(1)
+	assert.False(t, fs.FileExisted(context, "/a"))
+
+	removed, err := fs.RemoveExpired(context, "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/a"}, removed)
+}
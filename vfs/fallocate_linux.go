@@ -0,0 +1,23 @@
+//go:build linux
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// modes of fallocate, from linux/falloc.h
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+)
+
+// punchHole releases size bytes of f at off, zeros are written if file system does not support it.
+func punchHole(f *os.File, off int64, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole | fallocKeepSize, off, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return writeZeros(f, off, size)
+	}
+	return err
+}
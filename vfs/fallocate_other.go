@@ -0,0 +1,10 @@
+//go:build !linux
+
+package vfs
+
+import "os"
+
+// holes can not be punched on this platform, zeros are written.
+func punchHole(f *os.File, off int64, size int64) error {
+	return writeZeros(f, off, size)
+}
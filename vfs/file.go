@@ -1,9 +1,12 @@
 package vfs
 
 import (
+	"context"
 	"os"
 	"strings"
 	"io/ioutil"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -11,6 +14,9 @@ var (
 	mountInfoFile = ".vfs_mount_info"
 )
 
+// size of zeros written at once by PunchHole
+const punchChunkSize = 64 << 10
+
 /**
  os filesystem wrapper
 */
@@ -18,13 +24,16 @@ type wrapperFileStat struct {
 	name string
 	size int64
 	modTime time.Time
+	accessTime time.Time
 	isDir 	bool
 }
 
 type wrapperFileSystem struct {
+	mu            sync.RWMutex
 	pwd           map[*Context]*Path
 	mount         *Path
 	pathDelimiter string
+	clock         Clock
 }
 
 type wrapperFile struct {
@@ -65,6 +74,82 @@ func (f *wrapperFile) WriteAt(b []byte, off int64) (n int, err error) {
 	return f.f.WriteAt(b, off)
 }
 
+func (f *wrapperFile) WriteAtV(b [][]byte, offs []int64) error {
+	for i := range b {
+		if _, err := f.f.WriteAt(b[i], offs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace writes b and truncates file to it, which is not atomic to readers of os file.
+func (f *wrapperFile) Replace(b []byte) error {
+	if _, err := f.f.WriteAt(b, 0); err != nil {
+		return err
+	}
+	return f.f.Truncate(int64(len(b)))
+}
+
+func (f *wrapperFile) Truncate(size int64) error {
+	return f.f.Truncate(size)
+}
+
+// PunchHole releases range within end of file by fallocate where supported, writes zeros otherwise.
+func (f *wrapperFile) PunchHole(off int64, size int64) error {
+	info, err := f.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if off + size > info.Size() {
+		size = info.Size() - off
+	}
+
+	if size <= 0 {
+		return nil
+	}
+	return punchHole(f.f, off, size)
+}
+
+// writeZeros writes size zeros at off, by chunks not to allocate whole range.
+func writeZeros(f *os.File, off int64, size int64) error {
+	zeros := make([]byte, punchChunkSize)
+	for size > 0 {
+		chunk := zeros
+		if int64(len(chunk)) > size {
+			chunk = chunk[:size]
+		}
+
+		if _, err := f.WriteAt(chunk, off); err != nil {
+			return err
+		}
+		off += int64(len(chunk))
+		size -= int64(len(chunk))
+	}
+	return nil
+}
+
+func (f *wrapperFile) SeekData(off int64) (int64, error) {
+	return seekData(f.f, off)
+}
+
+func (f *wrapperFile) SeekHole(off int64) (int64, error) {
+	return seekHole(f.f, off)
+}
+
+func (f *wrapperFile) Mmap() (ReadOnlyMapping, error) {
+	return MapFile(f.f)
+}
+
+func (f *wrapperFile) Sync() error {
+	return f.f.Sync()
+}
+
+func (f *wrapperFile) Close() error {
+	return f.f.Close()
+}
+
 func (f *wrapperFile) Delete() {
 
 }
@@ -81,15 +166,25 @@ func (s *wrapperFileStat) ModTime() time.Time {
 	return s.modTime
 }
 
+func (s *wrapperFileStat) AccessTime() time.Time {
+	return s.accessTime
+}
+
 func (s *wrapperFileStat) IsDir() bool {
 	return s.isDir
 }
 
+// Generation is not supported by os file system.
+func (s *wrapperFileStat) Generation() uint64 {
+	return 0
+}
+
 func (s *wrapperFileStat) Immutable() FileStat {
 	stat := &wrapperFileStat{
 		name: s.name,
 		size: s.size,
 		modTime: s.modTime,
+		accessTime: s.accessTime,
 		isDir: s.isDir,
 	}
 
@@ -119,6 +214,7 @@ func NewWrapperFileSystemWithPathDelimiter(mountOnPath string, delimiter string)
 		pwd:           make(map[*Context]*Path),
 		mount:         NewPathWithDelimiter(mountOnPath, delimiter),
 		pathDelimiter: delimiter,
+		clock:         systemClock{},
 	}
 
 	// is directory existed?
@@ -143,12 +239,25 @@ func NewWrapperFileSystemWithPathDelimiter(mountOnPath string, delimiter string)
 }
 
 func (w *wrapperFileSystem) NewFile(context *Context, pathname string) (File, error) {
+	return w.newFile(context, "NewFile", pathname, 0)
+}
+
+// CreateFileWithTTL creates file like NewFile, expiring after ttl.
+func (w *wrapperFileSystem) CreateFileWithTTL(context *Context, pathname string, ttl time.Duration) (File, error) {
+	return w.newFile(context, "CreateFileWithTTL", pathname, ttl)
+}
+
+func (w *wrapperFileSystem) newFile(context *Context, op string, pathname string, ttl time.Duration) (File, error) {
 
 	filepath := NewPathWithDelimiter(pathname, w.pathDelimiter)
 	filename := filepath.FileName()
 
 	if filename == "" {
-		return nil, &WrapperFileSystemError{Err: illegalFileNameErr, Op: "NewFile", Path: pathname}
+		return nil, &WrapperFileSystemError{Err: illegalFileNameErr, Op: op, Path: pathname}
+	}
+
+	if err := w.checkContext(context, op, pathname); err != nil {
+		return nil, err
 	}
 
 	fullPath := w.workingDirectory(context, pathname) + w.pathDelimiter + pathname
@@ -159,36 +268,63 @@ func (w *wrapperFileSystem) NewFile(context *Context, pathname string) (File, er
 		// if not, create directory first
 		err := os.MkdirAll(path, os.ModePerm)
 		if err != nil {
-			return nil, &WrapperFileSystemError{Err: err, Op: "NewFile", Path: pathname}
+			return nil, &WrapperFileSystemError{Err: err, Op: op, Path: pathname}
 		}
 	}
 
 	// file create
+	// file is kept open in context's open-file table until closed or context released
 	f, err := os.Create(fullPath)
-	if f != nil {
-		defer f.Close()
+	if err != nil {
+		return nil, &WrapperFileSystemError{Err: err, Op: op, Path: pathname}
 	}
 
-	if err != nil {
-		return nil, &WrapperFileSystemError{Err: err, Op: "NewFile", Path: pathname}
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = w.clock.Now().Add(ttl)
+	}
+
+	if err := setExpiry(fullPath, expiry); err != nil {
+		f.Close()
+		return nil, &WrapperFileSystemError{Err: err, Op: op, Path: pathname}
 	}
 
-	file := newWrapperFile(f)
+	// entry of created file is committed, its data are committed by Sync of file
+	if err := SyncDir(path); err != nil {
+		f.Close()
+		return nil, &WrapperFileSystemError{Err: err, Op: op, Path: pathname}
+	}
+
+	file, ok := context.track(newWrapperFile(f))
+	if !ok {
+		f.Close()
+		return nil, &WrapperFileSystemError{Err: invalidContextErr, Op: op, Path: pathname}
+	}
 
 	return file, err
 }
 
 func (w *wrapperFileSystem) Remove(context *Context, pathname string) error {
 
-	// check if file existed.
-	if !w.FileExisted(context, pathname) {
-		return &WrapperFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "Remove", Path: pathname}
+	if err := w.checkContext(context, "Remove", pathname); err != nil {
+		return err
 	}
 
 	// get context's working directory
 	fullPath := w.workingDirectory(context, pathname) + w.pathDelimiter + pathname
 
-	err := os.RemoveAll(fullPath)
+	// check if file existed, expired file is removed too.
+	if _, err := os.Lstat(fullPath); os.IsNotExist(err) {
+		return &WrapperFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "Remove", Path: pathname}
+	}
+
+	err := removeAll(context, fullPath)
+	if err == nil {
+		err = RemoveFileMeta(fullPath)
+	}
+	if err == nil {
+		err = SyncDir(filepath.Dir(fullPath))
+	}
 
 	if err != nil {
 		return &WrapperFileSystemError{Err: err, Op: "Remove", Path: pathname}
@@ -198,15 +334,28 @@ func (w *wrapperFileSystem) Remove(context *Context, pathname string) error {
 }
 
 func (w *wrapperFileSystem) OpenFile(context *Context, pathname string)	(File, error) {
+	if err := w.checkContext(context, "OpenFile", pathname); err != nil {
+		return nil, err
+	}
+
 	fullPath := w.workingDirectory(context, pathname) + w.pathDelimiter + pathname
+	if w.expired(fullPath) {
+		return nil, &WrapperFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "OpenFile", Path: pathname}
+	}
 
 	f, err := os.OpenFile(fullPath, os.O_RDWR, os.ModeAppend)
 
 	if err != nil {
 		return nil, &WrapperFileSystemError{Err: err, Op: "OpenFile", Path: pathname}
-	} else {
-		return newWrapperFile(f), nil
 	}
+
+	file, ok := context.track(newWrapperFile(f))
+	if !ok {
+		f.Close()
+		return nil, &WrapperFileSystemError{Err: invalidContextErr, Op: "OpenFile", Path: pathname}
+	}
+
+	return file, nil
 }
 
 func (w *wrapperFileSystem) Create(context *Context, pathname string) (File, error) {
@@ -214,11 +363,18 @@ func (w *wrapperFileSystem) Create(context *Context, pathname string) (File, err
 }
 
 func (w *wrapperFileSystem) Mkdir(context *Context, pathname string) error {
+	if err := w.checkContext(context, "Mkdir", pathname); err != nil {
+		return err
+	}
+
 	if w.FileExisted(context, pathname) {
 		return &WrapperFileSystemError{Err: fileExistsErr, Op: "Mkdir", Path: pathname}
 	} else {
 		fullPath := w.workingDirectory(context, pathname) + w.pathDelimiter + pathname
 		err := os.MkdirAll(fullPath, os.ModePerm)
+		if err == nil {
+			err = SyncDir(filepath.Dir(filepath.Clean(fullPath)))
+		}
 		if err != nil {
 			return &WrapperFileSystemError{Err: err, Op: "Mkdir", Path: pathname}
 		}
@@ -228,20 +384,27 @@ func (w *wrapperFileSystem) Mkdir(context *Context, pathname string) error {
 }
 
 func (w *wrapperFileSystem) FileExisted(context *Context, pathname string) bool {
+	if w.checkContext(context, "FileExisted", pathname) != nil {
+		return false
+	}
+
 	fullPath := w.workingDirectory(context, pathname) + w.pathDelimiter + pathname
 	_, err := os.Stat(fullPath)
-	return !os.IsNotExist(err)
+	return !os.IsNotExist(err) && !w.expired(fullPath)
 }
 
 func (w *wrapperFileSystem) ChangeDirectory(context *Context, pathname string) error {
 
-	if w.pwd[context] == nil {
-		return &WrapperFileSystemError{ Err: invalidContextErr, Op: "ChangeDirectory", Path: pathname}
+	if err := w.checkContext(context, "ChangeDirectory", pathname); err != nil {
+		return err
 	}
 
 	if !w.FileExisted(context, pathname) {
 		return &WrapperFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "ChangeDirectory", Path: pathname}
 	} else {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
 		if strings.HasPrefix(pathname, w.pathDelimiter) {
 			// replace
 			w.pwd[context] = NewPathWithDelimiter(pathname, w.pathDelimiter)
@@ -254,13 +417,42 @@ func (w *wrapperFileSystem) ChangeDirectory(context *Context, pathname string) e
 }
 
 func (w *wrapperFileSystem) Context() *Context {
-	context := &Context{}
-	w.pwd[context] = NewPathWithDelimiter("/", w.pathDelimiter)
-	return context
+	return w.ContextWithParent(nil)
+}
+
+// ContextWithParent returns new context bound to parent.
+// if parent is nil, context.Background() is used.
+func (w *wrapperFileSystem) ContextWithParent(parent context.Context) *Context {
+	c := newContext(parent)
+
+	w.mu.Lock()
+	w.pwd[c] = NewPathWithDelimiter("/", w.pathDelimiter)
+	w.mu.Unlock()
+
+	return c
+}
+
+// ReleaseContext closes all files opened through the context
+// and forgets its working directory.
+func (w *wrapperFileSystem) ReleaseContext(context *Context) error {
+	w.mu.Lock()
+	_, ok := w.pwd[context]
+	delete(w.pwd, context)
+	w.mu.Unlock()
+
+	if !ok || !context.release() {
+		return &WrapperFileSystemError{Err: invalidContextErr, Op: "ReleaseContext", Path: ""}
+	}
+
+	return nil
 }
 
 func (w *wrapperFileSystem) ListSegments(context *Context, pathname string) ([]FileStat, error) {
 
+	if err := w.checkContext(context, "ls", pathname); err != nil {
+		return nil, err
+	}
+
 	fullPath := w.workingDirectory(context, pathname) + w.pathDelimiter + pathname
 
 	// read directory info
@@ -272,6 +464,14 @@ func (w *wrapperFileSystem) ListSegments(context *Context, pathname string) ([]F
 
 	fileStats := make([]FileStat, 0)
 	for _, info := range infos {
+		if err := context.Err(); err != nil {
+			return nil, &WrapperFileSystemError{Err: err, Op: "ls", Path: pathname}
+		}
+
+		if info.Name() == MetaDir || (!info.IsDir() && w.expired(filepath.Join(fullPath, info.Name()))) {
+			continue
+		}
+
 		if info.Name() != mountInfoFile {
 			// skip .vfs_mount_info
 
@@ -280,6 +480,7 @@ func (w *wrapperFileSystem) ListSegments(context *Context, pathname string) ([]F
 				isDir: info.IsDir(),
 				size: info.Size(),
 				modTime: info.ModTime(),
+				accessTime: accessTime(info),
 			})
 		}
 	}
@@ -287,14 +488,252 @@ func (w *wrapperFileSystem) ListSegments(context *Context, pathname string) ([]F
 	return fileStats, nil
 }
 
+// Watch emits changes of pathname, and of its children.
+// if recursive, changes of all descendants are emitted too.
+// changes are detected by inotify, or by polling where inotify is not available.
+// watch stops when returned cancel function is called or context is done.
+func (w *wrapperFileSystem) Watch(context *Context, pathname string, recursive bool) (<-chan Event, func(), error) {
+	if err := w.checkContext(context, "Watch", pathname); err != nil {
+		return nil, nil, err
+	}
+
+	fullPath := w.workingDirectory(context, pathname) + w.pathDelimiter + pathname
+
+	// absolute path of watched path in this file system
+	base := NewPathWithDelimiter(pathname, w.pathDelimiter)
+	if !strings.HasPrefix(pathname, w.pathDelimiter) {
+		base = w.pwdPath(context).Concat(base)
+	}
+
+	wt := newWatch(base.String(), w.pathDelimiter, recursive)
+	wt.rewrite = func(rel string) (string, bool) {
+		if rel == mountInfoFile || strings.HasSuffix(rel, "/" + mountInfoFile) || isMetaPath(rel) {
+			// skip .vfs_mount_info and metadata of files
+			return "", false
+		}
+
+		if rel == "" {
+			return base.String(), true
+		}
+
+		return base.Concat(NewPathWithDelimiter(strings.Replace(rel, "/", w.pathDelimiter, -1), w.pathDelimiter)).String(), true
+	}
+
+	if err := watchPath(fullPath, recursive, wt); err != nil {
+		wt.stop()
+		return nil, nil, &WrapperFileSystemError{Err: err, Op: "Watch", Path: pathname}
+	}
+
+	go func() {
+		select {
+		case <-context.Done():
+			wt.stop()
+		case <-wt.done:
+		}
+	}()
+
+	return wt.out, wt.stop, nil
+}
+
+// Clone copies src into dst, including all children of src.
+// data blocks are shared by reflink where os file system supports it.
+func (w *wrapperFileSystem) Clone(context *Context, src string, dst string) error {
+	return w.CloneTree(context, src, dst, nil)
+}
+
+// CloneTree clones src like Clone, except entries that skip returns true for.
+// files are cloned one by one, so changes of them while cloned may be seen partly.
+func (w *wrapperFileSystem) CloneTree(context *Context, src string, dst string, skip func(name string) bool) error {
+	if err := w.checkContext(context, "Clone", src); err != nil {
+		return err
+	}
+
+	if !w.FileExisted(context, src) {
+		return &WrapperFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "Clone", Path: src}
+	}
+
+	if w.FileExisted(context, dst) {
+		return &WrapperFileSystemError{Err: fileExistsErr, Op: "Clone", Path: dst}
+	}
+
+	srcPath := w.workingDirectory(context, src) + w.pathDelimiter + src
+	dstPath := w.workingDirectory(context, dst) + w.pathDelimiter + dst
+
+	if rel, err := filepath.Rel(srcPath, dstPath); err == nil && !strings.HasPrefix(rel, "..") && !skipped(rel, skip) {
+		return &WrapperFileSystemError{Err: cloneIntoItselfErr, Op: "Clone", Path: dst}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return &WrapperFileSystemError{Err: err, Op: "Clone", Path: dst}
+	}
+
+	err := CloneTree(srcPath, dstPath, func(name string) bool {
+		return name == mountInfoFile || (skip != nil && skip(name))
+	})
+	if err == nil {
+		err = SyncDir(filepath.Dir(dstPath))
+	}
+
+	if err != nil {
+		return &WrapperFileSystemError{Err: err, Op: "Clone", Path: dst}
+	}
+
+	return nil
+}
+
+// skipped returns true if skip returns true for any parent directory on relative path rel.
+func skipped(rel string, skip func(name string) bool) bool {
+	if skip == nil {
+		return false
+	}
+
+	for dir := filepath.Dir(rel); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if skip(filepath.Base(dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetExpiry sets time file pathname expires at, zero time means file does not expire.
+func (w *wrapperFileSystem) SetExpiry(context *Context, pathname string, expiry time.Time) error {
+	if err := w.checkContext(context, "SetExpiry", pathname); err != nil {
+		return err
+	}
+
+	fullPath := w.workingDirectory(context, pathname) + w.pathDelimiter + pathname
+
+	info, err := os.Stat(fullPath)
+	if err != nil || w.expired(fullPath) {
+		return &WrapperFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "SetExpiry", Path: pathname}
+	} else if info.IsDir() {
+		return &WrapperFileSystemError{Err: isDirectoryErr, Op: "SetExpiry", Path: pathname}
+	}
+
+	if err := setExpiry(fullPath, expiry); err != nil {
+		return &WrapperFileSystemError{Err: err, Op: "SetExpiry", Path: pathname}
+	}
+	return nil
+}
+
+// RemoveExpired removes expired files under pathname, including pathname itself.
+// metadata directories are visited only, not every file.
+func (w *wrapperFileSystem) RemoveExpired(context *Context, pathname string) ([]string, error) {
+	if err := w.checkContext(context, "RemoveExpired", pathname); err != nil {
+		return nil, err
+	}
+
+	fullPath := w.workingDirectory(context, pathname) + w.pathDelimiter + pathname
+
+	// absolute path of pathname in this file system
+	base := NewPathWithDelimiter(pathname, w.pathDelimiter)
+	if !strings.HasPrefix(pathname, w.pathDelimiter) {
+		base = w.pwdPath(context).Concat(base)
+	}
+
+	removed := make([]string, 0)
+	remove := func(path string) error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := RemoveFileMeta(path); err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(fullPath, path)
+		if rel == "." {
+			removed = append(removed, base.String())
+		} else {
+			rel = strings.Replace(filepath.ToSlash(rel), "/", w.pathDelimiter, -1)
+			removed = append(removed, base.Concat(NewPathWithDelimiter(rel, w.pathDelimiter)).String())
+		}
+		return nil
+	}
+
+	err := filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed while walking
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := context.Err(); err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			if path == fullPath && w.expired(path) {
+				return remove(path)
+			}
+			return nil
+		} else if info.Name() != MetaDir {
+			return nil
+		}
+
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range infos {
+			if strings.HasPrefix(i.Name(), TempPrefix) {
+				// metadata being written
+				continue
+			}
+
+			file := filepath.Join(filepath.Dir(path), i.Name())
+			if w.expired(file) {
+				if err := remove(file); err != nil {
+					return err
+				}
+			}
+		}
+		return filepath.SkipDir
+	})
+
+	if err != nil {
+		return nil, &WrapperFileSystemError{Err: err, Op: "RemoveExpired", Path: pathname}
+	}
+	return removed, nil
+}
+
+// expired returns true if os file path is expired.
+func (w *wrapperFileSystem) expired(path string) bool {
+	meta, err := ReadFileMeta(path)
+	return err == nil && meta.Expired(w.clock.Now())
+}
+
 func (w *wrapperFileSystem) PresentWorkingDirectory(context *Context) string {
-	return w.pwdPath(context).String()
+	p := w.pwdPath(context)
+
+	if p == nil {
+		return ""
+	}
+
+	return p.String()
 }
 
 func (w *wrapperFileSystem) pwdPath(context *Context) *Path {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
 	return w.pwd[context]
 }
 
+// checkContext returns error if context is released or cancelled.
+func (w *wrapperFileSystem) checkContext(context *Context, op string, pathname string) error {
+	if context == nil || w.pwdPath(context) == nil {
+		return &WrapperFileSystemError{Err: invalidContextErr, Op: op, Path: pathname}
+	}
+
+	if err := context.Err(); err != nil {
+		return &WrapperFileSystemError{Err: err, Op: op, Path: pathname}
+	}
+
+	return nil
+}
+
 func (w *wrapperFileSystem) workingDirectory(context *Context, pathname string) string {
 	// if pathname starts with __dir_name_ pathDelimiter (like "/"),
 	// then start on mount root
@@ -314,6 +753,34 @@ func isDirectoryExist(path string) bool {
 	return !os.IsNotExist(err) && fileinfo != nil && fileinfo.IsDir()
 }
 
+// removeAll removes path and any children it contains like os.RemoveAll,
+// but stops as soon as context is cancelled.
+func removeAll(context *Context, path string) error {
+	if err := context.Err(); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range infos {
+			if err := removeAll(context, filepath.Join(path, i.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return os.Remove(path)
+}
+
 func isNestedFilePath(path string, delimiter string) (bool, string) {
 
 	// find path already mounted
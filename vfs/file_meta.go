@@ -0,0 +1,173 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// MetaDir is sibling directory of files keeping their metadata,
+	// shared by os file system and stores on it.
+	MetaDir = ".kayat_meta"
+
+	// TempPrefix is prefix of temporary files of atomic writes.
+	// left only if write is interrupted.
+	TempPrefix = ".kayat_tmp_"
+
+	fileMetaVersion = 2
+
+	// offset of generation in metadata of any version, so it is updated in place
+	fileMetaGenerationOffset = 1
+)
+
+var corruptedFileMetaErr = errors.New("corrupted file metadata")
+
+/**
+ FileMeta is metadata of a file of os file system.
+ encoded as version(1) generation(8) expiry(8), expiry is unix time in nanoseconds, 0 if not expiring.
+ version 1 has no expiry.
+ */
+type FileMeta struct {
+	Generation uint64
+	Expiry     time.Time
+}
+
+// MetaPath returns path of metadata of os file path.
+func MetaPath(path string) string {
+	return filepath.Join(filepath.Dir(path), MetaDir, filepath.Base(path))
+}
+
+// ReadFileMeta returns metadata of os file path, zero value if not existed.
+func ReadFileMeta(path string) (FileMeta, error) {
+	data, err := ioutil.ReadFile(MetaPath(path))
+	if os.IsNotExist(err) {
+		return FileMeta{}, nil
+	} else if err != nil {
+		return FileMeta{}, err
+	}
+
+	if len(data) < 9 || data[0] < 1 || data[0] > fileMetaVersion || (data[0] == fileMetaVersion && len(data) < 17) {
+		return FileMeta{}, &os.PathError{Op: "ReadFileMeta", Path: MetaPath(path), Err: corruptedFileMetaErr}
+	}
+
+	meta := FileMeta{Generation: binary.LittleEndian.Uint64(data[fileMetaGenerationOffset:])}
+	if data[0] == fileMetaVersion {
+		if nanos := int64(binary.LittleEndian.Uint64(data[9:])); nanos != 0 {
+			meta.Expiry = time.Unix(0, nanos)
+		}
+	}
+
+	return meta, nil
+}
+
+// WriteFileMeta replaces metadata of os file path atomically.
+func WriteFileMeta(path string, meta FileMeta) error {
+	data := make([]byte, 17)
+	data[0] = fileMetaVersion
+	binary.LittleEndian.PutUint64(data[fileMetaGenerationOffset:], meta.Generation)
+	if !meta.Expiry.IsZero() {
+		binary.LittleEndian.PutUint64(data[9:], uint64(meta.Expiry.UnixNano()))
+	}
+
+	return WriteFileAtomic(MetaPath(path), data, false)
+}
+
+// UpdateGeneration rewrites generation in metadata file f in place, by update of current one.
+// generation is 8 bytes at fixed offset, so it is not torn by file systems writing sectors atomically.
+func UpdateGeneration(f *os.File, update func(generation uint64) uint64) error {
+	data := make([]byte, fileMetaGenerationOffset + 8)
+	if _, err := f.ReadAt(data, 0); err == io.EOF || (err == nil && (data[0] < 1 || data[0] > fileMetaVersion)) {
+		return &os.PathError{Op: "UpdateGeneration", Path: f.Name(), Err: corruptedFileMetaErr}
+	} else if err != nil {
+		return err
+	}
+
+	generation := update(binary.LittleEndian.Uint64(data[fileMetaGenerationOffset:]))
+	binary.LittleEndian.PutUint64(data[fileMetaGenerationOffset:], generation)
+	_, err := f.WriteAt(data[fileMetaGenerationOffset:], fileMetaGenerationOffset)
+	return err
+}
+
+// Expired returns true if file of meta is expired at now.
+func (m FileMeta) Expired(now time.Time) bool {
+	return !m.Expiry.IsZero() && !now.Before(m.Expiry)
+}
+
+func RemoveFileMeta(path string) error {
+	err := os.Remove(MetaPath(path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// setExpiry sets expiry in metadata of os file path, keeping its generation.
+// metadata is not written for file not expiring without metadata.
+func setExpiry(path string, expiry time.Time) error {
+	meta, err := ReadFileMeta(path)
+	if err != nil {
+		return err
+	}
+
+	if expiry.IsZero() && meta == (FileMeta{}) {
+		return nil
+	}
+
+	meta.Expiry = expiry
+	return WriteFileMeta(path, meta)
+}
+
+// isMetaPath returns true if relative path rel is in metadata directory.
+func isMetaPath(rel string) bool {
+	for _, segment := range strings.Split(rel, "/") {
+		if segment == MetaDir {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteFileAtomic writes temporary file and renames it into path,
+// so readers see either old or new content.
+// temporary file is synced before renamed if sync, so crashes do not leave path empty.
+func WriteFileAtomic(path string, data []byte, sync bool) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// name of temporary file is kept within 255 bytes limit of names
+	base := filepath.Base(path)
+	if len(base) > 200 {
+		base = base[:200]
+	}
+
+	tmp, err := ioutil.TempFile(dir, TempPrefix + base + "-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil && sync {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
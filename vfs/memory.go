@@ -1,8 +1,11 @@
 package vfs
 
 import (
+	"context"
+	"io"
 	"time"
 	"sync"
+	"sync/atomic"
 	"strings"
 )
 
@@ -19,22 +22,36 @@ type fileNode struct {
 type virtualFile struct {
 	mu sync.RWMutex
 	deleted bool
-	data    []byte
+	data    *sparseData
 	stat 	*memFileStat
+	onChange func(op EventOp)
+	fs      *memFileSystem
+	entry   *memEntry	// accounting of file, guarded by usage of fs
+	expiry  time.Time	// zero if file does not expire
+	// access time in unix nanoseconds, updated atomically as reads hold read lock only
+	accessed int64
 }
 
 type memFileStat struct {
 	name string
 	size int64
 	modTime time.Time
+	accessTime time.Time
 	isDir 	bool
+	generation uint64
 }
 
 type memFileSystem struct {
+	mu sync.RWMutex
+	// guards structure of tree under rootNode
+	tree sync.RWMutex
 	mount 	*Path
 	rootNode *fileNode
 	pwd map[*Context]*fileNode
 	pathDelimiter string
+	watchers *watchHub
+	usage *memUsage
+	clock Clock
 }
 
 type MemFileSystemError struct {
@@ -43,10 +60,6 @@ type MemFileSystemError struct {
 	Path string
 }
 
-type Context struct {
-
-}
-
 func (e *MemFileSystemError) Error() string {
 	return e.Op + ": " + e.Path + ": " + e.Err.Error()
 }
@@ -63,16 +76,26 @@ func (m *memFileStat) ModTime() time.Time {
 	return m.modTime
 }
 
+func (m *memFileStat) AccessTime() time.Time {
+	return m.accessTime
+}
+
 func (m *memFileStat) IsDir() bool {
 	return m.isDir
 }
 
+func (m *memFileStat) Generation() uint64 {
+	return m.generation
+}
+
 func (m *memFileStat) Immutable() FileStat {
 	return &memFileStat{
 		name: m.name,
 		size: m.size,
 		modTime: m.modTime,
+		accessTime: m.accessTime,
 		isDir: m.isDir,
+		generation: m.generation,
 	}
 }
 
@@ -91,12 +114,13 @@ func (n *fileNode) addFile(path *Path, file File, i int) {
 	if i == path.Len() - 1 {
 		n.children[dir].file = file
 	} else {
-		n.children[dir].file = newVirtualDirectory(dir)
+		// parent directories are created at same time as file
+		n.children[dir].file = newVirtualDirectory(dir, file.Stat().ModTime())
 		n.children[dir].addFile(path, file, i+1)
 	}
 }
 
-func (n *fileNode) addDirectory(path *Path, i int) {
+func (n *fileNode) addDirectory(path *Path, i int, now time.Time) {
 	if i > path.Len() - 1 {
 		return
 	}
@@ -104,11 +128,47 @@ func (n *fileNode) addDirectory(path *Path, i int) {
 	dir := path.NthPath(i)
 
 	if n.children[dir] == nil {
-		n.children[dir] = newFileNode(newVirtualDirectory(dir))
+		n.children[dir] = newFileNode(newVirtualDirectory(dir, now))
 		n.children[dir].parent = n
 	}
 
-	n.children[dir].addDirectory(path, i+1)
+	n.children[dir].addDirectory(path, i+1, now)
+}
+
+// missing returns number of nodes added for path by addFile or addDirectory.
+func (n *fileNode) missing(path *Path, i int) int64 {
+	if i > path.Len() - 1 {
+		return 0
+	}
+
+	child := n.children[path.NthPath(i)]
+	if child == nil {
+		return int64(path.Len() - i)
+	}
+	return child.missing(path, i+1)
+}
+
+// under returns true if directory path under n is, or is added by addDirectory, under node dir,
+// but not under entry between them that skip returns true for, as clone into entry left out of it is not into itself.
+func (n *fileNode) under(path *Path, dir *fileNode, skip func(name string) bool) bool {
+	left := false
+	i := 0
+	for ; i < path.Len() && n.children[path.NthPath(i)] != nil; i++ {
+		n = n.children[path.NthPath(i)]
+	}
+
+	// directories not existing are added under n
+	for ; i < path.Len(); i++ {
+		left = left || (skip != nil && skip(path.NthPath(i)))
+	}
+
+	for ; n != nil; n = n.parent {
+		if n == dir {
+			return !left
+		}
+		left = left || (skip != nil && skip(n.file.Stat().Name()))
+	}
+	return false
 }
 
 func (n *fileNode) getFile(path *Path, i int) File {
@@ -167,6 +227,45 @@ func (n *fileNode) removeAllFiles() {
 	n.file = nil
 }
 
+// clone returns copy of n and its children, named name.
+// data of files are shared copy-on-write.
+func (n *fileNode) clone(name string, parent *fileNode) *fileNode {
+	c := newFileNode(n.file.(*virtualFile).clone(name))
+	c.parent = parent
+
+	for dir, child := range n.children {
+		c.children[dir] = child.clone(dir, c)
+	}
+
+	return c
+}
+
+// without returns tree of n, leaving out nodes that skip returns true for, and their children.
+// nodes returned share files of n.
+func (n *fileNode) without(skip func(name string) bool) *fileNode {
+	c := &fileNode{file: n.file, children: make(map[string]*fileNode), parent: n.parent}
+
+	for name, child := range n.children {
+		if !skip(name) {
+			c.children[name] = child.without(skip)
+			c.children[name].parent = c
+		}
+	}
+
+	return c
+}
+
+// nextGeneration returns generation following prev.
+// generation is based on current time, so a file recreated after removal
+// does not reuse generation of removed one.
+func nextGeneration(prev uint64) uint64 {
+	now := uint64(time.Now().UnixNano())
+	if now > prev {
+		return now
+	}
+	return prev + 1
+}
+
 func newFileNode(file File) *fileNode {
 	return &fileNode{
 		file: file,
@@ -179,6 +278,16 @@ func NewMemoryFileSystem(mountOnPath string) (VirtualFileSystem, error) {
 }
 
 func NewMemoryFileSystemWithPathDelimiter(mountOnPath string, delimiter string) (VirtualFileSystem, error) {
+	return NewMemoryFileSystemWithOptions(mountOnPath, MemoryOptions{PathDelimiter: delimiter})
+}
+
+// NewMemoryFileSystemWithOptions returns memory file system limited by options.
+func NewMemoryFileSystemWithOptions(mountOnPath string, options MemoryOptions) (VirtualFileSystem, error) {
+	delimiter := options.PathDelimiter
+	if delimiter == "" {
+		delimiter = DEFAULT_PATH_DELIMITER
+	}
+
 	if !strings.HasPrefix(mountOnPath, delimiter) {
 		return nil, &MemFileSystemError{Err: invalidMountOnPathErr, Op: "mount", Path: mountOnPath}
 	}
@@ -192,11 +301,19 @@ func NewMemoryFileSystemWithPathDelimiter(mountOnPath string, delimiter string)
 		return nil, &MemFileSystemError{Err: nestedMountedErr(nestedPath), Op: "mount", Path: mountOnPath}
 	}
 
+	if options.Clock == nil {
+		options.Clock = systemClock{}
+	}
+	clock := options.Clock
+
 	mfs := &memFileSystem{
 		mount: NewPathWithDelimiter(mountOnPath, delimiter),
-		rootNode: newFileNode(newVirtualDirectory(delimiter)),
+		rootNode: newFileNode(newVirtualDirectory(delimiter, clock.Now())),
 		pathDelimiter: delimiter,
 		pwd: make(map[*Context]*fileNode),
+		watchers: newWatchHub(),
+		usage: newMemUsage(options),
+		clock: clock,
 	}
 
 	memFileSystems[mountOnPath] = mfs
@@ -232,30 +349,49 @@ func isNestedPath(path string, delimiter string) (bool, string) {
 	return false, ""
 }
 
-func newVirtualDirectory(name string) File {
+// newVirtualDirectory returns directory name created at now.
+func newVirtualDirectory(name string, now time.Time) File {
 	return &virtualFile{
 		stat: &memFileStat{
 			name: name,
 			size: 0,
-			modTime: time.Now(),
+			modTime: now,
+			accessTime: now,
 			isDir: true,
 		},
+		data: newSparseData(),
+		accessed: now.UnixNano(),
 	}
 }
 
-func newVirtualFile(name string) File {
+// newVirtualFile returns empty file name created at now.
+func newVirtualFile(name string, now time.Time) File {
 	return &virtualFile{
 		stat: &memFileStat{
 			name: name,
 			size: 0,
-			modTime: time.Now(),
+			modTime: now,
+			accessTime: now,
 			isDir: false,
+			generation: nextGeneration(0),
 		},
+		data: newSparseData(),
+		accessed: now.UnixNano(),
 	}
 }
 
+// Stat returns copy of current stat.
 func (f *virtualFile) Stat() FileStat {
-	return f.stat
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.stat == nil {
+		return nil
+	}
+
+	stat := f.stat.Immutable().(*memFileStat)
+	stat.accessTime = time.Unix(0, atomic.LoadInt64(&f.accessed))
+	return stat
 }
 
 func (f *virtualFile) Read(b []byte) (n int, err error) {
@@ -266,13 +402,15 @@ func (f *virtualFile) Read(b []byte) (n int, err error) {
 		return 0, &MemFileSystemError{Err: fileReadWriteErr, Op: "Read", Path: ""}
 	}
 
-	if len(b) < len(f.data) {
+	if int64(len(b)) < f.stat.Size() {
 		n = len(b)
 	} else {
-		n = len(f.data)
+		n = int(f.stat.Size())
 	}
 
-	copy(b, f.data)
+	f.data.readAt(b[:n], 0)
+	f.accessedAt(f.now())
+	f.usage().touch(f)
 	return n, nil
 }
 
@@ -292,53 +430,311 @@ func (f *virtualFile) ReadAt(b []byte, off int64) (n int, err error) {
 	if int64(len(b)) < f.stat.Size() - off {
 		n = len(b)
 	} else {
-		n = len(f.data) - int(off)
+		n = int(f.stat.Size() - off)
 	}
 
-	copy(b, f.data[off:])
+	f.data.readAt(b[:n], off)
+	f.accessedAt(f.now())
+	f.usage().touch(f)
 	return n, nil
 }
 
 func (f *virtualFile) Write(b []byte) (n int, err error) {
-	f.mu.Lock()
+	err = f.lockResize("Write", func() int64 {
+		return f.data.writeGrow(0, int64(len(b)))
+	})
+	if err != nil {
+		return 0, err
+	}
 	defer f.mu.Unlock()
 
-	if f.deleted {
-		return 0, &MemFileSystemError{Err: fileReadWriteErr, Op: "Write", Path: ""}
+	n = len(b)
+	f.data.writeAt(b, 0)
+	if f.stat.size < int64(len(b)) {
+		f.stat.size = int64(len(b))
 	}
+	f.changed(Write)
 
-	n = len(b)
+	return n, nil
+}
+
+func (f *virtualFile) WriteAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &MemFileSystemError{Err: invalidOffsetErr, Op: "WriteAt", Path: ""}
+	}
 
-	if f.stat.Size() <= int64(len(b)) {
-		f.data = make([]byte, len(b))
+	err = f.lockResize("WriteAt", func() int64 {
+		return f.data.writeGrow(off, int64(len(b)))
+	})
+	if err != nil {
+		return 0, err
 	}
+	defer f.mu.Unlock()
 
-	copy(f.data, b)
-	f.stat.size = int64(len(f.data))
+	// only pages of written range are allocated, gap before is hole
+	n = len(b)
+	f.data.writeAt(b, off)
+	if f.stat.size < off + int64(len(b)) {
+		f.stat.size = off + int64(len(b))
+	}
+	f.changed(Write)
 
 	return n, nil
 }
 
-func (f *virtualFile) WriteAt(b []byte, off int64) (n int, err error) {
+// WriteAtV writes each of b at offset of same index, generation is changed once.
+func (f *virtualFile) WriteAtV(b [][]byte, offs []int64) error {
+	for _, off := range offs {
+		if off < 0 {
+			return &MemFileSystemError{Err: invalidOffsetErr, Op: "WriteAtV", Path: ""}
+		}
+	}
+
+	err := f.lockResize("WriteAtV", func() int64 {
+		return f.data.writeVGrow(b, offs)
+	})
+	if err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+
+	for i := range b {
+		f.data.writeAt(b[i], offs[i])
+		if end := offs[i] + int64(len(b[i])); f.stat.size < end {
+			f.stat.size = end
+		}
+	}
+	f.changed(Write)
+
+	return nil
+}
+
+// Replace replaces data of f by b, readers see either old or new data.
+func (f *virtualFile) Replace(b []byte) error {
+	err := f.lockResize("Replace", func() int64 {
+		return f.data.truncateGrow(0) + int64(len(b))
+	})
+	if err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+
+	f.data.truncate(0)
+	f.data.writeAt(b, 0)
+	f.stat.size = int64(len(b))
+	f.changed(Write)
+
+	return nil
+}
+
+func (f *virtualFile) Truncate(size int64) error {
+	if size < 0 {
+		return &MemFileSystemError{Err: invalidOffsetErr, Op: "Truncate", Path: ""}
+	}
+
+	err := f.lockResize("Truncate", func() int64 {
+		return f.data.truncateGrow(size)
+	})
+	if err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+
+	// extended range is hole
+	f.data.truncate(size)
+	f.stat.size = size
+	f.changed(Write)
+
+	return nil
+}
+
+// clone returns copy of f named name, sharing data copy-on-write.
+func (f *virtualFile) clone(name string) *virtualFile {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	return &virtualFile{
+		data: f.data.share(),
+		expiry: f.expiry,
+		accessed: atomic.LoadInt64(&f.accessed),
+		stat: &memFileStat{
+			name: name,
+			size: f.stat.size,
+			modTime: f.stat.modTime,
+			isDir: f.stat.isDir,
+			generation: f.stat.generation,
+		},
+	}
+}
+
+// PunchHole releases data of size bytes at off, which is read as zeros after.
+// size of file is not changed, range beyond end of file is ignored.
+func (f *virtualFile) PunchHole(off int64, size int64) error {
+	if off < 0 || size < 0 {
+		return &MemFileSystemError{Err: invalidOffsetErr, Op: "PunchHole", Path: ""}
+	}
+
+	err := f.lockResize("PunchHole", func() int64 {
+		return f.data.punchGrow(off, size)
+	})
+	if err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+
+	f.data.punch(off, size)
+	f.changed(Write)
+
+	return nil
+}
+
+// SeekData returns first offset from off holding data, io.EOF if there is no data after off.
+func (f *virtualFile) SeekData(off int64) (int64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if err := f.checkSeek("SeekData", off); err != nil {
+		return 0, err
+	}
+
+	if data := f.data.seekData(off, f.stat.size); data >= 0 {
+		return data, nil
+	}
+	return 0, io.EOF
+}
+
+// SeekHole returns first offset from off in hole, end of file is hole too.
+// io.EOF is returned if off is at end of file or beyond.
+func (f *virtualFile) SeekHole(off int64) (int64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if err := f.checkSeek("SeekHole", off); err != nil {
+		return 0, err
+	}
+
+	return f.data.seekHole(off, f.stat.size), nil
+}
+
+// checkSeek validates offset to seek from.
+// called with read lock held.
+func (f *virtualFile) checkSeek(op string, off int64) error {
 	if f.deleted {
-		return 0, &MemFileSystemError{Err: fileReadWriteErr, Op: "WriteAt", Path: ""}
+		return &MemFileSystemError{Err: fileReadWriteErr, Op: op, Path: ""}
+	} else if off < 0 {
+		return &MemFileSystemError{Err: invalidOffsetErr, Op: op, Path: ""}
+	} else if off >= f.stat.size {
+		return io.EOF
 	}
+	return nil
+}
 
-	n = len(b)
-	// expand data and copy original data into new data pool
-	if f.stat.Size() < off + int64(len(b)) {
-		original := f.data
-		f.data = make([]byte, len(b) + int(off) + 1)
-		copy(f.data, original)
+// Mmap returns view of data of f, holes of f are allocated for it.
+// view shares data with f, so it sees writes in place, until f is resized, punched or cloned.
+func (f *virtualFile) Mmap() (ReadOnlyMapping, error) {
+	err := f.lockResize("Mmap", func() int64 {
+		return f.data.flattenGrow(f.stat.size)
+	})
+	if err != nil {
+		return nil, err
 	}
+	defer f.mu.Unlock()
 
-	copy(f.data[off:], b)
-	f.stat.size = int64(len(f.data))
+	data := f.data.flatten(f.stat.size)
+	f.accessedAt(f.now())
+	return MapBytes(data), nil
+}
 
-	return n, nil
+// allocated returns bytes of data allocated by f.
+func (f *virtualFile) allocated() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.data == nil {
+		return 0
+	}
+	return f.data.allocated
+}
+
+// lockResize locks f to change bytes allocated by f by grow(), with space reserved.
+// grow is called with lock held, and negative if bytes are released.
+// if there is no space, other files are evicted without lock held, and space is reserved again.
+func (f *virtualFile) lockResize(op string, grow func() int64) error {
+	for {
+		f.mu.Lock()
+		if f.deleted {
+			f.mu.Unlock()
+			return &MemFileSystemError{Err: fileReadWriteErr, Op: op, Path: ""}
+		}
+
+		bytes := grow()
+		if f.usage().resize(f, bytes) {
+			return nil
+		}
+		f.mu.Unlock()
+
+		if err := f.fs.makeSpace(op, f, bytes); err != nil {
+			return err
+		}
+	}
+}
+
+// usage returns accounting of file system of f, nil if not limited.
+func (f *virtualFile) usage() *memUsage {
+	if f.fs == nil {
+		return nil
+	}
+	return f.fs.usage
+}
+
+func (f *virtualFile) isDir() bool {
+	stat := f.Stat()
+	return stat != nil && stat.IsDir()
+}
+
+// expired returns true if f is expired at now.
+func (f *virtualFile) expired(now time.Time) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return !f.expiry.IsZero() && !now.Before(f.expiry)
+}
+
+// now returns time of clock of file system of f.
+func (f *virtualFile) now() time.Time {
+	if f.fs == nil {
+		return time.Now()
+	}
+	return f.fs.clock.Now()
+}
+
+// accessedAt sets access time of f to now.
+// called with read lock held at least.
+func (f *virtualFile) accessedAt(now time.Time) {
+	atomic.StoreInt64(&f.accessed, now.UnixNano())
+}
+
+// changed bumps generation, updates modification and access time,
+// and notifies watchers of file.
+// must be called with lock held.
+func (f *virtualFile) changed(op EventOp) {
+	now := f.now()
+	f.stat.generation = nextGeneration(f.stat.generation)
+	f.stat.modTime = now
+	f.accessedAt(now)
+
+	if f.onChange != nil {
+		f.onChange(op)
+	}
+}
+
+// Sync does nothing, data of memory file is not kept in storage.
+func (f *virtualFile) Sync() error {
+	return nil
+}
+
+func (f *virtualFile) Close() error {
+	// nothing to release, data lives in memory until deleted
+	return nil
 }
 
 func (f *virtualFile) Delete() {
@@ -350,50 +746,129 @@ func (f *virtualFile) Delete() {
 }
 
 func (fs *memFileSystem) NewFile(context *Context, pathname string) (File, error) {
+	return fs.newFile(context, "NewFile", pathname, 0)
+}
+
+// CreateFileWithTTL creates file like NewFile, expiring after ttl.
+func (fs *memFileSystem) CreateFileWithTTL(context *Context, pathname string, ttl time.Duration) (File, error) {
+	return fs.newFile(context, "CreateFileWithTTL", pathname, ttl)
+}
+
+func (fs *memFileSystem) newFile(context *Context, op string, pathname string, ttl time.Duration) (File, error) {
 	path := NewPathWithDelimiter(pathname, fs.pathDelimiter)
 	filename := path.FileName()
 
 	if filename == "" {
-		return nil, &MemFileSystemError{Err: illegalFileNameErr, Op: "NewFile", Path: pathname}
+		return nil, &MemFileSystemError{Err: illegalFileNameErr, Op: op, Path: pathname}
 	}
 
+	if err := fs.checkContext(context, op, pathname); err != nil {
+		return nil, err
+	}
+
+	fs.tree.Lock()
+	defer fs.tree.Unlock()
+
 	var err error
 
 	wd := fs.workingDirectoryNode(context, pathname)
+	if n := wd.getFileNode(path, 0); n != nil && fs.isExpired(n) {
+		// expired file is replaced, as if removed
+		abs := fs.nodePath(n)
+		fs.removeNode(n)
+		fs.watchers.emit(abs, Remove)
+	}
+
 	file := wd.getFile(path, 0)
 	if file == nil {
 		// create new file
 		// if file is already existed (file != nil), then just return the file
-		file = newVirtualFile(filename)
+		if err := fs.reserveInodes(op, pathname, fs.rootNode.missing(path, 0)); err != nil {
+			return nil, err
+		}
+
+		file = newVirtualFile(filename, fs.clock.Now())
+		if ttl > 0 {
+			file.(*virtualFile).expiry = fs.clock.Now().Add(ttl)
+		}
 		fs.rootNode.addFile(path, file, 0)
+
+		node := fs.rootNode.getFileNode(path, 0)
+		file.(*virtualFile).fs = fs
+		fs.usage.track(file.(*virtualFile), node, 0)
+
+		abs := fs.nodePath(node)
+		file.(*virtualFile).onChange = func(op EventOp) {
+			fs.watchers.emit(abs, op)
+		}
+		fs.watchers.emit(abs, Create)
 	} else {
-		err = &MemFileSystemError{Err: fileExistsErr, Op: "NewFile", Path: pathname}
+		err = &MemFileSystemError{Err: fileExistsErr, Op: op, Path: pathname}
 	}
 
-	return file, err
+	tracked, ok := context.track(file)
+	if !ok {
+		return nil, &MemFileSystemError{Err: invalidContextErr, Op: op, Path: pathname}
+	}
+	return tracked, err
 }
 
 func (fs *memFileSystem) FileExisted(context *Context, pathname string) bool {
-	wd := fs.workingDirectoryNode(context, pathname)
-	if wd == nil {
+	if fs.checkContext(context, "FileExisted", pathname) != nil {
 		return false
-	} else {
-		return wd.getFile(NewPathWithDelimiter(pathname, fs.pathDelimiter), 0) != nil
 	}
+
+	fs.tree.RLock()
+	defer fs.tree.RUnlock()
+
+	wd := fs.workingDirectoryNode(context, pathname)
+	return fs.lookup(wd, NewPathWithDelimiter(pathname, fs.pathDelimiter)) != nil
 }
 
 func (fs *memFileSystem) Remove(context *Context, pathname string) error {
+	if err := fs.checkContext(context, "Remove", pathname); err != nil {
+		return err
+	}
+
+	fs.tree.Lock()
+	defer fs.tree.Unlock()
+
 	wd := fs.workingDirectoryNode(context, pathname)
-	return wd.removeFile(NewPathWithDelimiter(pathname, fs.pathDelimiter), 0)
+	path := NewPathWithDelimiter(pathname, fs.pathDelimiter)
+
+	n := wd.getFileNode(path, 0)
+	if n == nil {
+		return noSuchFileOrDirectoryErr
+	}
+
+	abs := fs.nodePath(n)
+	inodes, files := n.count(make([]*virtualFile, 0))
+
+	err := wd.removeFile(path, 0)
+	if err == nil {
+		fs.usage.untrack(files, inodes)
+		fs.watchers.emit(abs, Remove)
+	}
+
+	return err
 }
 
 func (fs *memFileSystem) OpenFile(context *Context, pathname string) (File, error) {
+	if err := fs.checkContext(context, "OpenFile", pathname); err != nil {
+		return nil, err
+	}
+
+	fs.tree.RLock()
+	defer fs.tree.RUnlock()
+
 	wd := fs.workingDirectoryNode(context, pathname)
-	file := wd.getFile(NewPathWithDelimiter(pathname, fs.pathDelimiter), 0)
-	if file == nil {
+	n := fs.lookup(wd, NewPathWithDelimiter(pathname, fs.pathDelimiter))
+	if n == nil {
 		return nil, &MemFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "OpenFile", Path: pathname}
-	} else {
+	} else if file, ok := context.track(n.file); ok {
 		return file, nil
+	} else {
+		return nil, &MemFileSystemError{Err: invalidContextErr, Op: "OpenFile", Path: pathname}
 	}
 }
 
@@ -402,6 +877,12 @@ func (fs *memFileSystem) Create(context *Context, pathname string) (File, error)
 }
 
 func (fs *memFileSystem) Mkdir(context *Context, pathname string) error {
+	if err := fs.checkContext(context, "Mkdir", pathname); err != nil {
+		return err
+	}
+
+	fs.tree.Lock()
+	defer fs.tree.Unlock()
 
 	var err error
 	wd := fs.workingDirectoryNode(context, pathname)
@@ -410,7 +891,11 @@ func (fs *memFileSystem) Mkdir(context *Context, pathname string) error {
 	file := wd.getFile(path, 0)
 	if file == nil {
 		// create new directory
-		wd.addDirectory(path, 0)
+		if err := fs.reserveInodes("Mkdir", pathname, wd.missing(path, 0)); err != nil {
+			return err
+		}
+		wd.addDirectory(path, 0, fs.clock.Now())
+		fs.watchers.emit(fs.nodePath(wd.getFileNode(path, 0)), Create)
 	} else {
 		err = &MemFileSystemError{Err: fileExistsErr, Op: "MkdirAll", Path: pathname}
 	}
@@ -419,19 +904,53 @@ func (fs *memFileSystem) Mkdir(context *Context, pathname string) error {
 }
 
 func (fs *memFileSystem) Context() *Context {
-	context := &Context{}
-	fs.pwd[context] = fs.rootNode
-	return context
+	return fs.ContextWithParent(nil)
+}
+
+// ContextWithParent returns new context bound to parent.
+// if parent is nil, context.Background() is used.
+func (fs *memFileSystem) ContextWithParent(parent context.Context) *Context {
+	c := newContext(parent)
+
+	fs.mu.Lock()
+	fs.pwd[c] = fs.rootNode
+	fs.mu.Unlock()
+
+	return c
+}
+
+// ReleaseContext closes all files opened through the context
+// and forgets its working directory.
+func (fs *memFileSystem) ReleaseContext(context *Context) error {
+	fs.mu.Lock()
+	_, ok := fs.pwd[context]
+	delete(fs.pwd, context)
+	fs.mu.Unlock()
+
+	if !ok || !context.release() {
+		return &MemFileSystemError{Err: invalidContextErr, Op: "ReleaseContext", Path: ""}
+	}
+
+	return nil
 }
 
 func (fs *memFileSystem) ChangeDirectory(context *Context, pathname string) error {
+	if err := fs.checkContext(context, "ChangeDirectory", pathname); err != nil {
+		return err
+	}
+
+	fs.tree.RLock()
+	defer fs.tree.RUnlock()
+
 	wd := fs.workingDirectoryNode(context, pathname)
 	if wd == nil {
 		return &MemFileSystemError{Err: invalidContextErr, Op: "ChangeDirectory", Path: pathname}
 	} else {
 		n := wd.getFileNode(NewPathWithDelimiter(pathname, fs.pathDelimiter), 0)
 		if n != nil {
+			fs.mu.Lock()
 			fs.pwd[context] = n
+			fs.mu.Unlock()
 			return nil
 		} else {
 			return &MemFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "ChangeDirectory", Path: pathname}
@@ -440,14 +959,28 @@ func (fs *memFileSystem) ChangeDirectory(context *Context, pathname string) erro
 }
 
 func (fs *memFileSystem) ListSegments(context *Context, pathname string) ([]FileStat, error) {
+	if err := fs.checkContext(context, "ListSegments", pathname); err != nil {
+		return nil, err
+	}
+
+	fs.tree.RLock()
+	defer fs.tree.RUnlock()
+
 	wd := fs.workingDirectoryNode(context, pathname)
-	n := wd.getFileNode(NewPathWithDelimiter(pathname, fs.pathDelimiter), 0)
+	n := fs.lookup(wd, NewPathWithDelimiter(pathname, fs.pathDelimiter))
 
 	if n == nil {
 		return nil, &MemFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "ListSegments", Path: pathname}
 	} else {
 		result := make([]FileStat, 0)
-		for _, child := range wd.children {
+		for _, child := range n.children {
+			if err := context.Err(); err != nil {
+				return nil, &MemFileSystemError{Err: err, Op: "ListSegments", Path: pathname}
+			}
+
+			if fs.isExpired(child) {
+				continue
+			}
 			result = append(result, child.file.Stat().Immutable())
 		}
 		return result, nil
@@ -461,6 +994,215 @@ func (fs *memFileSystem) PresentWorkingDirectory(context *Context) string {
 		return ""
 	}
 
+	return fs.nodePath(n)
+}
+
+// Watch emits changes of pathname, and of its children.
+// if recursive, changes of all descendants are emitted too.
+// watch stops when returned cancel function is called or context is done.
+func (fs *memFileSystem) Watch(context *Context, pathname string, recursive bool) (<-chan Event, func(), error) {
+	if err := fs.checkContext(context, "Watch", pathname); err != nil {
+		return nil, nil, err
+	}
+
+	fs.tree.RLock()
+	wd := fs.workingDirectoryNode(context, pathname)
+	n := wd.getFileNode(NewPathWithDelimiter(pathname, fs.pathDelimiter), 0)
+	if n == nil {
+		fs.tree.RUnlock()
+		return nil, nil, &MemFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "Watch", Path: pathname}
+	}
+
+	w := newWatch(fs.nodePath(n), fs.pathDelimiter, recursive)
+	fs.tree.RUnlock()
+	fs.watchers.add(w)
+
+	cancel := func() {
+		fs.watchers.remove(w)
+		w.stop()
+	}
+
+	go func() {
+		select {
+		case <-context.Done():
+			cancel()
+		case <-w.done:
+		}
+	}()
+
+	return w.out, cancel, nil
+}
+
+// Clone copies src into dst, including all children of src.
+// data of files are shared copy-on-write, so clone is cheap.
+func (fs *memFileSystem) Clone(context *Context, src string, dst string) error {
+	return fs.CloneTree(context, src, dst, nil)
+}
+
+// CloneTree clones src like Clone, except entries that skip returns true for.
+// whole tree is cloned under one lock, so no change of tree is seen partly.
+func (fs *memFileSystem) CloneTree(context *Context, src string, dst string, skip func(name string) bool) error {
+	if err := fs.checkContext(context, "Clone", src); err != nil {
+		return err
+	}
+
+	fs.tree.Lock()
+	defer fs.tree.Unlock()
+
+	srcNode := fs.lookup(fs.workingDirectoryNode(context, src), NewPathWithDelimiter(src, fs.pathDelimiter))
+	if srcNode == nil {
+		return &MemFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "Clone", Path: src}
+	}
+
+	// nodes to clone, taken before parents of dst are added
+	cloned := srcNode
+	if skip != nil {
+		cloned = srcNode.without(skip)
+	}
+
+	dstPath := NewPathWithDelimiter(dst, fs.pathDelimiter)
+	if dstPath.FileName() == "" {
+		return &MemFileSystemError{Err: illegalFileNameErr, Op: "Clone", Path: dst}
+	}
+
+	wd := fs.workingDirectoryNode(context, dst)
+	if wd.getFileNode(dstPath, 0) != nil {
+		return &MemFileSystemError{Err: fileExistsErr, Op: "Clone", Path: dst}
+	}
+
+	// checked before parents of dst are added, so they are not left behind
+	if wd.under(dstPath.Parent(), srcNode, skip) {
+		return &MemFileSystemError{Err: cloneIntoItselfErr, Op: "Clone", Path: dst}
+	}
+
+	// space of parents and clone of src
+	inodes, files := cloned.count(make([]*virtualFile, 0))
+	parents := wd.missing(dstPath.Parent(), 0)
+	inodes += parents
+
+	var bytes int64
+	for _, f := range files {
+		bytes += f.allocated()
+	}
+
+	for !fs.usage.reserveClone(bytes, inodes) {
+		if err := fs.evict("Clone", srcNode, bytes, inodes); err != nil {
+			err.(*NoSpaceError).Path = dst
+			return err
+		}
+	}
+
+	wd.addDirectory(dstPath.Parent(), 0, fs.clock.Now())
+	parent := wd.getFileNode(dstPath.Parent(), 0)
+
+	node := cloned.clone(dstPath.FileName(), parent)
+	parent.children[dstPath.FileName()] = node
+	fs.watchFiles(node)
+	fs.watchers.emit(fs.nodePath(node), Create)
+
+	return nil
+}
+
+// SetExpiry sets time file pathname expires at, zero time means file does not expire.
+func (fs *memFileSystem) SetExpiry(context *Context, pathname string, expiry time.Time) error {
+	if err := fs.checkContext(context, "SetExpiry", pathname); err != nil {
+		return err
+	}
+
+	fs.tree.RLock()
+	defer fs.tree.RUnlock()
+
+	n := fs.lookup(fs.workingDirectoryNode(context, pathname), NewPathWithDelimiter(pathname, fs.pathDelimiter))
+	if n == nil {
+		return &MemFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "SetExpiry", Path: pathname}
+	}
+
+	f := n.file.(*virtualFile)
+	if f.isDir() {
+		return &MemFileSystemError{Err: isDirectoryErr, Op: "SetExpiry", Path: pathname}
+	}
+
+	f.mu.Lock()
+	f.expiry = expiry
+	f.mu.Unlock()
+	return nil
+}
+
+// RemoveExpired removes expired files under pathname, including pathname itself.
+func (fs *memFileSystem) RemoveExpired(context *Context, pathname string) ([]string, error) {
+	if err := fs.checkContext(context, "RemoveExpired", pathname); err != nil {
+		return nil, err
+	}
+
+	fs.tree.Lock()
+	defer fs.tree.Unlock()
+
+	n := fs.workingDirectoryNode(context, pathname).getFileNode(NewPathWithDelimiter(pathname, fs.pathDelimiter), 0)
+	if n == nil {
+		return nil, &MemFileSystemError{Err: noSuchFileOrDirectoryErr, Op: "RemoveExpired", Path: pathname}
+	}
+
+	removed := make([]string, 0)
+	for _, e := range n.expiredNodes(fs.clock.Now(), nil) {
+		abs := fs.nodePath(e)
+		fs.removeNode(e)
+		fs.watchers.emit(abs, Remove)
+		removed = append(removed, abs)
+	}
+
+	return removed, nil
+}
+
+// expiredNodes appends nodes of files under n, expired at now.
+func (n *fileNode) expiredNodes(now time.Time, nodes []*fileNode) []*fileNode {
+	if f, ok := n.file.(*virtualFile); ok && f.expired(now) {
+		return append(nodes, n)
+	}
+
+	for _, child := range n.children {
+		nodes = child.expiredNodes(now, nodes)
+	}
+	return nodes
+}
+
+// lookup returns node of path from wd, nil if not existed or expired.
+// called with tree locked.
+func (fs *memFileSystem) lookup(wd *fileNode, path *Path) *fileNode {
+	if wd == nil {
+		return nil
+	}
+
+	n := wd.getFileNode(path, 0)
+	if n == nil || fs.isExpired(n) {
+		return nil
+	}
+	return n
+}
+
+func (fs *memFileSystem) isExpired(n *fileNode) bool {
+	f, ok := n.file.(*virtualFile)
+	return ok && f.expired(fs.clock.Now())
+}
+
+// watchFiles lets files under n notify their changes to watchers, and accounts their space.
+func (fs *memFileSystem) watchFiles(n *fileNode) {
+	if f, ok := n.file.(*virtualFile); ok && !f.Stat().IsDir() {
+		abs := fs.nodePath(n)
+		f.onChange = func(op EventOp) {
+			fs.watchers.emit(abs, op)
+		}
+
+		f.fs = fs
+		fs.usage.track(f, n, f.allocated())
+	}
+
+	for _, child := range n.children {
+		fs.watchFiles(child)
+	}
+}
+
+// nodePath returns absolute path of node n.
+func (fs *memFileSystem) nodePath(n *fileNode) string {
 	res := make([]string, 0)
 
 	for n != nil && n != fs.rootNode {
@@ -476,9 +1218,24 @@ func (fs *memFileSystem) Type() string {
 }
 
 func (fs *memFileSystem) PresentWorkingDirectoryNode(context *Context) *fileNode {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	return fs.pwd[context]
 }
 
+// checkContext returns error if context is released or cancelled.
+func (fs *memFileSystem) checkContext(context *Context, op string, pathname string) error {
+	if context == nil || fs.PresentWorkingDirectoryNode(context) == nil {
+		return &MemFileSystemError{Err: invalidContextErr, Op: op, Path: pathname}
+	}
+
+	if err := context.Err(); err != nil {
+		return &MemFileSystemError{Err: err, Op: op, Path: pathname}
+	}
+
+	return nil
+}
+
 func (fs *memFileSystem) workingDirectoryNode(context *Context, pathname string) *fileNode {
 	// if pathname starts with path pathDelimiter (like "/"),
 	// then start on root node
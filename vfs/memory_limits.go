@@ -0,0 +1,333 @@
+package vfs
+
+import (
+	"container/list"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type EvictionPolicy int
+
+const (
+	// exceeding limit fails with NoSpaceError
+	NoEviction EvictionPolicy = iota
+	// least recently accessed files are evicted to make space
+	EvictLRU
+	// files not modified for TTL are evicted to make space, least recently modified first
+	EvictTTL
+)
+
+/**
+ MemoryOptions of memory file system.
+ MaxBytes limits total bytes allocated by files, holes of sparse files are not counted,
+ MaxInodes limits number of files and directories,
+ zero means no limit. when limit would be exceeded, files are evicted by Eviction
+ to make space, or NoSpaceError is returned if no file can be evicted.
+ clones are accounted by their allocated bytes, though pages are shared until written.
+ Clock gives time of files, like their modification, access and expiry, system clock if nil.
+ */
+type MemoryOptions struct {
+	MaxBytes      int64
+	MaxInodes     int64
+	Eviction      EvictionPolicy
+	TTL           time.Duration
+	PathDelimiter string
+	Clock         Clock
+}
+
+/**
+ NoSpaceError is returned when limit of memory file system is exceeded.
+ Resource is "bytes" or "inodes".
+ */
+type NoSpaceError struct {
+	Op       string
+	Path     string
+	Resource string
+	Limit    int64
+}
+
+// memUsage accounts bytes and inodes of memory file system against its limits.
+// lock order is tree, file, usage.
+type memUsage struct {
+	mu      sync.Mutex
+	options MemoryOptions
+	bytes   int64
+	inodes  int64
+	// entries of files, least recently accessed first
+	files *list.List
+}
+
+// memEntry is accounting of a file.
+type memEntry struct {
+	file     *virtualFile
+	node     *fileNode
+	bytes    int64
+	modified time.Time
+	element  *list.Element
+}
+
+func (e *NoSpaceError) Error() string {
+	return e.Op + ": " + e.Path + ": no space left on device: " + e.Resource + " limit " + strconv.FormatInt(e.Limit, 10)
+}
+
+// IsNoSpace returns true if err is, or is caused by, NoSpaceError.
+func IsNoSpace(err error) bool {
+	switch e := err.(type) {
+	case *NoSpaceError:
+		return true
+	case *MemFileSystemError:
+		return IsNoSpace(e.Err)
+	case *os.PathError:
+		return IsNoSpace(e.Err)
+	}
+	return false
+}
+
+// newMemUsage returns accounting of options, nil if nothing is limited.
+func newMemUsage(options MemoryOptions) *memUsage {
+	if options.MaxBytes <= 0 && options.MaxInodes <= 0 {
+		return nil
+	}
+
+	return &memUsage{options: options, files: list.New()}
+}
+
+// track starts accounting of file f of node, with its current size.
+func (u *memUsage) track(f *virtualFile, node *fileNode, bytes int64) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	f.entry = &memEntry{file: f, node: node, bytes: bytes, modified: u.options.Clock.Now()}
+	f.entry.element = u.files.PushBack(f.entry)
+	u.bytes += bytes
+}
+
+// untrack stops accounting of files, and releases their bytes and inodes.
+func (u *memUsage) untrack(files []*virtualFile, inodes int64) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, f := range files {
+		if f.entry != nil {
+			u.bytes -= f.entry.bytes
+			u.files.Remove(f.entry.element)
+			f.entry = nil
+		}
+	}
+
+	u.inodes -= inodes
+}
+
+// resize accounts growth of file f, returns false if there is no space.
+// called with lock of f held.
+func (u *memUsage) resize(f *virtualFile, grow int64) bool {
+	if u == nil {
+		return true
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if f.entry == nil {
+		// being removed
+		return true
+	}
+
+	if grow > 0 && u.options.MaxBytes > 0 && u.bytes + grow > u.options.MaxBytes {
+		return false
+	}
+
+	u.bytes += grow
+	f.entry.bytes += grow
+	f.entry.modified = u.options.Clock.Now()
+	u.files.MoveToBack(f.entry.element)
+	return true
+}
+
+// reserveInodes accounts new inodes, returns false if there is no space.
+func (u *memUsage) reserveInodes(inodes int64) bool {
+	if u == nil {
+		return true
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.options.MaxInodes > 0 && u.inodes + inodes > u.options.MaxInodes {
+		return false
+	}
+
+	u.inodes += inodes
+	return true
+}
+
+// reserveClone accounts bytes and inodes of clone, returns false if there is no space.
+func (u *memUsage) reserveClone(bytes int64, inodes int64) bool {
+	if u == nil {
+		return true
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if (u.options.MaxBytes > 0 && u.bytes + bytes > u.options.MaxBytes) ||
+		(u.options.MaxInodes > 0 && u.inodes + inodes > u.options.MaxInodes) {
+		return false
+	}
+
+	// bytes are added by track of cloned files
+	u.inodes += inodes
+	return true
+}
+
+// touch marks file f accessed.
+func (u *memUsage) touch(f *virtualFile) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if f.entry != nil {
+		u.files.MoveToBack(f.entry.element)
+	}
+}
+
+// victim returns node of file to evict, so bytes and inodes more fit in limits.
+// returns nil if they fit already, NoSpaceError if no file can be evicted.
+// files under keep are not evicted.
+func (u *memUsage) victim(op string, keep *fileNode, bytes int64, inodes int64) (*fileNode, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var noSpace *NoSpaceError
+	if u.options.MaxBytes > 0 && u.bytes + bytes > u.options.MaxBytes {
+		noSpace = &NoSpaceError{Op: op, Resource: "bytes", Limit: u.options.MaxBytes}
+	} else if u.options.MaxInodes > 0 && u.inodes + inodes > u.options.MaxInodes {
+		noSpace = &NoSpaceError{Op: op, Resource: "inodes", Limit: u.options.MaxInodes}
+	} else {
+		return nil, nil
+	}
+
+	var victim *memEntry
+	now := u.options.Clock.Now()
+	for e := u.files.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*memEntry)
+		if keep != nil && entry.node.isUnder(keep) {
+			continue
+		}
+
+		switch u.options.Eviction {
+		case EvictLRU:
+			return entry.node, nil
+		case EvictTTL:
+			if now.Sub(entry.modified) >= u.options.TTL &&
+				(victim == nil || entry.modified.Before(victim.modified)) {
+				victim = entry
+			}
+		}
+	}
+
+	if victim == nil {
+		return nil, noSpace
+	}
+	return victim.node, nil
+}
+
+// isUnder returns true if n is node, or its descendant.
+func (n *fileNode) isUnder(node *fileNode) bool {
+	for ; n != nil; n = n.parent {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns number of nodes of n and its descendants, and files among them.
+func (n *fileNode) count(files []*virtualFile) (int64, []*virtualFile) {
+	cnt := int64(1)
+	if f, ok := n.file.(*virtualFile); ok && !f.isDir() {
+		files = append(files, f)
+	}
+
+	for _, child := range n.children {
+		var c int64
+		c, files = child.count(files)
+		cnt += c
+	}
+
+	return cnt, files
+}
+
+// evict removes files by eviction policy, until bytes and inodes more fit in limits.
+// called with tree locked.
+func (fs *memFileSystem) evict(op string, keep *fileNode, bytes int64, inodes int64) error {
+	if fs.usage == nil {
+		return nil
+	}
+
+	for {
+		node, err := fs.usage.victim(op, keep, bytes, inodes)
+		if err != nil || node == nil {
+			return err
+		}
+
+		abs := fs.nodePath(node)
+		fs.removeNode(node)
+		fs.watchers.emit(abs, Remove)
+	}
+}
+
+// removeNode removes node n and its descendants, releasing their space.
+// called with tree locked.
+func (fs *memFileSystem) removeNode(n *fileNode) {
+	inodes, files := n.count(make([]*virtualFile, 0))
+
+	for name, child := range n.parent.children {
+		if child == n {
+			delete(n.parent.children, name)
+		}
+	}
+
+	n.removeAllFiles()
+	fs.usage.untrack(files, inodes)
+}
+
+// reserveInodes accounts inodes, evicting files if needed.
+// called with tree locked.
+func (fs *memFileSystem) reserveInodes(op string, pathname string, inodes int64) error {
+	for !fs.usage.reserveInodes(inodes) {
+		if err := fs.evict(op, nil, 0, inodes); err != nil {
+			err.(*NoSpaceError).Path = pathname
+			return err
+		}
+	}
+	return nil
+}
+
+// makeSpace evicts files other than f, so f can grow.
+func (fs *memFileSystem) makeSpace(op string, f *virtualFile, grow int64) error {
+	fs.tree.Lock()
+	defer fs.tree.Unlock()
+
+	var keep *fileNode
+	fs.usage.mu.Lock()
+	if f.entry != nil {
+		keep = f.entry.node
+	}
+	fs.usage.mu.Unlock()
+
+	return fs.evict(op, keep, grow, 0)
+}
@@ -0,0 +1,113 @@
+package vfs
+
+import (
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFileSystem_Limits(t *testing.T) {
+	fs, err := NewMemoryFileSystemWithOptions("/TestMemFileSystem_Limits", MemoryOptions{MaxBytes: 10, MaxInodes: 3})
+	assert.Nil(t, err)
+
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+
+	a, err := fs.NewFile(context, "/a")
+	assert.Nil(t, err)
+
+	_, err = a.WriteAt([]byte("12345678"), 0)
+	assert.Nil(t, err)
+
+	_, err = a.WriteAt([]byte("abc"), 8)
+	assert.True(t, IsNoSpace(err))
+	assert.Equal(t, int64(8), a.Stat().Size())
+
+	// shrinking frees space
+	assert.Nil(t, a.Truncate(4))
+	_, err = a.WriteAt([]byte("abcdef"), 4)
+	assert.Nil(t, err)
+
+	// directory and file are two inodes
+	_, err = fs.NewFile(context, "/d/b")
+	assert.Nil(t, err)
+
+	_, err = fs.NewFile(context, "/c")
+	assert.True(t, IsNoSpace(err))
+	assert.Equal(t, "inodes", err.(*NoSpaceError).Resource)
+
+	assert.Nil(t, fs.Remove(context, "/d"))
+	_, err = fs.NewFile(context, "/c")
+	assert.Nil(t, err)
+
+	// clone is accounted by its size
+	assert.True(t, IsNoSpace(fs.Clone(context, "/a", "/e")))
+	assert.False(t, fs.FileExisted(context, "/e"))
+}
+
+func TestMemFileSystem_EvictLRU(t *testing.T) {
+	fs, _ := NewMemoryFileSystemWithOptions("/TestMemFileSystem_EvictLRU", MemoryOptions{MaxBytes: 8, Eviction: EvictLRU})
+
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+
+	events, cancel, err := fs.Watch(context, "/", false)
+	assert.Nil(t, err)
+	defer cancel()
+
+	for _, name := range []string{"/a", "/b"} {
+		f, _ := fs.NewFile(context, name)
+		f.WriteAt([]byte("1234"), 0)
+	}
+
+	// a is accessed after b
+	a, _ := fs.OpenFile(context, "/a")
+	a.ReadAt(make([]byte, 4), 0)
+
+	c, _ := fs.NewFile(context, "/c")
+	_, err = c.WriteAt([]byte("1234"), 0)
+	assert.Nil(t, err)
+
+	assert.True(t, fs.FileExisted(context, "/a"))
+	assert.False(t, fs.FileExisted(context, "/b"))
+
+	removed := false
+	for !removed {
+		select {
+		case ev := <-events:
+			removed = ev.Path == "/b" && ev.Op & Remove != 0
+		case <-time.After(time.Second):
+			t.Fatal("no remove event")
+		}
+	}
+
+	// file being written is not evicted
+	_, err = c.WriteAt([]byte("12345678"), 0)
+	assert.Nil(t, err)
+	assert.False(t, fs.FileExisted(context, "/a"))
+
+	_, err = c.WriteAt([]byte("9"), 8)
+	assert.True(t, IsNoSpace(err))
+}
+
+func TestMemFileSystem_EvictTTL(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	fs, _ := NewMemoryFileSystemWithOptions("/TestMemFileSystem_EvictTTL",
+		MemoryOptions{MaxBytes: 8, Eviction: EvictTTL, TTL: time.Minute, Clock: clock})
+
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+
+	a, _ := fs.NewFile(context, "/a")
+	a.WriteAt([]byte("1234"), 0)
+
+	b, _ := fs.NewFile(context, "/b")
+	_, err := b.WriteAt([]byte("12345678"), 0)
+	assert.True(t, IsNoSpace(err))
+
+	// a is expired
+	clock.Advance(time.Minute)
+	_, err = b.WriteAt([]byte("12345678"), 0)
+	assert.Nil(t, err)
+	assert.False(t, fs.FileExisted(context, "/a"))
+}
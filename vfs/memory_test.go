@@ -2,12 +2,13 @@ package vfs
 
 import (
 	"testing"
+	"time"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestVirtualFile_ReadWrite(t *testing.T) {
 	filename := "TestVirtualFile_ReadWrite"
-	file := newVirtualFile(filename)
+	file := newVirtualFile(filename, time.Now())
 	file.Write([]byte("test1234"))
 
 	res := make([]byte, 8)
@@ -19,7 +20,7 @@ func TestVirtualFile_ReadWrite(t *testing.T) {
 func TestVirtualFile_ReadWriteAt(t *testing.T) {
 
 	filename := "TestVirtualFile_ReadWriteAt"
-	file := newVirtualFile(filename)
+	file := newVirtualFile(filename, time.Now())
 
 	file.Write([]byte("aaaaaaaaaaaaaaa"))
 	file.WriteAt([]byte("123456789"), 9)
@@ -35,10 +36,10 @@ func TestFileNode_addFile(t *testing.T) {
 	p2 := NewPath("test/__dir_name_/add2")
 	iter1 := p1.Iterator()
 	iter2 := p2.Iterator()
-	n1 := newFileNode(newVirtualDirectory("/"))
-	n2 := newFileNode(newVirtualDirectory("/"))
-	f1 := newVirtualFile("add")
-	f2 := newVirtualFile("add2")
+	n1 := newFileNode(newVirtualDirectory("/", time.Now()))
+	n2 := newFileNode(newVirtualDirectory("/", time.Now()))
+	f1 := newVirtualFile("add", time.Now())
+	f2 := newVirtualFile("add2", time.Now())
 
 	n1.addFile(p1, f1, 0)
 
@@ -63,8 +64,8 @@ func TestFileNode_getFile(t *testing.T) {
 	p1 := NewPath("test/__dir_name_/add")
 	p2 := NewPath("test/__dir_name_/add2")
 
-	n := newFileNode(newVirtualDirectory("/"))
-	f := newVirtualFile("add")
+	n := newFileNode(newVirtualDirectory("/", time.Now()))
+	f := newVirtualFile("add", time.Now())
 	n.addFile(p1, f, 0)
 
 	assert.Equal(t, f, n.getFile(p1, 0))
@@ -73,8 +74,8 @@ func TestFileNode_getFile(t *testing.T) {
 
 func TestFileNode_removeFile(t *testing.T) {
 	p1 := NewPath("test/__dir_name_/add1")
-	n := newFileNode(newVirtualDirectory("/"))
-	f := newVirtualFile("add1")
+	n := newFileNode(newVirtualDirectory("/", time.Now()))
+	f := newVirtualFile("add1", time.Now())
 	n.addFile(p1, f, 0)
 
 	assert.NotNil(t, n.removeFile(NewPath("test/__dir_name_/add2"), 0))
@@ -0,0 +1,67 @@
+package vfs
+
+import (
+	"os"
+	"sync"
+)
+
+/**
+ ReadOnlyMapping is view of data of file, valid until closed.
+ bytes must not be modified, and must not be read while file is written.
+ later writes of file may or may not be seen by view.
+ */
+type ReadOnlyMapping interface {
+	Bytes() []byte
+	Close() error
+}
+
+type mapping struct {
+	mu    sync.Mutex
+	data  []byte
+	unmap func(data []byte) error
+}
+
+// MapBytes returns mapping of data in memory.
+func MapBytes(data []byte) ReadOnlyMapping {
+	return &mapping{data: data}
+}
+
+// MapFile maps data of os file f, by mmap where supported, read into memory otherwise.
+// f can be closed, while mapping is used.
+func MapFile(f *os.File) (ReadOnlyMapping, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		// empty range can not be mapped
+		return MapBytes(make([]byte, 0)), nil
+	}
+
+	data, err := mmap(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &mapping{data: data, unmap: munmap}, nil
+}
+
+// Bytes returns data of mapping, nil after closed.
+func (m *mapping) Bytes() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data
+}
+
+func (m *mapping) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data := m.data
+	m.data = nil
+
+	if data == nil || m.unmap == nil {
+		return nil
+	}
+	return m.unmap(data)
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// files can not be mapped on this platform, data is read into memory.
+func mmap(f *os.File, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+func munmap(data []byte) error {
+	return nil
+}
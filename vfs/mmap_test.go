@@ -0,0 +1,75 @@
+package vfs
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualFile_Mmap(t *testing.T) {
+	fs, err := NewMemoryFileSystemWithOptions("/TestVirtualFile_Mmap", MemoryOptions{MaxBytes: 3 * pageSize})
+	assert.Nil(t, err)
+
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+
+	f, err := fs.NewFile(context, "/file")
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("tail"), pageSize + 4)
+	assert.Nil(t, err)
+
+	// hole is allocated for mapping
+	m, err := f.Mmap()
+	assert.Nil(t, err)
+	assert.Equal(t, pageSize + 8, len(m.Bytes()))
+	assert.Equal(t, make([]byte, pageSize + 4), m.Bytes()[:pageSize + 4])
+	assert.Equal(t, "tail", string(m.Bytes()[pageSize + 4:]))
+	assert.Equal(t, int64(pageSize + 8), f.(*contextFile).File.(*virtualFile).allocated())
+
+	// mapping shares data with file
+	_, err = f.WriteAt([]byte("head"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "head", string(m.Bytes()[:4]))
+
+	again, err := f.Mmap()
+	assert.Nil(t, err)
+	assert.Equal(t, &m.Bytes()[0], &again.Bytes()[0])
+
+	// clone does not see writes through shared pages
+	assert.Nil(t, fs.Clone(context, "/file", "/clone"))
+	_, err = f.WriteAt([]byte("HEAD"), 0)
+	assert.Nil(t, err)
+	c, _ := fs.OpenFile(context, "/clone")
+	res := make([]byte, 4)
+	c.ReadAt(res, 0)
+	assert.Equal(t, "head", string(res))
+
+	// no space to allocate holes
+	big, _ := fs.NewFile(context, "/big")
+	assert.Nil(t, big.Truncate(pageSize))
+	_, err = big.Mmap()
+	assert.True(t, IsNoSpace(err))
+
+	assert.Nil(t, m.Close())
+	assert.Nil(t, m.Bytes())
+}
+
+func TestWrapperFile_Mmap(t *testing.T) {
+	fs, err := NewWrapperFileSystem(__dir_name_ + "/TestWrapperFile_Mmap")
+	assert.Nil(t, err)
+
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+	defer fs.Remove(context, "/file")
+
+	f, err := fs.NewFile(context, "/file")
+	assert.Nil(t, err)
+	defer f.Close()
+
+	_, err = f.WriteAt([]byte("mapped"), 0)
+	assert.Nil(t, err)
+
+	m, err := f.Mmap()
+	assert.Nil(t, err)
+	assert.Equal(t, "mapped", string(m.Bytes()))
+	assert.Nil(t, m.Close())
+}
@@ -0,0 +1,136 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// how often root is rescanned when inotify is not available.
+var pollInterval = 500 * time.Millisecond
+
+type pollEntry struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// WatchPath watches os path root and emits changes of files under it.
+// event paths are relative to root and separated by "/".
+// inotify is used where available, otherwise root is polled periodically.
+func WatchPath(root string, recursive bool) (<-chan Event, func(), error) {
+	w := newWatch("", "/", recursive)
+	if err := watchPath(root, recursive, w); err != nil {
+		w.stop()
+		return nil, nil, err
+	}
+
+	return w.out, w.stop, nil
+}
+
+func watchPath(root string, recursive bool, w *watch) error {
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+
+	if err := watchInotify(root, recursive, w); err != nil {
+		// fallback to polling
+		go pollPath(root, recursive, w)
+	}
+
+	return nil
+}
+
+func pollPath(root string, recursive bool, w *watch) {
+	prev := scanPath(root, recursive)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		cur := scanPath(root, recursive)
+
+		for name, entry := range cur {
+			p, ok := prev[name]
+			if !ok {
+				w.push(Event{Path: name, Op: Create})
+				continue
+			}
+
+			var op EventOp
+			if entry.mode != p.mode {
+				op |= Chmod
+			}
+			if entry.size != p.size || !entry.modTime.Equal(p.modTime) {
+				op |= Write
+			}
+			if op != 0 {
+				w.push(Event{Path: name, Op: op})
+			}
+		}
+
+		for name := range prev {
+			if _, ok := cur[name]; !ok {
+				w.push(Event{Path: name, Op: Remove})
+			}
+		}
+
+		prev = cur
+	}
+}
+
+// scanPath returns entries under root keyed by relative path.
+// if root is not a directory, root itself is keyed by "".
+func scanPath(root string, recursive bool) map[string]pollEntry {
+	res := make(map[string]pollEntry)
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return res
+	}
+
+	if !info.IsDir() {
+		res[""] = pollEntry{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+		return res
+	}
+
+	var walk func(dir string, rel string)
+	walk = func(dir string, rel string) {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return
+		}
+
+		for _, i := range infos {
+			name := i.Name()
+			if rel != "" {
+				name = rel + "/" + name
+			}
+
+			res[name] = pollEntry{size: i.Size(), modTime: i.ModTime(), mode: i.Mode()}
+
+			if recursive && i.IsDir() {
+				walk(filepath.Join(dir, i.Name()), name)
+			}
+		}
+	}
+
+	walk(root, "")
+	return res
+}
+
+func joinRelPath(rel string, name string) string {
+	if rel == "" {
+		return name
+	}
+	if name == "" {
+		return rel
+	}
+	return rel + "/" + name
+}
@@ -0,0 +1,165 @@
+//go:build linux
+
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_MOVE_SELF
+
+type inotify struct {
+	mu        sync.Mutex
+	fd        int
+	file      *os.File
+	root      string
+	recursive bool
+	paths     map[int]string // watch descriptor -> relative path
+	w         *watch
+}
+
+func watchInotify(root string, recursive bool, w *watch) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+
+	n := &inotify{
+		fd:        fd,
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		root:      root,
+		recursive: recursive,
+		paths:     make(map[int]string),
+		w:         w,
+	}
+
+	if err := n.add("", false); err != nil {
+		n.file.Close()
+		return err
+	}
+
+	go n.run()
+	go func() {
+		// closing file wakes up blocked read
+		<-w.done
+		n.file.Close()
+	}()
+
+	return nil
+}
+
+// add watches rel, and its sub directories if recursive.
+// if created, entries already in new directory are reported as created,
+// since they may be created before watch is added.
+func (n *inotify) add(rel string, created bool) error {
+	path := filepath.Join(n.root, filepath.FromSlash(rel))
+
+	wd, err := syscall.InotifyAddWatch(n.fd, path, inotifyMask)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.paths[wd] = rel
+	n.mu.Unlock()
+
+	if n.recursive {
+		infos, _ := ioutil.ReadDir(path)
+		for _, i := range infos {
+			if created {
+				n.w.push(Event{Path: joinRelPath(rel, i.Name()), Op: Create})
+			}
+			if i.IsDir() {
+				n.add(joinRelPath(rel, i.Name()), created)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (n *inotify) run() {
+	buf := make([]byte, (syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)*64)
+
+	for {
+		size, err := n.file.Read(buf)
+		if err != nil {
+			// closed
+			return
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= size {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(raw.Len)
+
+			name := ""
+			if raw.Len > 0 {
+				name = strings.TrimRight(string(buf[start:offset]), "\x00")
+			}
+
+			n.handle(int(raw.Wd), raw.Mask, name)
+		}
+	}
+}
+
+func (n *inotify) handle(wd int, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		n.w.push(Event{Path: "", Op: Overflow})
+		return
+	}
+
+	n.mu.Lock()
+	rel, ok := n.paths[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(n.paths, wd)
+	}
+	n.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// sub directory removed/moved is reported by its parent, too
+	if rel != "" && mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+		return
+	}
+
+	path := joinRelPath(rel, name)
+
+	var op EventOp
+	if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		op |= Create
+	}
+	if mask&syscall.IN_MODIFY != 0 {
+		op |= Write
+	}
+	if mask&(syscall.IN_DELETE|syscall.IN_DELETE_SELF) != 0 {
+		op |= Remove
+	}
+	if mask&(syscall.IN_MOVED_FROM|syscall.IN_MOVE_SELF) != 0 {
+		op |= Rename
+	}
+	if mask&syscall.IN_ATTRIB != 0 {
+		op |= Chmod
+	}
+
+	if op == 0 {
+		return
+	}
+
+	n.w.push(Event{Path: path, Op: op})
+
+	if n.recursive && mask&syscall.IN_ISDIR != 0 && op&Create != 0 {
+		n.add(path, true)
+	}
+}
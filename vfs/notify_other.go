@@ -0,0 +1,9 @@
+//go:build !linux
+
+package vfs
+
+import "errors"
+
+func watchInotify(root string, recursive bool, w *watch) error {
+	return errors.New("inotify is not supported on this platform")
+}
@@ -90,6 +90,20 @@ func (p *Path) FileName() string {
 	return p.filename
 }
 
+// Parent returns path without the last segment.
+func (p *Path) Parent() *Path {
+	if len(p.paths) == 0 {
+		return NewPathWithDelimiter(p.String(), p.delimiter)
+	}
+
+	parent := strings.Join(p.paths[:len(p.paths) - 1], p.delimiter)
+	if p.isRoot {
+		parent = p.delimiter + parent
+	}
+
+	return NewPathWithDelimiter(parent, p.delimiter)
+}
+
 func (p *Path) Iterator() Iterator {
 	return newPathIterator(p)
 }
@@ -16,3 +16,10 @@ func TestPath_Iterator(t *testing.T) {
 		i++
 	}
 }
+
+func TestPath_Parent(t *testing.T) {
+	assert.Equal(t, "/test/path", NewPath("/test/path/iter").Parent().String())
+	assert.Equal(t, "test", NewPath("test/path").Parent().String())
+	assert.Equal(t, "/", NewPath("/test").Parent().String())
+	assert.Equal(t, "", NewPath("test").Parent().String())
+}
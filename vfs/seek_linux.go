@@ -0,0 +1,39 @@
+//go:build linux
+
+package vfs
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// whence of lseek, from linux/fs.h
+const (
+	seekDataWhence = 3
+	seekHoleWhence = 4
+)
+
+func seekData(f *os.File, off int64) (int64, error) {
+	return seekWhence(f, off, seekDataWhence)
+}
+
+func seekHole(f *os.File, off int64) (int64, error) {
+	return seekWhence(f, off, seekHoleWhence)
+}
+
+// seekWhence seeks f by lseek, keeping offset of f for Read and Write.
+// ENXIO, returned if there is no such offset, is io.EOF.
+func seekWhence(f *os.File, off int64, whence int) (int64, error) {
+	current, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Seek(current, io.SeekStart)
+
+	res, err := f.Seek(off, whence)
+	if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENXIO {
+		return 0, io.EOF
+	}
+	return res, err
+}
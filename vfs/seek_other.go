@@ -0,0 +1,30 @@
+//go:build !linux
+
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// holes are not known on this platform, so file is data up to its end.
+
+func seekData(f *os.File, off int64) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	} else if off >= info.Size() {
+		return 0, io.EOF
+	}
+	return off, nil
+}
+
+func seekHole(f *os.File, off int64) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	} else if off >= info.Size() {
+		return 0, io.EOF
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,360 @@
+package vfs
+
+import "sort"
+
+// size of pages of data of memory files
+const pageSize = 4096
+
+/**
+ sparseData is data of memory file, allocated by pages for written regions only,
+ so holes are read as zeros without holding memory.
+ a page holds bytes from its start up to last byte written in it.
+ pages are shared with clones, and copied before written.
+ pages can be flattened into contiguous bytes for mapping, which they are slices of
+ until pages are copied, released or grown.
+ indexes of pages are kept sorted, so ranges and end are found without scanning all pages.
+ */
+type sparseData struct {
+	pages map[int64][]byte
+	// indexes of pages in order
+	order []int64
+	// pages not shared with clones, which can be written in place
+	owned     map[int64]bool
+	allocated int64
+	// contiguous bytes pages are slices of, nil if not flattened
+	flat []byte
+}
+
+func newSparseData() *sparseData {
+	return &sparseData{pages: make(map[int64][]byte), order: make([]int64, 0), owned: make(map[int64]bool)}
+}
+
+// readAt copies data at off into b, holes are read as zeros.
+func (d *sparseData) readAt(b []byte, off int64) {
+	for n := 0; n < len(b); {
+		idx, in := (off + int64(n)) / pageSize, int((off + int64(n)) % pageSize)
+		chunk := pageSize - in
+		if chunk > len(b) - n {
+			chunk = len(b) - n
+		}
+
+		dst := b[n:n + chunk]
+		copied := 0
+		if page := d.pages[idx]; in < len(page) {
+			copied = copy(dst, page[in:])
+		}
+		zero(dst[copied:])
+
+		n += chunk
+	}
+}
+
+// writeAt copies b into data at off, allocating pages of range.
+func (d *sparseData) writeAt(b []byte, off int64) {
+	for n := 0; n < len(b); {
+		idx, in := (off + int64(n)) / pageSize, int((off + int64(n)) % pageSize)
+		chunk := pageSize - in
+		if chunk > len(b) - n {
+			chunk = len(b) - n
+		}
+
+		copy(d.page(idx, in + chunk)[in:], b[n:n + chunk])
+		n += chunk
+	}
+}
+
+// writeGrow returns bytes allocated by writing n bytes at off.
+func (d *sparseData) writeGrow(off int64, n int64) int64 {
+	var grow int64
+	for end := off + n; off < end; {
+		idx, in := off / pageSize, off % pageSize
+		chunk := pageSize - in
+		if chunk > end - off {
+			chunk = end - off
+		}
+
+		if size := in + chunk - int64(len(d.pages[idx])); size > 0 {
+			grow += size
+		}
+		off += chunk
+	}
+	return grow
+}
+
+// writeVGrow returns bytes allocated by writing each of b at offset of same index,
+// pages written by more than one of them are counted once.
+func (d *sparseData) writeVGrow(b [][]byte, offs []int64) int64 {
+	// end of bytes written in each page
+	ends := make(map[int64]int64)
+	for i := range b {
+		for off, end := offs[i], offs[i] + int64(len(b[i])); off < end; {
+			idx, in := off / pageSize, off % pageSize
+			chunk := pageSize - in
+			if chunk > end - off {
+				chunk = end - off
+			}
+
+			if in + chunk > ends[idx] {
+				ends[idx] = in + chunk
+			}
+			off += chunk
+		}
+	}
+
+	var grow int64
+	for idx, end := range ends {
+		if size := end - int64(len(d.pages[idx])); size > 0 {
+			grow += size
+		}
+	}
+	return grow
+}
+
+// page returns page idx owned by d, extended to size bytes at least.
+func (d *sparseData) page(idx int64, size int) []byte {
+	page, ok := d.pages[idx]
+	if !ok {
+		d.insert(idx)
+	}
+
+	if !d.owned[idx] {
+		// copy page shared with clone
+		page = append(make([]byte, 0, len(page)), page...)
+		d.owned[idx] = true
+		d.flat = nil
+	}
+
+	if len(page) < size {
+		d.allocated += int64(size - len(page))
+
+		if cap(page) >= size {
+			// capacity may hold bytes of truncated data
+			prev := len(page)
+			page = page[:size]
+			zero(page[prev:])
+		} else {
+			d.flat = nil
+			capacity := 2 * cap(page)
+			if capacity < size {
+				capacity = size
+			} else if capacity > pageSize {
+				capacity = pageSize
+			}
+
+			grown := make([]byte, size, capacity)
+			copy(grown, page)
+			page = grown
+		}
+	}
+
+	d.pages[idx] = page
+	return page
+}
+
+// truncate releases data from size.
+func (d *sparseData) truncate(size int64) {
+	d.punch(size, d.end() - size)
+}
+
+// truncateGrow returns bytes allocated by truncate of size, negative if released.
+func (d *sparseData) truncateGrow(size int64) int64 {
+	return d.punchGrow(size, d.end() - size)
+}
+
+// punch releases data of n bytes at off, range is read as zeros after.
+// pages wholly in range are released, others are zeroed in range.
+func (d *sparseData) punch(off int64, n int64) {
+	d.overlaps(off, n, func(idx int64, lo int, hi int) {
+		page := d.pages[idx]
+
+		switch {
+		case lo == 0 && hi == len(page):
+			delete(d.pages, idx)
+			delete(d.owned, idx)
+			d.remove(idx)
+			d.allocated -= int64(len(page))
+			d.flat = nil
+		case hi == len(page):
+			// slicing does not write shared page
+			d.pages[idx] = page[:lo]
+			d.allocated -= int64(hi - lo)
+			d.flat = nil
+		default:
+			zero(d.page(idx, 0)[lo:hi])
+		}
+	})
+}
+
+// punchGrow returns bytes allocated by punch of n bytes at off, negative if released.
+func (d *sparseData) punchGrow(off int64, n int64) int64 {
+	var grow int64
+	d.overlaps(off, n, func(idx int64, lo int, hi int) {
+		if hi == len(d.pages[idx]) {
+			grow -= int64(hi - lo)
+		}
+	})
+	return grow
+}
+
+// overlaps calls fn with range [lo, hi) of each page overlapping n bytes at off.
+func (d *sparseData) overlaps(off int64, n int64, fn func(idx int64, lo int, hi int)) {
+	if n <= 0 {
+		return
+	}
+
+	end := off + n
+	// pages overlapping are copied, as fn may release them
+	overlapping := d.indexes(off / pageSize, (end - 1) / pageSize + 1)
+	for _, idx := range append(make([]int64, 0, len(overlapping)), overlapping...) {
+		start := idx * pageSize
+
+		lo, hi := off - start, end - start
+		if lo < 0 {
+			lo = 0
+		}
+		if size := int64(len(d.pages[idx])); hi > size {
+			hi = size
+		}
+
+		if lo < hi {
+			fn(idx, int(lo), int(hi))
+		}
+	}
+}
+
+// seekData returns first offset from off, holding data before size, -1 if none.
+func (d *sparseData) seekData(off int64, size int64) int64 {
+	for _, idx := range d.order[d.search(off / pageSize):] {
+		start := idx * pageSize
+		if start >= size {
+			break
+		}
+
+		if end := start + int64(len(d.pages[idx])); end > off {
+			if start > off {
+				return start
+			}
+			return off
+		}
+	}
+	return -1
+}
+
+// seekHole returns first offset from off in hole, end of data at size is hole too.
+func (d *sparseData) seekHole(off int64, size int64) int64 {
+	for off < size {
+		page := d.pages[off / pageSize]
+		end := off / pageSize * pageSize + int64(len(page))
+		if off >= end {
+			return off
+		}
+		off = end
+	}
+	return size
+}
+
+// end returns offset following last page.
+func (d *sparseData) end() int64 {
+	if len(d.order) == 0 {
+		return 0
+	}
+
+	last := d.order[len(d.order) - 1]
+	return last * pageSize + int64(len(d.pages[last]))
+}
+
+// indexes returns indexes of pages in [from, to) in order, slice of order of pages.
+func (d *sparseData) indexes(from int64, to int64) []int64 {
+	return d.order[d.search(from):d.search(to)]
+}
+
+// search returns position in order of first page from idx.
+func (d *sparseData) search(idx int64) int {
+	return sort.Search(len(d.order), func(i int) bool {
+		return d.order[i] >= idx
+	})
+}
+
+// insert puts index of new page idx in order.
+func (d *sparseData) insert(idx int64) {
+	if n := len(d.order); n == 0 || d.order[n - 1] < idx {
+		// pages are mostly appended
+		d.order = append(d.order, idx)
+		return
+	}
+
+	i := d.search(idx)
+	d.order = append(d.order, 0)
+	copy(d.order[i + 1:], d.order[i:])
+	d.order[i] = idx
+}
+
+// remove takes index of released page idx out of order.
+func (d *sparseData) remove(idx int64) {
+	if i := d.search(idx); i < len(d.order) && d.order[i] == idx {
+		d.order = append(d.order[:i], d.order[i + 1:]...)
+	}
+}
+
+// share returns copy of d sharing its pages, pages are copied by next write of either.
+func (d *sparseData) share() *sparseData {
+	pages := make(map[int64][]byte, len(d.pages))
+	for idx, page := range d.pages {
+		pages[idx] = page
+	}
+
+	d.owned = make(map[int64]bool)
+	d.flat = nil
+	order := append(make([]int64, 0, len(d.order)), d.order...)
+	return &sparseData{pages: pages, order: order, owned: make(map[int64]bool), allocated: d.allocated}
+}
+
+// flatten returns data of size as contiguous bytes, holes are allocated as zeros.
+// pages are moved into returned bytes, so in place writes are seen by them.
+func (d *sparseData) flatten(size int64) []byte {
+	if d.flat != nil && int64(len(d.flat)) == size {
+		return d.flat
+	}
+
+	flat := make([]byte, size)
+	for idx, page := range d.pages {
+		copy(flat[idx * pageSize:], page)
+	}
+
+	for start := int64(0); start < size; start += pageSize {
+		end := start + pageSize
+		if end > size {
+			end = size
+		}
+
+		// capacity is limited, so growing page does not overwrite next one
+		d.pages[start / pageSize] = flat[start:end:end]
+		d.owned[start / pageSize] = true
+	}
+
+	// every page before size is allocated
+	count := (size + pageSize - 1) / pageSize
+	order := make([]int64, 0, count)
+	for idx := int64(0); idx < count; idx++ {
+		order = append(order, idx)
+	}
+	d.order = append(order, d.order[d.search(count):]...)
+
+	d.allocated = size
+	d.flat = flat
+	return flat
+}
+
+// flattenGrow returns bytes allocated by flatten of size.
+func (d *sparseData) flattenGrow(size int64) int64 {
+	if d.flat != nil && int64(len(d.flat)) == size {
+		return 0
+	}
+	return size - d.allocated
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,156 @@
+package vfs
+
+import (
+	"io"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualFile_Sparse(t *testing.T) {
+	fs, err := NewMemoryFileSystemWithOptions("/TestVirtualFile_Sparse", MemoryOptions{MaxBytes: 3 * pageSize})
+	assert.Nil(t, err)
+
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+
+	f, err := fs.NewFile(context, "/file")
+	assert.Nil(t, err)
+
+	// only written pages are allocated
+	_, err = f.WriteAt([]byte("data"), 10 << 30)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("head"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10 << 30 + 4), f.Stat().Size())
+	assert.Equal(t, int64(8), f.(*contextFile).File.(*virtualFile).allocated())
+
+	res := make([]byte, 8)
+	_, err = f.ReadAt(res, 10 << 30 - 4)
+	assert.Nil(t, err)
+	assert.Equal(t, "\x00\x00\x00\x00data", string(res))
+
+	off, err := f.SeekHole(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), off)
+	off, err = f.SeekData(4)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10 << 30), off)
+	off, err = f.SeekHole(10 << 30 + 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10 << 30 + 4), off)
+	_, err = f.SeekData(10 << 30 + 4)
+	assert.Equal(t, io.EOF, err)
+
+	// punched range is read as zeros
+	assert.Nil(t, f.PunchHole(1, 2))
+	_, err = f.ReadAt(res[:4], 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "h\x00\x00d", string(res[:4]))
+	assert.Nil(t, f.PunchHole(10 << 30, 4))
+	assert.Equal(t, int64(4), f.(*contextFile).File.(*virtualFile).allocated())
+	_, err = f.SeekData(4)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, int64(10 << 30 + 4), f.Stat().Size())
+
+	// clone shares pages until written
+	assert.Nil(t, fs.Clone(context, "/file", "/clone"))
+	c, err := fs.OpenFile(context, "/clone")
+	assert.Nil(t, err)
+	_, err = c.WriteAt([]byte("c"), 0)
+	assert.Nil(t, err)
+	_, err = f.ReadAt(res[:1], 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "h", string(res[:1]))
+
+	// truncate releases pages, extended range is hole
+	assert.Nil(t, f.Truncate(2))
+	assert.Nil(t, f.Truncate(2 * pageSize))
+	assert.Equal(t, int64(2), f.(*contextFile).File.(*virtualFile).allocated())
+	_, err = f.ReadAt(res, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "h\x00\x00\x00\x00\x00\x00\x00", string(res))
+}
+
+func TestWrapperFile_Sparse(t *testing.T) {
+	fs, err := NewWrapperFileSystem(__dir_name_ + "/TestWrapperFile_Sparse")
+	assert.Nil(t, err)
+
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+	defer fs.Remove(context, "/file")
+
+	f, err := fs.NewFile(context, "/file")
+	assert.Nil(t, err)
+	defer f.Close()
+
+	_, err = f.WriteAt([]byte("12345678"), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, f.PunchHole(2, 10))
+
+	res := make([]byte, 8)
+	_, err = f.ReadAt(res, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "12\x00\x00\x00\x00\x00\x00", string(res))
+
+	off, err := f.SeekData(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), off)
+	_, err = f.SeekHole(8)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestVirtualFile_WriteAtV(t *testing.T) {
+	fs, err := NewMemoryFileSystemWithOptions("/TestVirtualFile_WriteAtV", MemoryOptions{MaxBytes: 2 * pageSize})
+	assert.Nil(t, err)
+
+	context := fs.Context()
+	defer fs.ReleaseContext(context)
+
+	f, err := fs.NewFile(context, "/file")
+	assert.Nil(t, err)
+	vf := f.(*contextFile).File.(*virtualFile)
+
+	changes := 0
+	vf.onChange = func(op EventOp) {
+		changes++
+	}
+
+	// page written twice is allocated once
+	assert.Nil(t, f.WriteAtV([][]byte{[]byte("head"), []byte("ab"), []byte("tail")}, []int64{0, 2, pageSize + 4}))
+	assert.Equal(t, 1, changes)
+	assert.Equal(t, int64(pageSize + 8), f.Stat().Size())
+	assert.Equal(t, int64(4 + 8), vf.allocated())
+
+	res := make([]byte, 4)
+	_, err = f.ReadAt(res, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "heab", string(res))
+
+	assert.NotNil(t, f.WriteAtV([][]byte{[]byte("a")}, []int64{-1}))
+	assert.NotNil(t, f.WriteAtV([][]byte{make([]byte, 3 * pageSize)}, []int64{0}))
+}
+
+func TestSparseData_Order(t *testing.T) {
+	d := newSparseData()
+
+	// pages written out of order are kept in order
+	d.writeAt([]byte("c"), 5 * pageSize)
+	d.writeAt([]byte("a"), 0)
+	d.writeAt([]byte("bb"), 2 * pageSize + 10)
+	assert.Equal(t, []int64{0, 2, 5}, d.order)
+	assert.Equal(t, int64(5 * pageSize + 1), d.end())
+	assert.Equal(t, int64(2 * pageSize), d.seekData(1, d.end()))
+
+	// released pages leave order, clones keep their own
+	clone := d.share()
+	d.punch(2 * pageSize, 3 * pageSize + 1)
+	assert.Equal(t, []int64{0}, d.order)
+	assert.Equal(t, int64(1), d.end())
+	assert.Equal(t, []int64{0, 2, 5}, clone.order)
+
+	// flattened pages are all in order
+	clone.truncate(3 * pageSize)
+	clone.flatten(3 * pageSize)
+	assert.Equal(t, []int64{0, 1, 2}, clone.order)
+	assert.Equal(t, int64(3 * pageSize), clone.end())
+}
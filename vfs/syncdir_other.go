@@ -0,0 +1,8 @@
+//go:build !unix
+
+package vfs
+
+// directories can not be synced on this platform, their entries are committed by file system.
+func SyncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package vfs
+
+import "os"
+
+// SyncDir commits entries of directory path, like files created, removed or renamed in it,
+// to stable storage.
+func SyncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
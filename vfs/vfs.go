@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	"context"
 	"time"
 	"fmt"
 	"errors"
@@ -15,6 +16,8 @@ var (
 	invalidContextErr        = errors.New("invalid context")
 	invalidMountOnPathErr    = errors.New("invalid mount path. mount __dir_name_ should be absolute __dir_name_")
 	fileReadWriteErr         = errors.New("cannot open file to read/write")
+	cloneIntoItselfErr       = errors.New("cannot clone directory into itself")
+	isDirectoryErr           = errors.New("is a directory")
 	nestedMountedErr         = func(path string) error {
 		return errors.New(fmt.Sprintf("mount path cannot be sub/parent directory of already mounted file system %s", path))
 	}
@@ -29,7 +32,19 @@ type VirtualFileSystem interface {
 	FileExisted(context *Context, pathname string)	bool
 	ChangeDirectory(context *Context, pathname string) error
 	Context() *Context
+	ContextWithParent(parent context.Context) *Context
+	ReleaseContext(context *Context) error
 	ListSegments(context *Context, pathname string) ([]FileStat, error)
+	Watch(context *Context, pathname string, recursive bool) (<-chan Event, func(), error)
+	Clone(context *Context, src string, dst string) error
+	// CloneTree clones src like Clone, except entries that skip returns true for, and their children.
+	CloneTree(context *Context, src string, dst string, skip func(name string) bool) error
+	// expired files are absent until removed by RemoveExpired,
+	// non-positive ttl or zero expiry means file does not expire.
+	CreateFileWithTTL(context *Context, pathname string, ttl time.Duration) (File, error)
+	SetExpiry(context *Context, pathname string, expiry time.Time) error
+	// RemoveExpired removes expired files under pathname, returns their absolute paths.
+	RemoveExpired(context *Context, pathname string) ([]string, error)
 	PresentWorkingDirectory(context *Context) string
 	Type() string
 }
@@ -40,6 +55,23 @@ type File interface {
 	ReadAt(b []byte, off int64) (n int, err error)
 	Write(b []byte) (n int, err error)
 	WriteAt(b []byte, off int64) (n int, err error)
+	// WriteAtV writes each of b at offset of same index in order, as one change of file.
+	WriteAtV(b [][]byte, offs []int64) error
+	Truncate(size int64) error
+	// Replace replaces data of file by b as one change of file.
+	Replace(b []byte) error
+	// PunchHole zeroes size bytes at off, releasing their space where supported.
+	// size of file is not changed.
+	PunchHole(off int64, size int64) error
+	// SeekData returns first offset from off holding data, SeekHole first offset in hole.
+	// end of file is hole, io.EOF is returned if there is no such offset.
+	SeekData(off int64) (int64, error)
+	SeekHole(off int64) (int64, error)
+	// Mmap returns read-only view of data of file without copying it.
+	Mmap() (ReadOnlyMapping, error)
+	// Sync commits data of file to stable storage, memory files have nothing to commit.
+	Sync() error
+	Close() error
 	Delete()
 }
 
@@ -47,6 +79,10 @@ type FileStat interface {
 	Name() string
 	Size() int64
 	ModTime() time.Time
+	// AccessTime is time file is last read or modified.
+	AccessTime() time.Time
 	IsDir() bool
+	// Generation changes on every modification of file, 0 if not supported.
+	Generation() uint64
 	Immutable() FileStat
 }
\ No newline at end of file
@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	gocontext "context"
 	"testing"
 	"github.com/stretchr/testify/assert"
 	"reflect"
@@ -94,6 +95,28 @@ func TestVirtualFileSystems_NewFile(t *testing.T) {
 	}
 }
 
+func TestVirtualFileSystems_Sync(t *testing.T) {
+
+	vfs, errs := GetVirtualFileSystems(__dir_name_ + "/mount_sync")
+	assertApplyAll(t, errs, assert.Nil)
+
+	for _, fs := range vfs {
+		context := fs.Context()
+
+		f, err := fs.NewFile(context, "/sync/file")
+		assert.Nil(t, err)
+
+		_, err = f.Write([]byte("data"))
+		assert.Nil(t, err)
+		assert.Nil(t, f.Sync())
+		assert.Nil(t, fs.Remove(context, "/sync/file"))
+
+		fs.ReleaseContext(context)
+	}
+
+	assert.Nil(t, SyncDir(__dir_name_))
+}
+
 func TestVirtualFileSystems_Remove(t *testing.T) {
 
 	vfs, errs := GetVirtualFileSystems(__dir_name_ + "/mount_remove")
@@ -246,4 +269,150 @@ func TestVirtualFileSystems_ListSegments(t *testing.T) {
 		}
 		assert.Equal(t, 0, len(expected))
 	}
-}
\ No newline at end of file
+}
+
+func TestVirtualFileSystems_ReleaseContext(t *testing.T) {
+	vfs, errs := GetVirtualFileSystems(__dir_name_ + "/mount_release")
+	assertApplyAll(t, vfs, assert.NotNil)
+	assertApplyAll(t, errs, assert.Nil)
+
+	for _, fs := range vfs {
+		context := fs.Context()
+
+		fs.NewFile(context, "test/path/file")
+		fs.OpenFile(context, "test/path/file")
+		assert.True(t, context.OpenFiles() > 0, fs.Type())
+
+		assert.Nil(t, fs.ReleaseContext(context))
+		assert.Equal(t, 0, context.OpenFiles(), fs.Type())
+		assert.NotNil(t, fs.ReleaseContext(context)) // already released
+
+		// released context cannot be used anymore
+		assert.Equal(t, "", fs.PresentWorkingDirectory(context), fs.Type())
+		assert.False(t, fs.FileExisted(context, "test/path/file"), fs.Type())
+		assert.NotNil(t, fs.ChangeDirectory(context, "test"), fs.Type())
+		_, err := fs.OpenFile(context, "test/path/file")
+		assert.NotNil(t, err, fs.Type())
+
+		assert.True(t, fs.FileExisted(fs.Context(), "test/path/file"), fs.Type())
+	}
+}
+
+func TestVirtualFileSystems_CloseUntracks(t *testing.T) {
+	vfs, errs := GetVirtualFileSystems(__dir_name_ + "/mount_untrack")
+	assertApplyAll(t, vfs, assert.NotNil)
+	assertApplyAll(t, errs, assert.Nil)
+
+	for _, fs := range vfs {
+		context := fs.Context()
+
+		f, err := fs.NewFile(context, "file")
+		assert.Nil(t, err, fs.Type())
+		for i := 0; i < 3; i++ {
+			opened, err := fs.OpenFile(context, "file")
+			assert.Nil(t, err, fs.Type())
+			assert.Nil(t, opened.Close(), fs.Type())
+		}
+		assert.Equal(t, 1, context.OpenFiles(), fs.Type())
+
+		// closed files are not closed again by release
+		assert.Nil(t, f.Close(), fs.Type())
+		assert.Nil(t, f.Close(), fs.Type())
+		assert.Equal(t, 0, context.OpenFiles(), fs.Type())
+		assert.Nil(t, fs.ReleaseContext(context), fs.Type())
+	}
+}
+
+func TestVirtualFileSystems_ContextCancel(t *testing.T) {
+	vfs, errs := GetVirtualFileSystems(__dir_name_ + "/mount_cancel")
+	assertApplyAll(t, vfs, assert.NotNil)
+	assertApplyAll(t, errs, assert.Nil)
+
+	for _, fs := range vfs {
+		parent, cancel := gocontext.WithCancel(gocontext.Background())
+		context := fs.ContextWithParent(parent)
+
+		fs.NewFile(context, "test/path/file")
+		cancel()
+
+		assert.Equal(t, gocontext.Canceled, context.Err())
+		assert.NotNil(t, fs.Remove(context, "test"), fs.Type())
+		_, err := fs.ListSegments(context, "")
+		assert.NotNil(t, err, fs.Type())
+
+		assert.True(t, fs.FileExisted(fs.Context(), "test/path/file"), fs.Type())
+		assert.Nil(t, fs.ReleaseContext(context))
+	}
+}
+
+func TestVirtualFileSystems_Watch(t *testing.T) {
+	vfs, errs := GetVirtualFileSystems(__dir_name_ + "/mount_watch")
+	assertApplyAll(t, vfs, assert.NotNil)
+	assertApplyAll(t, errs, assert.Nil)
+
+	for _, fs := range vfs {
+		context := fs.Context()
+		fs.Mkdir(context, "test")
+
+		events, cancel, err := fs.Watch(context, "test", true)
+		assert.Nil(t, err, fs.Type())
+
+		f, _ := fs.NewFile(context, "/test/path/file")
+		assert.True(t, waitEvent(t, events, "/test/path/file", Create), fs.Type())
+
+		f.WriteAt([]byte("test"), 0)
+		assert.True(t, waitEvent(t, events, "/test/path/file", Write), fs.Type())
+
+		fs.Remove(context, "/test/path/file")
+		assert.True(t, waitEvent(t, events, "/test/path/file", Remove), fs.Type())
+
+		cancel()
+		fs.ReleaseContext(context)
+	}
+}
+
+func TestVirtualFileSystems_Clone(t *testing.T) {
+	vfs, errs := GetVirtualFileSystems(__dir_name_ + "/mount_clone")
+	assertApplyAll(t, vfs, assert.NotNil)
+	assertApplyAll(t, errs, assert.Nil)
+
+	for _, fs := range vfs {
+		context := fs.Context()
+
+		f, _ := fs.NewFile(context, "/test/path/file")
+		f.WriteAt([]byte("test"), 0)
+
+		assert.Nil(t, fs.Clone(context, "test", "clone/test"), fs.Type())
+		assert.NotNil(t, fs.Clone(context, "test", "clone/test"), fs.Type())   // file exists err
+		assert.NotNil(t, fs.Clone(context, "test", "test/path/sub"), fs.Type()) // clone into itself err
+
+		// parents of failed clone into itself are not left behind
+		assert.NotNil(t, fs.Clone(context, "test", "test/new/dir/clone"), fs.Type())
+		assert.False(t, fs.FileExisted(context, "test/new"), fs.Type())
+
+		// clone is not changed by writes of original
+		f.WriteAt([]byte("1234"), 0)
+
+		cf, err := fs.OpenFile(context, "clone/test/path/file")
+		assert.Nil(t, err, fs.Type())
+
+		res := make([]byte, 4)
+		cf.ReadAt(res, 0)
+		assert.Equal(t, "test", string(res), fs.Type())
+
+		cf.WriteAt([]byte("abcd"), 0)
+		f.ReadAt(res, 0)
+		assert.Equal(t, "1234", string(res), fs.Type())
+
+		// clone into entry left out is not into itself
+		skip := func(name string) bool {
+			return name == "skipped"
+		}
+		fs.NewFile(context, "/test/skipped/file")
+		assert.Nil(t, fs.CloneTree(context, "test", "test/skipped/clone", skip), fs.Type())
+		assert.True(t, fs.FileExisted(context, "test/skipped/clone/path/file"), fs.Type())
+		assert.False(t, fs.FileExisted(context, "test/skipped/clone/skipped"), fs.Type())
+
+		fs.ReleaseContext(context)
+	}
+}
@@ -0,0 +1,213 @@
+package vfs
+
+import (
+	"strings"
+	"sync"
+)
+
+type EventOp uint32
+
+const (
+	Create EventOp = 1 << iota
+	Write
+	Remove
+	Rename
+	Chmod
+	// events are dropped because receiver is too slow.
+	// receiver should rescan watched path.
+	Overflow
+)
+
+var eventOpNames = []struct {
+	op   EventOp
+	name string
+}{
+	{Create, "CREATE"},
+	{Write, "WRITE"},
+	{Remove, "REMOVE"},
+	{Rename, "RENAME"},
+	{Chmod, "CHMOD"},
+	{Overflow, "OVERFLOW"},
+}
+
+// maximum number of undelivered events kept per watch.
+// when exceeded, queued events are replaced by single Overflow event.
+var maxPendingEvents = 4096
+
+/**
+ Event is a change of a file or directory on a watched path.
+ Op may hold several operations when events on same path are coalesced.
+ */
+type Event struct {
+	Path string
+	Op   EventOp
+}
+
+func (op EventOp) String() string {
+	names := make([]string, 0)
+	for _, n := range eventOpNames {
+		if op&n.op != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+func (e Event) String() string {
+	return e.Op.String() + ": " + e.Path
+}
+
+/**
+ watch queues events of one subscriber.
+ undelivered events on same path are coalesced into one,
+ and delivered in order by its own goroutine.
+ */
+type watch struct {
+	mu        sync.Mutex
+	path      string
+	delimiter string
+	recursive bool
+	rewrite   func(path string) (string, bool)
+	pending   []Event
+	index     map[string]int // path -> sequence of pending event
+	head      int            // sequence of pending[0]
+	notify    chan struct{}
+	done      chan struct{}
+	once      sync.Once
+	out       chan Event
+}
+
+type watchHub struct {
+	mu      sync.RWMutex
+	watches map[*watch]bool
+}
+
+func newWatch(path string, delimiter string, recursive bool) *watch {
+	w := &watch{
+		path:      path,
+		delimiter: delimiter,
+		recursive: recursive,
+		pending:   make([]Event, 0),
+		index:     make(map[string]int),
+		notify:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		out:       make(chan Event),
+	}
+
+	go w.run()
+	return w
+}
+
+// matches returns true if path is watched path itself or under it.
+func (w *watch) matches(path string) bool {
+	if path == w.path {
+		return true
+	}
+
+	prefix := w.path
+	if !strings.HasSuffix(prefix, w.delimiter) {
+		prefix = prefix + w.delimiter
+	}
+
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return w.recursive || !strings.Contains(path[len(prefix):], w.delimiter)
+}
+
+func (w *watch) push(ev Event) {
+	if w.rewrite != nil {
+		path, ok := w.rewrite(ev.Path)
+		if !ok {
+			return
+		}
+		ev.Path = path
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// coalesce with undelivered event on same path
+	if seq, ok := w.index[ev.Path]; ok {
+		w.pending[seq-w.head].Op |= ev.Op
+		return
+	}
+
+	if len(w.pending) >= maxPendingEvents {
+		w.pending = []Event{{Path: w.path, Op: Overflow}}
+		w.index = make(map[string]int)
+	}
+
+	w.index[ev.Path] = w.head + len(w.pending)
+	w.pending = append(w.pending, ev)
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watch) run() {
+	defer close(w.out)
+
+	for {
+		w.mu.Lock()
+		if len(w.pending) == 0 {
+			w.mu.Unlock()
+			select {
+			case <-w.notify:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+
+		ev := w.pending[0]
+		w.pending = w.pending[1:]
+		if seq, ok := w.index[ev.Path]; ok && seq == w.head {
+			delete(w.index, ev.Path)
+		}
+		w.head++
+		w.mu.Unlock()
+
+		select {
+		case w.out <- ev:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *watch) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watches: make(map[*watch]bool)}
+}
+
+func (h *watchHub) add(w *watch) {
+	h.mu.Lock()
+	h.watches[w] = true
+	h.mu.Unlock()
+}
+
+func (h *watchHub) remove(w *watch) {
+	h.mu.Lock()
+	delete(h.watches, w)
+	h.mu.Unlock()
+}
+
+func (h *watchHub) emit(path string, op EventOp) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for w := range h.watches {
+		if w.matches(path) {
+			w.push(Event{Path: path, Op: op})
+		}
+	}
+}
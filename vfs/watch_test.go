@@ -0,0 +1,111 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch_Matches(t *testing.T) {
+	w := newWatch("/test", "/", false)
+	defer w.stop()
+
+	assert.True(t, w.matches("/test"))
+	assert.True(t, w.matches("/test/file"))
+	assert.False(t, w.matches("/test/path/file"))
+	assert.False(t, w.matches("/test2"))
+
+	r := newWatch("/", "/", true)
+	defer r.stop()
+
+	assert.True(t, r.matches("/test/path/file"))
+}
+
+func TestWatch_Coalesce(t *testing.T) {
+	w := newWatch("/", "/", true)
+	defer w.stop()
+
+	// nobody receives yet, so events on same path are coalesced
+	w.push(Event{Path: "/a", Op: Create})
+	w.push(Event{Path: "/b", Op: Create})
+	w.push(Event{Path: "/a", Op: Write})
+
+	ops := make(map[string]EventOp)
+	for i := 0; i < 2; i++ {
+		ev := receiveEvent(t, w.out)
+		ops[ev.Path] |= ev.Op
+	}
+
+	assert.Equal(t, Create|Write, ops["/a"])
+	assert.Equal(t, Create, ops["/b"])
+}
+
+func TestWatch_Overflow(t *testing.T) {
+	max := maxPendingEvents
+	maxPendingEvents = 4
+	defer func() { maxPendingEvents = max }()
+
+	w := newWatch("/", "/", true)
+	defer w.stop()
+
+	for _, p := range []string{"/a", "/b", "/c", "/d", "/e", "/f", "/g", "/h", "/i"} {
+		w.push(Event{Path: p, Op: Create})
+	}
+
+	overflowed := false
+	for i := 0; i < 4 && !overflowed; i++ {
+		overflowed = receiveEvent(t, w.out).Op&Overflow != 0
+	}
+	assert.True(t, overflowed)
+}
+
+func receiveEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting event")
+		return Event{}
+	}
+}
+
+// waitEvent receives events until an event on path with op arrives.
+func waitEvent(t *testing.T, events <-chan Event, path string, op EventOp) bool {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Path == path && ev.Op&op != 0 {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func TestPollPath(t *testing.T) {
+	interval := pollInterval
+	pollInterval = 10 * time.Millisecond
+	defer func() { pollInterval = interval }()
+
+	dir := __dir_name_ + "/poll_path"
+	os.MkdirAll(dir + "/sub", os.ModePerm)
+	defer os.RemoveAll(dir)
+
+	w := newWatch("", "/", true)
+	defer w.stop()
+	go pollPath(dir, true, w)
+	time.Sleep(50 * time.Millisecond)
+
+	ioutil.WriteFile(dir + "/sub/file", []byte("test"), os.ModePerm)
+	assert.True(t, waitEvent(t, w.out, "sub/file", Create))
+
+	ioutil.WriteFile(dir + "/sub/file", []byte("test1234"), os.ModePerm)
+	assert.True(t, waitEvent(t, w.out, "sub/file", Write))
+
+	os.Remove(dir + "/sub/file")
+	assert.True(t, waitEvent(t, w.out, "sub/file", Remove))
+}
@@ -0,0 +1,34 @@
+package store
+
+import (
+	"errors"
+	"strings"
+)
+
+var notWalkableErr = errors.New("store can not walk all files")
+
+// fileWalker is implemented by stores listing all files of them and their sub stores,
+// including internal data in hidden sub stores, like snapshots and versions.
+// files private to the store itself, like metadata or temporary files, are not listed.
+type fileWalker interface {
+	walkFiles(fn func(name string) error) error
+}
+
+// walkFiles calls fn with name of each file of s, until fn returns error.
+// files removed while walking may be skipped, files created meanwhile may be given or not.
+func walkFiles(s Store, fn func(name string) error) error {
+	if w, ok := s.(fileWalker); ok {
+		return w.walkFiles(fn)
+	}
+	return notWalkableErr
+}
+
+// walkedFile returns sub store and base name of file name given by walkFiles,
+// since internal data in hidden directories is reached through sub stores only.
+func walkedFile(s Store, name string) (Store, string) {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return s, name
+	}
+	return s.SubStore(name[:i]), name[i + 1:]
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/overtheleaves/kayat-store/vfs"
+)
+
+// relayEvents forwards events with paths renamed into store relative names.
+// events with rename returning false are dropped.
+func relayEvents(events <-chan vfs.Event, cancel func(),
+	rename func(name string) (string, bool)) (<-chan vfs.Event, func(), error) {
+
+	out := make(chan vfs.Event)
+	done := make(chan struct{})
+	var once sync.Once
+
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}
+
+	go func() {
+		defer close(out)
+
+		for ev := range events {
+			name, ok := rename(ev.Path)
+			if !ok {
+				continue
+			}
+			ev.Path = name
+
+			select {
+			case out <- ev:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return out, stop, nil
+}